@@ -0,0 +1,458 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An archive is a backup that doesn't need the cluster it came from:
+// the metadata stream plus a copy of every blob it refers to, written
+// somewhere else.
+//
+//   POST /.cbfs/backup/archive/?dest=name          -> write one
+//   POST /.cbfs/backup/archive/restore/?dest=name  -> load one back
+//
+// dest is scheme:path, where the scheme picks one of
+// backupDestinations (file: if there's none).  Blobs already in the
+// destination aren't copied again, so archiving to the same place
+// repeatedly only sends new blobs.
+//
+// Each run writes its metadata under a name of its own and only points
+// the manifest at it once every blob is copied, so a run that fails
+// partway leaves the last complete archive as it was.
+
+var backupDir = flag.String("backupDir", "",
+	"Directory file: backup archives are written under")
+
+const (
+	archiveMetaName     = "meta.json.gz"
+	archiveManifestName = "manifest.json"
+)
+
+var errIncompleteArchive = errors.New("archive is incomplete")
+
+// Where archives are kept.  Names are slash separated.
+type backupDestination interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	Exists(name string) (bool, error)
+	Remove(name string) error
+}
+
+var backupDestinations = map[string]func(path string) (backupDestination, error){
+	"file": newDirDestination,
+}
+
+var errNoBackupDir = errors.New("no -backupDir for file: archives")
+
+func openBackupDestination(dest string) (backupDestination, error) {
+	scheme, path := "file", dest
+	if i := strings.Index(dest, ":"); i > 0 {
+		scheme, path = dest[:i], dest[i+1:]
+	}
+	open, ok := backupDestinations[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown backup destination %q", scheme)
+	}
+	return open(path)
+}
+
+// A directory under -backupDir.
+type dirDestination string
+
+func newDirDestination(path string) (backupDestination, error) {
+	if *backupDir == "" {
+		return nil, errNoBackupDir
+	}
+	return dirDestination(filepath.Join(*backupDir,
+		filepath.Clean("/"+path))), nil
+}
+
+func (d dirDestination) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+// Written to a temp file that takes its name when it's closed, so a
+// failed write doesn't look like it worked.
+type dirDestinationFile struct {
+	*os.File
+	final string
+}
+
+func (f dirDestinationFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.final)
+}
+
+func (d dirDestination) Create(name string) (io.WriteCloser, error) {
+	fn := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return dirDestinationFile{f, fn}, nil
+}
+
+func (d dirDestination) Open(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+func (d dirDestination) Exists(name string) (bool, error) {
+	_, err := os.Stat(d.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d dirDestination) Remove(name string) error {
+	return os.Remove(d.path(name))
+}
+
+func archiveBlobName(oid string) string {
+	return "blobs/" + oid[:2] + "/" + oid
+}
+
+// Every blob a file refers to, including its older revisions.
+func (fm fileMeta) allBlobs() []string {
+	rv := fm.blobs()
+	for _, pm := range fm.Previous {
+		rv = append(rv, pm.blobs()...)
+	}
+	return rv
+}
+
+type archiveManifest struct {
+	When     time.Time `json:"when"`
+	Node     string    `json:"node"`
+	Files    int       `json:"files"`
+	Blobs    int       `json:"blobs"`
+	Copied   int       `json:"copied"`
+	Bytes    int64     `json:"bytes"`
+	Complete bool      `json:"complete"`
+	// Where the metadata is.  Older archives have it in
+	// archiveMetaName.
+	Meta string `json:"meta,omitempty"`
+}
+
+func (m archiveManifest) metaName() string {
+	if m.Meta == "" {
+		return archiveMetaName
+	}
+	return m.Meta
+}
+
+func readArchiveManifest(dest backupDestination) (archiveManifest, error) {
+	m := archiveManifest{}
+	r, err := dest.Open(archiveManifestName)
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+	err = json.NewDecoder(r).Decode(&m)
+	return m, err
+}
+
+func archiveBlob(dest backupDestination, oid string) (int64, error) {
+	r, err := openBlob(oid, false)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	name := archiveBlobName(oid)
+	w, err := dest.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		dest.Remove(name)
+		return n, err
+	}
+	return n, w.Close()
+}
+
+func archiveBackup(dest backupDestination) (archiveManifest, error) {
+	defer logDuration("archive backup", time.Now())
+	m := archiveManifest{When: time.Now().UTC(), Node: serverId}
+	m.Meta = fmt.Sprintf("meta-%v.json.gz", m.When.UnixNano())
+	prev, prevErr := readArchiveManifest(dest)
+
+	w, err := dest.Create(m.Meta)
+	if err != nil {
+		return m, err
+	}
+	written := false
+	defer func() {
+		if !written {
+			dest.Remove(m.Meta)
+		}
+	}()
+	seen := map[string]bool{}
+	oids := []string{}
+	err = func() error {
+		defer w.Close()
+		fch := make(chan *namedFile)
+		ech := make(chan error)
+		qch := make(chan bool)
+		defer close(qch)
+		go pathGenerator("", fch, ech, qch)
+
+		gz := gzip.NewWriter(w)
+		err := streamFileMeta(gz, fch, ech, func(f *namedFile) bool {
+			m.Files++
+			for _, oid := range f.meta.allBlobs() {
+				if !seen[oid] {
+					seen[oid] = true
+					oids = append(oids, oid)
+				}
+			}
+			return false
+		})
+		if e := gz.Close(); err == nil {
+			err = e
+		}
+		return err
+	}()
+	if err != nil {
+		return m, err
+	}
+
+	m.Blobs = len(oids)
+	for _, oid := range oids {
+		if have, err := dest.Exists(archiveBlobName(oid)); err != nil {
+			return m, err
+		} else if have {
+			continue
+		}
+		n, err := archiveBlob(dest, oid)
+		if err != nil {
+			return m, fmt.Errorf("archiving blob %v: %v", oid, err)
+		}
+		m.Copied++
+		m.Bytes += n
+	}
+	m.Complete = true
+
+	mw, err := dest.Create(archiveManifestName)
+	if err != nil {
+		return m, err
+	}
+	err = json.NewEncoder(mw).Encode(m)
+	if e := mw.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return m, err
+	}
+	written = true
+
+	if prevErr == nil && prev.metaName() != m.Meta {
+		if err := dest.Remove(prev.metaName()); err != nil {
+			log.Printf("Error removing old archive metadata %v: %v",
+				prev.metaName(), err)
+		}
+	}
+	return m, nil
+}
+
+type archiveRestore struct {
+	Files   int   `json:"files"`
+	Skipped int   `json:"skipped"`
+	Blobs   int   `json:"blobs"`
+	Bytes   int64 `json:"bytes"`
+	Errors  int   `json:"errors"`
+}
+
+// Store a blob from the archive unless the cluster already has it.
+func restoreArchiveBlob(dest backupDestination, oid string) (int64, error) {
+	if bo, err := getBlobOwnership(oid); err == nil && len(bo.Nodes) > 0 {
+		return 0, nil
+	}
+	r, err := dest.Open(archiveBlobName(oid))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	f, err := NewHashRecord(*root, oid)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h, length, err := f.Process(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := recordBlobOwnership(h, length, true); err != nil {
+		return 0, err
+	}
+	inBackground(func() {
+		increaseReplicaCount(h, length, globalConfig.MinReplicas-1)
+	})
+	return length, nil
+}
+
+// Load an archive into the cluster, leaving any files already there
+// alone.
+func restoreArchive(dest backupDestination) (archiveRestore, error) {
+	defer logDuration("archive restore", time.Now())
+	rv := archiveRestore{}
+
+	m, err := readArchiveManifest(dest)
+	if err != nil {
+		return rv, err
+	}
+	if !m.Complete {
+		return rv, errIncompleteArchive
+	}
+	r, err := dest.Open(m.metaName())
+	if err != nil {
+		return rv, err
+	}
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return rv, err
+	}
+	defer gz.Close()
+
+	restored := map[string]bool{}
+	d := json.NewDecoder(gz)
+	for {
+		ob := struct {
+			Path string
+			Meta fileMeta
+		}{}
+		switch err := d.Decode(&ob); err {
+		case nil:
+		case io.EOF:
+			return rv, nil
+		default:
+			return rv, err
+		}
+
+		fn, fm := ob.Path, ob.Meta
+		exp := restoreExpiration(-1, fm)
+		if exp < 0 {
+			continue
+		}
+
+		if err := checkQuota(fn, fm.Length); err != nil {
+			log.Printf("Not restoring %v: %v", fn, err)
+			rv.Errors++
+			continue
+		}
+
+		failed := false
+		for _, oid := range fm.allBlobs() {
+			if restored[oid] {
+				continue
+			}
+			n, err := restoreArchiveBlob(dest, oid)
+			if err != nil {
+				log.Printf("Error restoring blob %v of %v: %v", oid, fn, err)
+				failed = true
+				break
+			}
+			restored[oid] = true
+			if n > 0 {
+				rv.Blobs++
+				rv.Bytes += n
+			}
+		}
+		if failed {
+			rv.Errors++
+			continue
+		}
+
+		switch err := maybeStoreMeta(shortName(fn), fm, exp, false); err {
+		case nil:
+			chargeQuota(fn, fm.Length, 1)
+			rv.Files++
+		case errExists:
+			rv.Skipped++
+		default:
+			log.Printf("Error restoring %v: %v", fn, err)
+			rv.Errors++
+		}
+	}
+}
+
+func archiveDestination(w http.ResponseWriter, req *http.Request) backupDestination {
+	name := req.FormValue("dest")
+	if name == "" {
+		http.Error(w, "Missing dest parameter", 400)
+		return nil
+	}
+	dest, err := openBackupDestination(name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil
+	}
+	return dest
+}
+
+func doArchiveBackup(w http.ResponseWriter, req *http.Request) {
+	dest := archiveDestination(w, req)
+	if dest == nil {
+		return
+	}
+
+	if bg, _ := strconv.ParseBool(req.FormValue("bg")); bg {
+		go func() {
+			if _, err := archiveBackup(dest); err != nil {
+				log.Printf("Error performing bg archive backup: %v", err)
+			}
+		}()
+		w.WriteHeader(202)
+		return
+	}
+
+	m, err := archiveBackup(dest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error performing archive backup: %v", err), 500)
+		return
+	}
+	sendJson(w, req, m)
+}
+
+func doRestoreArchive(w http.ResponseWriter, req *http.Request) {
+	dest := archiveDestination(w, req)
+	if dest == nil {
+		return
+	}
+	rv, err := restoreArchive(dest)
+	if os.IsNotExist(err) {
+		http.Error(w, "No archive at "+req.FormValue("dest"), 404)
+		return
+	}
+	if err == errIncompleteArchive {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error restoring archive: %v", err), 500)
+		return
+	}
+	sendJson(w, req, rv)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbfsarchive")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(prev string) { *backupDir = prev }(*backupDir)
+	*backupDir = dir
+
+	closeStore := withEmbeddedStore(t)
+	cleanRoot := withTmpRoot(t)
+
+	doTestRequest(t, "PUT", "/a.txt", "same")
+	doTestRequest(t, "PUT", "/dir/b.txt", "same")
+	doTestRequest(t, "PUT", "/dir/c.txt", "different")
+
+	m := archiveManifest{}
+	w := doTestRequest(t, "POST", archivePath+"?dest=file:nightly", "")
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &m) != nil {
+		t.Fatalf("Error archiving: %v %s", w.Code, w.Body)
+	}
+	if m.Files != 3 || m.Blobs != 2 || m.Copied != 2 || !m.Complete {
+		t.Errorf("Expected 3 files in 2 blobs, got %+v", m)
+	}
+
+	w = doTestRequest(t, "POST", archivePath+"?dest=nightly", "")
+	if json.Unmarshal(w.Body.Bytes(), &m) != nil || m.Copied != 0 {
+		t.Errorf("Expected blobs not to be copied again, got %+v", m)
+	}
+
+	if w := doTestRequest(t, "POST", archivePath+"?dest=s3:bucket", ""); w.Code != 400 {
+		t.Errorf("Expected unknown destinations to fail, got %v", w.Code)
+	}
+
+	cleanRoot()
+	closeStore()
+
+	// A whole new cluster.
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	rv := archiveRestore{}
+	w = doTestRequest(t, "POST", archiveRestPath+"?dest=nightly", "")
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &rv) != nil {
+		t.Fatalf("Error restoring: %v %s", w.Code, w.Body)
+	}
+	if rv.Files != 3 || rv.Blobs != 2 || rv.Errors != 0 {
+		t.Errorf("Expected 3 files and 2 blobs restored, got %+v", rv)
+	}
+
+	for fn, exp := range map[string]string{
+		"/a.txt": "same", "/dir/b.txt": "same", "/dir/c.txt": "different"} {
+		w := doTestRequest(t, "GET", fn, "")
+		if w.Code != 200 || w.Body.String() != exp {
+			t.Errorf("Expected %q for %v, got %v %q", exp, fn, w.Code, w.Body)
+		}
+	}
+
+	w = doTestRequest(t, "POST", archiveRestPath+"?dest=nightly", "")
+	if json.Unmarshal(w.Body.Bytes(), &rv) != nil || rv.Skipped != 3 || rv.Blobs != 0 {
+		t.Errorf("Expected existing files left alone, got %+v", rv)
+	}
+}
+
+func TestArchiveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbfsarchive")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(prev string) { *backupDir = prev }(*backupDir)
+	*backupDir = dir
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	doTestRequest(t, "PUT", "/a.txt", "first")
+	if w := doTestRequest(t, "POST", archivePath+"?dest=nightly",
+		""); w.Code != 200 {
+		t.Fatalf("Error archiving: %v %s", w.Code, w.Body)
+	}
+
+	// A file whose blob has gone missing fails the next run.
+	doTestRequest(t, "PUT", "/b.txt", "second")
+	fm := fileMeta{}
+	if err := couchbase.Get("b.txt", &fm); err != nil {
+		t.Fatalf("Error getting b.txt: %v", err)
+	}
+	forceRemoveObject(fm.OID)
+	if w := doTestRequest(t, "POST", archivePath+"?dest=nightly",
+		""); w.Code != 500 {
+		t.Fatalf("Expected archiving a missing blob to fail, got %v %s",
+			w.Code, w.Body)
+	}
+
+	dest, _ := openBackupDestination("nightly")
+	m, err := readArchiveManifest(dest)
+	if err != nil || !m.Complete || m.Files != 1 {
+		t.Errorf("Expected the first archive's manifest, got %+v/%v", m, err)
+	}
+	metas, _ := filepath.Glob(filepath.Join(dir, "nightly", "meta*"))
+	if len(metas) != 1 {
+		t.Errorf("Expected just the first run's metadata, got %v", metas)
+	}
+	rv, err := restoreArchive(dest)
+	if err != nil || rv.Skipped != 1 || rv.Errors != 0 {
+		t.Errorf("Expected the first archive to restore, got %+v/%v", rv, err)
+	}
+
+	m.Complete = false
+	mw, _ := dest.Create(archiveManifestName)
+	json.NewEncoder(mw).Encode(m)
+	mw.Close()
+	if w := doTestRequest(t, "POST", archiveRestPath+"?dest=nightly",
+		""); w.Code != 409 {
+		t.Errorf("Expected an incomplete archive to be refused, got %v %s",
+			w.Code, w.Body)
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests may be authenticated with an API key, either as HTTP basic
+// auth (key id and secret) or signed:
+//
+//   X-CBFS-Date: <http date>
+//   X-CBFS-Content-Sha256: <hex sha256 of the body, or UNSIGNED-PAYLOAD>
+//   Authorization: CBFS-HMAC <key id>:<hex hmac-sha256>
+//
+// The signature covers "METHOD\nrequest-uri\ndate\ncontent-sha256"
+// followed by a "name:value" line for each other X-CBFS-* header
+// (lowercased, sorted), and is keyed by the key's secret.  Without
+// X-CBFS-Content-Sha256 the body must be empty.  Nodes sign their
+// requests to each other the same way with the cluster secret, as
+// "Authorization: CBFS-Cluster <sig>".
+//
+// Keys and path ACLs live in the metadata store under /@auth.  Until
+// at least one key is defined, everything is allowed (except
+// internode requests when there's a cluster secret or peer
+// certificates are required), so the first configuration can be PUT
+// to /.cbfs/auth/ without credentials.
+
+const (
+	authKey        = "/@auth"
+	authPrefix     = "/.cbfs/auth/"
+	authReloadFreq = 30 * time.Second
+
+	clusterPrincipal = "@cluster"
+)
+
+// Once keys are configured, nodes can only fetch blobs from each
+// other with a cluster secret (or -tlsVerifyPeers).
+var clusterSecret = flag.String("clusterSecret", "",
+	"Shared secret authenticating requests between nodes (needed with API keys)")
+
+var errUnknownKey = errors.New("unknown key or bad secret")
+
+type role int
+
+const (
+	roleNone role = iota
+	roleReader
+	roleWriter
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"":       roleNone,
+	"reader": roleReader,
+	"writer": roleWriter,
+	"admin":  roleAdmin,
+}
+
+type apiKey struct {
+	Secret string `json:"secret,omitempty"`
+	Role   string `json:"role"`
+}
+
+// An ACL grants (or limits) the role of a key under a path prefix.
+// The key "*" applies to everyone, including unauthenticated
+// requests.  Prefixes for directories should end in a slash.
+type pathACL struct {
+	Prefix string `json:"prefix"`
+	Key    string `json:"key"`
+	Role   string `json:"role"`
+}
+
+type authConfig struct {
+	Keys map[string]apiKey `json:"keys"`
+	ACLs []pathACL         `json:"acls"`
+}
+
+func (a authConfig) enabled() bool {
+	return len(a.Keys) > 0
+}
+
+func (a authConfig) validate() error {
+	for id, k := range a.Keys {
+		if id == "" || id == "*" || strings.ContainsAny(id, ":") {
+			return fmt.Errorf("invalid key id: %q", id)
+		}
+		if k.Secret == "" {
+			return fmt.Errorf("key %v has no secret", id)
+		}
+		if _, ok := roleNames[k.Role]; !ok {
+			return fmt.Errorf("key %v has invalid role %q", id, k.Role)
+		}
+	}
+	for _, acl := range a.ACLs {
+		if _, ok := a.Keys[acl.Key]; !ok && acl.Key != "*" {
+			return fmt.Errorf("ACL for %q names unknown key %q",
+				acl.Prefix, acl.Key)
+		}
+		if _, ok := roleNames[acl.Role]; !ok {
+			return fmt.Errorf("ACL for %q has invalid role %q",
+				acl.Prefix, acl.Role)
+		}
+	}
+	return nil
+}
+
+// What a request needs to be allowed.
+type access struct {
+	role role
+	// The file or directory the request is about, if scoped.
+	path   string
+	scoped bool
+	// Requests nodes make of each other.
+	internode bool
+	// Requests for content by hash, which could be under any path.
+	everywhere bool
+}
+
+// The role a key has for the given access.  Admins can do anything.
+// Otherwise the longest matching ACL wins (one for the key itself
+// over one for "*"), and without one, the key's own role applies.
+// Unscoped requests only consider ACLs with an empty prefix, and
+// requests for everywhere get the least role the key has under any.
+func (a authConfig) roleFor(key string, need access) role {
+	if need.everywhere {
+		rv := a.roleFor(key, access{scoped: true})
+		for _, acl := range a.ACLs {
+			if acl.Key != key && acl.Key != "*" {
+				continue
+			}
+			r := a.roleFor(key, access{path: acl.Prefix, scoped: true})
+			if r < rv {
+				rv = r
+			}
+		}
+		return rv
+	}
+
+	k, known := a.Keys[key]
+	if known && roleNames[k.Role] == roleAdmin {
+		return roleAdmin
+	}
+
+	var best *pathACL
+	for i := range a.ACLs {
+		acl := &a.ACLs[i]
+		if acl.Key != key && acl.Key != "*" {
+			continue
+		}
+		if !strings.HasPrefix(need.path, acl.Prefix) ||
+			(!need.scoped && acl.Prefix != "") {
+			continue
+		}
+		if best == nil || len(acl.Prefix) > len(best.Prefix) ||
+			(len(acl.Prefix) == len(best.Prefix) && acl.Key == key) {
+			best = acl
+		}
+	}
+
+	switch {
+	case best != nil:
+		return roleNames[best.Role]
+	case known:
+		return roleNames[k.Role]
+	}
+	return roleNone
+}
+
+var authLock sync.RWMutex
+var currentAuth authConfig
+
+func getAuthConfig() authConfig {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return currentAuth
+}
+
+func setAuthConfig(a authConfig) {
+	authLock.Lock()
+	defer authLock.Unlock()
+	currentAuth = a
+}
+
+func updateAuthConfig() error {
+	a := authConfig{}
+	err := couchbase.Get(authKey, &a)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	setAuthConfig(a)
+	return nil
+}
+
+func reloadAuthConfig() {
+	for _ = range time.Tick(authReloadFreq) {
+		if err := updateAuthConfig(); err != nil {
+			log.Printf("Error updating auth config: %v", err)
+		}
+	}
+}
+
+const (
+	contentHashHeader = "X-CBFS-Content-Sha256"
+	// Bodies bigger than this are sent UNSIGNED-PAYLOAD between nodes.
+	maxSignedBody = 1024 * 1024
+)
+
+func payloadHash(req *http.Request) string {
+	if h := req.Header.Get(contentHashHeader); h != "" {
+		return h
+	}
+	return emptySHA256
+}
+
+func requestSignature(secret string, req *http.Request, date string) string {
+	lines := []string{}
+	for k, vs := range req.Header {
+		l := strings.ToLower(k)
+		if strings.HasPrefix(l, "x-cbfs-") && l != "x-cbfs-date" &&
+			l != "x-cbfs-content-sha256" {
+			lines = append(lines, l+":"+strings.Join(vs, ","))
+		}
+	}
+	sort.Strings(lines)
+	lines = append([]string{req.Method, req.URL.RequestURI(), date,
+		payloadHash(req)}, lines...)
+	return hex.EncodeToString(hmacSHA256([]byte(secret),
+		strings.Join(lines, "\n")))
+}
+
+// Set X-CBFS-Content-Sha256 for a request about to be signed.  Bodies
+// that can't be read again, or are too big to read twice, go
+// unsigned.
+func setContentHash(req *http.Request) {
+	switch {
+	case req.Header.Get(contentHashHeader) != "":
+	case req.Body == nil || req.Body == http.NoBody:
+		req.Header.Set(contentHashHeader, emptySHA256)
+	case req.GetBody == nil || req.ContentLength < 0 ||
+		req.ContentLength > maxSignedBody:
+		req.Header.Set(contentHashHeader, unsignedPayload)
+	default:
+		body, err := req.GetBody()
+		if err != nil {
+			req.Header.Set(contentHashHeader, unsignedPayload)
+			return
+		}
+		defer body.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			req.Header.Set(contentHashHeader, unsignedPayload)
+			return
+		}
+		req.Header.Set(contentHashHeader, hex.EncodeToString(h.Sum(nil)))
+	}
+}
+
+// Make sure a signed request's body has the hash it was signed with.
+func checkPayloadHash(req *http.Request) error {
+	h := payloadHash(req)
+	if h == unsignedPayload {
+		return nil
+	}
+	want, err := hex.DecodeString(h)
+	if err != nil || len(want) != sha256.Size {
+		return errors.New("invalid " + contentHashHeader)
+	}
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	req.Body = &sha256Reader{req.Body, sha256.New(), want}
+	return nil
+}
+
+func checkRequestDate(date string, now time.Time) error {
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return errors.New("invalid or missing X-CBFS-Date")
+	}
+	if d := now.Sub(t); d > maxRequestSkew || d < -maxRequestSkew {
+		return errors.New("request time too far from server time")
+	}
+	return nil
+}
+
+// Whether internode requests must come from a node proving itself
+// with the cluster secret or a peer certificate.
+func clusterAuthRequired() bool {
+	return *clusterSecret != "" || *tlsVerifyPeers
+}
+
+// Sign a request to another node with the cluster secret.
+func signClusterRequest(req *http.Request, now time.Time) {
+	date := now.UTC().Format(http.TimeFormat)
+	req.Header.Set("X-CBFS-Date", date)
+	setContentHash(req)
+	req.Header.Set("Authorization",
+		"CBFS-Cluster "+requestSignature(*clusterSecret, req, date))
+}
+
+// Signs cbfs requests passing through it when there's a cluster
+// secret.
+type clusterTransport struct {
+	http.RoundTripper
+}
+
+func (t clusterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if *clusterSecret == "" || !strings.HasPrefix(req.URL.Path, "/.cbfs/") {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	// RoundTrippers mustn't modify the request.
+	r2 := *req
+	r2.Header = http.Header{}
+	for k, v := range req.Header {
+		r2.Header[k] = v
+	}
+	signClusterRequest(&r2, time.Now())
+	return t.RoundTripper.RoundTrip(&r2)
+}
+
+// Figure out who made a request.  Unauthenticated requests return an
+// empty key.
+func authenticate(req *http.Request, a authConfig, now time.Time) (string, error) {
+	auth := req.Header.Get("Authorization")
+	scheme, arg := auth, ""
+	if i := strings.Index(auth, " "); i >= 0 {
+		scheme, arg = auth[:i], strings.TrimSpace(auth[i+1:])
+	}
+
+	if isTLSPeer(req) {
+		return clusterPrincipal, nil
+	}
+
+	switch scheme {
+	case "":
+		return "", nil
+	case "Basic":
+		b, err := base64.StdEncoding.DecodeString(arg)
+		if err != nil {
+			return "", errUnknownKey
+		}
+		parts := strings.SplitN(string(b), ":", 2)
+		k, ok := a.Keys[parts[0]]
+		if !ok || len(parts) != 2 ||
+			!hmac.Equal([]byte(k.Secret), []byte(parts[1])) {
+			return "", errUnknownKey
+		}
+		return parts[0], nil
+	case "CBFS-HMAC":
+		parts := strings.SplitN(arg, ":", 2)
+		k, ok := a.Keys[parts[0]]
+		if !ok || len(parts) != 2 {
+			return "", errUnknownKey
+		}
+		date := req.Header.Get("X-CBFS-Date")
+		if err := checkRequestDate(date, now); err != nil {
+			return "", err
+		}
+		if !hmac.Equal([]byte(requestSignature(k.Secret, req, date)),
+			[]byte(parts[1])) {
+			return "", errors.New("request signature doesn't match")
+		}
+		return parts[0], checkPayloadHash(req)
+	case "CBFS-Cluster":
+		if *clusterSecret == "" {
+			return "", errors.New("no cluster secret configured")
+		}
+		date := req.Header.Get("X-CBFS-Date")
+		if err := checkRequestDate(date, now); err != nil {
+			return "", err
+		}
+		if !hmac.Equal([]byte(requestSignature(*clusterSecret, req, date)),
+			[]byte(arg)) {
+			return "", errors.New("cluster signature doesn't match")
+		}
+		return clusterPrincipal, checkPayloadHash(req)
+	}
+	return "", errors.New("unsupported authorization: " + scheme)
+}
+
+func dirPath(p string) string {
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+func uploadPath(req *http.Request) string {
+	rest := minusPrefix(req.URL.Path, uploadPrefix)
+	if rest == "" {
+		return strings.TrimLeft(req.FormValue("path"), "/")
+	}
+	u := uploadSession{}
+	err := couchbase.Get(uploadKey(strings.Split(rest, "/")[0]), &u)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+func requiredAccess(req *http.Request) access {
+	p := req.URL.Path
+	global := func(r role) access { return access{role: r} }
+	scoped := func(r role, path string) access {
+		return access{role: r, path: path, scoped: true}
+	}
+	internode := access{role: roleAdmin, internode: true}
+
+	under := func(prefix string) bool { return strings.HasPrefix(p, prefix) }
+	rest := func(prefix string) string { return minusPrefix(p, prefix) }
+
+	if !under("/.cbfs/") {
+		path, _ := resolvePath(req)
+		switch req.Method {
+		case "GET", "HEAD":
+			return scoped(roleReader, path)
+		}
+		return scoped(roleWriter, path)
+	}
+
+	switch {
+	case under(uploadPrefix):
+		if up := uploadPath(req); up != "" {
+			return scoped(roleWriter, up)
+		}
+		return global(roleWriter)
+	case under(authPrefix), under(debugPrefix), under(quitPrefix),
+		under(proxyPrefix), under(crudproxyPrefix):
+		return global(roleAdmin)
+	case under(trashPrefix) && req.Method != "GET":
+		// Restoring and purging check the paths involved.
+		return global(roleReader)
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		switch {
+		case under(fetchPrefix):
+			return internode
+		case under(backupStrmPrefix):
+			return global(roleAdmin)
+		case under(fileInfoPrefix):
+			return scoped(roleReader, rest(fileInfoPrefix))
+		case under(metaPrefix):
+			return scoped(roleReader, rest(metaPrefix))
+		case under(listPrefix):
+			return scoped(roleReader, dirPath(rest(listPrefix)))
+		case under(zipPrefix):
+			return scoped(roleReader, dirPath(rest(zipPrefix)))
+		case under(tarPrefix):
+			return scoped(roleReader, dirPath(rest(tarPrefix)))
+		case under(fsckPrefix):
+			return scoped(roleReader, dirPath(rest(fsckPrefix)))
+		case under(changesPrefix):
+			return scoped(roleReader, dirPath(rest(changesPrefix)))
+		case under(trashPrefix):
+			return scoped(roleReader, dirPath(rest(trashPrefix)))
+		case under(auditPath):
+			return global(roleAdmin)
+		case under(retentionPrefix):
+			return scoped(roleReader, rest(retentionPrefix))
+		case under(quotaPrefix):
+			return scoped(roleReader, dirPath(rest(quotaPrefix)))
+		case under(blobPrefix):
+			return access{role: roleReader, everywhere: true}
+		}
+		return global(roleReader)
+	case "PUT":
+		switch {
+		case under(metaPrefix):
+			return scoped(roleWriter, rest(metaPrefix))
+		case under(retentionPrefix):
+			return scoped(roleWriter, rest(retentionPrefix))
+		case under(blobPrefix):
+			return internode
+		}
+	case "POST":
+		switch {
+		case p == blobInfoPath:
+			return access{role: roleReader, everywhere: true}
+		case p == blobPrefix, under(markBackupPrefix):
+			return internode
+		case under(renamePrefix):
+			return scoped(roleWriter, dirPath(rest(renamePrefix)))
+		}
+	case "DELETE":
+		if under(blobPrefix) {
+			return internode
+		}
+	}
+	return global(roleAdmin)
+}
+
+// Check a request is allowed before it's dispatched, responding with
+// an error if it's not.
+func authorize(w http.ResponseWriter, req *http.Request) bool {
+	return authorizeFor(w, req, requiredAccess(req))
+}
+
+// Like authorize, but for handlers that know what they need.  Every
+// access given must be allowed.
+func authorizeFor(w http.ResponseWriter, req *http.Request,
+	needs ...access) bool {
+
+	a := getAuthConfig()
+	if retentionOverride(req.Header) != "" {
+		needs = append(needs, access{role: roleAdmin})
+	}
+	internode := false
+	for _, need := range needs {
+		internode = internode || need.internode
+	}
+	if !a.enabled() && !(internode && clusterAuthRequired()) {
+		noteOverride(req, "")
+		return true
+	}
+
+	key, err := authenticate(req, a, time.Now())
+	if err != nil {
+		log.Printf("Authentication failure for %v %v from %v: %v",
+			req.Method, req.URL.Path, req.RemoteAddr, err)
+		http.Error(w, err.Error(), 401)
+		return false
+	}
+	allowed := true
+	for _, need := range needs {
+		allowed = allowed && a.roleFor(key, need) >= need.role
+	}
+	if key == clusterPrincipal || allowed {
+		noteOverride(req, key)
+		return true
+	}
+
+	if key == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cbfs"`)
+		http.Error(w, "authentication required", 401)
+	} else {
+		http.Error(w, "permission denied", 403)
+	}
+	return false
+}
+
+// Record who's overriding retention so it can be audited.  Requests
+// from other nodes already say who.
+func noteOverride(req *http.Request, key string) {
+	if retentionOverride(req.Header) == "" || key == clusterPrincipal {
+		return
+	}
+	if key == "" {
+		key = "anonymous@" + req.RemoteAddr
+	}
+	req.Header.Set(retentionOverrideHeader, key)
+}
+
+func doGetAuth(w http.ResponseWriter, req *http.Request) {
+	a := getAuthConfig()
+	rv := authConfig{Keys: map[string]apiKey{}, ACLs: a.ACLs}
+	for id, k := range a.Keys {
+		rv.Keys[id] = apiKey{Role: k.Role}
+	}
+	sendJson(w, req, rv)
+}
+
+func doSetAuth(w http.ResponseWriter, req *http.Request) {
+	a := authConfig{}
+	if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+		http.Error(w, "Error reading auth config: "+err.Error(), 400)
+		return
+	}
+	if err := a.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := couchbase.Set(authKey, 0, a); err != nil {
+		http.Error(w, "Error storing auth config: "+err.Error(), 500)
+		return
+	}
+	setAuthConfig(a)
+	log.Printf("Auth config updated: %v keys, %v ACLs",
+		len(a.Keys), len(a.ACLs))
+	if a.enabled() && !clusterAuthRequired() {
+		log.Printf("Warning: without -clusterSecret or -tlsVerifyPeers, " +
+			"nodes can't fetch blobs from each other now keys are set")
+	}
+	w.WriteHeader(204)
+}
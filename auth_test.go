@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAuth = authConfig{
+	Keys: map[string]apiKey{
+		"root":  {Secret: "rootpw", Role: "admin"},
+		"alice": {Secret: "alicepw", Role: "reader"},
+		"bob":   {Secret: "bobpw", Role: "writer"},
+	},
+	ACLs: []pathACL{
+		{Prefix: "alice/", Key: "alice", Role: "writer"},
+		{Prefix: "public/", Key: "*", Role: "reader"},
+		{Prefix: "secret/", Key: "*", Role: ""},
+	},
+}
+
+func TestRoleFor(t *testing.T) {
+	file := func(p string) access {
+		return access{role: roleReader, path: p, scoped: true}
+	}
+	tests := []struct {
+		key  string
+		need access
+		exp  role
+	}{
+		{"root", file("secret/x"), roleAdmin},
+		{"root", access{}, roleAdmin},
+		{"alice", file("x"), roleReader},
+		{"alice", file("alice/x"), roleWriter},
+		{"alice", file("secret/x"), roleNone},
+		{"alice", access{}, roleReader},
+		{"bob", file("public/x"), roleReader},
+		{"bob", file("x"), roleWriter},
+		{"", file("public/x"), roleReader},
+		{"", file("x"), roleNone},
+		{"", access{}, roleNone},
+		{"root", access{role: roleReader, everywhere: true}, roleAdmin},
+		{"alice", access{role: roleReader, everywhere: true}, roleNone},
+		{"bob", access{role: roleReader, everywhere: true}, roleNone},
+	}
+	for _, test := range tests {
+		if got := testAuth.roleFor(test.key, test.need); got != test.exp {
+			t.Errorf("Expected %v for %v on %+v, got %v",
+				test.exp, test.key, test.need, got)
+		}
+	}
+}
+
+func TestAuthValidate(t *testing.T) {
+	if err := testAuth.validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+	bad := []authConfig{
+		{Keys: map[string]apiKey{"x": {Role: "reader"}}},
+		{Keys: map[string]apiKey{"x": {Secret: "s", Role: "boss"}}},
+		{ACLs: []pathACL{{Prefix: "a/", Key: "nobody", Role: "reader"}}},
+	}
+	for _, a := range bad {
+		if err := a.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", a)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer setAuthConfig(authConfig{})
+	defer func(s string) { *clusterSecret = s }(*clusterSecret)
+	*clusterSecret = "clusterpw"
+
+	// Internode requests need the cluster secret even before any
+	// keys exist.
+	if w := doTestRequest(t, "GET", fetchPrefix+"abc", ""); w.Code != 401 {
+		t.Errorf("Expected unsigned fetch to fail, got %v", w.Code)
+	}
+
+	w := doTestRequest(t, "PUT", authPrefix, `{"keys": {"root":
+		{"secret": "rootpw", "role": "admin"}, "alice":
+		{"secret": "alicepw", "role": "reader"}, "carol":
+		{"secret": "carolpw", "role": "reader"}}, "acls": [
+		{"prefix": "alice/", "key": "alice", "role": "writer"},
+		{"prefix": "alice/", "key": "carol", "role": ""}]}`)
+	if w.Code != 204 {
+		t.Fatalf("Error setting auth config: %v %s", w.Code, w.Body)
+	}
+
+	do := func(method, path string, f func(*http.Request)) int {
+		req, err := http.NewRequest(method, "http://localhost"+path,
+			strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		f(req)
+		w := httptest.NewRecorder()
+		httpHandler(w, req)
+		return w.Code
+	}
+	basic := func(id, pw string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(id, pw) }
+	}
+	signed := func(id, pw string) func(*http.Request) {
+		return func(req *http.Request) {
+			d := time.Now().UTC().Format(http.TimeFormat)
+			req.Header.Set("X-CBFS-Date", d)
+			setContentHash(req)
+			req.Header.Set("Authorization", "CBFS-HMAC "+id+":"+
+				requestSignature(pw, req, d))
+		}
+	}
+	// Signed, then changed on the way.
+	tampered := func(f func(*http.Request)) func(*http.Request) {
+		return func(req *http.Request) {
+			signed("root", "rootpw")(req)
+			f(req)
+		}
+	}
+	cluster := func(req *http.Request) { signClusterRequest(req, time.Now()) }
+
+	tests := []struct {
+		method, path string
+		f            func(*http.Request)
+		exp          int
+	}{
+		{"PUT", "/x", func(*http.Request) {}, 401},
+		{"PUT", "/x", basic("root", "wrong"), 401},
+		{"PUT", "/x", basic("root", "rootpw"), 201},
+		{"PUT", "/x", basic("alice", "alicepw"), 403},
+		{"GET", "/x", basic("alice", "alicepw"), 200},
+		{"PUT", "/alice/x", signed("alice", "alicepw"), 201},
+		{"PUT", "/alice/x", signed("alice", "wrong"), 401},
+		{"GET", authPrefix, basic("alice", "alicepw"), 403},
+		{"GET", authPrefix, basic("root", "rootpw"), 200},
+		{"GET", "/x", cluster, 200},
+		{"GET", "/x", basic("carol", "carolpw"), 200},
+		{"GET", blobPrefix + strings.Repeat("0", 40), basic("carol", "carolpw"), 403},
+		{"POST", blobInfoPath, basic("carol", "carolpw"), 403},
+		{"GET", blobPrefix + strings.Repeat("0", 40), basic("alice", "alicepw"), 404},
+		{"GET", blobPrefix + strings.Repeat("0", 40), cluster, 404},
+		{"PUT", "/y", cluster, 201},
+		{"PUT", "/x", signed("root", "rootpw"), 201},
+		{"PUT", "/x", tampered(func(req *http.Request) {
+			req.Header.Set("X-CBFS-KeepRevs", "0")
+		}), 401},
+		{"PUT", "/x", tampered(func(req *http.Request) {
+			req.Body = ioutil.NopCloser(strings.NewReader("evil"))
+		}), 500},
+	}
+	for _, test := range tests {
+		if got := do(test.method, test.path, test.f); got != test.exp {
+			t.Errorf("Expected %v for %v %v, got %v",
+				test.exp, test.method, test.path, got)
+		}
+	}
+
+	// The stored config survives a reload, and secrets aren't
+	// handed back out.
+	setAuthConfig(authConfig{})
+	if err := updateAuthConfig(); err != nil {
+		t.Fatalf("Error reloading auth config: %v", err)
+	}
+	if got := getAuthConfig().Keys["alice"].Secret; got != "alicepw" {
+		t.Errorf("Expected alice's secret to reload, got %q", got)
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost"+authPrefix, nil)
+	req.SetBasicAuth("root", "rootpw")
+	httpHandler(w, req)
+	if strings.Contains(w.Body.String(), "alicepw") {
+		t.Errorf("Expected secrets to be hidden, got %s", w.Body)
+	}
+}
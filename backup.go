@@ -17,7 +17,6 @@ import (
 	"time"
 
 	"github.com/dustin/go-hashset"
-	"github.com/couchbase/gomemcached"
 
 	"github.com/couchbaselabs/cbfs/config"
 )
@@ -29,6 +28,17 @@ type backupItem struct {
 	Oid  string                `json:"oid"`
 	When time.Time             `json:"when"`
 	Conf cbfsconfig.CBFSConfig `json:"conf"`
+	// An incremental backup only has what changed since the backup
+	// whose OID is Base.
+	Incremental bool   `json:"incremental,omitempty"`
+	Base        string `json:"base,omitempty"`
+}
+
+// What an incremental backup compares against to tell whether a file
+// changed.
+type backupState struct {
+	Revno    int
+	Modified time.Time
 }
 
 type backups struct {
@@ -42,7 +52,8 @@ func logDuration(m string, startTime time.Time) {
 
 func streamFileMeta(w io.Writer,
 	fch chan *namedFile,
-	ech chan error) error {
+	ech chan error,
+	skip func(*namedFile) bool) error {
 
 	enc := json.NewEncoder(w)
 	for {
@@ -51,6 +62,9 @@ func streamFileMeta(w io.Writer,
 			if !ok {
 				return nil
 			}
+			if skip != nil && skip(f) {
+				continue
+			}
 			err := enc.Encode(map[string]interface{}{
 				"path": f.name,
 				"meta": f.meta,
@@ -67,7 +81,9 @@ func streamFileMeta(w io.Writer,
 	}
 }
 
-func backupTo(w io.Writer) (err error) {
+// Write a backup of every file, or with a base state, only the files
+// that changed since then followed by those that went away.
+func backupTo(w io.Writer, base map[string]backupState) (err error) {
 	fch := make(chan *namedFile)
 	ech := make(chan error)
 	qch := make(chan bool)
@@ -86,7 +102,97 @@ func backupTo(w io.Writer) (err error) {
 		}
 	}()
 
-	return streamFileMeta(gz, fch, ech)
+	if base == nil {
+		return streamFileMeta(gz, fch, ech, nil)
+	}
+
+	seen := map[string]bool{}
+	err = streamFileMeta(gz, fch, ech, func(f *namedFile) bool {
+		seen[f.name] = true
+		st, ok := base[f.name]
+		return ok && st.Revno == f.meta.Revno &&
+			st.Modified.Equal(f.meta.Modified)
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(gz)
+	for path := range base {
+		if !seen[path] {
+			err := enc.Encode(map[string]interface{}{
+				"path":    path,
+				"deleted": true,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The backups to replay, oldest first, to get to the one with oid.
+func backupChain(b backups, oid string) ([]backupItem, error) {
+	byOid := map[string]backupItem{}
+	for _, bi := range b.Backups {
+		byOid[bi.Oid] = bi
+	}
+	rv := []backupItem{}
+	for {
+		bi, ok := byOid[oid]
+		if !ok {
+			return nil, fmt.Errorf("backup %v is missing from the chain", oid)
+		}
+		rv = append([]backupItem{bi}, rv...)
+		if !bi.Incremental {
+			return rv, nil
+		}
+		if len(rv) > len(b.Backups) {
+			return nil, fmt.Errorf("backup chain of %v loops", oid)
+		}
+		oid = bi.Base
+	}
+}
+
+// The state of every file as of the last backup in a chain.
+func backupChainState(chain []backupItem) (map[string]backupState, error) {
+	rv := map[string]backupState{}
+	for _, bi := range chain {
+		err := func() error {
+			r := blobReader(bi.Oid)
+			defer r.Close()
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+
+			d := json.NewDecoder(gz)
+			for {
+				ob := struct {
+					Path    string
+					Deleted bool
+					Meta    backupState
+				}{}
+				switch err := d.Decode(&ob); err {
+				case nil:
+				case io.EOF:
+					return nil
+				default:
+					return err
+				}
+				if ob.Deleted {
+					delete(rv, ob.Path)
+				} else {
+					rv[ob.Path] = ob.Meta
+				}
+			}
+		}()
+		if err != nil {
+			return nil, fmt.Errorf("reading backup %v: %v", bi.Fn, err)
+		}
+	}
+	return rv, nil
 }
 
 func recordBackupObject() error {
@@ -115,8 +221,7 @@ func recordRemoteBackupObjects() {
 		return
 	}
 	for _, n := range rn {
-		u := fmt.Sprintf("http://%s%s",
-			n.Address(), markBackupPrefix)
+		u := n.URLBase() + markBackupPrefix
 		c := n.Client()
 		res, err := c.Post(u, "application/octet-stream", nil)
 		if err != nil {
@@ -131,33 +236,57 @@ func recordRemoteBackupObjects() {
 }
 
 func removeDeadBackups(b *backups) {
-	// Keep only backups we're pretty sure still exist.
+	// Keep only backups we're pretty sure still exist, and the ones
+	// they're incremental to.
 	obn := b.Backups
-	b.Backups = nil
-	for _, bi := range obn {
+	keep := make([]bool, len(obn))
+	needed := map[string]bool{}
+	for i := len(obn) - 1; i >= 0; i-- {
+		bi := obn[i]
 		fm := fileMeta{}
 		err := couchbase.Get(shortName(bi.Fn), &fm)
-		if gomemcached.IsNotFound(err) {
+		switch {
+		case !isNotFound(err):
+			keep[i] = true
+		case needed[bi.Oid]:
+			log.Printf("Keeping previous (deleted) backup %v as a base",
+				bi.Fn)
+			keep[i] = true
+		default:
 			log.Printf("Dropping previous (deleted) backup: %v",
 				bi.Fn)
-		} else {
-			b.Backups = append(b.Backups, bi)
+		}
+		if keep[i] && bi.Incremental {
+			needed[bi.Base] = true
 		}
 	}
 
+	b.Backups = nil
+	for i, bi := range obn {
+		if keep[i] {
+			b.Backups = append(b.Backups, bi)
+		}
+	}
 }
 
-func storeBackupObject(fn, h string) error {
+func storeBackupObject(fn, h, base string) error {
 	b := backups{}
 	err := couchbase.Get(backupKey, &b)
-	if err != nil && !gomemcached.IsNotFound(err) {
+	if err != nil && !isNotFound(err) {
 		log.Printf("Weird: %v", err)
 		// return err
 	}
 
 	removeDeadBackups(&b)
 
-	ob := backupItem{fn, h, time.Now().UTC(), *globalConfig}
+	ob := backupItem{
+		Fn:          fn,
+		Oid:         h,
+		When:        time.Now().UTC(),
+		Conf:        *globalConfig,
+		Incremental: base != "",
+		Base:        base,
+	}
 
 	b.Latest = ob
 	b.Backups = append(b.Backups, ob)
@@ -165,7 +294,31 @@ func storeBackupObject(fn, h string) error {
 	return couchbase.Set(backupKey, 0, &b)
 }
 
-func backupToCBFS(fn string) error {
+// Back up to fn, incrementally from the latest backup if asked.
+func backupToCBFS(fn string, incremental bool) error {
+	var baseState map[string]backupState
+	base := ""
+	if incremental {
+		b := backups{}
+		err := couchbase.Get(backupKey, &b)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		removeDeadBackups(&b)
+		if b.Latest.Oid == "" {
+			return errNoBaseBackup
+		}
+		chain, err := backupChain(b, b.Latest.Oid)
+		if err != nil {
+			return err
+		}
+		baseState, err = backupChainState(chain)
+		if err != nil {
+			return err
+		}
+		base = b.Latest.Oid
+	}
+
 	f, err := NewHashRecord(*root, "")
 	if err != nil {
 		return err
@@ -174,7 +327,7 @@ func backupToCBFS(fn string) error {
 
 	pr, pw := io.Pipe()
 
-	go func() { pw.CloseWithError(backupTo(pw)) }()
+	go func() { pw.CloseWithError(backupTo(pw, baseState)) }()
 
 	h, length, err := f.Process(pr)
 	if err != nil {
@@ -197,7 +350,7 @@ func backupToCBFS(fn string) error {
 		return err
 	}
 
-	err = storeBackupObject(fn, h)
+	err = storeBackupObject(fn, h, base)
 	if err != nil {
 		return err
 	}
@@ -207,17 +360,19 @@ func backupToCBFS(fn string) error {
 		log.Printf("Failed to record backup OID: %v", err)
 	}
 
-	go recordRemoteBackupObjects()
+	inBackground(recordRemoteBackupObjects)
 
 	log.Printf("Replicating backup %v.", h)
-	go increaseReplicaCount(h, length, globalConfig.MinReplicas-1)
+	inBackground(func() {
+		increaseReplicaCount(h, length, globalConfig.MinReplicas-1)
+	})
 
 	return nil
 }
 
 func doMarkBackup(w http.ResponseWriter, req *http.Request) {
 	if req.FormValue("all") == "true" {
-		go recordRemoteBackupObjects()
+		inBackground(recordRemoteBackupObjects)
 	}
 	err := recordBackupObject()
 	if err != nil {
@@ -227,16 +382,19 @@ func doMarkBackup(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(204)
 }
 
+var errNoBaseBackup = errors.New("no backup to be incremental to")
+
 func doBackupDocs(w http.ResponseWriter, req *http.Request) {
 	fn := req.FormValue("fn")
 	if fn == "" {
 		http.Error(w, "Missing fn parameter", 400)
 		return
 	}
+	incremental, _ := strconv.ParseBool(req.FormValue("incremental"))
 
 	if bg, _ := strconv.ParseBool(req.FormValue("bg")); bg {
 		go func() {
-			err := backupToCBFS(fn)
+			err := backupToCBFS(fn, incremental)
 			if err != nil {
 				log.Printf("Error performing bg backup: %v", err)
 			}
@@ -245,8 +403,11 @@ func doBackupDocs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err := backupToCBFS(fn)
-	if err != nil {
+	err := backupToCBFS(fn, incremental)
+	if err == errNoBaseBackup {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if err != nil {
 		http.Error(w, fmt.Sprintf("Error performing backup: %v", err), 500)
 		return
 	}
@@ -259,7 +420,7 @@ func doGetBackupInfo(w http.ResponseWriter, req *http.Request) {
 	err := couchbase.Get(backupKey, &b)
 	if err != nil {
 		code := 500
-		if gomemcached.IsNotFound(err) {
+		if isNotFound(err) {
 			code = 404
 		}
 		http.Error(w, err.Error(), code)
@@ -284,6 +445,18 @@ func maybeStoreMeta(k string, fm fileMeta, exp int, force bool) error {
 	return err
 }
 
+// The expiration to restore a file with.  Unless one's given, a
+// relative expiration in its headers counts from when it was modified.
+func restoreExpiration(exp int, fm fileMeta) int {
+	if exp == -1 {
+		exp = getExpiration(fm.Headers)
+		if exp > 0 && exp < 60*60*24*30 {
+			exp = int(fm.Modified.Add(time.Second * time.Duration(exp)).Unix())
+		}
+	}
+	return exp
+}
+
 func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 	d := json.NewDecoder(req.Body)
 	fm := fileMeta{}
@@ -308,26 +481,30 @@ func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 		return
 	}
 
-	_, err = referenceBlob(fm.OID)
-	if err != nil {
-		log.Printf("Missing blob %v while restoring %v - restoring anyway",
-			fm.OID, fn)
-	}
-
-	exp := getExpiration(req.Header)
-	if exp == -1 {
-		exp = getExpiration(fm.Headers)
-		if exp > 0 && exp < 60*60*24*30 {
-			exp = int(fm.Modified.Add(time.Second * time.Duration(exp)).Unix())
+	for _, oid := range fm.blobs() {
+		_, err = referenceBlob(oid)
+		if err != nil {
+			log.Printf("Missing blob %v while restoring %v - restoring anyway",
+				oid, fn)
 		}
 	}
 
+	exp := restoreExpiration(getExpiration(req.Header), fm)
 	if exp < 0 {
 		log.Printf("Attempt to restore expired file: %v", fn)
 		w.WriteHeader(201)
 		return
 	}
 
+	if err := checkQuota(fn, fm.Length); isOverQuota(err) {
+		log.Printf("Not restoring %v: %v", fn, err)
+		http.Error(w, err.Error(), 507)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	force := false
 	err = maybeStoreMeta(fn, fm, exp, force)
 	switch err {
@@ -343,6 +520,7 @@ func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 		return
 	}
 
+	chargeQuota(fn, fm.Length, 1)
 	log.Printf("Restored %v -> %v (exp=%v)", fn, fm.OID, exp)
 
 	w.WriteHeader(201)
@@ -366,10 +544,13 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 	visited := 0
 	for {
 		ob := struct {
-			Meta struct {
-				OID   string
-				Older []struct {
-					OID string
+			Deleted bool
+			Meta    struct {
+				OID    string
+				Chunks []chunkRef
+				Older  []struct {
+					OID    string
+					Chunks []chunkRef
 				}
 			}
 		}{}
@@ -377,6 +558,9 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 		err := d.Decode(&ob)
 		switch err {
 		case nil:
+			if ob.Deleted {
+				continue
+			}
 			oid, err := hex.DecodeString(ob.Meta.OID)
 			if err != nil {
 				return nil, visited, err
@@ -387,8 +571,18 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 			}
 			rv.Add(oid)
 			visited++
+			oids := []string{}
+			for _, c := range ob.Meta.Chunks {
+				oids = append(oids, c.OID)
+			}
 			for _, obs := range ob.Meta.Older {
-				oid, err = hex.DecodeString(obs.OID)
+				oids = append(oids, obs.OID)
+				for _, c := range obs.Chunks {
+					oids = append(oids, c.OID)
+				}
+			}
+			for _, o := range oids {
+				oid, err = hex.DecodeString(o)
 				if err != nil {
 					return nil, visited, err
 				}
@@ -406,7 +600,7 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 func loadExistingHashes() (*hashset.Hashset, error) {
 	b := backups{}
 	err := couchbase.Get(backupKey, &b)
-	if err != nil && !gomemcached.IsNotFound(err) {
+	if err != nil && !isNotFound(err) {
 		return nil, err
 	}
 
@@ -449,6 +643,12 @@ func loadExistingHashes() (*hashset.Hashset, error) {
 
 	visited := 0
 	hs := &hashset.Hashset{}
+	// The backups themselves, in case a base's file is gone.
+	for _, i := range b.Backups {
+		if oid, err := hex.DecodeString(i.Oid); err == nil {
+			hs.Add(oid)
+		}
+	}
 	for {
 		// Done getting all the things
 		if hsch == nil && visitch == nil && errch == nil {
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+type testBackupLine struct {
+	Path    string
+	Deleted bool
+	Meta    fileMeta
+}
+
+func readTestBackup(t *testing.T, oid string) map[string]testBackupLine {
+	r := blobReader(oid)
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("Error reading backup %v: %v", oid, err)
+	}
+	rv := map[string]testBackupLine{}
+	d := json.NewDecoder(gz)
+	for {
+		l := testBackupLine{}
+		if err := d.Decode(&l); err == io.EOF {
+			return rv
+		} else if err != nil {
+			t.Fatalf("Error decoding backup %v: %v", oid, err)
+		}
+		rv[l.Path] = l
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	if w := doTestRequest(t, "POST", backupPrefix+"?fn=bak/i0&incremental=true",
+		""); w.Code != 409 {
+		t.Errorf("Expected incremental without a base to fail, got %v", w.Code)
+	}
+
+	doTestRequest(t, "PUT", "/same.txt", "unchanged")
+	doTestRequest(t, "PUT", "/changed.txt", "before")
+	doTestRequest(t, "PUT", "/gone.txt", "going")
+	gone := fileMeta{}
+	couchbase.Get(shortName("gone.txt"), &gone)
+
+	if w := doTestRequest(t, "POST", backupPrefix+"?fn=bak/full", ""); w.Code != 201 {
+		t.Fatalf("Error backing up: %v %s", w.Code, w.Body)
+	}
+
+	doTestRequest(t, "PUT", "/changed.txt", "after")
+	doTestRequest(t, "DELETE", "/gone.txt", "")
+	doTestRequest(t, "PUT", "/new.txt", "new")
+
+	if w := doTestRequest(t, "POST", backupPrefix+"?fn=bak/i1&incremental=true",
+		""); w.Code != 201 {
+		t.Fatalf("Error backing up incrementally: %v %s", w.Code, w.Body)
+	}
+
+	b := backups{}
+	if err := couchbase.Get(backupKey, &b); err != nil || len(b.Backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %+v: %v", b, err)
+	}
+	full, incr := b.Backups[0], b.Backups[1]
+	if full.Incremental || !incr.Incremental || incr.Base != full.Oid {
+		t.Fatalf("Expected i1 to be incremental to full, got %+v", b.Backups)
+	}
+
+	// The full backup is a new file too.
+	got := readTestBackup(t, incr.Oid)
+	for _, p := range []string{"changed.txt", "new.txt", "bak/full"} {
+		if l, ok := got[p]; !ok || l.Deleted {
+			t.Errorf("Expected %v in the incremental backup, got %+v", p, got)
+		}
+	}
+	if !got["gone.txt"].Deleted {
+		t.Errorf("Expected gone.txt marked deleted, got %+v", got)
+	}
+	if _, ok := got["same.txt"]; ok || len(got) != 4 {
+		t.Errorf("Expected only changes, got %+v", got)
+	}
+
+	chain, err := backupChain(b, incr.Oid)
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("Error following the chain: %v %+v", err, chain)
+	}
+	state, err := backupChainState(chain)
+	if err != nil {
+		t.Fatalf("Error replaying the chain: %v", err)
+	}
+	if _, ok := state["gone.txt"]; ok || len(state) != 4 {
+		t.Errorf("Expected the chain to end with 4 files, got %v", state)
+	}
+
+	// The base's file going away mustn't break the chain.
+	doTestRequest(t, "DELETE", "/bak/full", "")
+	removeDeadBackups(&b)
+	if len(b.Backups) != 2 {
+		t.Errorf("Expected the base to be kept, got %+v", b.Backups)
+	}
+
+	hs, err := loadExistingHashes()
+	if err != nil {
+		t.Fatalf("Error loading backup hashes: %v", err)
+	}
+	for _, oid := range []string{gone.OID, full.Oid} {
+		h, _ := hex.DecodeString(oid)
+		if !hs.Contains(h) {
+			t.Errorf("Expected %v to be protected by the backups", oid)
+		}
+	}
+}
+
+func TestRestoreDocumentQuota(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	if w := doTestRequest(t, "PUT", "/a.txt", "0123456789"); w.Code != 201 {
+		t.Fatalf("Error storing: %v %s", w.Code, w.Body)
+	}
+	data, err := couchbase.GetRaw("a.txt")
+	if err != nil {
+		t.Fatalf("Error getting meta: %v", err)
+	}
+	w := doTestRequest(t, "PUT", quotaPrefix+"team", `{"maxBytes": 5}`)
+	if w.Code != 200 {
+		t.Fatalf("Error setting quota: %v %s", w.Code, w.Body)
+	}
+
+	w = doTestRequest(t, "POST", restorePrefix+"team/a.txt", string(data))
+	if w.Code != 507 {
+		t.Errorf("Expected restore over quota to fail, got %v %s", w.Code, w.Body)
+	}
+	if w := doTestRequest(t, "GET", "/team/a.txt", ""); w.Code != 404 {
+		t.Errorf("Expected nothing restored, got %v", w.Code)
+	}
+	if q := getTestQuota(t, "team/"); q.Bytes != 0 || q.Files != 0 {
+		t.Errorf("Expected nothing charged, got %+v", q)
+	}
+
+	w = doTestRequest(t, "POST", restorePrefix+"b.txt", string(data))
+	if w.Code != 201 {
+		t.Errorf("Error restoring: %v %s", w.Code, w.Body)
+	}
+}
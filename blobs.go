@@ -11,11 +11,11 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
-	"github.com/couchbase/gomemcached"
-	"github.com/couchbase/gomemcached/client"
 	cb "github.com/couchbaselabs/go-couchbase"
 	"github.com/sethwklein/errutil"
 )
@@ -27,6 +27,19 @@ type BlobOwnership struct {
 	Type       string               `json:"type"`
 	Garbage    bool                 `json:"garbage"`
 	Referenced time.Time            `json:"referenced"`
+	// Erasure coded blobs list their k data shards followed by
+	// their parity shards.  Each shard is a blob of its own that
+	// points back at its parent.
+	Shards     []string `json:"shards,omitempty"`
+	DataShards int      `json:"dataShards,omitempty"`
+	ShardOf    string   `json:"shardOf,omitempty"`
+	// Set from the files that hold on to this blob.
+	RetainUntil time.Time `json:"retainUntil,omitempty"`
+	LegalHold   bool      `json:"legalHold,omitempty"`
+}
+
+func (b BlobOwnership) held(now time.Time) bool {
+	return b.LegalHold || now.Before(b.RetainUntil)
 }
 
 type internodeCommand uint8
@@ -37,11 +50,19 @@ const (
 	fetchObjectCmd
 )
 
+// Something for one node to do about a blob, queued in taskqueue.go.
 type internodeTask struct {
-	node     StorageNode
-	cmd      internodeCommand
-	oid      string
-	prevNode string
+	Cmd       internodeCommand `json:"cmd"`
+	Node      string           `json:"node,omitempty"`
+	OID       string           `json:"oid"`
+	PrevNode  string           `json:"prevNode,omitempty"`
+	Priority  taskPriority     `json:"priority"`
+	Queued    time.Time        `json:"queued"`
+	Attempts  int              `json:"attempts,omitempty"`
+	NotBefore time.Time        `json:"notBefore,omitempty"`
+	LastError string           `json:"lastError,omitempty"`
+
+	seq uint64
 }
 
 var taskWorkers = flag.Int("taskWorkers", 4,
@@ -52,7 +73,7 @@ func (b BlobOwnership) ResolveNodes() NodeList {
 	for k := range b.Nodes {
 		keys = append(keys, "/"+k)
 	}
-	resps, _, err := couchbase.GetBulk(keys)
+	resps, err := couchbase.GetBulk(keys)
 	if err != nil {
 		log.Panicf("Error getting nodelist: %v", err)
 	}
@@ -60,13 +81,11 @@ func (b BlobOwnership) ResolveNodes() NodeList {
 	rv := make(NodeList, 0, len(resps))
 
 	for k, v := range resps {
-		if v.Status == gomemcached.SUCCESS {
-			a := StorageNode{}
-			err := json.Unmarshal(v.Body, &a)
-			if err == nil {
-				a.name = k[1:]
-				rv = append(rv, a)
-			}
+		a := StorageNode{}
+		err := json.Unmarshal(v, &a)
+		if err == nil {
+			a.name = k[1:]
+			rv = append(rv, a)
 		}
 	}
 
@@ -120,19 +139,17 @@ func getBlobs(oids []string) (map[string]BlobOwnership, error) {
 	res := map[string]BlobOwnership{}
 
 	for _, keys := range keysets {
-		bres, _, err := couchbase.GetBulk(keys)
+		bres, err := couchbase.GetBulk(keys)
 		if err != nil {
 			return nil, err
 		}
 		for k, v := range bres {
-			if v.Status == gomemcached.SUCCESS {
-				bo := BlobOwnership{}
-				err := json.Unmarshal(v.Body, &bo)
-				if err != nil {
-					return res, err
-				}
-				res[k[1:]] = bo
+			bo := BlobOwnership{}
+			err := json.Unmarshal(v, &bo)
+			if err != nil {
+				return res, err
 			}
+			res[k[1:]] = bo
 		}
 	}
 
@@ -177,6 +194,9 @@ func recordBlobOwnership(h string, l int64, force bool) error {
 				// Skip it fast if it already knows us
 				return nil, cb.UpdateCancel
 			}
+			if ownership.Nodes == nil {
+				ownership.Nodes = map[string]time.Time{}
+			}
 			ownership.Nodes[serverId] = time.Now().UTC()
 		} else {
 			ownership.Nodes = map[string]time.Time{
@@ -201,63 +221,57 @@ func recordBlobOwnership(h string, l int64, force bool) error {
 
 func referenceBlob(h string) (rv BlobOwnership, err error) {
 	k := "/" + h
-	err = couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		res, err := mc.Get(vb, k)
-		if err != nil {
-			return err
+	err = couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		if len(in) == 0 {
+			return nil, errNotFound
 		}
 		ownership := BlobOwnership{}
-		err = json.Unmarshal(res.Body, &ownership)
+		err := json.Unmarshal(in, &ownership)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		ownership.Referenced = time.Now()
 		ownership.Garbage = false
 		rv = ownership
-		req := &gomemcached.MCRequest{
-			Opcode:  gomemcached.SET,
-			VBucket: vb,
-			Key:     []byte(k),
-			Cas:     res.Cas,
-			Opaque:  0,
-			Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
-			Body:    mustEncode(&ownership)}
-		_, err = mc.Send(req)
-		return err
+		return json.Marshal(&ownership)
 	})
 	return
 }
 
 func markGarbage(h string) error {
 	k := "/" + h
-	return couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		res, err := mc.Get(vb, k)
-		if err != nil {
-			return err
+	return couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		if len(in) == 0 {
+			return nil, errNotFound
 		}
 		ownership := BlobOwnership{}
-		err = json.Unmarshal(res.Body, &ownership)
+		err := json.Unmarshal(in, &ownership)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		t := ownership.latestReference()
 		if time.Since(t) < time.Minute*15 {
-			return errors.New("too soon")
+			return nil, errors.New("too soon")
+		}
+		if ownership.held(time.Now()) {
+			return nil, errors.New("retained")
 		}
 		ownership.Garbage = true
-		req := &gomemcached.MCRequest{
-			Opcode:  gomemcached.SET,
-			VBucket: vb,
-			Key:     []byte(k),
-			Cas:     res.Cas,
-			Opaque:  0,
-			Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
-			Body:    mustEncode(&ownership)}
-		_, err = mc.Send(req)
-		return err
+		return json.Marshal(&ownership)
 	})
 }
 
+// Metadata updates requests kick off without waiting for them.
+var backgroundWork sync.WaitGroup
+
+func inBackground(f func()) {
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		f()
+	}()
+}
+
 func recordBlobAccess(h string) {
 	_, err := couchbase.Incr("/"+h+"/r", 1, 1, 0)
 	if err != nil {
@@ -333,12 +347,17 @@ func maybeRemoveBlobOwnership(h string) (rv error) {
 
 		err := json.Unmarshal(in, &ownership)
 		if err == nil {
+			minReplicas := globalConfig.MinReplicas
+			if ownership.ShardOf != "" {
+				// Parity covers shards, one copy is plenty.
+				minReplicas = 1
+			}
 			if ownership.Garbage {
 				// OK
 			} else if time.Since(ownership.Nodes[serverId]) < time.Hour {
 				rv = errors.New("too soon")
 				return nil, cb.UpdateCancel
-			} else if len(ownership.Nodes)-1 < globalConfig.MinReplicas {
+			} else if len(ownership.Nodes)-1 < minReplicas {
 				rv = errors.New("Insufficient replicas")
 				return nil, cb.UpdateCancel
 			}
@@ -379,7 +398,7 @@ func increaseReplicaCount(oid string, length int64, by int) error {
 	}
 	for _, n := range onto {
 		log.Printf("Asking %v to acquire %v", n, oid)
-		queueBlobAcquire(n, oid, "")
+		queueBlobAcquire(n, oid, "", prioritySalvage)
 	}
 	return nil
 }
@@ -408,7 +427,7 @@ func ensureMinimumReplicaCount() error {
 	}
 
 	// Find some less replicated docs to suck in.
-	err = couchbase.ViewCustom("cbfs", "repcounts",
+	err = couchbase.View("repcounts",
 		map[string]interface{}{
 			"reduce":   false,
 			"limit":    globalConfig.ReplicationCheckLimit,
@@ -451,20 +470,22 @@ func pruneBlob(oid string, nodemap map[string]string, nl NodeList) {
 	log.Printf("Pruning blob %v down from %v repls to %v",
 		oid, len(nodemap), globalConfig.MaxReplicas)
 
-	nm := map[string]StorageNode{}
+	holders := NodeList{}
 	for _, n := range nl {
-		nm[n.name] = n
+		if _, ok := nodemap[n.name]; ok {
+			holders = append(holders, n)
+		}
 	}
 
+	// Drop copies sharing a zone before ones that are the only copy
+	// in theirs.
 	remaining := len(nodemap)
-	for n := range nodemap {
+	for _, sn := range holders.pruneOrder() {
 		if remaining <= globalConfig.MaxReplicas {
 			break
 		}
 		remaining--
-		if sn, ok := nm[n]; ok {
-			queueBlobRemoval(sn, oid)
-		}
+		queueBlobRemoval(sn, oid)
 	}
 
 }
@@ -480,14 +501,16 @@ func pruneExcessiveReplicas() error {
 			Id  string
 			Doc struct {
 				Json struct {
-					Nodes map[string]string
+					Nodes       map[string]string
+					RetainUntil time.Time
+					LegalHold   bool
 				}
 			}
 		}
 	}{}
 
 	// Find some less replicated docs to suck in.
-	err = couchbase.ViewCustom("cbfs", "repcounts",
+	err = couchbase.View("repcounts",
 		map[string]interface{}{
 			"descending":   true,
 			"reduce":       false,
@@ -511,30 +534,42 @@ func pruneExcessiveReplicas() error {
 	}
 
 	for _, r := range viewRes.Rows {
-		pruneBlob(r.Id[1:], r.Doc.Json.Nodes, nl)
+		// Retained blobs keep every copy they've got.
+		j := r.Doc.Json
+		if j.LegalHold || time.Now().Before(j.RetainUntil) {
+			continue
+		}
+		pruneBlob(r.Id[1:], j.Nodes, nl)
 	}
 	return nil
 }
 
 func hasBlob(oid string) bool {
-	_, err := os.Stat(hashFilename(*root, oid))
+	_, err := localBlobFile(oid)
 	return err == nil
 }
 
 var fetchLocks namedLock
 
-func performFetch(oid, prev string) {
-	c := captureResponseWriter{w: ioutil.Discard, hdr: http.Header{}}
+func performFetch(oid, prev string) error {
+	c := captureResponseWriter{
+		w:   limitedWriter{ioutil.Discard, internodeBucket},
+		hdr: http.Header{},
+	}
 
 	// If we already have it, we don't need it more.
-	st, err := os.Stat(hashFilename(*root, oid))
+	fn, err := localBlobFile(oid)
+	var st os.FileInfo
+	if err == nil {
+		st, err = os.Stat(fn)
+	}
 	if err == nil {
-		err = recordBlobOwnership(oid, st.Size(), false)
+		err = recordBlobOwnership(oid, blobContentSize(st), false)
 		if err != nil {
 			log.Printf("Error recording fetched blob %v: %v",
 				oid, err)
 		}
-		return
+		return err
 	}
 
 	if fetchLocks.Lock(oid) {
@@ -542,27 +577,31 @@ func performFetch(oid, prev string) {
 		err = getBlobFromRemote(&c, oid, http.Header{}, 100)
 	} else {
 		log.Printf("Not fetching remote, already in progress.")
-		return
+		return nil
 	}
 
 	if err == nil && c.statusCode == 200 {
 		if prev != "" {
 			log.Printf("Removing ownership of %v from %v after takeover",
 				oid, prev)
-			n, err := findNode(prev)
+			n, err := taskNode(prev)
 			if err != nil {
 				log.Printf("Error finding old node of %v: %v", oid, err)
 				removeBlobOwnershipRecord(oid, prev)
 			} else {
 				log.Printf("Requesting post-move blob removal of %v from %v",
 					oid, n)
-				go queueBlobRemoval(n, oid)
+				queueBlobRemoval(n, oid)
 			}
 		}
-	} else {
-		log.Printf("Error grabbing remote object %v, got %v/%v",
-			oid, c.statusCode, err)
+		return nil
+	}
+	log.Printf("Error grabbing remote object %v, got %v/%v",
+		oid, c.statusCode, err)
+	if err == nil {
+		err = fmt.Errorf("fetching %v: status %v", oid, c.statusCode)
 	}
+	return err
 }
 
 // Return false on unrecoverable errors (i.e. the internode queue is
@@ -576,7 +615,8 @@ func salvageBlob(oid, deadNode string, todo int, nl NodeList) bool {
 	} else {
 		rv := true
 		for _, n := range candidates {
-			worked := maybeQueueBlobAcquire(n, oid, deadNode)
+			worked := maybeQueueBlobAcquire(n, oid, deadNode,
+				prioritySalvage)
 			log.Printf("Recommending %v get a copy of %v - queued=%v",
 				n, oid, worked)
 			rv = rv && worked
@@ -590,88 +630,123 @@ func salvageBlob(oid, deadNode string, todo int, nl NodeList) bool {
 	return true
 }
 
-var internodeTaskQueue chan internodeTask
+// The node a task is for, with a name even if it's gone.
+func taskNode(name string) (StorageNode, error) {
+	n, err := findNode(name)
+	n.name = name
+	return n, err
+}
 
-func internodeTaskWorker() {
-	for c := range internodeTaskQueue {
-		switch c.cmd {
-		case removeObjectCmd:
-			if err := c.node.deleteBlob(c.oid); err != nil {
-				log.Printf("Error deleting %v from %v: %v",
-					c.oid, c.node, err)
-				if c.node.IsDead() {
-					log.Printf("Node is dead, cleaning %v",
-						c.oid)
-					removeBlobOwnershipRecord(c.oid,
-						c.node.name)
-				}
-			}
-		case acquireObjectCmd:
-			if err := c.node.acquireBlob(c.oid, c.prevNode); err != nil {
-				log.Printf("Error requesting acquisition of %v from %v: %v",
-					c.oid, c.node, err)
+func runInternodeTask(c internodeTask) error {
+	switch c.Cmd {
+	case removeObjectCmd:
+		n, err := taskNode(c.Node)
+		if err == nil {
+			err = n.deleteBlob(c.OID)
+		}
+		if err != nil {
+			log.Printf("Error deleting %v from %v: %v", c.OID, n, err)
+			if isNotFound(err) || n.IsDead() {
+				log.Printf("Node is dead, cleaning %v", c.OID)
+				removeBlobOwnershipRecord(c.OID, c.Node)
+				return nil
 			}
-		case fetchObjectCmd:
-			performFetch(c.oid, c.prevNode)
-		default:
-			log.Fatalf("Unhandled worker task: %v", c)
 		}
+		return err
+	case acquireObjectCmd:
+		n, err := taskNode(c.Node)
+		if isNotFound(err) {
+			log.Printf("Not asking missing node %v for %v", c.Node, c.OID)
+			return nil
+		}
+		if err == nil {
+			err = n.acquireBlob(c.OID, c.PrevNode, c.Priority)
+		}
+		if err != nil {
+			log.Printf("Error requesting acquisition of %v from %v: %v",
+				c.OID, n, err)
+		}
+		return err
+	case fetchObjectCmd:
+		return performFetch(c.OID, c.PrevNode)
+	}
+	log.Printf("Dropping unhandled worker task: %+v", c)
+	return nil
+}
+
+func internodeTaskWorker() {
+	for {
+		c := internodeTaskQueue.next()
+		internodeTaskQueue.done(c, runInternodeTask(c))
 	}
 }
 
-func initTaskQueueWorkers() {
+func initTaskQueueWorkers() error {
+	q, err := openTaskQueue(filepath.Join(*root, taskQueueFile))
+	if err != nil {
+		return err
+	}
+	internodeTaskQueue = q
+	go q.promoteLoop()
+	go q.flushLoop()
 	for i := 0; i < *taskWorkers; i++ {
 		go internodeTaskWorker()
 	}
+	return nil
 }
 
-func queueBlobRemoval(n StorageNode, oid string) {
-	internodeTaskQueue <- internodeTask{
-		node: n,
-		cmd:  removeObjectCmd,
-		oid:  oid,
+func queueInternodeTask(t internodeTask) bool {
+	if internodeTaskQueue == nil {
+		log.Printf("No internode queue for %v of %v", t.Cmd, t.OID)
+		return false
 	}
+	if err := internodeTaskQueue.add(t); err != nil {
+		log.Printf("Error queueing %v of %v: %v", t.Cmd, t.OID, err)
+		return false
+	}
+	return true
+}
+
+func queueBlobRemoval(n StorageNode, oid string) {
+	queueInternodeTask(internodeTask{
+		Cmd:      removeObjectCmd,
+		Node:     n.name,
+		OID:      oid,
+		Priority: priorityCleanup,
+	})
 }
 
 // Ask a remote node to go get a blob
-func queueBlobAcquire(n StorageNode, oid string, prev string) {
-	internodeTaskQueue <- internodeTask{
-		node:     n,
-		cmd:      acquireObjectCmd,
-		oid:      oid,
-		prevNode: prev,
-	}
+func queueBlobAcquire(n StorageNode, oid string, prev string,
+	pri taskPriority) {
+
+	maybeQueueBlobAcquire(n, oid, prev, pri)
 }
 
 // Ask a remote node to go get a blob, return false if the queue is full
-func maybeQueueBlobAcquire(n StorageNode, oid string, prev string) bool {
-	select {
-	case internodeTaskQueue <- internodeTask{
-		node:     n,
-		cmd:      acquireObjectCmd,
-		oid:      oid,
-		prevNode: prev,
-	}:
-		return true
-	default:
-		return false
-	}
+func maybeQueueBlobAcquire(n StorageNode, oid string, prev string,
+	pri taskPriority) bool {
+
+	return queueInternodeTask(internodeTask{
+		Cmd:      acquireObjectCmd,
+		Node:     n.name,
+		OID:      oid,
+		PrevNode: prev,
+		Priority: pri,
+	})
 }
 
 // Ask this node to go get a blob.
 //
 // Returns false if queue is full and the request could not be queued.
-func maybeQueueBlobFetch(oid, prev string) bool {
-	select {
-	case internodeTaskQueue <- internodeTask{
-		cmd:      fetchObjectCmd,
-		oid:      oid,
-		prevNode: prev,
-	}:
-		return true
-	default:
-		return false
-	}
+func maybeQueueBlobFetch(oid, prev string, pri taskPriority) bool {
+	return queueInternodeTask(internodeTask{
+		Cmd:      fetchObjectCmd,
+		Node:     serverId,
+		OID:      oid,
+		PrevNode: prev,
+		Priority: pri,
+	})
 }
 
 type errNotLocal struct {
@@ -694,11 +769,13 @@ func openBlob(oid string, localOnly bool) (io.ReadCloser, error) {
 		return nil, err
 	}
 	nl := bo.ResolveNodes()
-	if len(nl) == 0 {
+	if len(nl) == 0 && len(bo.Shards) == 0 {
 		return nil, errors.New("no copies found")
 	}
 
-	if localOnly {
+	// Erasure coded content can't be redirected, it has to be
+	// put back together here.
+	if localOnly && len(nl) > 0 {
 		return nil, errNotLocal{nl.BlobURLs(oid)}
 	}
 
@@ -749,5 +826,9 @@ func openRemote(oid string, l int64, cachePerc int, nl NodeList) (io.ReadCloser,
 		rv := &hwFinisher{r, hw, oid, l}
 		return &readerClosers{rv, []io.Closer{rv, resp.Body}}, nil
 	}
+
+	if rv, err := openShards(oid); err != errNoShards {
+		return rv, err
+	}
 	return nil, fmt.Errorf("couldn't get ob from any of %v", nl)
 }
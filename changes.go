@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every change to the namespace is recorded under the next number
+// from changeSeqKey so readers can follow along from wherever they
+// left off:
+//
+//   GET /.cbfs/changes/[dir]?since=N[&feed=continuous]
+//
+// Changes are sent as a line of JSON each, followed (in a normal
+// feed) or interspersed (in a continuous one) by {"lastSeq": N}
+// lines saying how far the feed has been read.  Asking for
+// text/event-stream (or feed=eventsource) sends them as Server-Sent
+// Events instead, with the sequence as the event ID.
+//
+// Resuming from a sequence whose changes have expired gets a 410, and
+// the reader has to list everything again.
+
+const (
+	changeSeqKey     = "/@changeSeq"
+	changesBatch     = 500
+	changesPollFreq  = time.Second
+	changesHeartbeat = 30 * time.Second
+	// How long a sequence number may go missing before we assume its
+	// change is never going to show up.
+	changesGapWait = 5 * time.Second
+)
+
+type fileChange struct {
+	Type   string    `json:"type,omitempty"`
+	Seq    uint64    `json:"seq"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	OID    string    `json:"oid,omitempty"`
+	Revno  int       `json:"revno"`
+	Length int64     `json:"length"`
+	Node   string    `json:"node"`
+	Time   time.Time `json:"time"`
+}
+
+func changeKey(seq uint64) string {
+	return "/@change/" + strconv.FormatUint(seq, 10)
+}
+
+// Record a change to a file.  op is one of create, update, delete or
+// meta.
+func recordChange(op, path string, fm fileMeta) {
+	seq, err := couchbase.Incr(changeSeqKey, 1, 1, 0)
+	if err != nil {
+		log.Printf("Error allocating change sequence for %v %v: %v",
+			op, path, err)
+		return
+	}
+
+	c := fileChange{
+		Type:   "change",
+		Seq:    seq,
+		Op:     op,
+		Path:   path,
+		OID:    fm.OID,
+		Revno:  fm.Revno,
+		Length: fm.Length,
+		Node:   serverId,
+		Time:   time.Now().UTC(),
+	}
+	exp := expiryIn(globalConfig.ChangeRetention)
+	if err := couchbase.Set(changeKey(seq), exp, c); err != nil {
+		log.Printf("Error recording change %v (%v %v): %v",
+			seq, op, path, err)
+	}
+}
+
+func lastChangeSeq() (uint64, error) {
+	return couchbase.Incr(changeSeqKey, 0, 0, 0)
+}
+
+// Have changes after since (and before last) been dropped?  If both
+// since and the change after it are gone, the feed has moved on
+// without whoever was reading from since.  A lone missing change is
+// just a gap, or the one after since hasn't been written yet.
+func changesExpired(since, last uint64) (bool, error) {
+	if since == 0 || since >= last {
+		return false, nil
+	}
+	docs, err := couchbase.GetBulk([]string{changeKey(since),
+		changeKey(since + 1)})
+	if err != nil {
+		return false, err
+	}
+	return len(docs) == 0, nil
+}
+
+// Read the changes after since up to last.  A missing change stops
+// the read unless a later one has been around long enough that it
+// isn't still being written, or we're too far behind last for it to
+// matter.  Returns the changes and how far we got.
+func readChanges(since, last uint64) ([]fileChange, uint64, error) {
+	end := last
+	if end > since+changesBatch {
+		end = since + changesBatch
+	}
+	keys := []string{}
+	for seq := since + 1; seq <= end; seq++ {
+		keys = append(keys, changeKey(seq))
+	}
+	docs, err := couchbase.GetBulk(keys)
+	if err != nil {
+		return nil, since, err
+	}
+
+	got := make([]*fileChange, len(keys))
+	settled := end < last
+	for i := len(keys) - 1; i >= 0; i-- {
+		c := fileChange{}
+		if data, ok := docs[keys[i]]; ok && json.Unmarshal(data, &c) == nil {
+			got[i] = &c
+			settled = settled || time.Since(c.Time) > changesGapWait
+		} else if !settled {
+			// Nothing older than this can be trusted yet.
+			end = since + uint64(i)
+		}
+	}
+
+	rv := []fileChange{}
+	for i, c := range got {
+		if since+uint64(i) >= end {
+			break
+		}
+		if c != nil {
+			c.Type = ""
+			rv = append(rv, *c)
+		}
+	}
+	return rv, end, nil
+}
+
+func changeMatches(c fileChange, dir string) bool {
+	return dir == "" || c.Path == strings.TrimSuffix(dir, "/") ||
+		strings.HasPrefix(c.Path, dir)
+}
+
+func doGetChanges(w http.ResponseWriter, req *http.Request, dir string) {
+	dir = dirPath(strings.TrimLeft(dir, "/"))
+
+	sinceStr := req.FormValue("since")
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		sinceStr = id
+	}
+	since := uint64(0)
+	if sinceStr != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since: "+sinceStr, 400)
+			return
+		}
+	}
+
+	last, err := lastChangeSeq()
+	if err == nil {
+		var expired bool
+		if expired, err = changesExpired(since, last); expired {
+			http.Error(w, fmt.Sprintf("changes since %v have expired", since),
+				410)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Error checking changes after %v: %v", since, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	feed := req.FormValue("feed")
+	sse := feed == "eventsource" ||
+		strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	continuous := sse || feed == "continuous"
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	sendLast := func() {
+		if sse {
+			fmt.Fprintf(w, ": %d\n\n", since)
+		} else {
+			fmt.Fprintf(w, "{\"lastSeq\":%d}\n", since)
+		}
+		flush()
+	}
+
+	heartbeat := time.NewTicker(changesHeartbeat)
+	defer heartbeat.Stop()
+	poll := time.NewTicker(changesPollFreq)
+	defer poll.Stop()
+
+	for {
+		last, err := lastChangeSeq()
+		for err == nil && since < last {
+			var changes []fileChange
+			var next uint64
+			changes, next, err = readChanges(since, last)
+			for _, c := range changes {
+				if !changeMatches(c, dir) {
+					continue
+				}
+				if sse {
+					fmt.Fprintf(w, "id: %d\ndata: %s\n\n",
+						c.Seq, mustEncode(c))
+				} else {
+					fmt.Fprintf(w, "%s\n", mustEncode(c))
+				}
+			}
+			flush()
+			if next == since {
+				break
+			}
+			since = next
+		}
+		if err != nil {
+			log.Printf("Error reading changes after %v: %v", since, err)
+			return
+		}
+
+		if !continuous {
+			sendLast()
+			return
+		}
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			sendLast()
+		case <-poll.C:
+		}
+	}
+}
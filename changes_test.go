@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTestChanges(t *testing.T, path string) ([]fileChange, uint64) {
+	w := doTestRequest(t, "GET", changesPrefix+path, "")
+	if w.Code != 200 {
+		t.Fatalf("Error getting changes %v: %v %s", path, w.Code, w.Body)
+	}
+	rv := []fileChange{}
+	last := struct {
+		LastSeq *uint64
+	}{}
+	s := bufio.NewScanner(w.Body)
+	for s.Scan() {
+		if strings.Contains(s.Text(), "lastSeq") {
+			if err := json.Unmarshal(s.Bytes(), &last); err != nil {
+				t.Fatalf("Error parsing %s: %v", s.Bytes(), err)
+			}
+			continue
+		}
+		c := fileChange{}
+		if err := json.Unmarshal(s.Bytes(), &c); err != nil {
+			t.Fatalf("Error parsing %s: %v", s.Bytes(), err)
+		}
+		rv = append(rv, c)
+	}
+	if last.LastSeq == nil {
+		t.Fatalf("No lastSeq in changes %v:\n%s", path, w.Body)
+	}
+	return rv, *last.LastSeq
+}
+
+func TestChanges(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	for _, r := range []struct{ method, path, body string }{
+		{"PUT", "/a.txt", "one"},
+		{"PUT", "/a.txt", "two"},
+		{"PUT", metaPrefix + "a.txt", `{"x": 1}`},
+		{"DELETE", "/a.txt", ""},
+		{"PUT", "/b/c.txt", "three"},
+	} {
+		w := doTestRequest(t, r.method, r.path, r.body)
+		if w.Code >= 300 {
+			t.Fatalf("Error with %v %v: %v %s", r.method, r.path, w.Code, w.Body)
+		}
+	}
+
+	changes, last := readTestChanges(t, "")
+	got := []string{}
+	for _, c := range changes {
+		got = append(got, c.Op+":"+c.Path)
+	}
+	exp := "create:a.txt,update:a.txt,meta:a.txt,delete:a.txt,create:b/c.txt"
+	if strings.Join(got, ",") != exp || last != 5 {
+		t.Errorf("Expected %v through 5, got %v through %v", exp, got, last)
+	}
+	if c := changes[1]; c.Revno != 1 || c.Length != 3 || c.OID == "" ||
+		c.Node != serverId {
+		t.Errorf("Unexpected update: %+v", c)
+	}
+
+	if changes, _ := readTestChanges(t, "b/"); len(changes) != 1 {
+		t.Errorf("Expected only b/c.txt, got %v", changes)
+	}
+	if changes, last := readTestChanges(t, "?since=4"); len(changes) != 1 ||
+		changes[0].Seq != 5 || last != 5 {
+		t.Errorf("Expected just change 5, got %v through %v", changes, last)
+	}
+}
+
+func TestReadChangesGap(t *testing.T) {
+	defer withEmbeddedStore(t)()
+
+	old := time.Now().Add(-time.Minute)
+	couchbase.Set(changeKey(1), 0, fileChange{Seq: 1, Time: old})
+	couchbase.Set(changeKey(3), 0, fileChange{Seq: 3, Time: time.Now()})
+
+	changes, next, err := readChanges(0, 3)
+	if err != nil || len(changes) != 1 || next != 1 {
+		t.Errorf("Expected to stop before the recent gap, got %v, %v, %v",
+			changes, next, err)
+	}
+
+	couchbase.Set(changeKey(3), 0, fileChange{Seq: 3, Time: old})
+	changes, next, err = readChanges(0, 3)
+	if err != nil || len(changes) != 2 || next != 3 {
+		t.Errorf("Expected to skip the old gap, got %v, %v, %v",
+			changes, next, err)
+	}
+}
+
+func TestExpiredChanges(t *testing.T) {
+	defer withEmbeddedStore(t)()
+
+	couchbase.Incr(changeSeqKey, 4, 4, 0)
+	couchbase.Set(changeKey(4), 0, fileChange{Seq: 4, Time: time.Now()})
+
+	for _, since := range []string{"0", "3", "4"} {
+		if w := doTestRequest(t, "GET", changesPrefix+"?since="+since,
+			""); w.Code != 200 {
+			t.Errorf("Error getting changes since %v: %v %s",
+				since, w.Code, w.Body)
+		}
+	}
+	if w := doTestRequest(t, "GET", changesPrefix+"?since=1",
+		""); w.Code != 410 {
+		t.Errorf("Expected changes since 1 to have expired, got %v %s",
+			w.Code, w.Body)
+	}
+}
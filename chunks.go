@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Chunked files are split at content-defined boundaries found with a
+// gear rolling hash, so an edit only changes the chunks around it and
+// everything else dedups against chunks already in the cluster.
+//
+// The file's OID is still the hash of its entire content (that's
+// what clients see as its Etag), but there's no blob by that name.
+// The content is the concatenation of the blobs in its chunk list.
+
+const (
+	chunkMinSize = 256 * 1024
+	chunkMaxSize = 4 * 1024 * 1024
+	// Boundaries are where the top chunkAvgBits of the hash are
+	// zero, so chunks average around 1MB.
+	chunkAvgBits = 20
+)
+
+var errChunkedHash = errors.New("chunked content doesn't match X-CBFS-Hash")
+
+type chunkRef struct {
+	OID    string `json:"oid"`
+	Length int64  `json:"length"`
+}
+
+// Every node must find the same boundaries, so the table comes from
+// a fixed seed.
+var gearTable [256]uint64
+
+func init() {
+	r := rand.New(rand.NewSource(0x63626673))
+	for i := range gearTable {
+		gearTable[i] = uint64(r.Int63())<<1 ^ uint64(r.Int63())
+	}
+}
+
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   bufio.NewReaderSize(r, 64*1024),
+		buf: make([]byte, 0, chunkMaxSize),
+	}
+}
+
+// The returned chunk is only valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	h := uint64(0)
+	for len(c.buf) < chunkMaxSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		h = h<<1 + gearTable[b]
+		if len(c.buf) >= chunkMinSize && h>>(64-chunkAvgBits) == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
+
+func chunkedUpload(header http.Header) bool {
+	if b, err := strconv.ParseBool(header.Get("X-CBFS-Chunked")); err == nil {
+		return b
+	}
+	return globalConfig.ChunkedStorage
+}
+
+// All the blobs holding a file's content.
+func (fm fileMeta) blobs() []string {
+	return chunkOIDs(fm.OID, fm.Chunks)
+}
+
+func (pm prevMeta) blobs() []string {
+	return chunkOIDs(pm.OID, pm.Chunks)
+}
+
+func chunkOIDs(oid string, chunks []chunkRef) []string {
+	if len(chunks) == 0 {
+		return []string{oid}
+	}
+	rv := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		rv = append(rv, c.OID)
+	}
+	return rv
+}
+
+// Store a chunk unless the cluster already has enough copies of it.
+func storeChunk(fn string, data []byte, quorum int) (string, error) {
+	sh := getHash()
+	sh.Write(data)
+	h := hex.EncodeToString(sh.Sum(nil))
+	length := int64(len(data))
+
+	if bo, err := referenceBlob(h); err == nil && len(bo.Nodes) > 0 &&
+		len(bo.Nodes) >= quorum {
+		return h, nil
+	}
+
+	f, err := NewHashRecord(*root, h)
+	if err != nil {
+		log.Printf("Error writing tmp file: %v", err)
+		return "", errors.New("Error writing tmp file")
+	}
+	defer f.Close()
+
+	r, bgch := altStoreFile(fn, bytes.NewReader(data), length,
+		remoteCopies(quorum))
+	if _, _, err := f.Process(r); err != nil {
+		log.Printf("Error completing chunk write for %v: %v", fn, err)
+		return "", fmt.Errorf("Error completing blob write: %v", err)
+	}
+
+	err = recordBlobOwnership(h, length, true)
+	if err != nil {
+		log.Printf("Error storing blob ownership of %v for %v: %v",
+			h, fn, err)
+		return "", fmt.Errorf("Error recording blob ownership: %v", err)
+	}
+
+	replicas, err := awaitReplicas(fn, h, length, bgch, quorum)
+	if err != nil {
+		return "", err
+	}
+	if globalConfig.MinReplicas > replicas {
+		inBackground(func() {
+			increaseReplicaCount(h, length,
+				globalConfig.MinReplicas-replicas)
+		})
+	}
+
+	return h, nil
+}
+
+func storeChunkedFile(fn string, r io.Reader, quorum int,
+	header http.Header) (string, error) {
+
+	sh := getHash()
+	c := newChunker(io.TeeReader(r, sh))
+
+	fm := fileMeta{Headers: filterHeaders(header, isFileHeader)}
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading chunk for %v: %v", fn, err)
+			return "", fmt.Errorf("Error completing blob write: %v", err)
+		}
+		h, err := storeChunk(fn, data, quorum)
+		if err != nil {
+			return "", err
+		}
+		fm.Chunks = append(fm.Chunks, chunkRef{h, int64(len(data))})
+		fm.Length += int64(len(data))
+	}
+
+	fm.OID = hex.EncodeToString(sh.Sum(nil))
+	if hin := header.Get("X-CBFS-Hash"); hin != "" && hin != fm.OID {
+		return "", errChunkedHash
+	}
+	fm.Modified = time.Now().UTC()
+
+	if err := storeUserMeta(fn, fm, header); err != nil {
+		return "", err
+	}
+
+	log.Printf("Stored %v in %v chunks", fn, len(fm.Chunks))
+	return fm.OID, nil
+}
+
+// Presents a chunk list as one seekable stream.  Chunks are opened as
+// they're reached, locally if possible.
+type chunkReader struct {
+	chunks []chunkRef
+	size   int64
+	pos    int64
+	cur    io.ReadCloser
+	curEnd int64
+}
+
+func newChunkReader(chunks []chunkRef) *chunkReader {
+	rv := &chunkReader{chunks: chunks}
+	for _, c := range chunks {
+		rv.size += c.Length
+	}
+	return rv
+}
+
+func (c *chunkReader) closeCur() {
+	if c.cur != nil {
+		c.cur.Close()
+		c.cur = nil
+	}
+}
+
+func (c *chunkReader) open() error {
+	start := int64(0)
+	for _, ch := range c.chunks {
+		if c.pos < start+ch.Length {
+			f, err := openBlob(ch.OID, false)
+			if err != nil {
+				return fmt.Errorf("chunk %v: %v", ch.OID, err)
+			}
+			if skip := c.pos - start; skip > 0 {
+				if s, ok := f.(io.Seeker); ok {
+					_, err = s.Seek(skip, 0)
+				} else {
+					_, err = io.CopyN(ioutil.Discard, f, skip)
+				}
+				if err != nil {
+					f.Close()
+					return err
+				}
+			}
+			c.cur, c.curEnd = f, start+ch.Length
+			return nil
+		}
+		start += ch.Length
+	}
+	return io.EOF
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.pos >= c.size {
+		return 0, io.EOF
+	}
+	if c.cur == nil {
+		if err := c.open(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.curEnd-c.pos {
+		p = p[:c.curEnd-c.pos]
+	}
+	n, err := c.cur.Read(p)
+	c.pos += int64(n)
+	if c.pos == c.curEnd {
+		c.closeCur()
+		err = nil
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 1:
+		offset += c.pos
+	case 2:
+		offset += c.size
+	}
+	if offset < 0 {
+		return c.pos, errors.New("negative position")
+	}
+	if offset != c.pos {
+		c.closeCur()
+		c.pos = offset
+	}
+	return c.pos, nil
+}
+
+func (c *chunkReader) Close() error {
+	c.closeCur()
+	return nil
+}
+
+// Write a file's content to w, wherever its blobs are.
+func copyFileContent(w io.Writer, fm fileMeta) error {
+	for _, oid := range fm.blobs() {
+		if err := copyBlob(w, oid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
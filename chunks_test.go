@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func randomContent(size int) []byte {
+	rv := make([]byte, size)
+	r := rand.New(rand.NewSource(42))
+	for i := range rv {
+		rv[i] = byte(r.Intn(256))
+	}
+	return rv
+}
+
+func chunkContent(t *testing.T, data []byte) [][]byte {
+	rv := [][]byte{}
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return rv
+		}
+		if err != nil {
+			t.Fatalf("Error chunking: %v", err)
+		}
+		rv = append(rv, append([]byte{}, chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := randomContent(8 * 1024 * 1024)
+	chunks := chunkContent(t, data)
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %v", len(chunks))
+	}
+	for i, c := range chunks {
+		if len(c) > chunkMaxSize ||
+			(len(c) < chunkMinSize && i != len(chunks)-1) {
+			t.Errorf("Chunk %v has bad size %v", i, len(c))
+		}
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("Chunks don't reassemble the input")
+	}
+
+	// Inserting a byte near the front should leave later
+	// boundaries alone.
+	edited := append(append([]byte{}, data[:1000]...), data[999:]...)
+	seen := map[string]bool{}
+	for _, c := range chunks {
+		seen[string(c)] = true
+	}
+	shared := 0
+	for _, c := range chunkContent(t, edited) {
+		if seen[string(c)] {
+			shared++
+		}
+	}
+	if shared < len(chunks)-2 {
+		t.Errorf("Expected most of %v chunks to be shared, got %v",
+			len(chunks), shared)
+	}
+}
+
+func TestChunkedFile(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	data := randomContent(6 * 1024 * 1024)
+	put := func(fn string, content []byte) {
+		req, err := http.NewRequest("PUT", "http://localhost/"+fn,
+			bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		req.Header.Set("X-CBFS-Chunked", "true")
+		w := httptest.NewRecorder()
+		httpHandler(w, req)
+		if w.Code != 201 {
+			t.Fatalf("Error storing %v: %v %s", fn, w.Code, w.Body)
+		}
+	}
+
+	put("a", data)
+	fm := fileMeta{}
+	if err := couchbase.Get("a", &fm); err != nil {
+		t.Fatalf("Error getting meta: %v", err)
+	}
+	if len(fm.Chunks) < 2 || fm.Length != int64(len(data)) {
+		t.Fatalf("Expected a chunked file, got %v chunks, %v bytes",
+			len(fm.Chunks), fm.Length)
+	}
+
+	req, err := http.NewRequest("GET", "http://localhost/a", nil)
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("Error reading chunked file: %v, %v bytes",
+			w.Code, w.Body.Len())
+	}
+
+	// A range spanning a chunk boundary.
+	from := fm.Chunks[0].Length - 10
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", from, from+19))
+	w = httptest.NewRecorder()
+	httpHandler(w, req)
+	if w.Code != 206 || !bytes.Equal(w.Body.Bytes(), data[from:from+20]) {
+		t.Errorf("Error reading range: %v %v", w.Code, w.Body.Bytes())
+	}
+
+	// A mostly identical file reuses most of the chunks, and
+	// they're all referenced by file_blobs.
+	edited := append([]byte("x"), data...)
+	put("b", edited)
+	fmb := fileMeta{}
+	if err := couchbase.Get("b", &fmb); err != nil {
+		t.Fatalf("Error getting meta: %v", err)
+	}
+	viewRes := struct {
+		Rows []struct{ Key []string }
+	}{}
+	err = couchbase.View("file_blobs", map[string]interface{}{}, &viewRes)
+	if err != nil {
+		t.Fatalf("Error querying file_blobs: %v", err)
+	}
+	refs := map[string]bool{}
+	blobs := 0
+	for _, r := range viewRes.Rows {
+		switch r.Key[1] {
+		case "file":
+			refs[r.Key[0]] = true
+		case "blob":
+			blobs++
+		}
+	}
+	for _, oid := range append(fm.blobs(), fmb.blobs()...) {
+		if !refs[oid] {
+			t.Errorf("Chunk %v isn't referenced", oid)
+		}
+	}
+	if blobs > len(fm.Chunks)+2 {
+		t.Errorf("Expected chunks to be shared, got %v blobs for %v+%v chunks",
+			blobs, len(fm.Chunks), len(fmb.Chunks))
+	}
+}
@@ -0,0 +1,260 @@
+package cbfsclient
+
+import (
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// How to download a blob in parallel.  Zero values get the defaults.
+type DownloadOptions struct {
+	RangeSize   int64 // Bytes per request (8MB)
+	Concurrency int   // Ranges fetched at once (4)
+	Retries     int   // Attempts per range before giving up (3)
+	// Hash the cluster uses ("sha1"), or "none" to skip verifying.
+	Hash string
+	// A file with this content, read instead when no node has the
+	// blob (as with chunked and erasure-coded files).
+	Path string
+}
+
+func (o *DownloadOptions) setDefaults() {
+	if o.RangeSize <= 0 {
+		o.RangeSize = 8 * 1024 * 1024
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	if o.Retries <= 0 {
+		o.Retries = 3
+	}
+	if o.Hash == "" {
+		o.Hash = "sha1"
+	}
+}
+
+var downloadHashes = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
+	"sha1":   crypto.SHA1,
+	"sha224": crypto.SHA224,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+func (o DownloadOptions) hash() (hash.Hash, error) {
+	if o.Hash == "none" {
+		return nil, nil
+	}
+	h, ok := downloadHashes[o.Hash]
+	if !ok || !h.Available() {
+		return nil, fmt.Errorf("can't verify %v hashes", o.Hash)
+	}
+	return h.New(), nil
+}
+
+// Download a blob into w, fetching ranges of it concurrently from the
+// nodes that have it (or opts.Path from any node).  A failed range is tried again on another
+// node.  The content is written in order and hashed as it goes; if
+// it doesn't match the blob's hash, an error is returned after it's
+// all been written.
+func (c *Client) DownloadBlob(w io.Writer, oid string, length int64,
+	opts DownloadOptions) (int64, error) {
+
+	infos, err := c.GetBlobInfos(oid)
+	if err != nil {
+		return 0, err
+	}
+	urls, err := c.contentURLs(oid, opts.Path, infos[oid].Nodes)
+	if err != nil {
+		return 0, err
+	}
+	return downloadBlob(w, oid, length, urls, opts)
+}
+
+// Download the file at path into w as DownloadBlob does.
+func (c *Client) DownloadFile(w io.Writer, path string,
+	opts DownloadOptions) (int64, error) {
+
+	f, err := c.OpenFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return f.ParallelWriteTo(w, opts)
+}
+
+// Like WriteTo, but fetches the file in parallel ranges via
+// DownloadBlob.  Always starts from the beginning.
+func (f *FileHandle) ParallelWriteTo(w io.Writer, opts DownloadOptions) (int64, error) {
+	urls, err := f.urls()
+	if err != nil {
+		return 0, err
+	}
+	n, err := downloadBlob(w, f.oid, f.length, urls, opts)
+	f.off = n
+	return n, err
+}
+
+type downloadRange struct {
+	i    int64
+	data []byte
+	err  error
+}
+
+func downloadBlob(w io.Writer, oid string, length int64, urls []string,
+	opts DownloadOptions) (int64, error) {
+
+	opts.setDefaults()
+	h, err := opts.hash()
+	if err != nil {
+		return 0, err
+	}
+
+	nranges := (length + opts.RangeSize - 1) / opts.RangeSize
+	// Ranges can finish out of order, but only so far ahead of the
+	// one being written.
+	slots := make(chan bool, 2*opts.Concurrency)
+	work := make(chan int64)
+	results := make(chan downloadRange)
+	quit := make(chan bool)
+	defer close(quit)
+
+	go func() {
+		defer close(work)
+		for i := int64(0); i < nranges; i++ {
+			select {
+			case slots <- true:
+			case <-quit:
+				return
+			}
+			select {
+			case work <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	d := &rangeDownloader{urls: urls, failed: map[string]bool{}}
+	for i := 0; i < opts.Concurrency; i++ {
+		go func() {
+			for r := range work {
+				off := r * opts.RangeSize
+				end := off + opts.RangeSize
+				if end > length {
+					end = length
+				}
+				data, err := d.fetch(r, off, end, length, opts.Retries)
+				select {
+				case results <- downloadRange{r, data, err}:
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+
+	written := int64(0)
+	pending := map[int64][]byte{}
+	for next := int64(0); next < nranges; {
+		r := <-results
+		if r.err != nil {
+			return written, r.err
+		}
+		pending[r.i] = r.data
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			delete(pending, next)
+			n, err := w.Write(data)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			if h != nil {
+				h.Write(data)
+			}
+			<-slots
+			next++
+		}
+	}
+
+	if h != nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != oid {
+			return written, fmt.Errorf("downloaded %v hashed to %v", oid, got)
+		}
+	}
+	return written, nil
+}
+
+// Fetches ranges, moving away from nodes that fail.
+type rangeDownloader struct {
+	urls   []string
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+// The url to use for the given attempt at range i.  Ranges are spread
+// across the nodes that haven't failed yet.
+func (d *rangeDownloader) url(i int64, attempt int) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ok := []string{}
+	for _, u := range d.urls {
+		if !d.failed[u] {
+			ok = append(ok, u)
+		}
+	}
+	if len(ok) == 0 {
+		ok = d.urls
+	}
+	return ok[(i+int64(attempt))%int64(len(ok))]
+}
+
+func (d *rangeDownloader) fetch(i, off, end, length int64, retries int) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < retries; attempt++ {
+		u := d.url(i, attempt)
+		var data []byte
+		if data, err = fetchRange(u, off, end, length); err == nil {
+			return data, nil
+		}
+		d.mu.Lock()
+		d.failed[u] = true
+		d.mu.Unlock()
+	}
+	return nil, fmt.Errorf("bytes %v-%v: %v", off, end-1, err)
+}
+
+func fetchRange(u string, off, end, length int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if off > 0 || end < length {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", off, end-1))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := rangeBody(res, off)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, end-off))
+	if err == nil && int64(len(data)) != end-off {
+		err = fmt.Errorf("expected %v bytes from %v, got %v",
+			end-off, u, len(data))
+	}
+	return data, err
+}
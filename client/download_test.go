@@ -0,0 +1,109 @@
+package cbfsclient
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadBlob(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 50000)
+	sum := sha1.Sum(data)
+	oid := hex.EncodeToString(sum[:])
+
+	var served int32
+	good := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&served, 1)
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+		}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "broken", 500)
+		}))
+	defer bad.Close()
+
+	cluster := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var rv interface{}
+			switch req.URL.Path {
+			case "/.cbfs/nodes/":
+				rv = map[string]StorageNode{
+					"good": {Addr: strings.TrimPrefix(good.URL, "http://")},
+					"bad":  {Addr: strings.TrimPrefix(bad.URL, "http://")},
+				}
+			case "/.cbfs/blob/info/":
+				req.ParseForm()
+				nodes := map[string]time.Time{"good": {}, "bad": {}}
+				rv = map[string]BlobInfo{req.FormValue("blob"): {nodes}}
+			}
+			json.NewEncoder(w).Encode(rv)
+		}))
+	defer cluster.Close()
+
+	c, err := New(cluster.URL)
+	if err != nil {
+		t.Fatalf("Error making client: %v", err)
+	}
+
+	opts := DownloadOptions{RangeSize: 100000, Concurrency: 3}
+	buf := &bytes.Buffer{}
+	n, err := c.DownloadBlob(buf, oid, int64(len(data)), opts)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("Expected %v bytes, got %v: %v", len(data), n, err)
+	}
+	if served != 8 {
+		t.Errorf("Expected 8 ranges from the good node, got %v", served)
+	}
+
+	bogus := strings.Repeat("0", 40)
+	if _, err := c.DownloadBlob(&bytes.Buffer{}, bogus, int64(len(data)),
+		opts); err == nil {
+		t.Errorf("Expected the wrong hash to be noticed")
+	}
+}
+
+func TestDownloadPathOnlyFile(t *testing.T) {
+	data := bytes.Repeat([]byte("chunky bacon "), 1000)
+	sum := sha1.Sum(data)
+	oid := hex.EncodeToString(sum[:])
+	var ranged int32
+	c, cleanup := withPathOnlyFile(t, "/dir/chunked.txt", data,
+		[]ChunkRef{{"aa", 6000}, {"bb", int64(len(data) - 6000)}},
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Range") != "" {
+				atomic.AddInt32(&ranged, 1)
+			}
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+		})
+	defer cleanup()
+
+	opts := DownloadOptions{RangeSize: 1000, Concurrency: 3}
+	buf := &bytes.Buffer{}
+	n, err := c.DownloadFile(buf, "dir/chunked.txt", opts)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("Expected %v bytes, got %v: %v", len(data), n, err)
+	}
+	if ranged != 13 {
+		t.Errorf("Expected 13 ranges of the file, got %v", ranged)
+	}
+
+	if _, err := c.DownloadBlob(&bytes.Buffer{}, oid, int64(len(data)),
+		opts); err == nil {
+		t.Errorf("Expected a blob no node has to fail without a path")
+	}
+	opts.Path = "dir/chunked.txt"
+	buf.Reset()
+	n, err = c.DownloadBlob(buf, oid, int64(len(data)), opts)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Expected %v bytes by path, got %v: %v", len(data), n, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
@@ -167,6 +168,7 @@ func (c Client) Get(path string) (io.ReadCloser, error) {
 // File info
 type FileHandle struct {
 	c      Client
+	path   string
 	oid    string
 	off    int64
 	length int64
@@ -184,20 +186,47 @@ func (f *FileHandle) Meta() FileMeta {
 	return f.meta
 }
 
-func (f *FileHandle) randomUrl() (string, error) {
-	allnodes, err := f.c.Nodes()
+// URLs to fetch the content from.  Chunked and erasure-coded files
+// have no blob of their own, so they're read by path from any node,
+// which puts them together.
+func (f *FileHandle) urls() ([]string, error) {
+	return f.c.contentURLs(f.oid, f.path, f.nodes)
+}
+
+// Where to read oid from: the given nodes that have it, or failing
+// that (chunked and erasure-coded files have no blob of their own) the
+// file at path, if any, on every node.
+func (c *Client) contentURLs(oid, path string,
+	nodes map[string]time.Time) ([]string, error) {
+
+	allnodes, err := c.Nodes()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	nodelist := []StorageNode{}
-	for k := range f.nodes {
+	rv := []string{}
+	for k := range nodes {
 		if n, ok := allnodes[k]; ok {
-			nodelist = append(nodelist, n)
+			rv = append(rv, n.BlobURL(oid))
+		}
+	}
+	if len(rv) == 0 && path != "" {
+		for _, n := range allnodes {
+			rv = append(rv, n.URLFor(path))
 		}
 	}
+	if len(rv) == 0 {
+		return nil, fmt.Errorf("no nodes have %v", oid)
+	}
+	return rv, nil
+}
 
-	return nodelist[rand.Intn(len(nodelist))].BlobURL(f.oid), nil
+func (f *FileHandle) randomUrl() (string, error) {
+	urls, err := f.urls()
+	if err != nil {
+		return "", err
+	}
+	return urls[rand.Intn(len(urls))], nil
 }
 
 func (f *FileHandle) Read(b []byte) (int, error) {
@@ -234,15 +263,29 @@ func (f *FileHandle) WriteTo(w io.Writer) (int64, error) {
 	}
 
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return 0, httputil.HTTPErrorf(res, "Unexpected http response: %S\n%B")
+	body, err := rangeBody(res, f.off)
+	if err != nil {
+		return 0, err
 	}
 
-	n, err := io.Copy(w, res.Body)
+	n, err := io.Copy(w, body)
 	f.off += n
 	return n, err
 }
 
+// The body of a response to a GET from off.  Nodes putting together
+// erasure-coded files can't seek in them, so they send it all.
+func rangeBody(res *http.Response, off int64) (io.Reader, error) {
+	switch res.StatusCode {
+	case 206:
+		return res.Body, nil
+	case 200:
+		_, err := io.CopyN(ioutil.Discard, res.Body, off)
+		return res.Body, err
+	}
+	return nil, httputil.HTTPErrorf(res, "Unexpected http response: %S\n%B")
+}
+
 // Implement io.ReaderAt
 func (f *FileHandle) ReadAt(p []byte, off int64) (n int, err error) {
 	end := int64(len(p)) + off
@@ -265,15 +308,12 @@ func (f *FileHandle) ReadAt(p []byte, off int64) (n int, err error) {
 		return 0, err
 	}
 	defer res.Body.Close()
-	exp := 206
-	if off == 0 && end == f.length {
-		exp = 200
-	}
-	if res.StatusCode != exp {
-		return 0, httputil.HTTPErrorf(res, "Unexpected http response: %S\n%B")
+	body, err := rangeBody(res, off)
+	if err != nil {
+		return 0, err
 	}
 
-	n, err = io.ReadFull(res.Body, p)
+	n, err = io.ReadFull(io.LimitReader(body, end-off), p)
 	if err == io.ErrUnexpectedEOF {
 		err = io.EOF
 	}
@@ -359,11 +399,15 @@ func (c Client) OpenFile(path string) (*FileHandle, error) {
 
 	h := j.Meta.OID
 
-	infos, err := c.GetBlobInfos(h)
-	if err != nil {
-		return nil, err
+	var nodes map[string]time.Time
+	if len(j.Meta.Chunks) == 0 {
+		infos, err := c.GetBlobInfos(h)
+		if err != nil {
+			return nil, err
+		}
+		nodes = infos[h].Nodes
 	}
 
-	return &FileHandle{c, h, 0, j.Meta.Length, j.Meta,
-		infos[h].Nodes}, nil
+	return &FileHandle{c, noSlash(path), h, 0, j.Meta.Length, j.Meta,
+		nodes}, nil
 }
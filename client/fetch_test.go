@@ -0,0 +1,125 @@
+package cbfsclient
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A cluster of one node holding a file that has no blob of its own.
+func withPathOnlyFile(t *testing.T, path string, data []byte,
+	chunks []ChunkRef, serve http.HandlerFunc) (*Client, func()) {
+
+	sum := sha1.Sum(data)
+	meta := FileMeta{
+		OID:    hex.EncodeToString(sum[:]),
+		Length: int64(len(data)),
+		Chunks: chunks,
+	}
+
+	node := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != path {
+				http.Error(w, "no blobs here", 404)
+				return
+			}
+			serve(w, req)
+		}))
+	cluster := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var rv interface{}
+			switch req.URL.Path {
+			case "/.cbfs/nodes/":
+				rv = map[string]StorageNode{
+					"a": {Addr: strings.TrimPrefix(node.URL, "http://")},
+				}
+			case "/.cbfs/info/file" + path:
+				rv = map[string]interface{}{"meta": meta, "path": path}
+			case "/.cbfs/blob/info/":
+				rv = map[string]BlobInfo{}
+			}
+			json.NewEncoder(w).Encode(rv)
+		}))
+
+	c, err := New(cluster.URL)
+	if err != nil {
+		t.Fatalf("Error making client: %v", err)
+	}
+	return c, func() {
+		cluster.Close()
+		node.Close()
+	}
+}
+
+func TestOpenChunkedFile(t *testing.T) {
+	data := bytes.Repeat([]byte("chunky bacon "), 1000)
+	c, cleanup := withPathOnlyFile(t, "/dir/chunked.txt", data,
+		[]ChunkRef{{"aa", 6000}, {"bb", int64(len(data) - 6000)}},
+		func(w http.ResponseWriter, req *http.Request) {
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+		})
+	defer cleanup()
+
+	fh, err := c.OpenFile("/dir/chunked.txt")
+	if err != nil {
+		t.Fatalf("Error opening chunked file: %v", err)
+	}
+	if got, err := ioutil.ReadAll(fh); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected %v bytes read, got %v: %v", len(data), len(got), err)
+	}
+
+	fh.Seek(0, 0)
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, fh); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Expected %v bytes copied, got %v: %v", len(data), buf.Len(), err)
+	}
+
+	p := make([]byte, 10)
+	if _, err := fh.ReadAt(p, 6995); err != nil || string(p) != string(data[6995:7005]) {
+		t.Errorf("Expected %q at 6995, got %q: %v", data[6995:7005], p, err)
+	}
+}
+
+func TestOpenErasureCodedFile(t *testing.T) {
+	data := bytes.Repeat([]byte("striped "), 1000)
+	ranged := 0
+	c, cleanup := withPathOnlyFile(t, "/ec.txt", data, nil,
+		func(w http.ResponseWriter, req *http.Request) {
+			// Rebuilt from shards, so no ranges.
+			if req.Header.Get("Range") != "" {
+				ranged++
+			}
+			w.Write(data)
+		})
+	defer cleanup()
+
+	fh, err := c.OpenFile("ec.txt")
+	if err != nil {
+		t.Fatalf("Error opening erasure-coded file: %v", err)
+	}
+	if got, err := ioutil.ReadAll(fh); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected %v bytes read, got %v: %v", len(data), len(got), err)
+	}
+
+	p := make([]byte, 10)
+	if _, err := fh.ReadAt(p, 4000); err != nil || string(p) != string(data[4000:4010]) {
+		t.Errorf("Expected %q at 4000, got %q: %v", data[4000:4010], p, err)
+	}
+
+	fh.Seek(7990, 0)
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, fh); err != nil || buf.String() != string(data[7990:]) {
+		t.Errorf("Expected the last 10 bytes, got %q: %v", buf, err)
+	}
+	if ranged == 0 {
+		t.Errorf("Expected ranged requests")
+	}
+}
@@ -41,6 +41,15 @@ type FileMeta struct {
 	Previous []PrevMeta `json:"older"`
 	// Current revision number
 	Revno int `json:"revno"`
+	// Blobs holding the content of a chunked file, in order.  A
+	// chunked file has no blob for its OID.
+	Chunks []ChunkRef `json:"chunks,omitempty"`
+}
+
+// One piece of a chunked file.
+type ChunkRef struct {
+	OID    string `json:"oid"`    // Hash
+	Length int64  `json:"length"` // Length
 }
 
 // Results from a list operation.
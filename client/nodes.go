@@ -20,6 +20,8 @@ type StorageNode struct {
 	Size      int64
 	UptimeStr string `json:"uptime_str"`
 	Version   string
+	Scheme    string
+	Zone      string
 }
 
 func (a StorageNode) BlobURL(h string) string {
@@ -30,7 +32,11 @@ func (a StorageNode) URLFor(h string) string {
 	if h[0] != '/' {
 		h = "/" + h
 	}
-	return fmt.Sprintf("http://%s%s", a.Addr, h)
+	scheme := a.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, a.Addr, h)
 }
 
 // Get the information about the nodes in a cluster.
@@ -0,0 +1,81 @@
+package cbfsclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/dustin/httputil"
+)
+
+// A storage quota on a path prefix and how much of it is used.  A
+// limit of 0 means no limit.
+type Quota struct {
+	Prefix   string `json:"prefix"`
+	MaxBytes int64  `json:"maxBytes"`
+	MaxFiles int64  `json:"maxFiles"`
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+}
+
+func (c Client) quotaURL(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return c.URLFor(".cbfs/quota/" + prefix)
+}
+
+// Get all the quotas.
+func (c Client) Quotas() ([]Quota, error) {
+	rv := []Quota{}
+	err := getJsonData(c.quotaURL(""), &rv)
+	return rv, err
+}
+
+// Set the quota on a prefix, returning its current usage.
+func (c Client) SetQuota(prefix string, maxBytes, maxFiles int64) (Quota, error) {
+	rv := Quota{}
+	data, err := json.Marshal(Quota{MaxBytes: maxBytes, MaxFiles: maxFiles})
+	if err != nil {
+		return rv, err
+	}
+	req, err := http.NewRequest("PUT", c.quotaURL(prefix),
+		bytes.NewBuffer(data))
+	if err != nil {
+		return rv, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return rv, httputil.HTTPError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
+
+// Remove the quota on a prefix.
+func (c Client) RemoveQuota(prefix string) error {
+	req, err := http.NewRequest("DELETE", c.quotaURL(prefix), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == 404 {
+		return Missing
+	}
+	if res.StatusCode != 204 {
+		return httputil.HTTPError(res)
+	}
+	return nil
+}
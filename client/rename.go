@@ -0,0 +1,38 @@
+package cbfsclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/dustin/httputil"
+)
+
+// The outcome of a rename.  Errors has (some of) the files that
+// couldn't be moved.
+type RenameResult struct {
+	Moved      int               `json:"moved"`
+	Failed     int               `json:"failed"`
+	Errors     map[string]string `json:"errors"`
+	Incomplete bool              `json:"incomplete"`
+}
+
+// Rename a file, or everything under a directory, on the server.
+func (c Client) Rename(src, dest string) (RenameResult, error) {
+	rv := RenameResult{}
+	u := c.URLFor(".cbfs/rename/"+src) + "?" +
+		url.Values{"to": []string{dest}}.Encode()
+	res, err := http.Post(u, "", nil)
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return rv, Missing
+	}
+	if res.StatusCode != 200 {
+		return rv, httputil.HTTPError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
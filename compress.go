@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Blobs may be compressed at rest.  The content is gzipped in fixed
+// size segments, each its own gzip member, so the file is still one
+// valid gzip stream (and can be sent as is to clients that accept
+// gzip) but range reads only inflate what they touch.  Each member
+// records its own length in a "CZ" extra field so readers can hop
+// between them, and an empty member at the end records the length of
+// the content.
+//
+//   member 0 | member 1 | ... | trailer member
+//
+// Whether a blob is worth compressing is decided from its first
+// segment; blobs that don't shrink enough are stored as they are.
+// Compressed blobs are named with gzSuffix.  Compression happens
+// before encryption, and hashes are always of the content.
+
+var blobCodec = flag.String("blobCodec", "",
+	`Compress blobs at rest with this codec ("gzip")`)
+
+const (
+	gzSegmentSize = 256 * 1024
+	// Segments must shrink at least this much to be stored compressed.
+	gzMinRatio = 0.9
+
+	// magic, flags, mtime, xfl, os, xlen, subfield id, sublen
+	gzMemberHeaderLen = 10 + 2 + 4
+	gzTrailerLen      = gzMemberHeaderLen + 8 + 5 + 8
+)
+
+var errBadCompressedBlob = errors.New("invalid compressed blob")
+
+func initBlobCodec() error {
+	switch *blobCodec {
+	case "", "gzip":
+		return nil
+	}
+	return fmt.Errorf("unknown blob codec %q", *blobCodec)
+}
+
+func gzExtra(datalen int) []byte {
+	return append([]byte{'C', 'Z', byte(datalen), 0}, make([]byte, datalen)...)
+}
+
+// An empty gzip member carrying the content length.
+func gzTrailer(size int64) []byte {
+	rv := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 12, 0}
+	rv = append(rv, gzExtra(8)...)
+	binary.LittleEndian.PutUint64(rv[gzMemberHeaderLen:], uint64(size))
+	// A final, empty stored block, then a zero CRC and size.
+	return append(rv, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// Parse the header of one of our members, returning the length the
+// extra field holds.
+func parseGzHeader(hdr []byte, datalen int) (uint64, error) {
+	if len(hdr) < gzMemberHeaderLen+datalen ||
+		hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 || hdr[3] != 4 ||
+		int(binary.LittleEndian.Uint16(hdr[10:])) != 4+datalen ||
+		hdr[12] != 'C' || hdr[13] != 'Z' || int(hdr[14]) != datalen {
+		return 0, errBadCompressedBlob
+	}
+	if datalen == 4 {
+		return uint64(binary.LittleEndian.Uint32(hdr[gzMemberHeaderLen:])), nil
+	}
+	return binary.LittleEndian.Uint64(hdr[gzMemberHeaderLen:]), nil
+}
+
+type compressingWriter struct {
+	w       io.Writer
+	gz      *gzip.Writer
+	buf     []byte
+	out     bytes.Buffer
+	size    int64
+	decided bool
+	raw     bool
+}
+
+func newCompressingWriter(w io.Writer) *compressingWriter {
+	gz, _ := gzip.NewWriterLevel(ioutil.Discard, gzip.DefaultCompression)
+	return &compressingWriter{w: w, gz: gz,
+		buf: make([]byte, 0, gzSegmentSize*2)}
+}
+
+func (c *compressingWriter) compress(seg []byte) error {
+	c.out.Reset()
+	c.gz.Reset(&c.out)
+	c.gz.Header.Extra = gzExtra(4)
+	c.gz.Header.OS = 0xff
+	if _, err := c.gz.Write(seg); err != nil {
+		return err
+	}
+	if err := c.gz.Close(); err != nil {
+		return err
+	}
+	b := c.out.Bytes()
+	binary.LittleEndian.PutUint32(b[gzMemberHeaderLen:], uint32(len(b)))
+	return nil
+}
+
+func (c *compressingWriter) writeSegment(seg []byte) error {
+	if err := c.compress(seg); err != nil {
+		return err
+	}
+	if !c.decided {
+		c.decided = true
+		c.raw = float64(c.out.Len()) > float64(len(seg))*gzMinRatio
+		if c.raw {
+			_, err := c.w.Write(seg)
+			return err
+		}
+	}
+	c.size += int64(len(seg))
+	_, err := c.w.Write(c.out.Bytes())
+	return err
+}
+
+// Whether what was written went out compressed.
+func (c *compressingWriter) compressed() bool {
+	return c.decided && !c.raw
+}
+
+func (c *compressingWriter) Write(p []byte) (int, error) {
+	if c.raw {
+		return c.w.Write(p)
+	}
+	c.buf = append(c.buf, p...)
+	for !c.raw && len(c.buf) >= gzSegmentSize {
+		if err := c.writeSegment(c.buf[:gzSegmentSize]); err != nil {
+			return 0, err
+		}
+		c.buf = append(c.buf[:0], c.buf[gzSegmentSize:]...)
+	}
+	if c.raw && len(c.buf) > 0 {
+		_, err := c.w.Write(c.buf)
+		c.buf = c.buf[:0]
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *compressingWriter) Close() error {
+	if c.raw || (!c.decided && len(c.buf) == 0) {
+		return nil
+	}
+	if len(c.buf) > 0 {
+		if err := c.writeSegment(c.buf); err != nil {
+			return err
+		}
+		if c.raw {
+			return nil
+		}
+	}
+	_, err := c.w.Write(gzTrailer(c.size))
+	return err
+}
+
+type decompressingReader struct {
+	r       ReadSeekCloser
+	size    int64
+	offsets []int64 // of the members found so far
+	pos     int64
+	seg     int64
+	plain   []byte
+	cbuf    []byte
+}
+
+// Find where member seg starts.
+func (d *decompressingReader) offset(seg int64) (int64, error) {
+	hdr := make([]byte, gzMemberHeaderLen+4)
+	for int64(len(d.offsets)) <= seg {
+		off := d.offsets[len(d.offsets)-1]
+		if _, err := d.r.Seek(off, 0); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(d.r, hdr); err != nil {
+			return 0, err
+		}
+		l, err := parseGzHeader(hdr, 4)
+		if err != nil {
+			return 0, err
+		}
+		d.offsets = append(d.offsets, off+int64(l))
+	}
+	return d.offsets[seg], nil
+}
+
+func (d *decompressingReader) load(seg int64) error {
+	off, err := d.offset(seg)
+	if err != nil {
+		return err
+	}
+	end, err := d.offset(seg + 1)
+	if err != nil {
+		return err
+	}
+	if int64(cap(d.cbuf)) < end-off {
+		d.cbuf = make([]byte, end-off)
+	}
+	d.cbuf = d.cbuf[:end-off]
+	if _, err := d.r.Seek(off, 0); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(d.r, d.cbuf); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(d.cbuf))
+	if err != nil {
+		return err
+	}
+	gz.Multistream(false)
+	b := bytes.NewBuffer(d.plain[:0])
+	if _, err := b.ReadFrom(gz); err != nil {
+		d.seg = -1
+		return fmt.Errorf("segment %v: %v", seg, err)
+	}
+	d.plain, d.seg = b.Bytes(), seg
+	return nil
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	seg := d.pos / gzSegmentSize
+	if seg != d.seg {
+		if err := d.load(seg); err != nil {
+			return 0, err
+		}
+	}
+	at := d.pos - seg*gzSegmentSize
+	if at >= int64(len(d.plain)) {
+		return 0, errBadCompressedBlob
+	}
+	n := copy(p, d.plain[at:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 1:
+		offset += d.pos
+	case 2:
+		offset += d.size
+	}
+	if offset < 0 {
+		return d.pos, errors.New("negative position")
+	}
+	d.pos = offset
+	return d.pos, nil
+}
+
+func (d *decompressingReader) Close() error {
+	return d.r.Close()
+}
+
+// The content length of a compressed blob, or an error if it isn't
+// one.  Leaves r at the start.
+func compressedSize(r io.ReadSeeker) (int64, error) {
+	hdr := make([]byte, gzMemberHeaderLen+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		r.Seek(0, 0)
+		return 0, errBadCompressedBlob
+	}
+	if _, err := parseGzHeader(hdr, 4); err != nil {
+		r.Seek(0, 0)
+		return 0, err
+	}
+
+	trailer := make([]byte, gzTrailerLen)
+	_, err := r.Seek(-gzTrailerLen, 2)
+	if err == nil {
+		_, err = io.ReadFull(r, trailer)
+	}
+	r.Seek(0, 0)
+	if err != nil {
+		return 0, errBadCompressedBlob
+	}
+	size, err := parseGzHeader(trailer, 8)
+	if err != nil || !bytes.Equal(trailer, gzTrailer(int64(size))) {
+		return 0, errBadCompressedBlob
+	}
+	return int64(size), nil
+}
+
+// Wrap a compressed blob in a decompressing reader.
+func decompressBlob(r ReadSeekCloser) (ReadSeekCloser, error) {
+	size, err := compressedSize(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &decompressingReader{
+		r:       r,
+		size:    size,
+		offsets: []int64{0},
+		seg:     -1,
+	}, nil
+}
+
+// The gzipped form of a local blob, if it's stored compressed.
+func openLocalGzipBlob(oid string) (io.ReadCloser, bool) {
+	fn, err := localBlobFile(oid)
+	if err != nil ||
+		!strings.HasSuffix(strings.TrimSuffix(fn, encSuffix), gzSuffix) {
+		return nil, false
+	}
+	f, err := openBlobFile(fn)
+	if err != nil {
+		return nil, false
+	}
+	if d, ok := f.(*decompressingReader); ok {
+		return d.r, true
+	}
+	f.Close()
+	return nil, false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func withBlobCodec(codec string) func() {
+	prev := *blobCodec
+	*blobCodec = codec
+	return func() { *blobCodec = prev }
+}
+
+func textContent(size int) []byte {
+	return bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"),
+		size/43+1)[:size]
+}
+
+func TestCompressedBlobs(t *testing.T) {
+	defer withTmpRoot(t)()
+	defer withBlobCodec("gzip")()
+
+	for _, size := range []int{0, 10, gzSegmentSize, 3*gzSegmentSize + 123} {
+		data := textContent(size)
+		h := storeTestBlob(t, data)
+
+		fn, err := localBlobFile(h)
+		if err != nil {
+			t.Fatalf("Error finding blob: %v", err)
+		}
+		if compressed := strings.HasSuffix(fn, gzSuffix); compressed != (size > 1000) {
+			t.Errorf("Expected %v bytes compressed=%v, stored as %v",
+				size, size > 1000, fn)
+		}
+		st, _ := os.Stat(fn)
+		if size > 1000 && st.Size() > int64(size/10) {
+			t.Errorf("Expected %v bytes to compress, stored %v", size, st.Size())
+		}
+		if got := readTestBlob(t, h); !bytes.Equal(got, data) {
+			t.Errorf("Expected %v bytes back, got %v", size, len(got))
+		}
+		if err := verifyObjectHash(h); err != nil {
+			t.Errorf("Error verifying %v bytes: %v", size, err)
+		}
+		if got := blobContentSize(st); got != int64(size) {
+			t.Errorf("Expected size %v, got %v", size, got)
+		}
+	}
+
+	// Incompressible blobs are stored as they are.
+	data := randomContent(gzSegmentSize + 10)
+	h := storeTestBlob(t, data)
+	if raw, _ := ioutil.ReadFile(hashFilename(*root, h)); !bytes.Equal(raw, data) {
+		t.Errorf("Expected random content stored raw")
+	}
+
+	// The stored file is plain gzip.
+	data = textContent(3*gzSegmentSize + 123)
+	h = storeTestBlob(t, data)
+	f, err := os.Open(hashFilename(*root, h) + gzSuffix)
+	if err != nil {
+		t.Fatalf("Error opening blob: %v", err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Error reading gzip: %v", err)
+	}
+	if got, err := ioutil.ReadAll(gz); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected gzip to decompress to the content: %v", err)
+	}
+	f.Close()
+
+	// Ranges spanning segments.
+	r, err := openLocalBlob(h)
+	if err != nil {
+		t.Fatalf("Error opening blob: %v", err)
+	}
+	defer r.Close()
+	buf := make([]byte, 100)
+	for _, off := range []int64{2*gzSegmentSize - 50, 5, 3 * gzSegmentSize} {
+		if _, err := r.Seek(off, 0); err != nil {
+			t.Fatalf("Error seeking: %v", err)
+		}
+		n, err := io.ReadFull(r, buf)
+		if want := data[off:][:n]; (err != nil && n != len(want)) ||
+			!bytes.Equal(buf[:n], want) {
+			t.Errorf("Error reading range at %v: %v", off, err)
+		}
+	}
+}
+
+func TestCompressedEncryptedBlobs(t *testing.T) {
+	defer withTmpRoot(t)()
+	defer withBlobCodec("gzip")()
+	_, cleanup := withBlobKeys(t, hex.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	defer cleanup()
+
+	data := textContent(2*gzSegmentSize + 7)
+	h := storeTestBlob(t, data)
+	if got := readTestBlob(t, h); !bytes.Equal(got, data) {
+		t.Errorf("Expected %v bytes back, got %v", len(data), len(got))
+	}
+	st, _ := os.Stat(hashFilename(*root, h) + gzSuffix + encSuffix)
+	if st.Size() > int64(len(data)/10) {
+		t.Errorf("Expected compression before encryption, stored %v", st.Size())
+	}
+}
+
+// Plain blobs that happen to be our gzip format are read as they are.
+func TestPlainBlobsLookingCompressed(t *testing.T) {
+	defer withTmpRoot(t)()
+
+	restore := withBlobCodec("gzip")
+	h := storeTestBlob(t, textContent(gzSegmentSize+10))
+	data, err := ioutil.ReadFile(hashFilename(*root, h) + gzSuffix)
+	if err != nil {
+		t.Fatalf("Error reading compressed blob: %v", err)
+	}
+	restore()
+
+	h = storeTestBlob(t, data)
+	if _, err := os.Stat(hashFilename(*root, h)); err != nil {
+		t.Fatalf("Expected the blob stored plain: %v", err)
+	}
+	if got := readTestBlob(t, h); !bytes.Equal(got, data) {
+		t.Errorf("Expected %v bytes back as stored, got %v", len(data), len(got))
+	}
+	if err := verifyObjectHash(h); err != nil {
+		t.Errorf("Error verifying: %v", err)
+	}
+}
+
+func TestServeCompressedBlobs(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer withBlobCodec("gzip")()
+
+	data := string(textContent(gzSegmentSize + 500))
+	doTestRequest(t, "PUT", "/jack.txt", data)
+
+	get := func(hdr ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/jack.txt", nil)
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		httpHandler(w, req)
+		return w
+	}
+
+	w := get("Accept-Encoding", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.Len() > len(data)/10 {
+		t.Fatalf("Expected the stored gzip, got %v bytes, %v", w.Body.Len(), w.Header())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected a text content type, got %v", w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Error reading gzip: %v", err)
+	}
+	if got, err := ioutil.ReadAll(gz); err != nil || string(got) != data {
+		t.Errorf("Expected gzip to decompress to the content: %v", err)
+	}
+
+	if w := get(); w.Header().Get("Content-Encoding") != "" || w.Body.String() != data {
+		t.Errorf("Expected the content as is, got %v bytes, %v", w.Body.Len(), w.Header())
+	}
+
+	w = get("Accept-Encoding", "gzip", "Range", "bytes=262140-262149")
+	if w.Code != 206 || w.Header().Get("Content-Encoding") != "" ||
+		w.Body.String() != data[262140:262150] {
+		t.Errorf("Expected a range of the content, got %v %q", w.Code, w.Body)
+	}
+}
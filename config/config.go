@@ -64,6 +64,32 @@ type CBFSConfig struct {
 	TrimFullNodesSpace int64 `json:"trimFullSize"`
 	// How far time can drift from DB before warning
 	DriftWarnThresh time.Duration `json:"driftWarnThresh"`
+	// How long an upload session may sit idle before it's abandoned
+	UploadSessionTimeout time.Duration `json:"uploadTimeout"`
+	// Split new files into content-defined chunks by default
+	ChunkedStorage bool `json:"chunked"`
+	// How often to move encrypted blobs to the current master key
+	RekeyFreq time.Duration `json:"rekeyFreq"`
+	// Comma separated path prefixes to erasure code
+	ErasurePrefixes string `json:"erasurePrefixes"`
+	// Number of data shards for erasure coded files
+	ErasureDataShards int `json:"ecData"`
+	// Number of parity shards for erasure coded files
+	ErasureParityShards int `json:"ecParity"`
+	// Smallest file to erasure code by prefix
+	ErasureMinSize int64 `json:"ecMinSize"`
+	// How long to keep entries in the change feed
+	ChangeRetention time.Duration `json:"changeRetention"`
+	// How long deleted files stay in the trash (0 to delete right away)
+	TrashRetention time.Duration `json:"trashRetention"`
+	// Bytes/s each node may use for background blob transfers (0 for
+	// no limit)
+	InternodeBandwidth int64 `json:"internodeBandwidth"`
+	// How often to send changes to other clusters
+	ReplicationFreq time.Duration `json:"replicationFreq"`
+	// Copies an upload needs before it succeeds (0 for one more if
+	// there's a node for it)
+	WriteQuorum int `json:"writeQuorum"`
 }
 
 // Get the default configuration
@@ -91,6 +117,14 @@ func DefaultConfig() CBFSConfig {
 		TrimFullNodesCount:    10000,
 		TrimFullNodesSpace:    1 * 1024 * 1024 * 1024,
 		DriftWarnThresh:       5 * time.Minute,
+		UploadSessionTimeout:  24 * time.Hour,
+		RekeyFreq:             24 * time.Hour,
+		ErasureDataShards:     4,
+		ErasureParityShards:   2,
+		ErasureMinSize:        16 * 1024 * 1024,
+		ChangeRetention:       7 * 24 * time.Hour,
+		TrashRetention:        7 * 24 * time.Hour,
+		ReplicationFreq:       time.Minute,
 	}
 }
 
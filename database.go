@@ -1,18 +1,20 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"log"
 	"net/http"
 
 	// Alias this because we call our connection couchbase
 	cb "github.com/couchbase/go-couchbase"
 	"github.com/couchbase/go-couchbase/util"
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/client"
 )
 
-var couchbase *cb.Bucket
-
 const ddocKey = "/@ddocVersion"
-const ddocVersion = 3
+const ddocVersion = 9
 const designDoc = `
 {
     "spatialInfos": [],
@@ -61,7 +63,7 @@ const designDoc = `
     ],
     "views": {
         "file_blobs": {
-            "map": "function (doc, meta) {\n  if (doc.type === \"file\") {\n    var toEmit = {};\n    toEmit[doc.oid] = doc.name ? doc.name : meta.id;\n    if (doc.older) {\n      for (var i = 0; i < doc.older.length; i++) {\n        toEmit[doc.older[i].oid] = doc.name ? doc.name : meta.id;\n      }\n    }\n    for (var k in toEmit) {\n      emit([k, \"file\", doc.name ? doc.name : meta.id], null);\n    }\n  } else if (doc.type === \"blob\") {\n    var replicas=0;\n    for (var node in doc.nodes) {\n      replicas++;\n      emit([doc.oid, \"blob\", node], null);\n    }\n    if (replicas === 0) {\n      emit([doc.oid, \"blob\", \"\"], null);\n    }\n  }\n}"
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\" || doc.type === \"trash\") {\n    var f = doc.type === \"trash\" ? doc.meta : doc;\n    var toEmit = {};\n    var revs = [f].concat(f.older || []);\n    for (var i = 0; i < revs.length; i++) {\n      toEmit[revs[i].oid] = true;\n      var chunks = revs[i].chunks || [];\n      for (var j = 0; j < chunks.length; j++) {\n        toEmit[chunks[j].oid] = true;\n      }\n    }\n    for (var k in toEmit) {\n      emit([k, \"file\", doc.name ? doc.name : meta.id], null);\n    }\n  } else if (doc.type === \"upload\") {\n    for (var n in doc.parts) {\n      emit([doc.parts[n].oid, \"file\", meta.id], null);\n    }\n  } else if (doc.type === \"derived\") {\n    emit([doc.oid, \"file\", meta.id], null);\n  } else if (doc.type === \"blob\") {\n    var replicas=0;\n    for (var node in doc.nodes) {\n      replicas++;\n      emit([doc.oid, \"blob\", node], null);\n    }\n    if (replicas === 0) {\n      emit([doc.oid, \"blob\", \"\"], null);\n    }\n    var shards = doc.shards || [];\n    for (var s = 0; s < shards.length; s++) {\n      emit([shards[s], \"file\", meta.id], null);\n    }\n  }\n}"
         },
         "file_browse": {
             "map": "function (doc, meta) {\n  if(doc.type == \"file\") {  \n    var idarr = (doc.name ? doc.name : meta.id).split(\"/\");\n    emit(idarr, doc.length);\n  }\n}",
@@ -80,25 +82,90 @@ const designDoc = `
             "reduce": "_sum"
         },
         "repcounts": {
-            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage) {\n    var nreps = 0;\n    for (var x in doc.nodes) {\n      nreps++;\n    }\n    emit(nreps, null);\n  }\n}",
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && !doc.garbage && !doc.shardOf && !doc.shards) {\n    var nreps = 0;\n    for (var x in doc.nodes) {\n      nreps++;\n    }\n    emit(nreps, null);\n  }\n}",
             "reduce": "_count"
+        },
+        "ec_blobs": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"blob\" && doc.shards) {\n    emit(doc.oid, null);\n  }\n}"
+        },
+        "uploads": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"upload\") {\n    emit(doc.updated, null);\n  }\n}"
+        },
+        "trash": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"trash\") {\n    emit(doc.path.split(\"/\"), null);\n  }\n}"
+        },
+        "quotas": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"quota\") {\n    emit(doc.prefix, null);\n  }\n}"
         }
     }
 }
 `
 
-func dbConnect() (*cb.Bucket, error) {
+// MetaStore backed by a couchbase bucket.
+type cbStore struct {
+	*cb.Bucket
+}
+
+func (s *cbStore) GetBulk(keys []string) (map[string][]byte, error) {
+	res, _, err := s.Bucket.GetBulk(keys)
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[string][]byte, len(res))
+	for k, v := range res {
+		if v.Status == gomemcached.SUCCESS {
+			rv[k] = v.Body
+		}
+	}
+	return rv, nil
+}
+
+func (s *cbStore) CAS(k string, exp int, cas uint64, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Do(k, func(mc *memcached.Client, vb uint16) error {
+		req := &gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: vb,
+			Key:     []byte(k),
+			Cas:     cas,
+			Opaque:  0,
+			Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
+			Body:    body}
+		binary.BigEndian.PutUint32(req.Extras[4:], uint32(exp))
+		_, err := mc.Send(req)
+		if res, ok := err.(*gomemcached.MCResponse); ok &&
+			res.Status == gomemcached.KEY_EEXISTS {
+			err = errCASMismatch
+		}
+		return err
+	})
+}
+
+func (s *cbStore) Update(k string, exp int,
+	f func([]byte) ([]byte, error)) error {
+	return s.Bucket.Update(k, exp, f)
+}
+
+func (s *cbStore) View(name string, params map[string]interface{},
+	vres interface{}) error {
+	return s.ViewCustom("cbfs", name, params, vres)
+}
+
+func dbConnect() (MetaStore, error) {
 	cb.HTTPClient = &http.Client{
 		Transport: TimeoutTransport(*viewTimeout),
 	}
 
 	log.Printf("Connecting to couchbase bucket %v at %v",
 		*couchbaseBucket, *couchbaseServer)
-	rv, err := cb.GetBucket(*couchbaseServer, "default", *couchbaseBucket)
+	b, err := cb.GetBucket(*couchbaseServer, "default", *couchbaseBucket)
 	if err != nil {
 		return nil, err
 	}
 
-	return rv, couchbaseutil.UpdateView(rv, "cbfs",
+	return &cbStore{b}, couchbaseutil.UpdateView(b, "cbfs",
 		ddocKey, designDoc, ddocVersion)
 }
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var davBind = flag.String("davbind", "",
+	"Address to bind a WebDAV server to (empty to disable)")
+var davPrefix = flag.String("davPrefix", "/.cbfs/dav/",
+	"Path to serve WebDAV under on the main port (empty to disable)")
+
+// WebDAV (classes 1 and 2) over the cbfs namespace.  Collections are
+// just path prefixes, so MKCOL has nothing to do and any path ending
+// in / can be listed even when there's nothing beneath it yet.
+//
+// Locks are exclusive write locks kept in the metadata store.  A lock
+// on a collection covers everything beneath it, but taking one doesn't
+// look for locks already held beneath it.
+
+const (
+	davMaxLockTime = time.Hour
+	davTokenScheme = "opaquelocktoken:"
+)
+
+var errDAVLocked = errors.New("locked")
+
+type davLock struct {
+	Type    string    `json:"type"`
+	Token   string    `json:"token"`
+	Path    string    `json:"path"`
+	Depth   string    `json:"depth"`
+	Owner   string    `json:"owner,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l davLock) live() bool {
+	return time.Now().Before(l.Expires)
+}
+
+type davLockScope struct {
+	Exclusive *struct{} `xml:"D:exclusive"`
+}
+
+type davLockType struct {
+	Write struct{} `xml:"D:write"`
+}
+
+type davLockEntry struct {
+	Scope davLockScope `xml:"D:lockscope"`
+	Type  davLockType  `xml:"D:locktype"`
+}
+
+type davActiveLock struct {
+	davLockEntry
+	Depth string `xml:"D:depth"`
+	Owner *struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"D:owner,omitempty"`
+	Timeout string `xml:"D:timeout"`
+	Token   string `xml:"D:locktoken>D:href"`
+	Root    string `xml:"D:lockroot>D:href"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname,omitempty"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+	SupportedLock []davLockEntry  `xml:"D:supportedlock>D:lockentry"`
+}
+
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Xmlns     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davLockResult struct {
+	XMLName xml.Name        `xml:"D:prop"`
+	Xmlns   string          `xml:"xmlns:D,attr"`
+	Locks   []davActiveLock `xml:"D:lockdiscovery>D:activelock"`
+}
+
+type davLockInfo struct {
+	XMLName xml.Name `xml:"DAV: lockinfo"`
+	Scope   struct {
+		Shared *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	Owner *struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+// A file beneath a collection being copied, moved or deleted.
+type davEntry struct {
+	name string
+	meta fileMeta
+}
+
+func sendDAVXML(w http.ResponseWriter, status int, ob interface{}) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(ob); err != nil {
+		log.Printf("Error encoding WebDAV response: %v", err)
+	}
+}
+
+func davMounted(p, prefix string) bool {
+	return prefix != "" &&
+		(strings.HasPrefix(p, prefix) || p+"/" == prefix)
+}
+
+// The namespace path a request is for, without the leading /, but
+// keeping any trailing / that marks a collection.
+func davPath(p, prefix string) string {
+	if len(p) < len(prefix) {
+		return ""
+	}
+	return strings.TrimLeft(minusPrefix(p, prefix), "/")
+}
+
+func davHref(prefix, name string, collection bool) string {
+	if collection && name != "" {
+		name += "/"
+	}
+	return (&url.URL{Path: prefix + name}).EscapedPath()
+}
+
+// Drop the headers that are about the DAV request so they don't end
+// up stored with the file.
+func davFileHeaders(in http.Header) http.Header {
+	rv := http.Header{}
+	for k, v := range in {
+		switch strings.ToLower(k) {
+		case "authorization", "if", "lock-token", "depth", "overwrite",
+			"destination", "timeout":
+			continue
+		}
+		rv[k] = v
+	}
+	return rv
+}
+
+// Build a request the native handlers will treat as being for the
+// named file.
+func davRequest(req *http.Request, name string) *http.Request {
+	rv := *req
+	u := *req.URL
+	u.Path = "/" + name
+	u.RawPath = ""
+	rv.URL = &u
+	rv.Header = davFileHeaders(req.Header)
+	return &rv
+}
+
+// Where a COPY or MOVE is going.
+func davDestination(req *http.Request, prefix string) (string, error) {
+	u, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || !davMounted(u.Path, prefix) {
+		return "", errors.New("destination isn't served here")
+	}
+	return davPath(u.Path, prefix), nil
+}
+
+func davAccess(req *http.Request, prefix, p string) []access {
+	need := access{role: roleWriter, path: p, scoped: true}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		need.role = roleReader
+	case "COPY":
+		need.role = roleReader
+		fallthrough
+	case "MOVE":
+		if dst, err := davDestination(req, prefix); err == nil {
+			return []access{need,
+				{role: roleWriter, path: dst, scoped: true}}
+		}
+	}
+	return []access{need}
+}
+
+func getDAVFile(name string) (fileMeta, bool) {
+	fm := fileMeta{}
+	if name == "" {
+		return fm, false
+	}
+	err := couchbase.Get(shortName(name), &fm)
+	return fm, err == nil && fm.Type == "file"
+}
+
+// Find every file beneath a collection.
+func davWalk(dir string) ([]davEntry, error) {
+	fl, err := listFiles(dir, true, 1)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		dir += "/"
+	}
+
+	rv := []davEntry{}
+	for name, v := range fl.Files {
+		fm := fileMeta{}
+		if rm, ok := v.(*json.RawMessage); ok && json.Unmarshal(*rm, &fm) == nil {
+			rv = append(rv, davEntry{dir + name, fm})
+		}
+	}
+	for name := range fl.Dirs {
+		sub, err := davWalk(dir + name)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, sub...)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].name < rv[j].name })
+	return rv, nil
+}
+
+// The files a request names: either the one file or everything
+// beneath the collection.  A path that's neither is not found.
+func davFiles(p string) ([]davEntry, bool, error) {
+	name := strings.Trim(p, "/")
+	if !strings.HasSuffix(p, "/") {
+		if fm, ok := getDAVFile(name); ok {
+			return []davEntry{{name, fm}}, false, nil
+		}
+	}
+	rv, err := davWalk(name)
+	if err == nil && len(rv) == 0 && !strings.HasSuffix(p, "/") {
+		err = errNotFound
+	}
+	return rv, true, err
+}
+
+func davFileProps(name string, fm fileMeta) davProp {
+	return davProp{
+		DisplayName:   path.Base(name),
+		ContentLength: &fm.Length,
+		ContentType:   fm.Headers.Get("Content-Type"),
+		LastModified:  fm.Modified.UTC().Format(http.TimeFormat),
+		ETag:          `"` + fm.OID + `"`,
+		SupportedLock: davSupportedLocks(),
+	}
+}
+
+func davCollectionProps(name string) davProp {
+	return davProp{
+		DisplayName:   path.Base("/" + name),
+		ResourceType:  davResourceType{Collection: &struct{}{}},
+		SupportedLock: davSupportedLocks(),
+	}
+}
+
+func davSupportedLocks() []davLockEntry {
+	return []davLockEntry{{Scope: davLockScope{Exclusive: &struct{}{}}}}
+}
+
+func davPropfind(w http.ResponseWriter, req *http.Request, prefix, p string) {
+	// Clients always say, but a missing Depth should mean infinity,
+	// which we don't do.
+	depth := req.Header.Get("Depth")
+	if depth == "infinity" {
+		http.Error(w, "infinite depth listings aren't supported", 403)
+		return
+	}
+
+	name := strings.Trim(p, "/")
+	ok := davResponse{Status: "HTTP/1.1 200 OK"}
+	rv := davMultistatus{Xmlns: "DAV:"}
+
+	if !strings.HasSuffix(p, "/") {
+		if fm, found := getDAVFile(name); found {
+			ok.Href = davHref(prefix, name, false)
+			ok.Prop = davFileProps(name, fm)
+			rv.Responses = append(rv.Responses, ok)
+			sendDAVXML(w, 207, rv)
+			return
+		}
+	}
+
+	fl, err := listFiles(name, true, 1)
+	if err != nil {
+		log.Printf("Error listing %v: %v", name, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if name != "" && !strings.HasSuffix(p, "/") &&
+		len(fl.Files)+len(fl.Dirs) == 0 {
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	ok.Href = davHref(prefix, name, true)
+	ok.Prop = davCollectionProps(name)
+	rv.Responses = append(rv.Responses, ok)
+
+	if depth != "0" {
+		dir := name
+		if dir != "" {
+			dir += "/"
+		}
+		for sub, v := range fl.Files {
+			fm := fileMeta{}
+			rm, isRaw := v.(*json.RawMessage)
+			if !isRaw || json.Unmarshal(*rm, &fm) != nil {
+				continue
+			}
+			ok.Href = davHref(prefix, dir+sub, false)
+			ok.Prop = davFileProps(dir+sub, fm)
+			rv.Responses = append(rv.Responses, ok)
+		}
+		for sub := range fl.Dirs {
+			ok.Href = davHref(prefix, dir+sub, true)
+			ok.Prop = davCollectionProps(dir + sub)
+			rv.Responses = append(rv.Responses, ok)
+		}
+		sort.Slice(rv.Responses, func(i, j int) bool {
+			return rv.Responses[i].Href < rv.Responses[j].Href
+		})
+	}
+
+	sendDAVXML(w, 207, rv)
+}
+
+func davLockKey(name string) string {
+	return shortName("/@davlock/" + name)
+}
+
+// Find a live lock on p or a collection above it that the request
+// doesn't hold the token for.
+func davLockedOut(req *http.Request, p string) (davLock, bool) {
+	name := strings.Trim(p, "/")
+	names := []string{name}
+	for name != "" {
+		name = path.Dir("/" + name)[1:]
+		names = append(names, name)
+	}
+
+	keys := []string{}
+	for _, n := range names {
+		keys = append(keys, davLockKey(n))
+	}
+	docs, err := couchbase.GetBulk(keys)
+	if err != nil {
+		log.Printf("Error checking locks on %v: %v", p, err)
+	}
+
+	held := req.Header.Get("If")
+	for i, k := range keys {
+		l := davLock{}
+		data, ok := docs[k]
+		if !ok || json.Unmarshal(data, &l) != nil || !l.live() {
+			continue
+		}
+		if (i == 0 || l.Depth == "infinity") &&
+			!strings.Contains(held, l.Token) {
+			return l, true
+		}
+	}
+	return davLock{}, false
+}
+
+func davLockTimeout(h string) time.Duration {
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if s, err := strconv.Atoi(strings.TrimPrefix(t, "Second-")); err == nil &&
+			s > 0 && time.Duration(s)*time.Second < davMaxLockTime {
+			return time.Duration(s) * time.Second
+		}
+	}
+	return davMaxLockTime
+}
+
+func (l davLock) active(prefix string) davActiveLock {
+	rv := davActiveLock{
+		davLockEntry: davSupportedLocks()[0],
+		Depth:        l.Depth,
+		Timeout: "Second-" + strconv.Itoa(
+			int(time.Until(l.Expires).Seconds())),
+		Token: l.Token,
+		Root:  davHref(prefix, l.Path, false),
+	}
+	if l.Owner != "" {
+		rv.Owner = &struct {
+			Inner string `xml:",innerxml"`
+		}{l.Owner}
+	}
+	return rv
+}
+
+func davLockError(w http.ResponseWriter, err error) {
+	switch err {
+	case errDAVLocked:
+		http.Error(w, "locked", 423)
+	case errNotFound:
+		http.Error(w, "no such lock", 412)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func davDoLock(w http.ResponseWriter, req *http.Request, prefix, p string) {
+	name := strings.Trim(p, "/")
+	timeout := davLockTimeout(req.Header.Get("Timeout"))
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	l := davLock{}
+	if len(body) == 0 {
+		// Refreshing a lock we hold.
+		held := req.Header.Get("If")
+		err = couchbase.Update(davLockKey(name), int(timeout.Seconds()),
+			func(in []byte) ([]byte, error) {
+				if in == nil || json.Unmarshal(in, &l) != nil || !l.live() ||
+					!strings.Contains(held, l.Token) {
+					return nil, errNotFound
+				}
+				l.Expires = time.Now().Add(timeout)
+				return json.Marshal(l)
+			})
+		if err != nil {
+			davLockError(w, err)
+			return
+		}
+		sendDAVXML(w, 200, davLockResult{Xmlns: "DAV:",
+			Locks: []davActiveLock{l.active(prefix)}})
+		return
+	}
+
+	info := davLockInfo{}
+	if err := xml.Unmarshal(body, &info); err != nil {
+		http.Error(w, "Error parsing lockinfo: "+err.Error(), 400)
+		return
+	}
+	if info.Scope.Shared != nil {
+		http.Error(w, "shared locks aren't supported", 501)
+		return
+	}
+	if _, locked := davLockedOut(req, p); locked {
+		http.Error(w, "locked", 423)
+		return
+	}
+
+	token, err := randomID()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	l = davLock{
+		Type:    "davlock",
+		Token:   davTokenScheme + token,
+		Path:    name,
+		Depth:   "infinity",
+		Expires: time.Now().Add(timeout),
+	}
+	if req.Header.Get("Depth") == "0" {
+		l.Depth = "0"
+	}
+	if info.Owner != nil {
+		l.Owner = info.Owner.Inner
+	}
+
+	err = couchbase.Update(davLockKey(name), int(timeout.Seconds()),
+		func(in []byte) ([]byte, error) {
+			existing := davLock{}
+			if in != nil && json.Unmarshal(in, &existing) == nil &&
+				existing.live() {
+				return nil, errDAVLocked
+			}
+			return json.Marshal(l)
+		})
+	if err != nil {
+		davLockError(w, err)
+		return
+	}
+
+	log.Printf("Locked %v (%v)", name, l.Token)
+	w.Header().Set("Lock-Token", "<"+l.Token+">")
+	sendDAVXML(w, 200, davLockResult{Xmlns: "DAV:",
+		Locks: []davActiveLock{l.active(prefix)}})
+}
+
+func davDoUnlock(w http.ResponseWriter, req *http.Request, p string) {
+	name := strings.Trim(p, "/")
+	token := strings.Trim(req.Header.Get("Lock-Token"), "<>")
+	err := couchbase.Update(davLockKey(name), 0,
+		func(in []byte) ([]byte, error) {
+			l := davLock{}
+			if in == nil || json.Unmarshal(in, &l) != nil ||
+				l.Token != token {
+				return nil, errNotFound
+			}
+			return nil, nil
+		})
+	if err != nil {
+		http.Error(w, "no such lock", 409)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func davDelete(w http.ResponseWriter, req *http.Request, p string) {
+	files, collection, err := davFiles(p)
+	switch {
+	case isNotFound(err):
+		http.Error(w, "not found", 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	case !collection:
+		doDeleteUserDoc(w, davRequest(req, files[0].name))
+		return
+	}
+
+	for _, f := range files {
+		if _, locked := davLockedOut(req, f.name); locked {
+			http.Error(w, "locked: "+f.name, 423)
+			return
+		}
+	}
+	for _, f := range files {
+		if _, err := deleteFile(f.name, nil); isRetained(err) {
+			http.Error(w, err.Error(), 403)
+			return
+		} else if err != nil {
+			log.Printf("Error deleting %v: %v", f.name, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	w.WriteHeader(204)
+}
+
+// COPY links new file records to the same blobs, and MOVE renames
+// them.
+func davCopy(w http.ResponseWriter, req *http.Request, prefix, p string,
+	move bool) {
+
+	dst, err := davDestination(req, prefix)
+	if err != nil {
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	src := strings.Trim(p, "/")
+	if dst = strings.Trim(dst, "/"); dst == src || src == "" || dst == "" ||
+		strings.HasPrefix(dst, src+"/") {
+		http.Error(w, "can't copy or move there", 403)
+		return
+	}
+	if _, locked := davLockedOut(req, dst); locked {
+		http.Error(w, "destination is locked", 423)
+		return
+	}
+	if _, locked := davLockedOut(req, p); move && locked {
+		http.Error(w, "source is locked", 423)
+		return
+	}
+
+	files, collection, err := davFiles(p)
+	switch {
+	case isNotFound(err):
+		http.Error(w, "not found", 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	case collection && !move && req.Header.Get("Depth") == "0":
+		// Only the collection itself, which is nothing.
+		files = nil
+	}
+
+	existing, _, err := davFiles(dst)
+	exists := err == nil && len(existing) > 0
+	if exists && req.Header.Get("Overwrite") == "F" {
+		http.Error(w, "destination exists", 412)
+		return
+	}
+	// What's at the destination goes, unless it's a collection a
+	// file is copied over.
+	replaced := []davEntry{}
+	for _, f := range existing {
+		if collection || move || f.name == dst {
+			replaced = append(replaced, f)
+		}
+	}
+
+	// Nothing changes until everything's been checked.
+	now := time.Now()
+	changes := []quotaChange{}
+	for _, f := range replaced {
+		if _, locked := davLockedOut(req, f.name); locked {
+			http.Error(w, "locked: "+f.name, 423)
+			return
+		}
+		if err := retained(f.name, f.meta, now); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		changes = append(changes, quotaChange{fn: f.name,
+			bytes: -f.meta.Length, files: -1})
+	}
+	for _, f := range files {
+		if move {
+			if _, locked := davLockedOut(req, f.name); locked {
+				http.Error(w, "locked: "+f.name, 423)
+				return
+			}
+			if err := retained(f.name, f.meta, now); err != nil {
+				http.Error(w, err.Error(), 403)
+				return
+			}
+		}
+		c := quotaChange{fn: dst + strings.TrimPrefix(f.name, src),
+			bytes: f.meta.Length, files: 1}
+		if move {
+			c.from = f.name
+		}
+		changes = append(changes, c)
+	}
+	if err := checkQuotaChanges(changes); isOverQuota(err) {
+		http.Error(w, err.Error(), 507)
+		return
+	} else if err != nil {
+		log.Printf("Error checking quotas for %v: %v", dst, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	for _, f := range replaced {
+		if _, err := deleteFile(f.name, nil); isRetained(err) {
+			http.Error(w, err.Error(), 403)
+			return
+		} else if err != nil {
+			log.Printf("Error replacing %v: %v", f.name, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	for _, f := range files {
+		to := dst + strings.TrimPrefix(f.name, src)
+		if move {
+			_, err = renameFile(f.name, to)
+		} else {
+			_, err = linkCopy(f.meta, to)
+		}
+		switch {
+		case isRetained(err):
+			http.Error(w, err.Error(), 403)
+			return
+		case isOverQuota(err):
+			http.Error(w, err.Error(), 507)
+			return
+		case err == errExists, err == errFileChanged:
+			http.Error(w, err.Error(), 409)
+			return
+		case err != nil:
+			log.Printf("Error copying %v -> %v: %v", f.name, to, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("%v %v -> %v (%v)", req.Method, f.name, to, f.meta.OID)
+	}
+
+	if exists {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(201)
+	}
+}
+
+func davHandler(w http.ResponseWriter, req *http.Request, prefix string) {
+	p := davPath(req.URL.Path, prefix)
+	if !authorizeFor(w, req, davAccess(req, prefix, p)...) {
+		return
+	}
+
+	switch req.Method {
+	case "PUT", "DELETE", "MKCOL", "MOVE":
+		if _, locked := davLockedOut(req, p); locked {
+			http.Error(w, "locked", 423)
+			return
+		}
+	}
+
+	name := strings.Trim(p, "/")
+	switch req.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, "+
+			"PROPFIND, MKCOL, COPY, MOVE, LOCK, UNLOCK")
+		w.WriteHeader(200)
+	case "PROPFIND":
+		davPropfind(w, req, prefix, p)
+	case "GET":
+		doGetUserDoc(w, davRequest(req, p))
+	case "HEAD":
+		doHeadUserFile(w, davRequest(req, p))
+	case "PUT":
+		if name == "" || strings.HasSuffix(p, "/") {
+			http.Error(w, "can't PUT a collection", 409)
+			return
+		}
+		putUserFile(w, davRequest(req, name))
+	case "DELETE":
+		davDelete(w, req, p)
+	case "MKCOL":
+		if req.ContentLength > 0 {
+			http.Error(w, "MKCOL bodies aren't supported", 415)
+		} else if _, exists := getDAVFile(name); exists {
+			http.Error(w, "a file exists there", 405)
+		} else {
+			w.WriteHeader(201)
+		}
+	case "COPY", "MOVE":
+		davCopy(w, req, prefix, p, req.Method == "MOVE")
+	case "LOCK":
+		davDoLock(w, req, prefix, p)
+	case "UNLOCK":
+		davDoUnlock(w, req, p)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func davHandlerName(*http.Request) string {
+	return "dav"
+}
+
+func serveDAV() {
+	if *davBind == "" {
+		return
+	}
+
+	s := &http.Server{
+		Addr: *davBind,
+		Handler: instrumented(davHandlerName,
+			func(w http.ResponseWriter, req *http.Request) {
+				davHandler(w, req, "/")
+			}),
+		ReadTimeout: *readTimeout,
+	}
+	log.Printf("Listening to WebDAV requests on %s", *davBind)
+
+	l, err := net.Listen("tcp", *davBind)
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	log.Fatal(s.Serve(tlsListen(l)))
+}
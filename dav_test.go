@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func davDo(t *testing.T, method, path, body string,
+	hdrs map[string]string) *httptest.ResponseRecorder {
+
+	req, err := http.NewRequest(method, "http://localhost/.cbfs/dav/"+path,
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	return w
+}
+
+func TestDAV(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	for _, k := range []string{"a/b.txt", "a/c/d.txt", "e.txt"} {
+		if w := davDo(t, "PUT", k, "data for "+k, nil); w.Code != 201 {
+			t.Fatalf("Error putting %v: %v %s", k, w.Code, w.Body)
+		}
+	}
+	if w := davDo(t, "MKCOL", "new/", "", nil); w.Code != 201 {
+		t.Errorf("Error making collection: %v %s", w.Code, w.Body)
+	}
+
+	propfind := func(p, depth string) []string {
+		w := davDo(t, "PROPFIND", p, "", map[string]string{"Depth": depth})
+		if w.Code != 207 {
+			t.Fatalf("Error listing %v: %v %s", p, w.Code, w.Body)
+		}
+		res := struct {
+			Responses []struct {
+				Href string `xml:"href"`
+			} `xml:"response"`
+		}{}
+		if err := xml.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Error parsing listing of %v: %v\n%s", p, err, w.Body)
+		}
+		rv := []string{}
+		for _, r := range res.Responses {
+			rv = append(rv, r.Href)
+		}
+		return rv
+	}
+
+	got := strings.Join(propfind("a/", "1"), ",")
+	if got != "/.cbfs/dav/a/,/.cbfs/dav/a/b.txt,/.cbfs/dav/a/c/" {
+		t.Errorf("Unexpected listing: %v", got)
+	}
+	if got := propfind("e.txt", "0"); len(got) != 1 {
+		t.Errorf("Expected just the file, got %v", got)
+	}
+	if got := propfind("new/", "1"); len(got) != 1 {
+		t.Errorf("Expected an empty collection, got %v", got)
+	}
+	if w := davDo(t, "PROPFIND", "missing", "", nil); w.Code != 404 {
+		t.Errorf("Expected 404 for missing path, got %v", w.Code)
+	}
+
+	w := davDo(t, "COPY", "e.txt", "", map[string]string{
+		"Destination": "http://localhost/.cbfs/dav/f.txt"})
+	if w.Code != 201 {
+		t.Fatalf("Error copying: %v %s", w.Code, w.Body)
+	}
+	w = davDo(t, "COPY", "e.txt", "", map[string]string{
+		"Destination": "http://localhost/.cbfs/dav/f.txt",
+		"Overwrite":   "F"})
+	if w.Code != 412 {
+		t.Errorf("Expected copy over existing file to fail, got %v", w.Code)
+	}
+
+	w = davDo(t, "MOVE", "a", "", map[string]string{
+		"Destination": "http://localhost/.cbfs/dav/a/inside"})
+	if w.Code != 403 {
+		t.Errorf("Expected a move into itself to fail, got %v", w.Code)
+	}
+
+	w = davDo(t, "MOVE", "a", "", map[string]string{
+		"Destination": "http://localhost/.cbfs/dav/moved"})
+	if w.Code != 201 {
+		t.Fatalf("Error moving: %v %s", w.Code, w.Body)
+	}
+	for k, exp := range map[string]string{
+		"f.txt":         "data for e.txt",
+		"moved/b.txt":   "data for a/b.txt",
+		"moved/c/d.txt": "data for a/c/d.txt",
+	} {
+		if w := davDo(t, "GET", k, "", nil); w.Code != 200 || w.Body.String() != exp {
+			t.Errorf("Error getting %v: %v %s", k, w.Code, w.Body)
+		}
+	}
+	if w := davDo(t, "GET", "a/b.txt", "", nil); w.Code != 404 {
+		t.Errorf("Expected moved file to be gone, got %v", w.Code)
+	}
+
+	w = davDo(t, "MOVE", "e.txt", "", map[string]string{
+		"Destination": "http://localhost/.cbfs/dav/f.txt"})
+	if w.Code != 204 {
+		t.Errorf("Error moving over a file: %v %s", w.Code, w.Body)
+	}
+	if w := davDo(t, "GET", "e.txt", "", nil); w.Code != 404 {
+		t.Errorf("Expected moved file to be gone, got %v", w.Code)
+	}
+
+	w = davDo(t, "LOCK", "moved/", `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner><D:href>me</D:href></D:owner>
+</D:lockinfo>`, map[string]string{"Timeout": "Second-60"})
+	token := strings.Trim(w.Header().Get("Lock-Token"), "<>")
+	if w.Code != 200 || token == "" {
+		t.Fatalf("Error locking: %v %s", w.Code, w.Body)
+	}
+	if w := davDo(t, "LOCK", "moved/b.txt", "<D:lockinfo xmlns:D='DAV:'/>",
+		nil); w.Code != 423 {
+		t.Errorf("Expected lock beneath a lock to fail, got %v", w.Code)
+	}
+	if w := davDo(t, "PUT", "moved/b.txt", "new", nil); w.Code != 423 {
+		t.Errorf("Expected locked PUT to fail, got %v", w.Code)
+	}
+	w = davDo(t, "PUT", "moved/b.txt", "new",
+		map[string]string{"If": "(<" + token + ">)"})
+	if w.Code != 201 {
+		t.Errorf("Error putting with the lock: %v %s", w.Code, w.Body)
+	}
+	w = davDo(t, "UNLOCK", "moved/", "",
+		map[string]string{"Lock-Token": "<" + token + ">"})
+	if w.Code != 204 {
+		t.Errorf("Error unlocking: %v %s", w.Code, w.Body)
+	}
+
+	if w := davDo(t, "DELETE", "moved", "", nil); w.Code != 204 {
+		t.Fatalf("Error deleting: %v %s", w.Code, w.Body)
+	}
+	if w := davDo(t, "PROPFIND", "moved", "", nil); w.Code != 404 {
+		t.Errorf("Expected deleted collection to be gone, got %v", w.Code)
+	}
+}
+
+func TestDAVCopyChecksFirst(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	for _, k := range []string{"src/v.txt", "src/w.txt", "src/x.txt",
+		"dst/y.txt", "dst/z.txt"} {
+		if w := davDo(t, "PUT", k, "data for "+k, nil); w.Code != 201 {
+			t.Fatalf("Error putting %v: %v %s", k, w.Code, w.Body)
+		}
+	}
+	intact := func(what string) {
+		if w := davDo(t, "GET", "dst/y.txt", "", nil); w.Code != 200 {
+			t.Errorf("Expected %v to leave the destination, got %v", what, w.Code)
+		}
+		if w := davDo(t, "GET", "dst/x.txt", "", nil); w.Code != 404 {
+			t.Errorf("Expected %v to copy nothing, got %v", what, w.Code)
+		}
+	}
+	to := map[string]string{"Destination": "http://localhost/.cbfs/dav/dst"}
+
+	w := doTestRequest(t, "PUT", quotaPrefix+"dst", `{"maxFiles": 2}`)
+	if w.Code != 200 {
+		t.Fatalf("Error setting quota: %v %s", w.Code, w.Body)
+	}
+	if w := davDo(t, "COPY", "src", "", to); w.Code != 507 {
+		t.Errorf("Expected copy over quota to fail, got %v %s", w.Code, w.Body)
+	}
+	intact("copy over quota")
+
+	w = doTestRequest(t, "PUT", retentionPrefix+"src/x.txt", `{"legalHold": true}`)
+	if w.Code != 204 {
+		t.Fatalf("Error placing a hold: %v %s", w.Code, w.Body)
+	}
+	if w := davDo(t, "MOVE", "src", "", to); w.Code != 403 {
+		t.Errorf("Expected move of a held file to fail, got %v %s", w.Code, w.Body)
+	}
+	intact("move of a held file")
+
+	w = davDo(t, "LOCK", "dst/z.txt", "<D:lockinfo xmlns:D='DAV:'/>", nil)
+	if w.Code != 200 {
+		t.Fatalf("Error locking: %v %s", w.Code, w.Body)
+	}
+	if w := davDo(t, "COPY", "src", "", to); w.Code != 423 {
+		t.Errorf("Expected copy over a locked file to fail, got %v %s", w.Code, w.Body)
+	}
+	intact("copy over a locked file")
+}
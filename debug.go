@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cb "github.com/couchbaselabs/go-couchbase"
@@ -96,9 +97,10 @@ func shortTaskName(n string) string {
 	return n
 }
 
-func endedTask(named string, t time.Time) {
-	taskDurations[shortTaskName(named)].Update(
-		int64(time.Since(t) / time.Millisecond))
+func endedTask(named string, t time.Time, err error) {
+	d := time.Since(t)
+	taskDurations[shortTaskName(named)].Update(int64(d / time.Millisecond))
+	recordTaskMetrics(shortTaskName(named), d, err)
 }
 
 type rateConn struct {
@@ -108,24 +110,28 @@ type rateConn struct {
 func (r *rateConn) WriteTo(w io.Writer) (int64, error) {
 	n, err := io.Copy(w, r.c)
 	readBytes.Update(n)
+	atomic.AddUint64(&netReadBytes, uint64(n))
 	return n, err
 }
 
 func (r *rateConn) Write(b []byte) (n int, err error) {
 	n, err = r.c.Write(b)
 	writeBytes.Update(int64(n))
+	atomic.AddUint64(&netWriteBytes, uint64(n))
 	return
 }
 
 func (r *rateConn) ReadFrom(rr io.Reader) (int64, error) {
 	n, err := io.Copy(r.c, rr)
 	writeBytes.Update(n)
+	atomic.AddUint64(&netWriteBytes, uint64(n))
 	return n, err
 }
 
 func (r *rateConn) Read(b []byte) (n int, err error) {
 	n, err = r.c.Read(b)
 	readBytes.Update(int64(n))
+	atomic.AddUint64(&netReadBytes, uint64(n))
 	return
 }
 
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+	bolt "go.etcd.io/bbolt"
+)
+
+var embeddedBucket = []byte("cbfs")
+
+// Memcached treats expirations longer than this as absolute times.
+const maxRelativeExp = 60 * 60 * 24 * 30
+
+// An in-process MetaStore for running a single node (or the tests)
+// without a couchbase cluster.
+//
+// Every value is stored with a 16 byte header of absolute expiration
+// (unix seconds, 0 for never) and CAS identifier.
+type embeddedStore struct {
+	db  *bolt.DB
+	cas uint64
+}
+
+func openEmbeddedStore(path string) (*embeddedStore, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(embeddedBucket); err != nil {
+			return err
+		}
+		return initViewIndexes(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &embeddedStore{db: db, cas: uint64(time.Now().UnixNano())}, nil
+}
+
+func (s *embeddedStore) Close() error {
+	return s.db.Close()
+}
+
+func absoluteExp(exp int) uint64 {
+	switch {
+	case exp <= 0:
+		return 0
+	case exp <= maxRelativeExp:
+		return uint64(time.Now().Unix()) + uint64(exp)
+	}
+	return uint64(exp)
+}
+
+type embeddedItem struct {
+	exp  uint64
+	cas  uint64
+	body []byte
+}
+
+func (i embeddedItem) expired(now time.Time) bool {
+	return i.exp != 0 && i.exp <= uint64(now.Unix())
+}
+
+func decodeItem(data []byte) (embeddedItem, bool) {
+	if len(data) < 16 {
+		return embeddedItem{}, false
+	}
+	return embeddedItem{
+		exp:  binary.BigEndian.Uint64(data),
+		cas:  binary.BigEndian.Uint64(data[8:]),
+		body: data[16:],
+	}, true
+}
+
+// Look up a live item.  The body is only valid within the transaction.
+func (s *embeddedStore) item(b *bolt.Bucket, k string) (embeddedItem, bool) {
+	i, ok := decodeItem(b.Get([]byte(k)))
+	if !ok || i.expired(time.Now()) {
+		return embeddedItem{}, false
+	}
+	return i, true
+}
+
+func (s *embeddedStore) put(b *bolt.Bucket, k string, exp int,
+	body []byte) error {
+
+	data := make([]byte, 16+len(body))
+	binary.BigEndian.PutUint64(data, absoluteExp(exp))
+	binary.BigEndian.PutUint64(data[8:], atomic.AddUint64(&s.cas, 1))
+	copy(data[16:], body)
+	if err := b.Put([]byte(k), data); err != nil {
+		return err
+	}
+	return indexDoc(b.Tx(), k, body)
+}
+
+func (s *embeddedStore) remove(b *bolt.Bucket, k string) error {
+	if err := b.Delete([]byte(k)); err != nil {
+		return err
+	}
+	return indexDoc(b.Tx(), k, nil)
+}
+
+func (s *embeddedStore) update(f func(b *bolt.Bucket) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return f(tx.Bucket(embeddedBucket))
+	})
+}
+
+func (s *embeddedStore) view(f func(b *bolt.Bucket) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return f(tx.Bucket(embeddedBucket))
+	})
+}
+
+func (s *embeddedStore) Gets(k string, rv interface{}, cas *uint64) error {
+	var data []byte
+	err := s.view(func(b *bolt.Bucket) error {
+		i, ok := s.item(b, k)
+		if !ok {
+			return errNotFound
+		}
+		data = append(data, i.body...)
+		if cas != nil {
+			*cas = i.cas
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, rv)
+}
+
+func (s *embeddedStore) Get(k string, rv interface{}) error {
+	return s.Gets(k, rv, nil)
+}
+
+func (s *embeddedStore) GetRaw(k string) ([]byte, error) {
+	var rv []byte
+	err := s.view(func(b *bolt.Bucket) error {
+		i, ok := s.item(b, k)
+		if !ok {
+			return errNotFound
+		}
+		rv = append(rv, i.body...)
+		return nil
+	})
+	return rv, err
+}
+
+func (s *embeddedStore) GetBulk(keys []string) (map[string][]byte, error) {
+	rv := map[string][]byte{}
+	err := s.view(func(b *bolt.Bucket) error {
+		for _, k := range keys {
+			if i, ok := s.item(b, k); ok {
+				rv[k] = append([]byte{}, i.body...)
+			}
+		}
+		return nil
+	})
+	return rv, err
+}
+
+func (s *embeddedStore) Set(k string, exp int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.SetRaw(k, exp, data)
+}
+
+func (s *embeddedStore) SetRaw(k string, exp int, v []byte) error {
+	return s.update(func(b *bolt.Bucket) error {
+		return s.put(b, k, exp, v)
+	})
+}
+
+func (s *embeddedStore) Add(k string, exp int, v interface{}) (bool, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	added := false
+	err = s.update(func(b *bolt.Bucket) error {
+		if _, exists := s.item(b, k); exists {
+			return nil
+		}
+		added = true
+		return s.put(b, k, exp, data)
+	})
+	return added, err
+}
+
+func (s *embeddedStore) CAS(k string, exp int, cas uint64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.update(func(b *bolt.Bucket) error {
+		i, ok := s.item(b, k)
+		if !ok {
+			return errNotFound
+		}
+		if i.cas != cas {
+			return errCASMismatch
+		}
+		return s.put(b, k, exp, data)
+	})
+}
+
+// The callback runs inside the write transaction, so it must not
+// call back into the store.
+func (s *embeddedStore) Update(k string, exp int,
+	f func([]byte) ([]byte, error)) error {
+
+	return s.update(func(b *bolt.Bucket) error {
+		var in []byte
+		if i, ok := s.item(b, k); ok {
+			in = append(in, i.body...)
+		}
+		out, err := f(in)
+		switch {
+		case err != nil:
+			return err
+		case out == nil && in == nil:
+			return nil
+		case out == nil:
+			return s.remove(b, k)
+		}
+		return s.put(b, k, exp, out)
+	})
+}
+
+func (s *embeddedStore) Delete(k string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		if _, ok := s.item(b, k); !ok {
+			return errNotFound
+		}
+		return s.remove(b, k)
+	})
+}
+
+func (s *embeddedStore) Incr(k string, amt, def uint64, exp int) (uint64, error) {
+	rv := def
+	err := s.update(func(b *bolt.Bucket) error {
+		if i, ok := s.item(b, k); ok {
+			v, err := strconv.ParseUint(string(i.body), 10, 64)
+			if err != nil {
+				return err
+			}
+			rv = v + amt
+		}
+		return s.put(b, k, exp, []byte(strconv.FormatUint(rv, 10)))
+	})
+	return rv, err
+}
+
+func (s *embeddedStore) View(name string, params map[string]interface{},
+	vres interface{}) error {
+
+	v, ok := embeddedViews[name]
+	if !ok {
+		return cb.ViewError{From: "embedded", Reason: "no such view: " + name}
+	}
+
+	var res viewResult
+	err := s.view(func(b *bolt.Bucket) error {
+		ib := b.Tx().Bucket(viewsBucket).Bucket([]byte(name))
+		var err error
+		res, err = v.query(b, ib.Bucket(viewRowsBucket), params)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, vres)
+}
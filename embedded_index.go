@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The embedded store keeps its views up to date as documents change
+// rather than mapping every document on every query.  Each view has a
+// bucket of rows keyed so that byte order is collation order (the
+// row's key, then its doc id), and a bucket of the row keys each doc
+// emitted so they can be removed when it changes.  Rows of expired
+// docs are skipped at query time.
+
+var (
+	viewsBucket     = []byte("views")
+	viewRowsBucket  = []byte("rows")
+	viewDocsBucket  = []byte("docs")
+	viewsVersionKey = []byte("version")
+)
+
+// Append an encoding of a JSON value whose byte order matches
+// collate's order.  Encodings are prefix free, so one may follow
+// another.
+func appendCollationKey(buf []byte, k interface{}) []byte {
+	switch x := k.(type) {
+	case nil:
+		return append(buf, 1)
+	case bool:
+		if x {
+			return append(buf, 3)
+		}
+		return append(buf, 2)
+	case float64:
+		bits := math.Float64bits(x)
+		if bits>>63 == 0 {
+			bits |= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, bits)
+		return append(append(buf, 4), b...)
+	case string:
+		buf = append(buf, 5)
+		for i := 0; i < len(x); i++ {
+			buf = append(buf, x[i])
+			if x[i] == 0 {
+				buf = append(buf, 0xff)
+			}
+		}
+		return append(buf, 0, 1)
+	case []interface{}:
+		buf = append(buf, 6)
+		for _, e := range x {
+			buf = appendCollationKey(buf, e)
+		}
+		return append(buf, 0)
+	}
+	return append(buf, 7)
+}
+
+// Create the view buckets, rebuilding them from scratch if they were
+// made for different views.
+func initViewIndexes(tx *bolt.Tx) error {
+	version := []byte(strconv.Itoa(ddocVersion))
+	if vb := tx.Bucket(viewsBucket); vb != nil {
+		if bytes.Equal(vb.Get(viewsVersionKey), version) {
+			return nil
+		}
+		if err := tx.DeleteBucket(viewsBucket); err != nil {
+			return err
+		}
+	}
+
+	vb, err := tx.CreateBucket(viewsBucket)
+	if err != nil {
+		return err
+	}
+	for name := range embeddedViews {
+		ib, err := vb.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		if _, err := ib.CreateBucket(viewRowsBucket); err != nil {
+			return err
+		}
+		if _, err := ib.CreateBucket(viewDocsBucket); err != nil {
+			return err
+		}
+	}
+	if err := vb.Put(viewsVersionKey, version); err != nil {
+		return err
+	}
+
+	return tx.Bucket(embeddedBucket).ForEach(func(k, data []byte) error {
+		i, ok := decodeItem(data)
+		if !ok {
+			return nil
+		}
+		return indexDoc(tx, string(k), i.body)
+	})
+}
+
+// Replace the rows doc id emitted with those of its new body (nil if
+// it's been deleted).
+func indexDoc(tx *bolt.Tx, id string, body []byte) error {
+	var d viewDoc
+	parsed := body != nil && json.Unmarshal(body, &d) == nil
+
+	vb := tx.Bucket(viewsBucket)
+	for name, v := range embeddedViews {
+		ib := vb.Bucket([]byte(name))
+		rows, docs := ib.Bucket(viewRowsBucket), ib.Bucket(viewDocsBucket)
+
+		if old := docs.Get([]byte(id)); old != nil {
+			keys := [][]byte{}
+			if err := json.Unmarshal(old, &keys); err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := rows.Delete(k); err != nil {
+					return err
+				}
+			}
+			if err := docs.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		if !parsed {
+			continue
+		}
+
+		keys := [][]byte{}
+		var err error
+		v.emit(id, d, func(k, val interface{}) {
+			if err != nil {
+				return
+			}
+			if k, err = jsonParam(k); err != nil {
+				return
+			}
+			var data []byte
+			data, err = json.Marshal(viewRow{ID: id, Key: k, Value: val})
+			if err != nil {
+				return
+			}
+			rk := appendCollationKey(appendCollationKey(nil, k), id)
+			rk = append(rk, byte(len(keys)>>8), byte(len(keys)))
+			keys = append(keys, rk)
+			err = rows.Put(rk, data)
+		})
+		if err != nil {
+			return fmt.Errorf("indexing %v in %v: %v", id, name, err)
+		}
+		if len(keys) > 0 {
+			data, err := json.Marshal(keys)
+			if err != nil {
+				return err
+			}
+			if err := docs.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v embeddedView) query(b, rows *bolt.Bucket,
+	params map[string]interface{}) (viewResult, error) {
+
+	descending := boolParam(params, "descending", false)
+
+	startKey, hasStart, err := keyParam(params, "startkey", "start_key")
+	if err != nil {
+		return viewResult{}, err
+	}
+	endKey, hasEnd, err := keyParam(params, "endkey", "end_key")
+	if err != nil {
+		return viewResult{}, err
+	}
+	if k, ok, err := keyParam(params, "key"); err != nil {
+		return viewResult{}, err
+	} else if ok {
+		startKey, hasStart, endKey, hasEnd = k, true, k, true
+	}
+	_, hasStartDocID := params["startkey_docid"]
+
+	// Where to start, and the bound past which to stop.  0xff sorts
+	// after everything that follows an encoded key.
+	var from, to []byte
+	if hasStart {
+		from = appendCollationKey(nil, startKey)
+		if hasStartDocID {
+			from = appendCollationKey(from, fmt.Sprint(params["startkey_docid"]))
+		}
+		if descending {
+			from = append(from, 0xff)
+		}
+	}
+	if hasEnd {
+		to = appendCollationKey(nil, endKey)
+		if !descending {
+			to = append(to, 0xff)
+		}
+	}
+
+	reduce := v.reduce != "" && boolParam(params, "reduce", true)
+	limit, hasLimit := intParam(params, "limit")
+	hasLimit = hasLimit && limit >= 0
+
+	c := rows.Cursor()
+	var k, data []byte
+	switch {
+	case !descending && from == nil:
+		k, data = c.First()
+	case !descending:
+		k, data = c.Seek(from)
+	case from == nil:
+		k, data = c.Last()
+	default:
+		if k, data = c.Seek(from); k == nil {
+			k, data = c.Last()
+		} else {
+			k, data = c.Prev()
+		}
+	}
+
+	now := time.Now()
+	filtered := []viewRow{}
+	for ; k != nil; k, data = nextRow(c, descending) {
+		if to != nil && ((!descending && bytes.Compare(k, to) > 0) ||
+			(descending && bytes.Compare(k, to) < 0)) {
+			break
+		}
+		if !reduce && hasLimit && len(filtered) >= limit {
+			break
+		}
+		r := viewRow{}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return viewResult{}, err
+		}
+		i, ok := decodeItem(b.Get([]byte(r.ID)))
+		if !ok || i.expired(now) {
+			continue
+		}
+		r.body = append([]byte{}, i.body...)
+		filtered = append(filtered, r)
+	}
+
+	if reduce {
+		filtered = v.reduceRows(filtered, params)
+	} else if boolParam(params, "include_docs", false) {
+		for i := range filtered {
+			doc := json.RawMessage(filtered[i].body)
+			filtered[i].Doc = map[string]interface{}{
+				"meta": map[string]interface{}{"id": filtered[i].ID},
+				"json": &doc,
+			}
+		}
+	}
+
+	if hasLimit && limit < len(filtered) {
+		filtered = filtered[:limit]
+	}
+
+	return viewResult{TotalRows: len(filtered), Rows: filtered}, nil
+}
+
+func nextRow(c *bolt.Cursor, descending bool) ([]byte, []byte) {
+	if descending {
+		return c.Prev()
+	}
+	return c.Next()
+}
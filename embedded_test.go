@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Point the global metadata store at a fresh embedded store for the
+// duration of a test.
+func withEmbeddedStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cbfstest")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	s, err := openEmbeddedStore(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatalf("Error opening embedded store: %v", err)
+	}
+	prev := couchbase
+	couchbase = s
+	return func() {
+		backgroundWork.Wait()
+		couchbase = prev
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEmbeddedCRUD(t *testing.T) {
+	defer withEmbeddedStore(t)()
+
+	m := map[string]string{}
+	if err := couchbase.Get("/x", &m); !isNotFound(err) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+
+	if added, err := couchbase.Add("/x", 0, map[string]string{"a": "b"}); !added || err != nil {
+		t.Fatalf("Expected add, got %v/%v", added, err)
+	}
+	if added, err := couchbase.Add("/x", 0, map[string]string{}); added || err != nil {
+		t.Fatalf("Expected no add, got %v/%v", added, err)
+	}
+
+	cas := uint64(0)
+	if err := couchbase.Gets("/x", &m, &cas); err != nil || m["a"] != "b" {
+		t.Fatalf("Expected a=b, got %v/%v", m, err)
+	}
+	if err := couchbase.CAS("/x", 0, cas+1, m); err != errCASMismatch {
+		t.Fatalf("Expected CAS mismatch, got %v", err)
+	}
+	m["a"] = "c"
+	if err := couchbase.CAS("/x", 0, cas, m); err != nil {
+		t.Fatalf("Expected CAS to work, got %v", err)
+	}
+
+	err := couchbase.Update("/x", 0, func(in []byte) ([]byte, error) {
+		return nil, cb.UpdateCancel
+	})
+	if err != cb.UpdateCancel {
+		t.Fatalf("Expected cancel, got %v", err)
+	}
+	err = couchbase.Update("/x", 0, func(in []byte) ([]byte, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Error deleting via update: %v", err)
+	}
+	if err := couchbase.Delete("/x"); !isNotFound(err) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+
+	for i := uint64(1); i < 4; i++ {
+		v, err := couchbase.Incr("/c", 1, 1, 0)
+		if err != nil || v != i {
+			t.Fatalf("Expected %v, got %v/%v", i, v, err)
+		}
+	}
+}
+
+func TestEmbeddedExpiration(t *testing.T) {
+	defer withEmbeddedStore(t)()
+
+	past := int(time.Now().Add(-time.Hour).Unix())
+	if err := couchbase.Set("/x", past, 1); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := couchbase.GetRaw("/x"); !isNotFound(err) {
+		t.Fatalf("Expected expired item to be missing, got %v", err)
+	}
+	if added, err := couchbase.Add("/x", 60, 2); !added || err != nil {
+		t.Fatalf("Expected to add over expired item: %v/%v", added, err)
+	}
+}
+
+func TestEmbeddedViews(t *testing.T) {
+	defer withEmbeddedStore(t)()
+
+	for _, fn := range []string{"a/b/c", "a/b/d", "a/e", "f"} {
+		err := storeMeta(fn, 0, fileMeta{OID: "o" + fn, Length: 10}, 0, nil)
+		if err != nil {
+			t.Fatalf("Error storing %v: %v", fn, err)
+		}
+	}
+	for i, nodes := range [][]string{{"n1"}, {"n1", "n2"}, {"n2"}} {
+		bo := BlobOwnership{
+			OID:    string('a' + byte(i)),
+			Type:   "blob",
+			Length: 5,
+			Nodes:  map[string]time.Time{},
+		}
+		for _, n := range nodes {
+			bo.Nodes[n] = time.Now()
+		}
+		if err := couchbase.Set("/"+bo.OID, 0, bo); err != nil {
+			t.Fatalf("Error storing blob: %v", err)
+		}
+	}
+
+	fl, err := listFiles("a", false, 1)
+	if err != nil {
+		t.Fatalf("Error listing: %v", err)
+	}
+	if len(fl.Files) != 1 || fl.Files["e"] == nil {
+		t.Errorf("Expected just e in files, got %v", fl.Files)
+	}
+	if len(fl.Dirs) != 1 || fl.Dirs["b"] == nil {
+		t.Errorf("Expected just b in dirs, got %v", fl.Dirs)
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key   string
+			Value float64
+		}
+	}{}
+	err = couchbase.View("node_size",
+		map[string]interface{}{"group_level": 1}, &viewRes)
+	if err != nil {
+		t.Fatalf("Error querying node_size: %v", err)
+	}
+	got := map[string]float64{}
+	for _, r := range viewRes.Rows {
+		got[r.Key] = r.Value
+	}
+	if len(got) != 2 || got["n1"] != 10 || got["n2"] != 10 {
+		t.Errorf("Unexpected node sizes: %v", got)
+	}
+
+	repRes := struct {
+		Rows []struct {
+			Key int
+			Id  string
+		}
+	}{}
+	err = couchbase.View("repcounts", map[string]interface{}{
+		"reduce":   false,
+		"startkey": 1,
+		"endkey":   1,
+	}, &repRes)
+	if err != nil {
+		t.Fatalf("Error querying repcounts: %v", err)
+	}
+	if len(repRes.Rows) != 2 || repRes.Rows[0].Id != "/a" ||
+		repRes.Rows[1].Id != "/c" {
+		t.Errorf("Expected /a and /c to be singly replicated, got %+v",
+			repRes.Rows)
+	}
+}
+
+func TestCollation(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		exp  int
+	}{
+		{nil, false, -1},
+		{true, 1.0, -1},
+		{2.0, 10.0, -1},
+		{"b", "a", 1},
+		{"z", []interface{}{}, -1},
+		{[]interface{}{"a"}, []interface{}{"a", "b"}, -1},
+		{[]interface{}{"a", "c"}, []interface{}{"a", "b"}, 1},
+		{[]interface{}{"a", "z"}, []interface{}{"a", map[string]interface{}{}}, -1},
+		{[]interface{}{"a"}, []interface{}{"a"}, 0},
+	}
+
+	for _, test := range tests {
+		got := collate(test.a, test.b)
+		if (got < 0 && test.exp >= 0) || (got > 0 && test.exp <= 0) ||
+			(got == 0 && test.exp != 0) {
+			t.Errorf("Expected %v for %v <=> %v, got %v",
+				test.exp, test.a, test.b, got)
+		}
+	}
+}
+
+func TestCollationKeys(t *testing.T) {
+	keys := []interface{}{
+		nil, false, true, -10.0, -0.5, 0.0, 2.0, 10.0,
+		"", "a", "a\x00", "a\x00b", "a\x01", "b",
+		[]interface{}{}, []interface{}{"a"}, []interface{}{"a", nil},
+		[]interface{}{"a", "b"}, []interface{}{"b"},
+		map[string]interface{}{},
+	}
+	for i, a := range keys {
+		for j, b := range keys {
+			got := bytes.Compare(appendCollationKey(nil, a),
+				appendCollationKey(nil, b))
+			if exp := collate(a, b); (got < 0) != (exp < 0) ||
+				(got > 0) != (exp > 0) || (i < j) != (got < 0) {
+				t.Errorf("Expected %v for %#v <=> %#v, got %v",
+					exp, a, b, got)
+			}
+		}
+	}
+}
+
+func TestEmbeddedViewUpdates(t *testing.T) {
+	defer withEmbeddedStore(t)()
+
+	upload := func(id, updated string) {
+		err := couchbase.Set(id, 0, map[string]string{
+			"type": "upload", "updated": updated})
+		if err != nil {
+			t.Fatalf("Error storing %v: %v", id, err)
+		}
+	}
+	ids := func(params map[string]interface{}) []string {
+		res := viewResult{}
+		if err := couchbase.View("uploads", params, &res); err != nil {
+			t.Fatalf("Error querying uploads: %v", err)
+		}
+		rv := []string{}
+		for _, r := range res.Rows {
+			rv = append(rv, r.ID)
+		}
+		return rv
+	}
+
+	upload("/u1", "2")
+	upload("/u2", "1")
+	upload("/u3", "3")
+	upload("/u1", "4")
+	if err := couchbase.Delete("/u3"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	past := int(time.Now().Add(-time.Hour).Unix())
+	if err := couchbase.Set("/u4", past, map[string]string{
+		"type": "upload", "updated": "0"}); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+
+	if got := ids(nil); !reflect.DeepEqual(got, []string{"/u2", "/u1"}) {
+		t.Errorf("Expected /u2, /u1, got %v", got)
+	}
+	got := ids(map[string]interface{}{"descending": true, "limit": 1})
+	if !reflect.DeepEqual(got, []string{"/u1"}) {
+		t.Errorf("Expected just /u1 descending, got %v", got)
+	}
+	got = ids(map[string]interface{}{"startkey": "2", "endkey": "9"})
+	if !reflect.DeepEqual(got, []string{"/u1"}) {
+		t.Errorf("Expected just /u1 in range, got %v", got)
+	}
+
+	// A reopened store keeps its indexes.
+	s := couchbase.(*embeddedStore)
+	path := s.db.Path()
+	s.Close()
+	s2, err := openEmbeddedStore(path)
+	if err != nil {
+		t.Fatalf("Error reopening: %v", err)
+	}
+	*s = *s2
+	if got := ids(nil); !reflect.DeepEqual(got, []string{"/u2", "/u1"}) {
+		t.Errorf("Expected /u2, /u1 after reopening, got %v", got)
+	}
+}
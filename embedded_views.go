@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Go renditions of the map/reduce functions in designDoc so the
+// embedded store can answer the same view queries.
+
+type viewRow struct {
+	ID    string      `json:"id,omitempty"`
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+	Doc   interface{} `json:"doc,omitempty"`
+
+	body []byte
+}
+
+type viewResult struct {
+	TotalRows int       `json:"total_rows"`
+	Rows      []viewRow `json:"rows"`
+}
+
+type viewDoc struct {
+	Type    string                 `json:"type"`
+	Name    string                 `json:"name"`
+	OID     string                 `json:"oid"`
+	Length  float64                `json:"length"`
+	Garbage bool                   `json:"garbage"`
+	Nodes   map[string]interface{} `json:"nodes"`
+	Chunks  []chunkRef             `json:"chunks"`
+	Older   []struct {
+		OID    string     `json:"oid"`
+		Chunks []chunkRef `json:"chunks"`
+	} `json:"older"`
+	Parts map[string]struct {
+		OID string `json:"oid"`
+	} `json:"parts"`
+	Updated string   `json:"updated"`
+	Shards  []string `json:"shards"`
+	ShardOf string   `json:"shardOf"`
+	Path    string   `json:"path"`
+	Meta    *viewDoc `json:"meta"`
+	Prefix  string   `json:"prefix"`
+}
+
+type embeddedView struct {
+	emit   func(id string, doc viewDoc, emit func(k, v interface{}))
+	reduce string
+}
+
+func (d viewDoc) path(id string) string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return id
+}
+
+// The blobs a file (and its older revisions) refer to.
+func (d viewDoc) blobRefs() map[string]bool {
+	oids := map[string]bool{d.OID: true}
+	for _, c := range d.Chunks {
+		oids[c.OID] = true
+	}
+	for _, o := range d.Older {
+		oids[o.OID] = true
+		for _, c := range o.Chunks {
+			oids[c.OID] = true
+		}
+	}
+	return oids
+}
+
+func stringsToKey(s []string) []interface{} {
+	rv := make([]interface{}, 0, len(s))
+	for _, x := range s {
+		rv = append(rv, x)
+	}
+	return rv
+}
+
+var embeddedViews = map[string]embeddedView{
+	"file_blobs": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			switch d.Type {
+			case "file":
+				for oid := range d.blobRefs() {
+					emit([]interface{}{oid, "file", d.path(id)}, nil)
+				}
+			case "trash":
+				if d.Meta != nil {
+					for oid := range d.Meta.blobRefs() {
+						emit([]interface{}{oid, "file", id}, nil)
+					}
+				}
+			case "upload":
+				for _, p := range d.Parts {
+					emit([]interface{}{p.OID, "file", id}, nil)
+				}
+			case "derived":
+				emit([]interface{}{d.OID, "file", id}, nil)
+			case "blob":
+				for n := range d.Nodes {
+					emit([]interface{}{d.OID, "blob", n}, nil)
+				}
+				if len(d.Nodes) == 0 {
+					emit([]interface{}{d.OID, "blob", ""}, nil)
+				}
+				for _, s := range d.Shards {
+					emit([]interface{}{s, "file", id}, nil)
+				}
+			}
+		},
+	},
+	"file_browse": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "file" {
+				emit(stringsToKey(strings.Split(d.path(id), "/")), d.Length)
+			}
+		},
+		reduce: "_stats",
+	},
+	"garbage": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "blob" {
+				k := "live"
+				if d.Garbage {
+					k = "garbage"
+				}
+				emit(k, d.Length)
+			}
+		},
+		reduce: "_stats",
+	},
+	"node_blobs": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "blob" {
+				for n := range d.Nodes {
+					emit(n, nil)
+				}
+			}
+		},
+		reduce: "_count",
+	},
+	"node_size": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			switch d.Type {
+			case "node":
+				emit(id[1:], 0.0)
+			case "blob":
+				for n := range d.Nodes {
+					emit(n, d.Length)
+				}
+			}
+		},
+		reduce: "_sum",
+	},
+	"repcounts": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "blob" && !d.Garbage && d.ShardOf == "" &&
+				len(d.Shards) == 0 {
+				emit(float64(len(d.Nodes)), nil)
+			}
+		},
+		reduce: "_count",
+	},
+	"ec_blobs": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "blob" && len(d.Shards) > 0 {
+				emit(d.OID, nil)
+			}
+		},
+	},
+	"uploads": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "upload" {
+				emit(d.Updated, nil)
+			}
+		},
+	},
+	"trash": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "trash" {
+				emit(stringsToKey(strings.Split(d.Path, "/")), nil)
+			}
+		},
+	},
+	"quotas": {
+		emit: func(id string, d viewDoc, emit func(k, v interface{})) {
+			if d.Type == "quota" {
+				emit(d.Prefix, nil)
+			}
+		},
+	},
+}
+
+// Normalize a query parameter into the same shape as a decoded
+// JSON key.
+func jsonParam(i interface{}) (interface{}, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	var rv interface{}
+	err = json.Unmarshal(data, &rv)
+	return rv, err
+}
+
+func typeRank(i interface{}) int {
+	switch x := i.(type) {
+	case nil:
+		return 0
+	case bool:
+		if x {
+			return 2
+		}
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+// Compare two JSON values using (an approximation of) couchdb view
+// collation.
+func collate(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	case string:
+		return strings.Compare(x, b.(string))
+	case []interface{}:
+		y := b.([]interface{})
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := collate(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return len(x) - len(y)
+	}
+	return 0
+}
+
+func intParam(params map[string]interface{}, name string) (int, bool) {
+	switch x := params[name].(type) {
+	case int:
+		return x, true
+	case float64:
+		return int(x), true
+	}
+	return 0, false
+}
+
+func boolParam(params map[string]interface{}, name string, def bool) bool {
+	if b, ok := params[name].(bool); ok {
+		return b
+	}
+	return def
+}
+
+func keyParam(params map[string]interface{},
+	names ...string) (interface{}, bool, error) {
+
+	for _, n := range names {
+		if v, ok := params[n]; ok {
+			k, err := jsonParam(v)
+			return k, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+type viewStats struct {
+	Sum    float64 `json:"sum"`
+	Count  float64 `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Sumsqr float64 `json:"sumsqr"`
+}
+
+func groupKey(k interface{}, level int, group bool) interface{} {
+	switch {
+	case !group:
+		return nil
+	case level <= 0:
+		return k
+	}
+	if a, ok := k.([]interface{}); ok && len(a) > level {
+		return a[:level]
+	}
+	return k
+}
+
+func (v embeddedView) reduceRows(rows []viewRow,
+	params map[string]interface{}) []viewRow {
+
+	level, hasLevel := intParam(params, "group_level")
+	group := boolParam(params, "group", false) || hasLevel
+
+	rv := []viewRow{}
+	var stats viewStats
+	var cur interface{}
+	flush := func() {
+		if stats.Count == 0 {
+			return
+		}
+		r := viewRow{Key: cur}
+		switch v.reduce {
+		case "_count":
+			r.Value = stats.Count
+		case "_sum":
+			r.Value = stats.Sum
+		default:
+			r.Value = stats
+		}
+		rv = append(rv, r)
+		stats = viewStats{}
+	}
+
+	for _, r := range rows {
+		k := groupKey(r.Key, level, group)
+		if stats.Count > 0 && collate(k, cur) != 0 {
+			flush()
+		}
+		cur = k
+		val, _ := r.Value.(float64)
+		if stats.Count == 0 || val < stats.Min {
+			stats.Min = val
+		}
+		if stats.Count == 0 || val > stats.Max {
+			stats.Max = val
+		}
+		stats.Count++
+		stats.Sum += val
+		stats.Sumsqr += val * val
+	}
+	flush()
+
+	return rv
+}
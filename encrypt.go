@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blobs may be encrypted at rest.  Each blob gets its own random data
+// key, stored in the blob's header wrapped by a master key.  Rotating
+// master keys only rewrites headers.
+//
+// The content is sealed with AES-GCM in fixed-size segments so range
+// reads only decrypt what they touch.  The last segment is sealed
+// differently from the rest so truncation is detected.
+//
+//   magic [8] | master key id [8] | wrap nonce [12] | wrapped key [48]
+//   segment 0 | segment 1 | ... (each up to encSegmentSize + 16)
+//
+// Hashes are always of the plaintext.
+
+const (
+	encMagic       = "CBFSENC1"
+	encKeyIDLen    = 8
+	encHeaderLen   = len(encMagic) + encKeyIDLen + 12 + 32 + 16
+	encSegmentSize = 64 * 1024
+	encTagSize     = 16
+
+	kmsKey          = "/@kms"
+	kmsRotatePrefix = "/.cbfs/kms/rotate/"
+	kmsCacheTime    = time.Minute
+)
+
+var encryptionKeys = flag.String("encryptionKeys", "",
+	`Master key file for encrypting blobs at rest, or "kms" to keep them in the metadata store`)
+
+var (
+	errUnknownMasterKey = errors.New("blob is encrypted with an unknown master key")
+	errNoBlobKeys       = errors.New("blob is encrypted but there are no master keys")
+	errBadEncryptedBlob = errors.New("invalid encrypted blob header")
+)
+
+type masterKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newMasterKey(raw []byte) (*masterKey, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("master keys must be 32 bytes, got %v", len(raw))
+	}
+	aead, err := newAESGCM(raw)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(raw)
+	return &masterKey{id[:encKeyIDLen], aead}, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// Where master keys come from.
+type keyManager interface {
+	// The key new blobs are encrypted with.
+	currentKey() (*masterKey, error)
+	findKey(id []byte) (*masterKey, error)
+	// Pick up any new keys.
+	reload() error
+}
+
+// nil when blobs aren't encrypted.
+var blobKeys keyManager
+
+func initBlobKeys() error {
+	switch *encryptionKeys {
+	case "":
+		return nil
+	case "kms":
+		blobKeys = &localKMS{}
+	default:
+		blobKeys = &keyFile{path: *encryptionKeys}
+	}
+	if err := blobKeys.reload(); err != nil {
+		return err
+	}
+	_, err := blobKeys.currentKey()
+	return err
+}
+
+func findMasterKey(keys []*masterKey, id []byte) (*masterKey, error) {
+	for _, k := range keys {
+		if bytes.Equal(k.id, id) {
+			return k, nil
+		}
+	}
+	return nil, errUnknownMasterKey
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// A file with one hex or base64 encoded 256-bit key per line.  The
+// first one is current, the rest are only used to read (and re-key)
+// blobs encrypted with them.  Lines starting with # are ignored.
+type keyFile struct {
+	path string
+	mu   sync.Mutex
+	keys []*masterKey
+}
+
+func (k *keyFile) reload() error {
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	keys := []*masterKey{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := decodeKey(line)
+		if err != nil {
+			return fmt.Errorf("invalid key in %v: %v", k.path, err)
+		}
+		mk, err := newMasterKey(raw)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, mk)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	return nil
+}
+
+func (k *keyFile) currentKey() (*masterKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) == 0 {
+		return nil, errors.New("no keys in " + k.path)
+	}
+	return k.keys[0], nil
+}
+
+func (k *keyFile) findKey(id []byte) (*masterKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return findMasterKey(k.keys, id)
+}
+
+// A stand-in for a real KMS keeping master keys in the metadata
+// store, so every node sees rotations.  Anyone who can read the
+// metadata store can read the keys, so it's only for testing.
+type kmsDoc struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+type localKMS struct {
+	mu     sync.Mutex
+	keys   []*masterKey
+	cur    *masterKey
+	loaded time.Time
+}
+
+func (k *localKMS) reload() error {
+	doc := kmsDoc{}
+	err := couchbase.Get(kmsKey, &doc)
+	if isNotFound(err) {
+		doc, err = rotateKMSKey()
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := []*masterKey{}
+	var cur *masterKey
+	for id, s := range doc.Keys {
+		raw, err := decodeKey(s)
+		if err != nil {
+			return fmt.Errorf("invalid KMS key %v: %v", id, err)
+		}
+		mk, err := newMasterKey(raw)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, mk)
+		if hex.EncodeToString(mk.id) == doc.Current {
+			cur = mk
+		}
+	}
+	if cur == nil {
+		return errors.New("KMS has no current key")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.cur, k.loaded = keys, cur, time.Now()
+	return nil
+}
+
+func (k *localKMS) currentKey() (*masterKey, error) {
+	k.mu.Lock()
+	stale := time.Since(k.loaded) > kmsCacheTime
+	k.mu.Unlock()
+	if stale {
+		if err := k.reload(); err != nil {
+			log.Printf("Error reloading KMS keys: %v", err)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cur == nil {
+		return nil, errors.New("KMS has no current key")
+	}
+	return k.cur, nil
+}
+
+func (k *localKMS) findKey(id []byte) (*masterKey, error) {
+	k.mu.Lock()
+	mk, err := findMasterKey(k.keys, id)
+	k.mu.Unlock()
+	if err == errUnknownMasterKey {
+		// Maybe another node rotated.
+		if err = k.reload(); err == nil {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			return findMasterKey(k.keys, id)
+		}
+	}
+	return mk, err
+}
+
+// Add a new random key to the KMS and make it current.
+func rotateKMSKey() (kmsDoc, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return kmsDoc{}, err
+	}
+	mk, err := newMasterKey(raw)
+	if err != nil {
+		return kmsDoc{}, err
+	}
+
+	rv := kmsDoc{}
+	err = couchbase.Update(kmsKey, 0, func(in []byte) ([]byte, error) {
+		rv = kmsDoc{}
+		if in != nil {
+			if err := json.Unmarshal(in, &rv); err != nil {
+				return nil, err
+			}
+		}
+		if rv.Keys == nil {
+			rv.Keys = map[string]string{}
+		}
+		rv.Current = hex.EncodeToString(mk.id)
+		rv.Keys[rv.Current] = base64.StdEncoding.EncodeToString(raw)
+		return json.Marshal(rv)
+	})
+	if err == nil {
+		log.Printf("New KMS master key %v", rv.Current)
+	}
+	return rv, err
+}
+
+func doRotateKMS(w http.ResponseWriter, req *http.Request) {
+	if _, ok := blobKeys.(*localKMS); !ok {
+		http.Error(w, "Not using the local KMS", 400)
+		return
+	}
+	if _, err := rotateKMSKey(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := blobKeys.reload(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func encNonce(seg int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(seg))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func wrapDataKey(mk *masterKey, dek []byte) ([]byte, error) {
+	hdr := make([]byte, 0, encHeaderLen)
+	hdr = append(hdr, encMagic...)
+	hdr = append(hdr, mk.id...)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hdr = append(hdr, nonce...)
+	return mk.aead.Seal(hdr, nonce, dek, []byte(encMagic)), nil
+}
+
+// The data key from a blob header.
+func unwrapDataKey(hdr []byte) ([]byte, error) {
+	if len(hdr) < encHeaderLen || string(hdr[:len(encMagic)]) != encMagic {
+		return nil, errBadEncryptedBlob
+	}
+	mk, err := blobKeys.findKey(hdr[len(encMagic) : len(encMagic)+encKeyIDLen])
+	if err != nil {
+		return nil, err
+	}
+	nonceAt := len(encMagic) + encKeyIDLen
+	return mk.aead.Open(nil, hdr[nonceAt:nonceAt+12],
+		hdr[nonceAt+12:encHeaderLen], []byte(encMagic))
+}
+
+type encryptingWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	seg  int64
+}
+
+func newEncryptingWriter(w io.Writer) (*encryptingWriter, error) {
+	mk, err := blobKeys.currentKey()
+	if err != nil {
+		return nil, err
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	hdr, err := wrapDataKey(mk, dek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{w: w, aead: aead,
+		buf: make([]byte, 0, encSegmentSize*2)}, nil
+}
+
+func (e *encryptingWriter) seal(data []byte, last bool) error {
+	_, err := e.w.Write(e.aead.Seal(nil, encNonce(e.seg, last), data, nil))
+	e.seg++
+	return err
+}
+
+// The last full segment is held back until Close in case it's the
+// last one.
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	for len(e.buf) > encSegmentSize {
+		if err := e.seal(e.buf[:encSegmentSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = append(e.buf[:0], e.buf[encSegmentSize:]...)
+	}
+	return len(p), nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+// Plaintext size and segment count of an encrypted file.
+func encryptedSize(fileSize int64) (int64, int64, error) {
+	body := fileSize - int64(encHeaderLen)
+	if body < encTagSize {
+		return 0, 0, errors.New("encrypted blob is truncated")
+	}
+	nsegs := (body + encSegmentSize + encTagSize - 1) /
+		(encSegmentSize + encTagSize)
+	size := body - nsegs*encTagSize
+	if size < (nsegs-1)*encSegmentSize {
+		return 0, 0, errors.New("encrypted blob is truncated")
+	}
+	return size, nsegs, nil
+}
+
+type decryptingReader struct {
+	f     *os.File
+	aead  cipher.AEAD
+	size  int64
+	nsegs int64
+	pos   int64
+	seg   int64
+	plain []byte
+	sbuf  []byte
+}
+
+func (d *decryptingReader) load(seg int64) error {
+	off := int64(encHeaderLen) + seg*(encSegmentSize+encTagSize)
+	clen := int64(encSegmentSize + encTagSize)
+	if seg == d.nsegs-1 {
+		clen = d.size - seg*encSegmentSize + encTagSize
+	}
+	if _, err := d.f.ReadAt(d.sbuf[:clen], off); err != nil {
+		return err
+	}
+	p, err := d.aead.Open(d.plain[:0], encNonce(seg, seg == d.nsegs-1),
+		d.sbuf[:clen], nil)
+	if err != nil {
+		d.seg = -1
+		return fmt.Errorf("segment %v of %v: %v", seg, d.f.Name(), err)
+	}
+	d.plain, d.seg = p, seg
+	return nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	seg := d.pos / encSegmentSize
+	if seg != d.seg {
+		if err := d.load(seg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-seg*encSegmentSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 1:
+		offset += d.pos
+	case 2:
+		offset += d.size
+	}
+	if offset < 0 {
+		return d.pos, errors.New("negative position")
+	}
+	d.pos = offset
+	return d.pos, nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.f.Close()
+}
+
+// Wrap an encrypted blob file in a decrypting reader.
+func decryptBlob(f *os.File) (ReadSeekCloser, error) {
+	if blobKeys == nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", f.Name(), errNoBlobKeys)
+	}
+	hdr := make([]byte, encHeaderLen)
+	n, err := f.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	dek, err := unwrapDataKey(hdr[:n])
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", f.Name(), err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size, nsegs, err := encryptedSize(st.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", f.Name(), err)
+	}
+	aead, err := newAESGCM(dek)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &decryptingReader{
+		f:     f,
+		aead:  aead,
+		size:  size,
+		nsegs: nsegs,
+		seg:   -1,
+		plain: make([]byte, 0, encSegmentSize),
+		sbuf:  make([]byte, encSegmentSize+encTagSize),
+	}, nil
+}
+
+// The content size of a local blob file.
+func localBlobSize(fn string) (int64, error) {
+	r, err := openBlobFile(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Seek(0, 2)
+}
+
+// Rewrap a blob's data key with the current master key.  Returns
+// false if there was nothing to do.
+func rekeyBlob(fn string, cur *masterKey) (bool, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, encHeaderLen)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	if bytes.Equal(hdr[len(encMagic):len(encMagic)+encKeyIDLen], cur.id) {
+		return false, nil
+	}
+	dek, err := unwrapDataKey(hdr)
+	if err != nil {
+		return false, err
+	}
+	if hdr, err = wrapDataKey(cur, dek); err != nil {
+		return false, err
+	}
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return false, err
+	}
+	return true, f.Sync()
+}
+
+// Move every local blob to the current master key.
+func rekeyBlobs() error {
+	if blobKeys == nil {
+		return nil
+	}
+	if err := blobKeys.reload(); err != nil {
+		return err
+	}
+	cur, err := blobKeys.currentKey()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	rekeyed, failed := 0, 0
+	err = filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := blobOID(info.Name()); !ok || info.IsDir() ||
+			!strings.HasSuffix(info.Name(), encSuffix) {
+			return nil
+		}
+		changed, err := rekeyBlob(path, cur)
+		switch {
+		case err != nil:
+			log.Printf("Error re-keying %v: %v", info.Name(), err)
+			failed++
+		case changed:
+			rekeyed++
+		}
+		return nil
+	})
+	if rekeyed > 0 || failed > 0 {
+		log.Printf("Re-keyed %v blobs (%v failed) in %v",
+			rekeyed, failed, time.Since(start))
+	}
+	return err
+}
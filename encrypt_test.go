@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func withBlobKeys(t *testing.T, keys ...string) (string, func()) {
+	fn := filepath.Join(*root, "keys")
+	writeKeys := func(keys ...string) {
+		data := "# test keys\n"
+		for _, k := range keys {
+			data += k + "\n"
+		}
+		if err := ioutil.WriteFile(fn, []byte(data), 0600); err != nil {
+			t.Fatalf("Error writing keys: %v", err)
+		}
+	}
+	writeKeys(keys...)
+
+	prev := *encryptionKeys
+	*encryptionKeys = fn
+	if err := initBlobKeys(); err != nil {
+		t.Fatalf("Error loading keys: %v", err)
+	}
+	return fn, func() {
+		*encryptionKeys = prev
+		blobKeys = nil
+	}
+}
+
+func storeTestBlob(t *testing.T, data []byte) string {
+	hr, err := NewHashRecord(*root, "")
+	if err != nil {
+		t.Fatalf("Error making hash record: %v", err)
+	}
+	defer hr.Close()
+	h, _, err := hr.Process(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error storing blob: %v", err)
+	}
+	return h
+}
+
+func readTestBlob(t *testing.T, h string) []byte {
+	f, err := openLocalBlob(h)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", h, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", h, err)
+	}
+	return data
+}
+
+func TestEncryptedBlobs(t *testing.T) {
+	defer withTmpRoot(t)()
+	key1 := hex.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := hex.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	keyFn, cleanup := withBlobKeys(t, key1)
+	defer cleanup()
+
+	for _, size := range []int{0, 10, encSegmentSize, 3*encSegmentSize + 123} {
+		data := randomContent(size)
+		h := storeTestBlob(t, data)
+
+		raw, err := ioutil.ReadFile(hashFilename(*root, h) + encSuffix)
+		if err != nil {
+			t.Fatalf("Error reading raw blob: %v", err)
+		}
+		if size > 0 && bytes.Contains(raw, data[:size/2+1]) {
+			t.Errorf("Found plaintext on disk for %v bytes", size)
+		}
+
+		if got := readTestBlob(t, h); !bytes.Equal(got, data) {
+			t.Errorf("Expected %v bytes back, got %v", size, len(got))
+		}
+		if err := verifyObjectHash(h); err != nil {
+			t.Errorf("Error verifying %v bytes: %v", size, err)
+		}
+		if got, err := localBlobSize(hashFilename(*root, h) + encSuffix); err != nil ||
+			got != int64(size) {
+			t.Errorf("Expected size %v, got %v/%v", size, got, err)
+		}
+	}
+
+	// Ranges spanning segments.
+	data := randomContent(3*encSegmentSize + 123)
+	h := storeTestBlob(t, data)
+	f, err := openLocalBlob(h)
+	if err != nil {
+		t.Fatalf("Error opening blob: %v", err)
+	}
+	buf := make([]byte, 100)
+	off := int64(2*encSegmentSize - 50)
+	if _, err := f.Seek(off, 0); err != nil {
+		t.Fatalf("Error seeking: %v", err)
+	}
+	if _, err := io.ReadFull(f, buf); err != nil ||
+		!bytes.Equal(buf, data[off:off+100]) {
+		t.Errorf("Error reading range: %v", err)
+	}
+	f.Close()
+
+	// Rotate to a new master key, keeping the old one around until
+	// everything's re-keyed.
+	ioutil.WriteFile(keyFn, []byte(key2+"\n"+key1+"\n"), 0600)
+	if err := rekeyBlobs(); err != nil {
+		t.Fatalf("Error re-keying: %v", err)
+	}
+	ioutil.WriteFile(keyFn, []byte(key2+"\n"), 0600)
+	if err := blobKeys.reload(); err != nil {
+		t.Fatalf("Error reloading keys: %v", err)
+	}
+	if got := readTestBlob(t, h); !bytes.Equal(got, data) {
+		t.Errorf("Expected content to survive re-keying")
+	}
+
+	// Dropping the last segment is noticed.
+	fn := hashFilename(*root, h) + encSuffix
+	st, _ := os.Stat(fn)
+	if err := os.Truncate(fn, st.Size()-123-encTagSize); err != nil {
+		t.Fatalf("Error truncating: %v", err)
+	}
+	f, err = openLocalBlob(h)
+	if err == nil {
+		_, err = ioutil.ReadAll(f)
+		f.Close()
+	}
+	if err == nil {
+		t.Errorf("Expected truncated blob to fail")
+	}
+}
+
+func TestPlainBlobsLookingEncrypted(t *testing.T) {
+	defer withTmpRoot(t)()
+
+	// Stored before encryption was turned on.
+	data := append([]byte(encMagic), randomContent(encHeaderLen)...)
+	h := storeTestBlob(t, data)
+
+	_, cleanup := withBlobKeys(t, hex.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	defer cleanup()
+
+	if got := readTestBlob(t, h); !bytes.Equal(got, data) {
+		t.Errorf("Expected plaintext back, got %v bytes", len(got))
+	}
+	if err := verifyObjectHash(h); err != nil {
+		t.Errorf("Error verifying plaintext blob: %v", err)
+	}
+
+	// Storing it again encrypts it, leaving just the one copy.
+	storeTestBlob(t, data)
+	if fn, err := localBlobFile(h); err != nil ||
+		fn != hashFilename(*root, h)+encSuffix {
+		t.Errorf("Expected an encrypted blob file, got %v/%v", fn, err)
+	}
+	if _, err := os.Stat(hashFilename(*root, h)); !os.IsNotExist(err) {
+		t.Errorf("Expected the plaintext copy to be gone, got %v", err)
+	}
+	if got := readTestBlob(t, h); !bytes.Equal(got, data) {
+		t.Errorf("Expected content back after encrypting, got %v bytes",
+			len(got))
+	}
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Erasure coded files are stored as k data shards and m parity shards
+// on k+m distinct nodes instead of as full replicas.  Content is
+// striped across the data shards ecBlockSize bytes at a time, so any k
+// shards can be read in lockstep to stream it back out.
+//
+// Each shard is an ordinary blob with a single owner.  The blob named
+// by the file's OID has no owners of its own, just the list of shards.
+// Shards end with a trailer naming their parent and index, so no two
+// shards (and no shard and ordinary blob) share an OID.
+
+const ecBlockSize = 64 * 1024
+
+var errNoShards = errors.New("not erasure coded")
+
+// The end of shard i of parent.
+func shardTrailer(parent string, i int) []byte {
+	return []byte("\ncbfs shard " + strconv.Itoa(i) + " of " + parent + "\n")
+}
+
+// Should fn (with the expected length l) be erasure coded?
+func erasureCoded(fn string, l int64, header http.Header) bool {
+	switch strings.ToLower(header.Get("X-CBFS-StorageClass")) {
+	case "erasure":
+		return true
+	case "replicated":
+		return false
+	}
+	if l < globalConfig.ErasureMinSize {
+		return false
+	}
+	for _, p := range strings.Split(globalConfig.ErasurePrefixes, ",") {
+		if p = strings.TrimSpace(p); p != "" && strings.HasPrefix(fn, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick the nodes to hold the shards of fn, or nil if it should be
+// replicated.  The local node comes first when it's eligible.
+func erasurePlacement(fn string, l int64, header http.Header) NodeList {
+	if l < 0 || !erasureCoded(fn, l, header) {
+		return nil
+	}
+	k, m := globalConfig.ErasureDataShards, globalConfig.ErasureParityShards
+	nl, err := findAllNodes()
+	if err != nil {
+		log.Printf("Error finding nodes to erasure code %v: %v", fn, err)
+		return nil
+	}
+	nl = nl.alive().withAtLeast(l/int64(k) + ecBlockSize)
+	if len(nl) < k+m {
+		log.Printf("Only %v nodes available for %v+%v erasure coding of %v, replicating",
+			len(nl), k, m, fn)
+		return nil
+	}
+	rv := nl.minusLocal().spreadFrom(map[string]bool{*nodeZone: true})
+	if len(rv) < len(nl) {
+		rv = append(NodeList{nl.named(serverId)}, rv...)
+	}
+	return rv[:k+m]
+}
+
+// Encodes everything written to it into shards, one hashRecord each.
+type shardWriter struct {
+	codec  *rsCodec
+	out    []*hashRecord
+	stripe []byte
+	n      int
+	blocks [][]byte
+}
+
+func newShardWriter(codec *rsCodec) (*shardWriter, error) {
+	w := &shardWriter{
+		codec:  codec,
+		stripe: make([]byte, codec.k*ecBlockSize),
+		blocks: make([][]byte, codec.k+codec.m),
+	}
+	for i := range w.blocks {
+		hr, err := NewHashRecord(*root, "")
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.out = append(w.out, hr)
+		if i >= codec.k {
+			w.blocks[i] = make([]byte, ecBlockSize)
+		}
+	}
+	return w, nil
+}
+
+func (w *shardWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		c := copy(w.stripe[w.n:], p)
+		w.n += c
+		written += c
+		p = p[c:]
+		if w.n == len(w.stripe) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *shardWriter) flush() error {
+	for i := w.n; i < len(w.stripe); i++ {
+		w.stripe[i] = 0
+	}
+	for i := 0; i < w.codec.k; i++ {
+		w.blocks[i] = w.stripe[i*ecBlockSize : (i+1)*ecBlockSize]
+	}
+	w.codec.encode(w.blocks)
+	for i, b := range w.blocks {
+		if _, err := w.out[i].Write(b); err != nil {
+			return err
+		}
+	}
+	w.n = 0
+	return nil
+}
+
+// Write out the last (padded) stripe and the trailers and return the
+// shard hashes.
+func (w *shardWriter) finish(parent string) ([]string, error) {
+	if w.n > 0 {
+		if err := w.flush(); err != nil {
+			return nil, err
+		}
+	}
+	rv := make([]string, 0, len(w.out))
+	for i, hr := range w.out {
+		if _, err := hr.Write(shardTrailer(parent, i)); err != nil {
+			return nil, err
+		}
+		h, err := hr.Finish()
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, h)
+	}
+	return rv, nil
+}
+
+func (w *shardWriter) Close() error {
+	for _, hr := range w.out {
+		hr.Close()
+	}
+	return nil
+}
+
+// Reads shards in lockstep, reconstructing any missing ones a stripe
+// at a time.
+type shardDecoder struct {
+	codec    *rsCodec
+	in       []io.Reader // nil where missing
+	bufs     [][]byte
+	blocks   [][]byte
+	dataOnly bool
+}
+
+func newShardDecoder(codec *rsCodec, in []io.Reader,
+	dataOnly bool) *shardDecoder {
+
+	d := &shardDecoder{
+		codec:    codec,
+		in:       in,
+		bufs:     make([][]byte, len(in)),
+		blocks:   make([][]byte, len(in)),
+		dataOnly: dataOnly,
+	}
+	for i, r := range in {
+		if r != nil {
+			d.bufs[i] = make([]byte, ecBlockSize)
+		}
+	}
+	return d
+}
+
+// The returned blocks are only valid until the next call.
+func (d *shardDecoder) next() ([][]byte, error) {
+	first := true
+	for i, r := range d.in {
+		d.blocks[i] = nil
+		if r == nil {
+			continue
+		}
+		_, err := io.ReadFull(r, d.bufs[i])
+		if err == io.EOF && first {
+			return nil, io.EOF
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.blocks[i] = d.bufs[i]
+		first = false
+	}
+	return d.blocks, d.codec.reconstruct(d.blocks, d.dataOnly)
+}
+
+// Presents the data shards as the original content.
+type shardReader struct {
+	d         *shardDecoder
+	buf       []byte
+	stripe    []byte
+	remaining int64
+}
+
+func (r *shardReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		blocks, err := r.d.next()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.buf = r.stripe[:0]
+		for _, b := range blocks[:r.d.codec.k] {
+			r.buf = append(r.buf, b...)
+		}
+		if int64(len(r.buf)) > r.remaining {
+			r.buf = r.buf[:r.remaining]
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func (bo BlobOwnership) codec() (*rsCodec, error) {
+	return newRSCodec(bo.DataShards, len(bo.Shards)-bo.DataShards)
+}
+
+// The length of each of bo's shards, not counting the trailer.
+func (bo BlobOwnership) shardDataLen() int64 {
+	stripe := int64(bo.DataShards * ecBlockSize)
+	return (bo.Length + stripe - 1) / stripe * ecBlockSize
+}
+
+// Open the data of a shard without caching a copy of it locally.
+func openShard(h string, l int64) (io.ReadCloser, error) {
+	if f, err := openLocalBlob(h); err == nil {
+		return &readerClosers{io.LimitReader(f, l), []io.Closer{f}}, nil
+	}
+	bo, err := getBlobOwnership(h)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openRemote(h, bo.Length, 0, bo.ResolveNodes())
+	if err != nil {
+		return nil, err
+	}
+	return &readerClosers{io.LimitReader(f, l), []io.Closer{f}}, nil
+}
+
+// Open k of bo's shards (preferring data shards and skipping those in
+// skip).  The returned slice has nil for the shards not opened.
+func openShardSet(bo BlobOwnership, k int,
+	skip map[int]bool) ([]io.ReadCloser, error) {
+
+	rv := make([]io.ReadCloser, len(bo.Shards))
+	opened := 0
+	for i, h := range bo.Shards {
+		if opened == k {
+			break
+		}
+		if skip[i] {
+			continue
+		}
+		f, err := openShard(h, bo.shardDataLen())
+		if err != nil {
+			log.Printf("Error opening shard %v of %v: %v", i, bo.OID, err)
+			continue
+		}
+		rv[i] = f
+		opened++
+	}
+	if opened < k {
+		closeShards(rv)
+		return nil, fmt.Errorf("only found %v of the %v shards needed for %v",
+			opened, k, bo.OID)
+	}
+	return rv, nil
+}
+
+func closeShards(fs []io.ReadCloser) {
+	for _, f := range fs {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func shardReaders(fs []io.ReadCloser) []io.Reader {
+	rv := make([]io.Reader, len(fs))
+	for i, f := range fs {
+		if f != nil {
+			rv[i] = f
+		}
+	}
+	return rv
+}
+
+// Read an erasure coded blob back out of its shards.
+func openShards(oid string) (io.ReadCloser, error) {
+	bo, err := getBlobOwnership(oid)
+	if err != nil || len(bo.Shards) == 0 {
+		return nil, errNoShards
+	}
+	codec, err := bo.codec()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := openShardSet(bo, codec.k, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	closers := []io.Closer{}
+	for _, f := range fs {
+		if f != nil {
+			closers = append(closers, f)
+		}
+	}
+	r := &shardReader{
+		d:         newShardDecoder(codec, shardReaders(fs), true),
+		stripe:    make([]byte, 0, codec.k*ecBlockSize),
+		remaining: bo.Length,
+	}
+	return &readerClosers{r, closers}, nil
+}
+
+// Note that h is a shard of parent before anyone records owning it.
+func markShard(h, parent string, l int64) error {
+	err := couchbase.Update("/"+h, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if len(in) > 0 {
+			if err := json.Unmarshal(in, &ownership); err != nil {
+				return nil, err
+			}
+		}
+		if ownership.ShardOf == parent {
+			return nil, cb.UpdateCancel
+		}
+		if ownership.ShardOf != "" || len(ownership.Nodes) > 0 {
+			return nil, fmt.Errorf("%v is already a blob of its own", h)
+		}
+		if ownership.Nodes == nil {
+			ownership.Nodes = map[string]time.Time{}
+		}
+		ownership.OID = h
+		ownership.Length = l
+		ownership.Type = "blob"
+		ownership.ShardOf = parent
+		return json.Marshal(ownership)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Copy a local blob to n.
+func pushBlob(n StorageNode, h string, l int64) error {
+	f, err := openLocalBlob(h)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequest("POST", n.URLBase()+blobPrefix, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = l
+	resp, err := n.ClientForTransfer(l).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return fmt.Errorf("Error pushing %v to %v: %v", h, n, resp.Status)
+	}
+	if got := resp.Header.Get("X-CBFS-Hash"); got != h {
+		return fmt.Errorf("Pushed %v to %v, but it stored %v", h, n, got)
+	}
+	return nil
+}
+
+// Put the local shard h of parent on n.
+func placeShard(h, parent string, l int64, n StorageNode) error {
+	if err := markShard(h, parent, l); err != nil {
+		return err
+	}
+	if n.IsLocal() {
+		return recordBlobOwnership(h, l, true)
+	}
+	return pushBlob(n, h, l)
+}
+
+// Remove a local blob file this node isn't registered as holding.
+func dropUnowned(h string) {
+	bo, err := getBlobOwnership(h)
+	if err == nil {
+		if _, ok := bo.Nodes[serverId]; ok {
+			return
+		}
+	}
+	removeLocalBlob(h)
+}
+
+func recordErasureBlob(oid string, l int64, shards []string, k int) error {
+	return couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+		ownership := BlobOwnership{}
+		if len(in) > 0 {
+			if err := json.Unmarshal(in, &ownership); err != nil {
+				return nil, err
+			}
+		}
+		if ownership.Nodes == nil {
+			ownership.Nodes = map[string]time.Time{}
+		}
+		ownership.OID = oid
+		ownership.Length = l
+		ownership.Type = "blob"
+		ownership.Garbage = false
+		ownership.Referenced = time.Now().UTC()
+		ownership.Shards = shards
+		ownership.DataShards = k
+		return json.Marshal(ownership)
+	})
+}
+
+// Store the content of r as fn in shards on nodes.
+func storeErasureFile(fn string, r io.Reader, nodes NodeList,
+	header http.Header) (string, error) {
+
+	codec, err := newRSCodec(globalConfig.ErasureDataShards,
+		globalConfig.ErasureParityShards)
+	if err != nil {
+		return "", err
+	}
+	w, err := newShardWriter(codec)
+	if err != nil {
+		log.Printf("Error writing tmp file: %v", err)
+		return "", errors.New("Error writing tmp file")
+	}
+	defer w.Close()
+
+	sh := getHash()
+	length, err := io.Copy(w, io.TeeReader(r, sh))
+	if err != nil {
+		log.Printf("Error reading %v: %v", fn, err)
+		return "", fmt.Errorf("Error completing blob write: %v", err)
+	}
+	oid := hex.EncodeToString(sh.Sum(nil))
+	if hin := header.Get("X-CBFS-Hash"); hin != "" && hin != oid {
+		return "", fmt.Errorf("Invalid hash %v != %v", hin, oid)
+	}
+
+	shards, err := w.finish(oid)
+	if err != nil {
+		log.Printf("Error completing shards of %v: %v", fn, err)
+		return "", fmt.Errorf("Error completing blob write: %v", err)
+	}
+	for _, h := range shards {
+		defer dropUnowned(h)
+	}
+
+	dataLen := BlobOwnership{Length: length, DataShards: codec.k}.shardDataLen()
+	for i, h := range shards {
+		l := dataLen + int64(len(shardTrailer(oid, i)))
+		if err := placeShard(h, oid, l, nodes[i]); err != nil {
+			log.Printf("Error placing shard %v of %v on %v: %v",
+				i, fn, nodes[i], err)
+			return "", fmt.Errorf("Error storing shard: %v", err)
+		}
+	}
+
+	if err := recordErasureBlob(oid, length, shards, codec.k); err != nil {
+		log.Printf("Error recording shards of %v for %v: %v", oid, fn, err)
+		return "", fmt.Errorf("Error recording blob ownership: %v", err)
+	}
+
+	fm := fileMeta{
+		Headers:  filterHeaders(header, isFileHeader),
+		OID:      oid,
+		Length:   length,
+		Modified: time.Now().UTC(),
+	}
+	if err := storeUserMeta(fn, fm, header); err != nil {
+		return "", err
+	}
+
+	log.Printf("Stored %v in %v+%v shards", fn, codec.k, codec.m)
+	return oid, nil
+}
+
+// Rebuild the missing shards of bo here and place them on nodes.
+func rebuildShards(bo BlobOwnership, missing []int, nodes NodeList) error {
+	codec, err := bo.codec()
+	if err != nil {
+		return err
+	}
+	if len(missing) > len(nodes) {
+		log.Printf("Only %v nodes to hold %v missing shards of %v",
+			len(nodes), len(missing), bo.OID)
+		missing = missing[:len(nodes)]
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	skip := map[int]bool{}
+	out := map[int]*hashRecord{}
+	for _, i := range missing {
+		skip[i] = true
+		hr, err := NewHashRecord(*root, bo.Shards[i])
+		if err != nil {
+			return err
+		}
+		defer hr.Close()
+		out[i] = hr
+	}
+
+	fs, err := openShardSet(bo, codec.k, skip)
+	if err != nil {
+		return err
+	}
+	defer closeShards(fs)
+
+	d := newShardDecoder(codec, shardReaders(fs), false)
+	for {
+		blocks, err := d.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for i, hr := range out {
+			if _, err := hr.Write(blocks[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for j, i := range missing {
+		h := bo.Shards[i]
+		if _, err := out[i].Write(shardTrailer(bo.OID, i)); err != nil {
+			return err
+		}
+		if _, err := out[i].Finish(); err != nil {
+			return err
+		}
+		l := bo.shardDataLen() + int64(len(shardTrailer(bo.OID, i)))
+		err := placeShard(h, bo.OID, l, nodes[j])
+		dropUnowned(h)
+		if err != nil {
+			return err
+		}
+		log.Printf("Rebuilt shard %v of %v on %v", i, bo.OID, nodes[j])
+	}
+	return nil
+}
+
+// Rebuild shards of erasure coded blobs that no live node holds.
+func repairShards() error {
+	nl, err := findAllNodes()
+	if err != nil {
+		return err
+	}
+	live := map[string]StorageNode{}
+	for _, n := range nl.alive() {
+		live[n.name] = n
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key string
+		}
+		Errors []cb.ViewError
+	}{}
+
+	startKey := ""
+	done := false
+	for !done {
+		params := map[string]interface{}{
+			"reduce": false,
+			"limit":  globalConfig.ReplicationCheckLimit,
+			"stale":  false,
+		}
+		if startKey != "" {
+			params["startkey"] = startKey
+		}
+		err := couchbase.View("ec_blobs", params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+		done = len(viewRes.Rows) < globalConfig.ReplicationCheckLimit
+
+		oids := []string{}
+		for _, r := range viewRes.Rows {
+			// The start key was the end of the last batch.
+			if r.Key != startKey {
+				oids = append(oids, r.Key)
+			}
+		}
+		if len(viewRes.Rows) > 0 {
+			startKey = viewRes.Rows[len(viewRes.Rows)-1].Key
+		}
+		if err := repairShardsOf(oids, live); err != nil {
+			return err
+		}
+
+		if !relockTask("repairShards") {
+			log.Printf("We lost the lock for repairing shards.")
+			return errors.New("Lost lock")
+		}
+	}
+	return nil
+}
+
+func repairShardsOf(oids []string, live map[string]StorageNode) error {
+	parents, err := getBlobs(oids)
+	if err != nil {
+		return err
+	}
+	shardOids := []string{}
+	for _, bo := range parents {
+		shardOids = append(shardOids, bo.Shards...)
+	}
+	shards, err := getBlobs(shardOids)
+	if err != nil {
+		return err
+	}
+
+	for _, bo := range parents {
+		missing := []int{}
+		holders := NodeList{}
+		shardLen := int64(0)
+		for i, h := range bo.Shards {
+			held := false
+			for n := range shards[h].Nodes {
+				if sn, ok := live[n]; ok {
+					held = true
+					holders = append(holders, sn)
+				}
+			}
+			if held {
+				shardLen = shards[h].Length
+			} else {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if len(bo.Shards)-len(missing) < bo.DataShards {
+			log.Printf("Erasure coded blob %v is missing %v of %v shards, can't repair",
+				bo.OID, len(missing), len(bo.Shards))
+			continue
+		}
+
+		candidates := NodeList{}
+		for _, n := range live {
+			candidates = append(candidates, n)
+		}
+		candidates = candidates.minus(holders).withAtLeast(shardLen).
+			spreadFrom(holders.zones())
+		log.Printf("Rebuilding %v missing shards of %v", len(missing), bo.OID)
+		if err := rebuildShards(bo, missing, candidates); err != nil {
+			log.Printf("Error rebuilding shards of %v: %v", bo.OID, err)
+		}
+	}
+	return nil
+}
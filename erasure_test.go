@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestErasureCoded(t *testing.T) {
+	defer func(c cbfsconfig.CBFSConfig) { *globalConfig = c }(*globalConfig)
+	globalConfig.ErasurePrefixes = "cold/, archive/"
+	globalConfig.ErasureMinSize = 1024
+
+	tests := []struct {
+		fn     string
+		l      int64
+		header string
+		exp    bool
+	}{
+		{"cold/x", 2048, "", true},
+		{"archive/x", 2048, "", true},
+		{"cold/x", 10, "", false},
+		{"hot/x", 2048, "", false},
+		{"hot/x", 10, "erasure", true},
+		{"cold/x", 2048, "replicated", false},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		if test.header != "" {
+			h.Set("X-CBFS-StorageClass", test.header)
+		}
+		if got := erasureCoded(test.fn, test.l, h); got != test.exp {
+			t.Errorf("Expected %v for %v (%v bytes, %q), got %v",
+				test.exp, test.fn, test.l, test.header, got)
+		}
+	}
+}
+
+func TestErasureFile(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer func(c cbfsconfig.CBFSConfig) { *globalConfig = c }(*globalConfig)
+	globalConfig.ErasureDataShards = 3
+	globalConfig.ErasureParityShards = 2
+
+	// Everything lands locally, which is enough to exercise the
+	// coding.
+	me := StorageNode{name: serverId}
+	nodes := NodeList{me, me, me, me, me}
+
+	data := randomContent(5*ecBlockSize + 123)
+	oid, err := storeErasureFile("cold/x", bytes.NewReader(data), nodes,
+		http.Header{})
+	if err != nil {
+		t.Fatalf("Error storing file: %v", err)
+	}
+
+	bo, err := getBlobOwnership(oid)
+	if err != nil {
+		t.Fatalf("Error getting ownership: %v", err)
+	}
+	if len(bo.Shards) != 5 || bo.DataShards != 3 || len(bo.Nodes) != 0 {
+		t.Fatalf("Expected 3+2 shards and no owners, got %+v", bo)
+	}
+	if hasBlob(oid) {
+		t.Errorf("Expected no full copy of %v", oid)
+	}
+
+	read := func() []byte {
+		f, err := openBlob(oid, false)
+		if err != nil {
+			t.Fatalf("Error opening %v: %v", oid, err)
+		}
+		defer f.Close()
+		got, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", oid, err)
+		}
+		return got
+	}
+	if got := read(); !bytes.Equal(got, data) {
+		t.Fatalf("Expected %v bytes back, got %v", len(data), len(got))
+	}
+
+	// Lose two shards, one of them data.
+	for _, i := range []int{1, 4} {
+		if err := forceRemoveObject(bo.Shards[i]); err != nil {
+			t.Fatalf("Error removing shard %v: %v", i, err)
+		}
+	}
+	if got := read(); !bytes.Equal(got, data) {
+		t.Fatalf("Expected %v bytes back after losing shards, got %v",
+			len(data), len(got))
+	}
+
+	if err := rebuildShards(bo, []int{1, 4}, NodeList{me, me}); err != nil {
+		t.Fatalf("Error rebuilding shards: %v", err)
+	}
+	for _, i := range []int{1, 4} {
+		if err := verifyObjectHash(bo.Shards[i]); err != nil {
+			t.Errorf("Error verifying rebuilt shard %v: %v", i, err)
+		}
+		sb, err := getBlobOwnership(bo.Shards[i])
+		if err != nil || sb.ShardOf != oid || len(sb.Nodes) != 1 {
+			t.Errorf("Expected rebuilt shard %v to be owned, got %+v/%v",
+				i, sb, err)
+		}
+	}
+
+	// Losing too many is an error, not short content.
+	for _, i := range []int{0, 1, 2} {
+		os.Remove(hashFilename(*root, bo.Shards[i]))
+	}
+	if _, err := openBlob(oid, false); err == nil {
+		t.Errorf("Expected failure with three shards lost")
+	}
+}
+
+func TestShardOIDs(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer func(c cbfsconfig.CBFSConfig) { *globalConfig = c }(*globalConfig)
+	globalConfig.ErasureDataShards = 2
+	globalConfig.ErasureParityShards = 1
+
+	// An ordinary blob with the content of every stripe of the file.
+	zeros := make([]byte, ecBlockSize)
+	h := storeTestBlob(t, zeros)
+	if err := recordBlobOwnership(h, int64(len(zeros)), true); err != nil {
+		t.Fatalf("Error recording %v: %v", h, err)
+	}
+
+	me := StorageNode{name: serverId}
+	data := make([]byte, 4*ecBlockSize)
+	oid, err := storeErasureFile("cold/zeros", bytes.NewReader(data),
+		NodeList{me, me, me}, http.Header{})
+	if err != nil {
+		t.Fatalf("Error storing file: %v", err)
+	}
+	bo, err := getBlobOwnership(oid)
+	if err != nil {
+		t.Fatalf("Error getting ownership: %v", err)
+	}
+	seen := map[string]bool{h: true}
+	for i, s := range bo.Shards {
+		if seen[s] {
+			t.Errorf("Shard %v of %v reuses OID %v", i, oid, s)
+		}
+		seen[s] = true
+	}
+
+	if b, err := getBlobOwnership(h); err != nil || b.ShardOf != "" {
+		t.Errorf("Expected %v to stay an ordinary blob, got %+v/%v", h, b, err)
+	}
+	if err := markShard(h, oid, int64(len(zeros))); err == nil {
+		t.Errorf("Expected marking an owned blob as a shard to fail")
+	}
+}
@@ -16,7 +16,7 @@ func doExport(w http.ResponseWriter, req *http.Request,
 	go pathGenerator(path, ch, cherr, quit)
 	go logErrors("export", cherr)
 
-	err := streamFileMeta(w, ch, cherr)
+	err := streamFileMeta(w, ch, cherr, nil)
 	if err != nil {
 		log.Printf("Error exporting meta: %v", err)
 	}
@@ -21,19 +21,107 @@ func hashFilename(base, hstr string) string {
 	return base + pathBelowBase
 }
 
+// Blob files are named for their hash, plus a suffix saying how the
+// content was transformed on its way to disk, so how to read one
+// never depends on what's in it.
+const (
+	encSuffix = ".enc"
+	gzSuffix  = ".gz"
+)
+
+// Longest first.
+var blobSuffixes = []string{gzSuffix + encSuffix, encSuffix, gzSuffix, ""}
+
+// The hash a file under the root is named for, if it's a blob.
+func blobOID(name string) (string, bool) {
+	if strings.HasPrefix(name, "tmp") {
+		return "", false
+	}
+	for _, s := range blobSuffixes {
+		if strings.HasSuffix(name, s) {
+			name = name[:len(name)-len(s)]
+			break
+		}
+	}
+	return name, len(name) == getHash().Size()*2
+}
+
+// The local file holding a blob, however it's stored.
+func localBlobFile(h string) (string, error) {
+	fn := hashFilename(*root, h)
+	var err error
+	for _, s := range blobSuffixes {
+		if _, err = os.Stat(fn + s); err == nil {
+			return fn + s, nil
+		}
+	}
+	return "", err
+}
+
+// Remove every local file of a blob.
+func removeLocalBlob(h string) error {
+	fn := hashFilename(*root, h)
+	var err error
+	removed := false
+	for _, s := range blobSuffixes {
+		if e := os.Remove(fn + s); e == nil {
+			removed = true
+		} else if !os.IsNotExist(e) || err == nil {
+			err = e
+		}
+	}
+	if removed && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 type ReadSeekCloser interface {
 	io.ReadSeeker
 	io.Closer
 }
 
 func openLocalBlob(hstr string) (ReadSeekCloser, error) {
-	return os.Open(hashFilename(*root, hstr))
+	fn, err := localBlobFile(hstr)
+	if err != nil {
+		return nil, err
+	}
+	return openBlobFile(fn)
+}
+
+func openBlobFile(fn string) (ReadSeekCloser, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	var r ReadSeekCloser = f
+	if strings.HasSuffix(fn, encSuffix) {
+		if r, err = decryptBlob(f); err != nil {
+			return nil, err
+		}
+		fn = strings.TrimSuffix(fn, encSuffix)
+	}
+	if strings.HasSuffix(fn, gzSuffix) {
+		return decompressBlob(r)
+	}
+	return r, nil
+}
+
+// The length of a local blob's content, which isn't the size of its
+// file if it's encrypted or compressed.
+func blobContentSize(info os.FileInfo) int64 {
+	size, err := localBlobSize(hashFilename(*root, info.Name()))
+	if err != nil {
+		log.Printf("Error finding size of %v: %v", info.Name(), err)
+		return info.Size()
+	}
+	return size
 }
 
 func removeObject(h string) error {
 	err := maybeRemoveBlobOwnership(h)
 	if err == nil {
-		err = os.Remove(hashFilename(*root, h))
+		err = removeLocalBlob(h)
 		log.Printf("Removed local copy of %v, result=%v",
 			h, errorOrSuccess(err))
 	}
@@ -42,7 +130,7 @@ func removeObject(h string) error {
 
 func forceRemoveObject(h string) error {
 	removeBlobOwnershipRecord(h, serverId)
-	return os.Remove(hashFilename(*root, h))
+	return removeLocalBlob(h)
 }
 
 func verifyObjectHash(h string) error {
@@ -84,20 +172,21 @@ func verifyWorker(ch chan os.FileInfo) {
 		nl = NodeList{}
 	}
 	for info := range ch {
+		h, _ := blobOID(info.Name())
 		var err error
 		force := false
-		if shouldVerifyObject(info.Name()) {
-			err = verifyObjectHash(info.Name())
+		if shouldVerifyObject(h) {
+			err = verifyObjectHash(h)
 			force = true
 		}
 		if err == nil {
-			recordBlobOwnership(info.Name(), info.Size(), force)
+			recordBlobOwnership(h, blobContentSize(info), force)
 		} else {
 			log.Printf("Invalid hash for object %v found at verification: %v",
-				info.Name(), err)
-			removeBlobOwnershipRecord(info.Name(), serverId)
+				h, err)
+			removeBlobOwnershipRecord(h, serverId)
 			if len(nl) > 0 {
-				salvageBlob(info.Name(), "", 1, nl)
+				salvageBlob(h, "", 1, nl)
 			}
 		}
 	}
@@ -105,13 +194,12 @@ func verifyWorker(ch chan os.FileInfo) {
 
 func quickVerifyWorker(ch chan os.FileInfo) {
 	for info := range ch {
-		recordBlobOwnership(info.Name(), info.Size(), false)
+		h, _ := blobOID(info.Name())
+		recordBlobOwnership(h, blobContentSize(info), false)
 	}
 }
 
 func reconcileWith(wf func(chan os.FileInfo)) error {
-	explen := getHash().Size() * 2
-
 	vch := make(chan os.FileInfo)
 	defer close(vch)
 
@@ -123,9 +211,7 @@ func reconcileWith(wf func(chan os.FileInfo)) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && !strings.HasPrefix(info.Name(), "tmp") &&
-			len(info.Name()) == explen {
-
+		if _, ok := blobOID(info.Name()); ok && !info.IsDir() {
 			vch <- info
 
 			return err
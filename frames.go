@@ -28,6 +28,7 @@ var framesBind = flag.String("frameBind", ":8423",
 type frameClient struct {
 	conn         frames.ChannelDialer
 	client       *http.Client
+	raw          *http.Client // without the signing transport
 	checker      *time.Timer
 	prevInfo     frames.Info
 	lastActivity time.Time
@@ -62,7 +63,7 @@ func destroyFrameClient(addr string) {
 		return
 	}
 	fc.checker.Stop()
-	err := framesweb.CloseFramesClient(fc.client)
+	err := framesweb.CloseFramesClient(fc.raw)
 	if err != nil {
 		log.Printf("Error closing %v frame client: %v", addr, err)
 	}
@@ -142,7 +143,8 @@ func connectNewFramesClient(addr string) *frameClient {
 
 	fwc := &frameClient{
 		conn:   conn,
-		client: hc,
+		client: &http.Client{Transport: clusterTransport{frt}},
+		raw:    hc,
 		checker: time.AfterFunc(frameCheckFreq, func() {
 			checkFrameClient(addr)
 		}),
@@ -164,7 +166,7 @@ func getFrameClient(addr string) *http.Client {
 }
 
 func serveFrame() {
-	if *framesBind == "" {
+	if *framesBind == "" || tlsEnabled() {
 		return
 	}
 
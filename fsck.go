@@ -51,17 +51,17 @@ func dofsck(w http.ResponseWriter, req *http.Request,
 
 	e := json.NewEncoder(w)
 	type status struct {
-		Path  string `json:"path"`
-		OID   string `json:"oid,omitempty"`
-		Reps  int    `json:"reps,omitempty"`
-		EType string `json:"etype,omitempty"`
-		Error string `json:"error,omitempty"`
+		Path   string `json:"path"`
+		OID    string `json:"oid,omitempty"`
+		Reps   int    `json:"reps,omitempty"`
+		Shards int    `json:"shards,omitempty"`
+		EType  string `json:"etype,omitempty"`
+		Error  string `json:"error,omitempty"`
 	}
 
 	for nfc := range keyClumper(ch, 1000) {
 		keys := []string{}
 		fnmap := map[string][]string{}
-		unprocessed := map[string]string{}
 
 		for _, nf := range nfc {
 			if nf.err != nil {
@@ -75,19 +75,13 @@ func dofsck(w http.ResponseWriter, req *http.Request,
 					return
 				}
 			}
-			keys = append(keys, "/"+nf.meta.OID)
-			unprocessed[nf.name] = nf.meta.OID
-
-			a, ok := fnmap[nf.meta.OID]
-			if ok {
-				a = append(a, nf.name)
-			} else {
-				a = []string{nf.name}
+			for _, oid := range nf.meta.blobs() {
+				keys = append(keys, "/"+oid)
+				fnmap[oid] = append(fnmap[oid], nf.name)
 			}
-			fnmap[nf.meta.OID] = a
 		}
 
-		bres, _, err := couchbase.GetBulk(keys)
+		bres, err := couchbase.GetBulk(keys)
 		if err != nil {
 			log.Printf("Error getting bulk keys: %v", err)
 			return
@@ -95,12 +89,9 @@ func dofsck(w http.ResponseWriter, req *http.Request,
 
 		for k, v := range bres {
 			names := fnmap[k[1:]]
-			for _, name := range names {
-				delete(unprocessed, name)
-			}
 
 			ownership := BlobOwnership{}
-			err := json.Unmarshal(v.Body, &ownership)
+			err := json.Unmarshal(v, &ownership)
 			if err != nil {
 				for _, name := range names {
 					if err = e.Encode(status{
@@ -118,9 +109,10 @@ func dofsck(w http.ResponseWriter, req *http.Request,
 			if !errsOnly {
 				for _, name := range names {
 					if err := e.Encode(status{
-						Path: name,
-						OID:  k[1:],
-						Reps: len(ownership.Nodes),
+						Path:   name,
+						OID:    k[1:],
+						Reps:   len(ownership.Nodes),
+						Shards: len(ownership.Shards),
 					}); err != nil {
 						log.Printf("Error encoding: %v", err)
 						return
@@ -129,21 +121,26 @@ func dofsck(w http.ResponseWriter, req *http.Request,
 			}
 		}
 
-		for k, v := range unprocessed {
+		for oid, names := range fnmap {
+			if _, ok := bres["/"+oid]; ok {
+				continue
+			}
 			// If we didn't get it in the first pass, try harder.
-			_, err := getBlobOwnership(v)
+			_, err := getBlobOwnership(oid)
 			if err == nil {
-				log.Printf("Got %v on the second try", v)
+				log.Printf("Got %v on the second try", oid)
 				continue
 			}
-			if err := e.Encode(status{
-				Path:  k,
-				OID:   v,
-				EType: "blob",
-				Error: "not found",
-			}); err != nil {
-				log.Printf("Error encoding: %v", err)
-				return
+			for _, name := range names {
+				if err := e.Encode(status{
+					Path:  name,
+					OID:   oid,
+					EType: "blob",
+					Error: "not found",
+				}); err != nil {
+					log.Printf("Error encoding: %v", err)
+					return
+				}
 			}
 		}
 	}
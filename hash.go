@@ -47,6 +47,8 @@ type hashRecord struct {
 	tmpf    *os.File
 	sh      hash.Hash
 	w       io.Writer
+	enc     io.Closer
+	comp    *compressingWriter
 	hashin  string
 	base    string
 	written int64
@@ -60,13 +62,33 @@ func NewHashRecord(tmpdir, hashin string) (*hashRecord, error) {
 
 	sh := getHash()
 
-	return &hashRecord{
+	rv := &hashRecord{
 		tmpf:   tmpf,
 		sh:     sh,
 		w:      io.MultiWriter(tmpf, sh),
 		hashin: hashin,
 		base:   *root,
-	}, nil
+	}
+
+	if blobKeys != nil {
+		ew, err := newEncryptingWriter(tmpf)
+		if err != nil {
+			rv.Close()
+			return nil, err
+		}
+		rv.w, rv.enc = io.MultiWriter(ew, sh), ew
+	}
+
+	if *blobCodec != "" {
+		var under io.Writer = tmpf
+		if ew, ok := rv.enc.(io.Writer); ok {
+			under = ew
+		}
+		cw := newCompressingWriter(under)
+		rv.w, rv.comp = io.MultiWriter(cw, sh), cw
+	}
+
+	return rv, nil
 }
 
 func (h *hashRecord) Write(p []byte) (n int, err error) {
@@ -78,13 +100,23 @@ func (h *hashRecord) Write(p []byte) (n int, err error) {
 }
 
 func (h *hashRecord) Finish() (string, error) {
+	if h.comp != nil {
+		if err := h.comp.Close(); err != nil {
+			return "", err
+		}
+	}
+	if h.enc != nil {
+		if err := h.enc.Close(); err != nil {
+			return "", err
+		}
+	}
 	err := h.tmpf.Close()
 	if err != nil {
 		return "", err
 	}
 
 	hs := hex.EncodeToString(h.sh.Sum([]byte{}))
-	fn := hashFilename(h.base, hs)
+	fn := hashFilename(h.base, hs) + h.suffix()
 
 	if h.hashin != "" && h.hashin != hs {
 		return "", fmt.Errorf("Invalid hash %v != %v",
@@ -106,9 +138,28 @@ func (h *hashRecord) Finish() (string, error) {
 
 	h.tmpf = nil
 
+	// Don't leave the blob behind stored some other way.
+	for _, s := range blobSuffixes {
+		if other := hashFilename(h.base, hs) + s; other != fn {
+			os.Remove(other)
+		}
+	}
+
 	return hs, nil
 }
 
+// The blob file suffix for how this was written.
+func (h *hashRecord) suffix() string {
+	s := ""
+	if h.comp != nil && h.comp.compressed() {
+		s = gzSuffix
+	}
+	if h.enc != nil {
+		s += encSuffix
+	}
+	return s
+}
+
 func (h *hashRecord) Process(r io.Reader) (string, int64, error) {
 	length, err := io.Copy(h, r)
 	if err != nil {
@@ -47,7 +47,7 @@ func updateSpaceUsed() error {
 		}
 	}{}
 
-	err := couchbase.ViewCustom("cbfs", "node_size",
+	err := couchbase.View("node_size",
 		map[string]interface{}{
 			"group_level": 1,
 			"key":         serverId,
@@ -92,16 +92,23 @@ func oneHeartbeat(startTime time.Time) {
 		c.Close()
 	}
 
+	frameBind := *framesBind
+	if tlsEnabled() {
+		frameBind = ""
+	}
+
 	aboutMe := StorageNode{
 		Addr:      localAddr,
 		Type:      "node",
 		Started:   startTime,
 		Time:      time.Now().UTC(),
 		BindAddr:  *bindAddr,
-		FrameBind: *framesBind,
+		FrameBind: frameBind,
 		Used:      spaceUsed,
 		Free:      availableSpace(),
 		Version:   VERSION,
+		Scheme:    nodeScheme(),
+		Zone:      *nodeZone,
 	}
 
 	err = couchbase.Set("/"+serverId, 0, aboutMe)
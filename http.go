@@ -8,13 +8,14 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/couchbase/gomemcached"
 )
 
 const (
@@ -39,8 +40,21 @@ const (
 	restorePrefix    = "/.cbfs/backup/restore/"
 	backupStrmPrefix = "/.cbfs/backup/stream/"
 	backupPrefix     = "/.cbfs/backup/"
+	archivePath      = "/.cbfs/backup/archive/"
+	archiveRestPath  = "/.cbfs/backup/archive/restore/"
 	quitPrefix       = "/.cbfs/exit/"
 	debugPrefix      = "/.cbfs/debug/"
+	uploadPrefix     = "/.cbfs/upload/"
+	changesPrefix    = "/.cbfs/changes/"
+	renamePrefix     = "/.cbfs/rename/"
+	trashPrefix      = "/.cbfs/trash/"
+	untrashPrefix    = "/.cbfs/trash/restore/"
+	policyPath       = "/.cbfs/retention/"
+	retentionPrefix  = "/.cbfs/retention/file/"
+	auditPath        = "/.cbfs/retention/audit/"
+	quotaPrefix      = "/.cbfs/quota/"
+	queuePrefix      = "/.cbfs/queue/"
+	replicationPath  = "/.cbfs/replication/"
 )
 
 type storInfo struct {
@@ -66,73 +80,87 @@ func sendJson(w http.ResponseWriter, req *http.Request, ob interface{}) {
 }
 
 // Given a Reader, we produce a new reader that will duplicate the
-// stream into the next available node and reproduce that content into
-// another node.  Iff that node successfully stores the content, we
-// return the hash it computed.
+// stream into up to copies other nodes as it's read.  Each node that
+// successfully stores the content reports the hash it computed.
 //
 // The returned Reader must be consumed until the input EOFs or is
-// closed.  The returned channel may yield a storInfo struct before
-// it's closed.  If it's closed without yielding a storInfo, there are
-// no remote nodes available.
+// closed.  The returned channel yields a storInfo struct for each node
+// the content was sent to before it's closed.  If it's closed without
+// yielding any, there are no remote nodes available.
 func altStoreFile(name string, r io.Reader,
-	length int64) (io.Reader, <-chan storInfo) {
+	length int64, copies int) (io.Reader, <-chan storInfo) {
 
-	bgch := make(chan storInfo, 2)
-	if length == -1 {
+	if length == -1 || copies < 1 {
 		// No alt store requested
+		bgch := make(chan storInfo)
 		close(bgch)
 		return r, bgch
 	}
 
 	nodes, err := findRemoteNodes()
-	nodes = nodes.withAtLeast(length)
-	if err == nil && len(nodes) > 0 {
+	nodes = nodes.withAtLeast(length).
+		spreadFrom(map[string]bool{*nodeZone: true})
+	if len(nodes) > copies {
+		nodes = nodes[:copies]
+	}
+	bgch := make(chan storInfo, len(nodes))
+	if err != nil || len(nodes) == 0 {
+		log.Printf("Doing a single-node upload: findRemote=%v, status=%v",
+			nodes, errorOrSuccess(err))
+		close(bgch)
+		return r, bgch
+	}
+
+	wg := sync.WaitGroup{}
+	for _, node := range nodes {
+		// Each node reads the stream and passes it on to the
+		// next, the last one to us.
 		r1, r2 := newMultiReader(r)
 		r = r2
 
-		go func() {
-			defer close(bgch)
+		wg.Add(1)
+		go func(node StorageNode) {
+			defer wg.Done()
+			bgch <- pipeToNode(name, node, r1)
+		}(node)
+	}
+	go func() {
+		wg.Wait()
+		close(bgch)
+	}()
 
-			rv := storInfo{node: nodes[0].Address()}
+	return r, bgch
+}
 
-			rurl := "http://" + nodes[0].Address() + blobPrefix
-			log.Printf("Piping secondary storage of %v to %v",
-				name, nodes[0])
+func pipeToNode(name string, node StorageNode, r ErrorCloser) storInfo {
+	rv := storInfo{node: node.Address()}
 
-			preq, err := http.NewRequest("POST", rurl, r1)
-			if err != nil {
-				r1.CloseWithError(err)
-				rv.err = err
-				bgch <- rv
-				return
-			}
+	rurl := node.URLBase() + blobPrefix
+	log.Printf("Piping secondary storage of %v to %v", name, node)
 
-			presp, err := nodes[0].Client().Do(preq)
-			if err == nil {
-				if presp.StatusCode != 201 {
-					rv.err = errors.New(presp.Status)
-					r1.CloseWithError(rv.err)
-					bgch <- rv
-				}
-				_, err := io.Copy(ioutil.Discard, presp.Body)
-				if err == nil {
-					rv.hs = presp.Header.Get("X-CBFS-Hash")
-				}
-				presp.Body.Close()
-			} else {
-				log.Printf("Error http'n %v to %v: %v", name,
-					rurl, err)
-			}
-			rv.err = err
-			bgch <- rv
-		}()
-	} else {
-		log.Printf("Doing a single-node upload: findRemote=%v, status=%v",
-			nodes, errorOrSuccess(err))
-		close(bgch)
+	preq, err := http.NewRequest("POST", rurl, r)
+	if err != nil {
+		r.CloseWithError(err)
+		rv.err = err
+		return rv
 	}
 
-	return r, bgch
+	presp, err := node.Client().Do(preq)
+	if err != nil {
+		log.Printf("Error http'n %v to %v: %v", name, rurl, err)
+		rv.err = err
+		return rv
+	}
+	defer presp.Body.Close()
+	if presp.StatusCode != 201 {
+		rv.err = errors.New(presp.Status)
+		r.CloseWithError(rv.err)
+		return rv
+	}
+	if _, rv.err = io.Copy(ioutil.Discard, presp.Body); rv.err == nil {
+		rv.hs = presp.Header.Get("X-CBFS-Hash")
+	}
+	return rv
 }
 
 func doPostRawBlob(w http.ResponseWriter, req *http.Request) {
@@ -174,14 +202,6 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 
 	fn, _ := resolvePath(req)
 
-	f, err := NewHashRecord(*root, req.Header.Get("X-CBFS-Hash"))
-	if err != nil {
-		log.Printf("Error writing tmp file: %v", err)
-		http.Error(w, "Error writing tmp file", 500)
-		return
-	}
-	defer f.Close()
-
 	l := req.ContentLength
 	if l < 1 {
 		// If we don't know, guess about a meg.
@@ -190,62 +210,224 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 	if t, _ := strconv.ParseBool(req.Header.Get("X-CBFS-Unsafe")); t {
 		l = -1
 	}
-	r, bgch := altStoreFile(fn, req.Body, l)
 
-	h, length, err := f.Process(r)
+	if err := validRetentionHeaders(req.Header); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, err := writeQuorum(req.Header); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := checkQuota(fn, req.ContentLength); isOverQuota(err) {
+		http.Error(w, err.Error(), 507)
+		return
+	} else if err != nil {
+		log.Printf("Error checking quota for %v: %v", fn, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// Don't bother storing a blob we can't use.  (storeMeta audits
+	// any override.)
+	if err := checkFileRetention("update", fn, nil); err != nil &&
+		retentionOverride(req.Header) == "" {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	h, err := storeUserFile(fn, req.Body, l, req.Header)
+	if err == errUploadPrecondition {
+		http.Error(w, "precondition failed", 412)
+		return
+	}
+	if isRetained(err) {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	if isOverQuota(err) {
+		http.Error(w, err.Error(), 507)
+		return
+	}
+	if isWriteQuorum(err) {
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	if err == errUnsafeQuorum {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	if err != nil {
-		log.Printf("Error completing blob write for %v: %v",
-			req.URL.Path, err)
-		http.Error(w, fmt.Sprintf("Error completing blob write: %v", err), 500)
+		http.Error(w, err.Error(), 500)
 		return
 	}
 
+	w.Header().Set("Etag", `"`+h+`"`)
+	w.WriteHeader(201)
+}
+
+// Store the content of r as the file fn (with sync copies on other
+// nodes unless l is -1) and return its hash.  The header supplies the
+// file's headers as well as any preconditions, expiration, revision
+// count and write quorum.
+func storeUserFile(fn string, r io.Reader, l int64,
+	header http.Header) (string, error) {
+
+	quorum, err := writeQuorum(header)
+	if err != nil {
+		return "", err
+	}
+	if l == -1 {
+		if header.Get("X-CBFS-Quorum") != "" && quorum > 1 {
+			return "", errUnsafeQuorum
+		}
+		quorum = 1
+	}
+
+	if chunkedUpload(header) {
+		return storeChunkedFile(fn, r, quorum, header)
+	}
+	if nodes := erasurePlacement(fn, l, header); nodes != nil {
+		return storeErasureFile(fn, r, nodes, header)
+	}
+
+	f, err := NewHashRecord(*root, header.Get("X-CBFS-Hash"))
+	if err != nil {
+		log.Printf("Error writing tmp file: %v", err)
+		return "", errors.New("Error writing tmp file")
+	}
+	defer f.Close()
+
+	r, bgch := altStoreFile(fn, r, l, remoteCopies(quorum))
+
+	h, length, err := f.Process(r)
+	if err != nil {
+		log.Printf("Error completing blob write for %v: %v", fn, err)
+		return "", fmt.Errorf("Error completing blob write: %v", err)
+	}
+
 	err = recordBlobOwnership(h, length, true)
 	if err != nil {
 		log.Printf("Error storing blob ownership of %v for %v: %v",
-			h, req.URL.Path, err)
-		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
-			500)
-		return
+			h, fn, err)
+		return "", fmt.Errorf("Error recording blob ownership: %v", err)
+	}
+
+	replicas, err := awaitReplicas(fn, h, length, bgch, quorum)
+	if err != nil {
+		return "", err
 	}
 
 	fm := fileMeta{
-		Headers:  req.Header,
+		Headers:  filterHeaders(header, isFileHeader),
 		OID:      h,
 		Length:   length,
 		Modified: time.Now().UTC(),
 	}
 
-	// We *should* have two replicas at this point.
-	replicas := 2
-	if si, hasStuff := <-bgch; hasStuff {
+	if err := storeUserMeta(fn, fm, header); err != nil {
+		return "", err
+	}
+
+	if globalConfig.MinReplicas > replicas {
+		// We're below min replica count.  Start fixing that
+		// up immediately.
+		inBackground(func() {
+			increaseReplicaCount(h, length,
+				globalConfig.MinReplicas-replicas)
+		})
+	}
+
+	return h, nil
+}
+
+// A write quorum of 0 means one other copy if there's a node for it,
+// otherwise it's how many copies, including ours, an upload needs.
+func writeQuorum(header http.Header) (int, error) {
+	s := header.Get("X-CBFS-Quorum")
+	if s == "" {
+		return globalConfig.WriteQuorum, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid X-CBFS-Quorum: %q", s)
+	}
+	return n, nil
+}
+
+// How many other nodes to send a quorum's worth of copies to.
+func remoteCopies(quorum int) int {
+	if quorum == 0 {
+		return 1
+	}
+	return quorum - 1
+}
+
+var errUnsafeQuorum = errors.New("X-CBFS-Quorum above 1 can't be met with X-CBFS-Unsafe")
+
+type errWriteQuorum struct {
+	have, want int
+	err        error
+}
+
+func (e errWriteQuorum) Error() string {
+	return fmt.Sprintf("Stored %v of %v required copies: %v",
+		e.have, e.want, e.err)
+}
+
+func isWriteQuorum(err error) bool {
+	_, ok := err.(errWriteQuorum)
+	return ok
+}
+
+// Wait for the sync copies altStoreFile may have started and return
+// how many copies of h we have.
+func awaitReplicas(fn, h string, length int64,
+	bgch <-chan storInfo, quorum int) (int, error) {
+
+	replicas := 1
+	var failed error
+	for si := range bgch {
 		if si.err != nil || si.hs != h {
 			log.Printf("Error in secondary store of %v to %v for %v: %v",
-				h, si.node, req.URL.Path, si.err)
-			http.Error(w,
-				fmt.Sprintf("Error creating sync secondary copy: %v\n%v",
-					si.err, si.hs), 500)
-
-			// We do have this item now, so even if it's
-			// not going to be linked to a file, we will
-			// increase the replica count to the minimum
-			// so we don't report underreplication.
-			if globalConfig.MinReplicas > 1 {
-				go increaseReplicaCount(h, length,
-					globalConfig.MinReplicas-1)
-			}
+				h, si.node, fn, si.err)
+			failed = fmt.Errorf("%v: %v %v", si.node, si.err, si.hs)
+			continue
+		}
+		replicas++
+	}
 
-			return
+	if failed == nil && replicas >= quorum {
+		if replicas == 1 {
+			log.Printf("Singly stored %v for %v", h, fn)
 		}
-	} else {
-		// In this case, the upstream couldn't find a
-		// secondary for us.
-		log.Printf("Singly stored %v for %v", h, req.URL.Path)
-		replicas--
+		return replicas, nil
+	}
+
+	// We do have this item now, so even if it's not going to be
+	// linked to a file, we will increase the replica count to the
+	// minimum so we don't report underreplication.
+	if globalConfig.MinReplicas > replicas {
+		inBackground(func() {
+			increaseReplicaCount(h, length,
+				globalConfig.MinReplicas-replicas)
+		})
+	}
+
+	if quorum == 0 {
+		return 0, fmt.Errorf("Error creating sync secondary copy: %v",
+			failed)
+	}
+	if failed == nil {
+		failed = errors.New("not enough nodes")
 	}
+	return 0, errWriteQuorum{replicas, quorum, failed}
+}
 
+// Record fm as the latest revision of fn.
+func storeUserMeta(fn string, fm fileMeta, header http.Header) error {
 	revs := globalConfig.DefaultVersionCount
-	rheader := req.Header.Get("X-CBFS-KeepRevs")
+	rheader := header.Get("X-CBFS-KeepRevs")
 	if rheader != "" {
 		i, err := strconv.Atoi(rheader)
 		if err == nil {
@@ -253,32 +435,33 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	exp := getExpiration(req.Header)
+	exp := getExpiration(header)
 
-	err = storeMeta(fn, exp, fm, revs, req.Header)
+	// The length given up front may have been missing or wrong.
+	err := checkQuota(fn, fm.Length)
+	if isOverQuota(err) {
+		log.Printf("Not storing %v -> %v: %v", fn, fm.OID, err)
+		return err
+	}
+	if err == nil {
+		err = storeMeta(fn, exp, fm, revs, header)
+	}
 	if err == errUploadPrecondition {
-		log.Printf("Upload precondition failed: %v -> %v", fn, h)
-		http.Error(w, "precondition failed", 412)
-		return
+		log.Printf("Upload precondition failed: %v -> %v", fn, fm.OID)
+		return err
+	}
+	if isRetained(err) {
+		log.Printf("Not overwriting %v -> %v: %v", fn, fm.OID, err)
+		return err
 	}
 	if err != nil {
 		log.Printf("Error storing file meta of %v -> %v: %v",
-			fn, h, err)
-		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
-			500)
-		return
+			fn, fm.OID, err)
+		return fmt.Errorf("Error recording blob ownership: %v", err)
 	}
 
-	log.Printf("Wrote %v -> %v", req.URL.Path, h)
-
-	if globalConfig.MinReplicas > replicas {
-		// We're below min replica count.  Start fixing that
-		// up immediately.
-		go increaseReplicaCount(h, length,
-			globalConfig.MinReplicas-replicas)
-	}
-
-	w.WriteHeader(201)
+	log.Printf("Wrote %v -> %v", fn, fm.OID)
+	return nil
 }
 
 func putRawHash(w http.ResponseWriter, req *http.Request) {
@@ -333,6 +516,18 @@ func doPut(w http.ResponseWriter, req *http.Request) {
 		putMeta(w, req, minusPrefix(req.URL.Path, metaPrefix))
 	case *enableCRUDProxy && strings.HasPrefix(req.URL.Path, crudproxyPrefix):
 		proxyCRUDPut(w, req, minusPrefix(req.URL.Path, crudproxyPrefix))
+	case strings.HasPrefix(req.URL.Path, uploadPrefix):
+		doUpload(w, req)
+	case req.URL.Path == authPrefix:
+		doSetAuth(w, req)
+	case req.URL.Path == policyPath:
+		doSetRetentionPolicies(w, req)
+	case strings.HasPrefix(req.URL.Path, retentionPrefix):
+		doSetRetention(w, req, minusPrefix(req.URL.Path, retentionPrefix))
+	case strings.HasPrefix(req.URL.Path, quotaPrefix):
+		doSetQuota(w, req, minusPrefix(req.URL.Path, quotaPrefix))
+	case req.URL.Path == replicationPath:
+		doSetReplication(w, req)
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
 		http.Error(w, "Can't PUT here", 400)
 	default:
@@ -341,11 +536,35 @@ func doPut(w http.ResponseWriter, req *http.Request) {
 }
 
 func isResponseHeader(s string) bool {
-	switch strings.ToLower(s) {
+	l := strings.ToLower(s)
+	switch l {
 	case "content-type":
 		return true
 	}
-	return false
+	return strings.HasPrefix(l, "x-amz-meta-")
+}
+
+// Request headers kept with a file.  Anything about the request
+// itself (credentials, signatures, quorum, overrides) is left out.
+func isFileHeader(s string) bool {
+	l := strings.ToLower(s)
+	switch l {
+	case "content-type", "content-encoding", "content-language",
+		"content-disposition", "cache-control", "expires",
+		"x-cbfs-expiration", "x-cbfs-source-revno", "x-cbfs-source-modified":
+		return true
+	}
+	return strings.HasPrefix(l, "x-amz-meta-")
+}
+
+func filterHeaders(in http.Header, keep func(string) bool) http.Header {
+	rv := http.Header{}
+	for k, v := range in {
+		if keep(k) {
+			rv[k] = v
+		}
+	}
+	return rv
 }
 
 func resolvePath(req *http.Request) (path string, key string) {
@@ -453,9 +672,11 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 	}
 
 	oid := got.OID
+	chunks := got.Chunks
 	respHeaders := got.Headers
 	modified := got.Modified
 	revno := got.Revno
+	length := got.Length
 	oldestRev := revno
 
 	if len(got.Previous) > 0 {
@@ -475,8 +696,10 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 		for _, rev := range got.Previous {
 			if rev.Revno == revno {
 				oid = rev.OID
+				chunks = rev.Chunks
 				modified = rev.Modified
 				respHeaders = rev.Headers
+				length = rev.Length
 				break
 			}
 		}
@@ -487,7 +710,29 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	if canGzip(req) && shouldGzip(got) {
+	if t, err := parseImageTransform(req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	} else if t != nil {
+		ctype := respHeaders.Get("Content-Type")
+		if ctype == "" {
+			ctype = mime.TypeByExtension(filepath.Ext(path))
+		}
+		doGetImage(w, req, path, oid, chunks, revno, length, ctype, *t)
+		return
+	}
+
+	// Blobs stored compressed go to clients that take gzip as they are.
+	var gzipped io.ReadCloser
+	if len(chunks) == 0 && canGzip(req) && req.Header.Get("Range") == "" {
+		gzipped, _ = openLocalGzipBlob(oid)
+	}
+
+	if gzipped != nil {
+		defer gzipped.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	} else if canGzip(req) && shouldGzip(got) {
 		w.Header().Set("Content-Encoding", "gzip")
 		gz := gzip.NewWriter(w)
 		defer gz.Close()
@@ -506,7 +751,17 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	f, err := openBlob(oid, req.Header.Get("X-CBFS-LocalOnly") != "")
+	if gzipped != nil {
+		serveGzippedBlob(w, path, oid, respHeaders, gzipped)
+		return
+	}
+
+	var f io.ReadCloser
+	if len(chunks) > 0 {
+		f = newChunkReader(chunks)
+	} else {
+		f, err = openBlob(oid, req.Header.Get("X-CBFS-LocalOnly") != "")
+	}
 	if err == nil {
 		// normal path
 		defer f.Close()
@@ -529,7 +784,9 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 
 	w.Header().Set("Etag", `"`+oid+`"`)
 
-	go recordBlobAccess(oid)
+	if len(chunks) == 0 {
+		inBackground(func() { recordBlobAccess(oid) })
+	}
 	if r, ok := f.(io.ReadSeeker); ok {
 		http.ServeContent(w, req, path, modified, r)
 	} else {
@@ -546,6 +803,14 @@ func doServeRawBlob(w http.ResponseWriter, req *http.Request, oid string) {
 		http.Error(w, "Error invalid hash: "+oid, 400)
 		return
 	}
+	if canGzip(req) && req.Header.Get("Range") == "" {
+		if f, ok := openLocalGzipBlob(oid); ok {
+			defer f.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			serveGzippedBlob(w, "", oid, nil, f)
+			return
+		}
+	}
 	f, err := openLocalBlob(oid)
 	if err != nil {
 		http.Error(w, "Error opening blob: "+err.Error(), 404)
@@ -556,10 +821,34 @@ func doServeRawBlob(w http.ResponseWriter, req *http.Request, oid string) {
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 
-	go recordBlobAccess(oid)
+	inBackground(func() { recordBlobAccess(oid) })
 	http.ServeContent(w, req, "", time.Time{}, f)
 }
 
+func serveGzippedBlob(w http.ResponseWriter, path, oid string,
+	respHeaders http.Header, f io.Reader) {
+
+	for k, v := range respHeaders {
+		if isResponseHeader(k) {
+			w.Header()[k] = v
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(filepath.Ext(path))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Etag", `"`+oid+`"`)
+
+	inBackground(func() { recordBlobAccess(oid) })
+	w.WriteHeader(200)
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Error serving compressed %v: %v", oid, err)
+	}
+}
+
 func getBlobFromRemote(w http.ResponseWriter, oid string,
 	respHeader http.Header, cachePerc int) error {
 
@@ -641,7 +930,11 @@ func doFetchDoc(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	if !maybeQueueBlobFetch(path, req.Header.Get("X-Prevnode")) {
+	pri := priorityRebalance
+	if p, err := strconv.Atoi(req.Header.Get("X-CBFS-Priority")); err == nil {
+		pri = taskPriority(p)
+	}
+	if !maybeQueueBlobFetch(path, req.Header.Get("X-Prevnode"), pri) {
 		http.Error(w, "Queue is full. Try later.", 503)
 		return
 	}
@@ -692,10 +985,32 @@ func doGet(w http.ResponseWriter, req *http.Request) {
 		doZipDocs(w, req, minusPrefix(req.URL.Path, zipPrefix))
 	case strings.HasPrefix(req.URL.Path, tarPrefix):
 		doTarDocs(w, req, minusPrefix(req.URL.Path, tarPrefix))
+	case strings.HasPrefix(req.URL.Path, trashPrefix):
+		doListTrash(w, req, minusPrefix(req.URL.Path, trashPrefix))
+	case req.URL.Path == policyPath:
+		doGetRetentionPolicies(w, req)
+	case req.URL.Path == auditPath:
+		doGetAudit(w, req)
+	case strings.HasPrefix(req.URL.Path, retentionPrefix):
+		doGetRetention(w, req, minusPrefix(req.URL.Path, retentionPrefix))
+	case strings.HasPrefix(req.URL.Path, quotaPrefix):
+		doGetQuota(w, req, minusPrefix(req.URL.Path, quotaPrefix))
+	case req.URL.Path == queuePrefix:
+		doListQueue(w, req)
+	case req.URL.Path == replicationPath:
+		doGetReplication(w, req)
+	case strings.HasPrefix(req.URL.Path, changesPrefix):
+		doGetChanges(w, req, minusPrefix(req.URL.Path, changesPrefix))
 	case strings.HasPrefix(req.URL.Path, fsckPrefix):
 		dofsck(w, req, minusPrefix(req.URL.Path, fsckPrefix))
 	case strings.HasPrefix(req.URL.Path, debugPrefix):
 		doDebug(w, req)
+	case strings.HasPrefix(req.URL.Path, uploadPrefix):
+		doUpload(w, req)
+	case req.URL.Path == authPrefix:
+		doGetAuth(w, req)
+	case req.URL.Path == metricsPath:
+		doGetMetrics(w, req)
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
 		http.Error(w, "Can't GET here", 400)
 	default:
@@ -723,19 +1038,16 @@ func doDeleteOID(w http.ResponseWriter, req *http.Request) {
 }
 
 func doDeleteUserDoc(w http.ResponseWriter, req *http.Request) {
-	_, k := resolvePath(req)
-	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
-		existing := fileMeta{}
-		err := json.Unmarshal(in, &existing)
-		if !shouldStoreMeta(req.Header, err == nil, existing) {
-			return in, errUploadPrecondition
-		}
-		return nil, nil
-	})
+	path, _ := resolvePath(req)
+	_, err := deleteFile(path, req.Header)
 	if err == nil {
 		w.WriteHeader(204)
 	} else if err == errUploadPrecondition {
 		http.Error(w, "precondition failed", 412)
+	} else if err == errFileChanged {
+		http.Error(w, err.Error(), 409)
+	} else if isRetained(err) {
+		http.Error(w, err.Error(), 403)
 	} else {
 		http.Error(w, err.Error(), 404)
 	}
@@ -747,6 +1059,14 @@ func doDelete(w http.ResponseWriter, req *http.Request) {
 		doDeleteOID(w, req)
 	case *enableCRUDProxy && strings.HasPrefix(req.URL.Path, crudproxyPrefix):
 		proxyCRUDDelete(w, req, minusPrefix(req.URL.Path, crudproxyPrefix))
+	case strings.HasPrefix(req.URL.Path, uploadPrefix):
+		doUpload(w, req)
+	case strings.HasPrefix(req.URL.Path, trashPrefix):
+		doPurgeTrash(w, req, minusPrefix(req.URL.Path, trashPrefix))
+	case strings.HasPrefix(req.URL.Path, quotaPrefix):
+		doDeleteQuota(w, req, minusPrefix(req.URL.Path, quotaPrefix))
+	case req.URL.Path == queuePrefix:
+		doDrainQueue(w, req)
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
 		http.Error(w, "Can't DELETE here", 400)
 	default:
@@ -790,10 +1110,11 @@ func doLinkFile(w http.ResponseWriter, req *http.Request) {
 	blob, err := referenceBlob(h)
 	if err != nil {
 		estat := 500
-		if gomemcached.IsNotFound(err) {
+		if isNotFound(err) {
 			estat = 404
 		}
 		http.Error(w, err.Error(), estat)
+		return
 	}
 
 	fm := fileMeta{
@@ -809,15 +1130,92 @@ func doLinkFile(w http.ResponseWriter, req *http.Request) {
 	if exp != 0 {
 		fm.Headers.Set("X-CBFS-Expiration", strconv.Itoa(exp))
 	}
+	for _, k := range []string{replicaRevnoHeader, replicaModifiedHeader} {
+		if v := req.Header.Get(k); v != "" {
+			fm.Headers.Set(k, v)
+		}
+	}
 
-	err = maybeStoreMeta(fn, fm, exp, true)
+	if err := validRetentionHeaders(req.Header); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	qs, err := quotasFor(fn)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	applyRetention(fn, &fm, req.Header)
+	if shortName(fn) != fn {
+		fm.Name = fn
+	}
+
+	// Retention and quotas are checked against whatever this replaces.
+	old := fileMeta{}
+	var overridden error
+	bytes, files := fm.Length, int64(1)
+	err = couchbase.Update(shortName(fn), exp, func(in []byte) ([]byte, error) {
+		old, overridden = fileMeta{}, nil
+		bytes, files = fm.Length, 1
+		if json.Unmarshal(in, &old) == nil && old.Type == "file" {
+			if rerr := retained(fn, old, time.Now()); rerr != nil {
+				if retentionOverride(req.Header) == "" {
+					return in, rerr
+				}
+				overridden = rerr
+			}
+			bytes, files = fm.Length-old.Length, 0
+		}
+		if err := overQuota(qs, bytes, files); err != nil {
+			return in, err
+		}
+		return json.Marshal(&fm)
+	})
+	switch {
+	case isRetained(err):
+		http.Error(w, err.Error(), 403)
+		return
+	case isOverQuota(err):
+		http.Error(w, err.Error(), 507)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if overridden != nil {
+		auditOverride("link", fn, old, req.Header, overridden)
+	}
+	if fm.held(time.Now()) {
+		holdBlobs(fm)
+	}
+	chargeQuota(fn, bytes, files)
+	recordChange("create", fn, fm)
 	w.WriteHeader(201)
 }
 
+// Store a new file record at dst referencing the same blobs as got.
+func linkCopy(got fileMeta, dst string) (fileMeta, error) {
+	for _, oid := range got.blobs() {
+		if _, err := referenceBlob(oid); err != nil {
+			return fileMeta{}, err
+		}
+	}
+
+	fm := fileMeta{
+		Headers:  got.Headers,
+		OID:      got.OID,
+		Chunks:   got.Chunks,
+		Length:   got.Length,
+		Modified: time.Now().UTC(),
+	}
+	if err := checkQuota(dst, fm.Length); err != nil {
+		return fm, err
+	}
+	err := storeMeta(dst, getExpiration(fm.Headers), fm,
+		globalConfig.DefaultVersionCount, nil)
+	return fm, err
+}
+
 func doPost(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path == blobPrefix {
 		doPostRawBlob(w, req)
@@ -829,10 +1227,24 @@ func doPost(w http.ResponseWriter, req *http.Request) {
 		doRestoreDocument(w, req, minusPrefix(req.URL.Path, restorePrefix))
 	} else if strings.HasPrefix(req.URL.Path, taskPrefix) {
 		doInduceTask(w, req, minusPrefix(req.URL.Path, taskPrefix))
+	} else if req.URL.Path == archivePath {
+		doArchiveBackup(w, req)
+	} else if req.URL.Path == archiveRestPath {
+		doRestoreArchive(w, req)
 	} else if strings.HasPrefix(req.URL.Path, backupPrefix) {
 		doBackupDocs(w, req)
 	} else if strings.HasPrefix(req.URL.Path, quitPrefix) {
 		doExit(w, req)
+	} else if strings.HasPrefix(req.URL.Path, uploadPrefix) {
+		doUpload(w, req)
+	} else if strings.HasPrefix(req.URL.Path, untrashPrefix) {
+		doRestoreTrash(w, req, minusPrefix(req.URL.Path, untrashPrefix))
+	} else if strings.HasPrefix(req.URL.Path, renamePrefix) {
+		doRename(w, req, minusPrefix(req.URL.Path, renamePrefix))
+	} else if strings.HasPrefix(req.URL.Path, quotaPrefix) {
+		doSetQuota(w, req, minusPrefix(req.URL.Path, quotaPrefix))
+	} else if req.URL.Path == kmsRotatePrefix {
+		doRotateKMS(w, req)
 	} else if strings.HasPrefix(req.URL.Path, "/.cbfs/") {
 		http.Error(w, "Can't POST here", 400)
 	} else {
@@ -841,6 +1253,13 @@ func doPost(w http.ResponseWriter, req *http.Request) {
 }
 
 func httpHandler(w http.ResponseWriter, req *http.Request) {
+	if prefix := dirPath(*davPrefix); davMounted(req.URL.Path, prefix) {
+		davHandler(w, req, prefix)
+		return
+	}
+	if !authorize(w, req) {
+		return
+	}
 	switch req.Method {
 	case "PUT":
 		doPut(w, req)
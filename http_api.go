@@ -16,14 +16,12 @@ import (
 	"strings"
 	"time"
 
-	"github.com/couchbase/gomemcached"
-	"github.com/couchbase/gomemcached/client"
 	"github.com/couchbaselabs/cbfs/config"
 )
 
 func doGetConfig(w http.ResponseWriter, req *http.Request) {
 	err := updateConfig()
-	if err != nil && !gomemcached.IsNotFound(err) {
+	if err != nil && !isNotFound(err) {
 		log.Printf("Error updating config: %v", err)
 	}
 
@@ -94,14 +92,12 @@ func doList(w http.ResponseWriter, req *http.Request) {
 	}
 
 	w.WriteHeader(200)
-	explen := getHash().Size() * 2
 	filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && !strings.HasPrefix(info.Name(), "tmp") &&
-			len(info.Name()) == explen {
-			_, e := w.Write([]byte(info.Name() + "\n"))
+		if h, ok := blobOID(info.Name()); ok && !info.IsDir() {
+			_, e := w.Write([]byte(h + "\n"))
 			return e
 		}
 		return nil
@@ -163,7 +159,7 @@ func doFileInfo(w http.ResponseWriter, req *http.Request, fn string) {
 	err := couchbase.Get(shortName(fn), &fm)
 	switch {
 	case err == nil:
-	case gomemcached.IsNotFound(err):
+	case isNotFound(err):
 		http.Error(w, "not found", 404)
 		return
 	default:
@@ -205,6 +201,11 @@ func putMeta(w http.ResponseWriter, req *http.Request, path string) {
 		return
 	}
 
+	if err := checkRetention("meta", path, got, req.Header); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
 	r := json.RawMessage{}
 	err = json.NewDecoder(req.Body).Decode(&r)
 	if err != nil {
@@ -213,22 +214,11 @@ func putMeta(w http.ResponseWriter, req *http.Request, path string) {
 	}
 
 	got.Userdata = &r
-	b := mustEncode(&got)
-
-	err = couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		req := &gomemcached.MCRequest{
-			Opcode:  gomemcached.SET,
-			VBucket: vb,
-			Key:     []byte(path),
-			Cas:     casid,
-			Opaque:  0,
-			Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
-			Body:    b}
-		_, err := mc.Send(req)
-		return err
-	})
+
+	err = couchbase.CAS(k, 0, casid, &got)
 
 	if err == nil {
+		recordChange("meta", path, got)
 		w.WriteHeader(201)
 	} else {
 		http.Error(w, err.Error(), 500)
@@ -260,6 +250,8 @@ func doListNodes(w http.ResponseWriter, req *http.Request) {
 			"bindaddr":   node.BindAddr,
 			"framesbind": node.FrameBind,
 			"version":    node.Version,
+			"scheme":     node.scheme(),
+			"zone":       node.Zone,
 		}
 		// Grandfathering these in.
 		if !node.Started.IsZero() {
@@ -280,7 +272,13 @@ func doGetFramesData(w http.ResponseWriter, req *http.Request) {
 func proxyViewRequest(w http.ResponseWriter, req *http.Request,
 	path string) {
 
-	nodes := couchbase.Nodes()
+	cbs, ok := couchbase.(*cbStore)
+	if !ok {
+		http.Error(w, "View proxy requires a couchbase metadata store",
+			http.StatusNotImplemented)
+		return
+	}
+	nodes := cbs.Nodes()
 	node := nodes[rand.Intn(len(nodes))]
 	u, err := url.Parse(node.CouchAPIBase)
 	if err != nil {
@@ -343,6 +341,11 @@ func proxyCRUDPut(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
+	if err := checkFileRetention("crudproxy", path, req.Header); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
 	err = couchbase.SetRaw(shortName(path), 0, data)
 	if err != nil {
 		w.WriteHeader(500)
@@ -356,6 +359,11 @@ func proxyCRUDPut(w http.ResponseWriter, req *http.Request,
 func proxyCRUDDelete(w http.ResponseWriter, req *http.Request,
 	path string) {
 
+	if err := checkFileRetention("crudproxy", path, req.Header); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
 	err := couchbase.Delete(shortName(path))
 	if err != nil {
 		w.WriteHeader(500)
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -11,3 +14,47 @@ func TestMinusPrefix(t *testing.T) {
 			minusPrefix(aPath, blobPrefix))
 	}
 }
+
+func TestStoredHeaders(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	for _, chunked := range []string{"false", "true"} {
+		req, _ := http.NewRequest("PUT", "http://localhost/x",
+			strings.NewReader("hello"))
+		req.Header.Set("Authorization", "Basic c2VjcmV0")
+		req.Header.Set("X-CBFS-Date", "Thu, 01 Jan 1970 00:00:00 GMT")
+		req.Header.Set("X-CBFS-Quorum", "1")
+		req.Header.Set("X-CBFS-Chunked", chunked)
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-Amz-Meta-Color", "blue")
+		w := httptest.NewRecorder()
+		httpHandler(w, req)
+		if w.Code != 201 {
+			t.Fatalf("Error storing: %v %s", w.Code, w.Body)
+		}
+
+		fm := fileMeta{}
+		if err := couchbase.Get(shortName("x"), &fm); err != nil {
+			t.Fatalf("Error getting meta: %v", err)
+		}
+		if len(fm.Headers) != 2 || fm.Headers.Get("Content-Type") != "text/plain" ||
+			fm.Headers.Get("X-Amz-Meta-Color") != "blue" {
+			t.Errorf("Expected only file headers stored, got %v", fm.Headers)
+		}
+	}
+}
+
+func TestLinkMissingBlob(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	h := strings.Repeat("0", getHash().Size()*2)
+	if w := doTestRequest(t, "POST", "/linked?blob="+h, ""); w.Code != 404 {
+		t.Errorf("Expected linking a missing blob to fail, got %v %s",
+			w.Code, w.Body)
+	}
+	if w := doTestRequest(t, "GET", "/linked", ""); w.Code != 404 {
+		t.Errorf("Expected no file after a failed link, got %v", w.Code)
+	}
+}
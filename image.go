@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Images can be resized on the way out:
+//
+//   GET /photo.jpg?width=200[&height=200][&fit=contain|cover|fill][&format=png]
+//
+// contain (the default) fits the image inside the box keeping its
+// shape, cover fills the box and crops what's left over, and fill
+// stretches it.  Giving just one side keeps the shape.  Each result
+// is stored as a blob of its own and remembered under the source's
+// OID and the transform for derivedImageTTL, and made again if the
+// source's revno has changed since.  At most -imageWorkers images are
+// made at once, using at most -imageMemory bytes between them, and only
+// from image files up to -maxImageSource bytes.
+
+var imageWorkers = flag.Int("imageWorkers", runtime.NumCPU(),
+	"Most images to resize at once")
+var imageMemory = flag.Int64("imageMemory", 1<<30,
+	"Most bytes of memory to resize images in at once")
+var maxImageSource = flag.Int64("maxImageSource", 64<<20,
+	"Largest image file (in bytes) to resize")
+
+const (
+	maxImageDimension = 4096
+	maxImagePixels    = 64 * 1024 * 1024
+	derivedImageTTL   = 30 * 24 * time.Hour
+	jpegQuality       = 85
+)
+
+var (
+	imageSlots     chan bool
+	imageSlotsOnce sync.Once
+)
+
+var (
+	errImageTooLarge = errors.New("image is too large to resize")
+	errNotImage      = errors.New("not an image")
+)
+
+// Memory set aside for images being resized.
+var imageMem = struct {
+	sync.Mutex
+	cond *sync.Cond
+	used int64
+}{}
+
+func init() {
+	imageMem.cond = sync.NewCond(&imageMem)
+}
+
+// Wait for n bytes of -imageMemory.
+func acquireImageMemory(n int64) error {
+	if n > *imageMemory {
+		return errImageTooLarge
+	}
+	imageMem.Lock()
+	defer imageMem.Unlock()
+	for imageMem.used+n > *imageMemory {
+		imageMem.cond.Wait()
+	}
+	imageMem.used += n
+	return nil
+}
+
+func releaseImageMemory(n int64) {
+	imageMem.Lock()
+	defer imageMem.Unlock()
+	imageMem.used -= n
+	imageMem.cond.Broadcast()
+}
+
+// About how much memory it takes to decode an image and make a w by h
+// one from it.
+func imageMemoryNeeded(conf image.Config, w, h int) int64 {
+	bpp := int64(4)
+	switch conf.ColorModel {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		bpp = 8
+	}
+	// The decoded source, then the scaled image and its encoding.
+	return int64(conf.Width)*int64(conf.Height)*bpp + 2*int64(w)*int64(h)*4
+}
+
+type imageTransform struct {
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Fit    string `json:"fit"`
+	Format string `json:"format,omitempty"`
+}
+
+func (t imageTransform) String() string {
+	return fmt.Sprintf("%dx%d-%s-%s", t.Width, t.Height, t.Fit, t.Format)
+}
+
+var imageFormats = map[string]string{
+	"jpeg": "jpeg", "jpg": "jpeg", "png": "png", "gif": "gif",
+}
+
+// The transform asked for, or nil if this isn't an image request.
+func parseImageTransform(req *http.Request) (*imageTransform, error) {
+	ws, hs := req.FormValue("width"), req.FormValue("height")
+	fit, format := req.FormValue("fit"), req.FormValue("format")
+	if ws == "" && hs == "" && fit == "" && format == "" {
+		return nil, nil
+	}
+
+	t := &imageTransform{Fit: "contain"}
+	for _, d := range []struct {
+		s string
+		v *int
+	}{{ws, &t.Width}, {hs, &t.Height}} {
+		if d.s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(d.s)
+		if err != nil || n < 1 || n > maxImageDimension {
+			return nil, fmt.Errorf("invalid image size %q", d.s)
+		}
+		*d.v = n
+	}
+	switch fit {
+	case "":
+	case "contain", "cover", "fill":
+		t.Fit = fit
+	default:
+		return nil, fmt.Errorf("invalid fit %q", fit)
+	}
+	if format != "" {
+		if t.Format = imageFormats[format]; t.Format == "" {
+			return nil, fmt.Errorf("invalid image format %q", format)
+		}
+	}
+	if t.Fit != "contain" && (t.Width == 0 || t.Height == 0) {
+		return nil, fmt.Errorf("fit=%v needs a width and height", t.Fit)
+	}
+	return t, nil
+}
+
+// A resized image, recorded so its blob isn't collected while it's
+// cached.
+type derivedImage struct {
+	Type        string         `json:"type"`
+	OID         string         `json:"oid"`
+	Length      int64          `json:"length"`
+	ContentType string         `json:"ctype"`
+	Source      string         `json:"source"`
+	Revno       int            `json:"revno"`
+	Transform   imageTransform `json:"transform"`
+	Created     time.Time      `json:"created"`
+}
+
+func derivedImageKey(oid string, t imageTransform) string {
+	return "/@derived/" + oid + "/" + t.String()
+}
+
+// The size of the image t makes from one that's w by h, and the part
+// of the source it comes from.
+func (t imageTransform) geometry(w, h int) (int, int, image.Rectangle) {
+	src := image.Rect(0, 0, w, h)
+	dw, dh := t.Width, t.Height
+	switch {
+	case t.Fit == "fill":
+	case t.Fit == "cover":
+		// Crop the source to the box's shape.
+		if w*dh > h*dw {
+			cw := h * dw / dh
+			src = image.Rect((w-cw)/2, 0, (w-cw)/2+cw, h)
+		} else {
+			ch := w * dh / dw
+			src = image.Rect(0, (h-ch)/2, w, (h-ch)/2+ch)
+		}
+	case dw == 0:
+		dw = w * dh / h
+	case dh == 0:
+		dh = h * dw / w
+	case w*dh > h*dw:
+		dh = h * dw / w
+	default:
+		dw = w * dh / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	return dw, dh, src
+}
+
+// Scale the r part of src to w by h, averaging the source pixels under
+// each new one.
+func scaleImage(src image.Image, r image.Rectangle, w, h int) *image.RGBA {
+	b := src.Bounds()
+	r = r.Add(b.Min)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := r.Min.Y + y*r.Dy()/h
+		y1 := r.Min.Y + (y+1)*r.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := r.Min.X + x*r.Dx()/w
+			x1 := r.Min.X + (x+1)*r.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sr, sg, sb, sa, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					sr, sg, sb, sa = sr+uint64(cr), sg+uint64(cg),
+						sb+uint64(cb), sa+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(sr / n), uint16(sg / n),
+				uint16(sb / n), uint16(sa / n)})
+		}
+	}
+	return dst
+}
+
+func transformImage(r io.Reader, t imageTransform) ([]byte, string, error) {
+	// Keep what the header took to decode it all after.
+	head := &bytes.Buffer{}
+	conf, format, err := image.DecodeConfig(io.TeeReader(r, head))
+	if err != nil {
+		return nil, "", err
+	}
+	if conf.Width*conf.Height > maxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+	w, h, crop := t.geometry(conf.Width, conf.Height)
+
+	need := imageMemoryNeeded(conf, w, h)
+	if err := acquireImageMemory(need); err != nil {
+		return nil, "", err
+	}
+	defer releaseImageMemory(need)
+
+	src, _, err := image.Decode(io.MultiReader(head, r))
+	if err != nil {
+		return nil, "", err
+	}
+	dst := scaleImage(src, crop, w, h)
+
+	if t.Format != "" {
+		format = t.Format
+	}
+	out := &bytes.Buffer{}
+	switch format {
+	case "png":
+		err = png.Encode(out, dst)
+	case "gif":
+		err = gif.Encode(out, dst, nil)
+	default:
+		format = "jpeg"
+		err = jpeg.Encode(out, dst, &jpeg.Options{Quality: jpegQuality})
+	}
+	return out.Bytes(), "image/" + format, err
+}
+
+// Make the derived image and store it.
+func deriveImage(req *http.Request, oid string, chunks []chunkRef,
+	revno int, t imageTransform) (derivedImage, error) {
+
+	imageSlotsOnce.Do(initImageWorkers)
+	select {
+	case imageSlots <- true:
+		defer func() { <-imageSlots }()
+	case <-req.Context().Done():
+		return derivedImage{}, req.Context().Err()
+	}
+
+	var r io.ReadCloser
+	var err error
+	if len(chunks) > 0 {
+		r = newChunkReader(chunks)
+	} else if r, err = openBlob(oid, false); err != nil {
+		return derivedImage{}, err
+	}
+	defer r.Close()
+
+	data, ctype, err := transformImage(r, t)
+	if err != nil {
+		return derivedImage{}, err
+	}
+
+	f, err := NewHashRecord(*root, "")
+	if err != nil {
+		return derivedImage{}, err
+	}
+	defer f.Close()
+	h, length, err := f.Process(bytes.NewReader(data))
+	if err != nil {
+		return derivedImage{}, err
+	}
+	if err := recordBlobOwnership(h, length, false); err != nil {
+		return derivedImage{}, err
+	}
+
+	d := derivedImage{
+		Type:        "derived",
+		OID:         h,
+		Length:      length,
+		ContentType: ctype,
+		Source:      oid,
+		Revno:       revno,
+		Transform:   t,
+		Created:     time.Now().UTC(),
+	}
+	err = couchbase.Set(derivedImageKey(oid, t), expiryIn(derivedImageTTL), d)
+	return d, err
+}
+
+// Whether a file of length bytes and type ctype can be resized.
+func checkImageSource(length int64, ctype string) error {
+	if !strings.HasPrefix(ctype, "image/") {
+		return errNotImage
+	}
+	if length > *maxImageSource {
+		return errImageTooLarge
+	}
+	return nil
+}
+
+func doGetImage(w http.ResponseWriter, req *http.Request, path string,
+	oid string, chunks []chunkRef, revno int, length int64, ctype string,
+	t imageTransform) {
+
+	d := derivedImage{}
+	var f io.ReadCloser
+	err := checkImageSource(length, ctype)
+	if err == nil {
+		err = couchbase.Get(derivedImageKey(oid, t), &d)
+		if err == nil && d.Revno == revno {
+			f, err = openBlob(d.OID, false)
+		} else if err == nil {
+			err = errors.New("source revision changed")
+		}
+		if err != nil {
+			if d, err = deriveImage(req, oid, chunks, revno, t); err == nil {
+				f, err = openBlob(d.OID, false)
+			}
+		}
+	}
+	switch {
+	case err == errImageTooLarge:
+		http.Error(w, err.Error(), 413)
+		return
+	case err == image.ErrFormat, err == errNotImage:
+		http.Error(w, path+" isn't an image", 415)
+		return
+	case err != nil:
+		log.Printf("Error making %v of %v: %v", t, path, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", d.ContentType)
+	w.Header().Set("X-CBFS-Revno", strconv.Itoa(revno))
+	w.Header().Set("Etag", `"`+d.OID+`"`)
+	if inm := req.Header.Get("If-None-Match"); inm == `"`+d.OID+`"` {
+		w.WriteHeader(304)
+		return
+	}
+
+	inBackground(func() { recordBlobAccess(d.OID) })
+	if r, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, req, "", d.Created, r)
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(d.Length, 10))
+		w.WriteHeader(200)
+		io.Copy(w, f)
+	}
+}
+
+func initImageWorkers() {
+	n := *imageWorkers
+	if n < 1 {
+		n = 1
+	}
+	imageSlots = make(chan bool, n)
+}
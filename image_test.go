@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testPNG(t *testing.T, w, h int, c color.Color) string {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("Error encoding test image: %v", err)
+	}
+	return buf.String()
+}
+
+func TestImageGeometry(t *testing.T) {
+	tests := []struct {
+		t    imageTransform
+		w, h int
+		crop image.Rectangle
+	}{
+		{imageTransform{Width: 20, Fit: "contain"}, 20, 10, image.Rect(0, 0, 100, 50)},
+		{imageTransform{Height: 10, Fit: "contain"}, 20, 10, image.Rect(0, 0, 100, 50)},
+		{imageTransform{Width: 20, Height: 20, Fit: "contain"}, 20, 10, image.Rect(0, 0, 100, 50)},
+		{imageTransform{Width: 20, Height: 20, Fit: "cover"}, 20, 20, image.Rect(25, 0, 75, 50)},
+		{imageTransform{Width: 20, Height: 20, Fit: "fill"}, 20, 20, image.Rect(0, 0, 100, 50)},
+	}
+
+	for _, test := range tests {
+		w, h, crop := test.t.geometry(100, 50)
+		if w != test.w || h != test.h || crop != test.crop {
+			t.Errorf("Expected %v of 100x50 to be %vx%v from %v, got %vx%v from %v",
+				test.t, test.w, test.h, test.crop, w, h, crop)
+		}
+	}
+}
+
+func TestImageResize(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	doTestRequest(t, "PUT", "/pic.png", testPNG(t, 100, 50, color.White))
+
+	w := doTestRequest(t, "GET", "/pic.png?width=20", "")
+	if w.Code != 200 {
+		t.Fatalf("Error resizing: %v %s", w.Code, w.Body)
+	}
+	img, format, err := image.Decode(w.Body)
+	if err != nil || format != "png" || img.Bounds().Dx() != 20 ||
+		img.Bounds().Dy() != 10 {
+		t.Errorf("Expected a 20x10 png, got %v %v: %v", format, img, err)
+	}
+	etag := w.Header().Get("Etag")
+
+	w = doTestRequest(t, "GET", "/pic.png?width=20&height=20&fit=cover&format=jpg", "")
+	img, format, err = image.Decode(w.Body)
+	if err != nil || format != "jpeg" || img.Bounds().Dx() != 20 ||
+		img.Bounds().Dy() != 20 || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expected a 20x20 jpeg, got %v %v: %v", format, img, err)
+	}
+
+	if w := doTestRequest(t, "GET", "/pic.png?width=20", ""); w.Header().Get("Etag") != etag {
+		t.Errorf("Expected the cached image again, got %v, wanted %v",
+			w.Header().Get("Etag"), etag)
+	}
+
+	doTestRequest(t, "PUT", "/pic.png", testPNG(t, 100, 50, color.Black))
+	if w := doTestRequest(t, "GET", "/pic.png?width=20", ""); w.Code != 200 ||
+		w.Header().Get("Etag") == etag {
+		t.Errorf("Expected a new image for the new revision, got %v %v",
+			w.Code, w.Header().Get("Etag"))
+	}
+
+	for _, q := range []string{"width=0", "width=x", "width=99999",
+		"fit=cover&width=20", "fit=squash&width=20", "format=bmp"} {
+		if w := doTestRequest(t, "GET", "/pic.png?"+q, ""); w.Code != 400 {
+			t.Errorf("Expected %v to fail, got %v", q, w.Code)
+		}
+	}
+
+	doTestRequest(t, "PUT", "/not.txt", "just text")
+	if w := doTestRequest(t, "GET", "/not.txt?width=20", ""); w.Code != 415 {
+		t.Errorf("Expected resizing text to fail, got %v", w.Code)
+	}
+}
+
+func TestImageSourceLimits(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer func(m, s int64) { *imageMemory, *maxImageSource = m, s }(
+		*imageMemory, *maxImageSource)
+
+	pic := testPNG(t, 100, 50, color.White)
+	doTestRequest(t, "PUT", "/pic.png", pic)
+
+	*maxImageSource = int64(len(pic)) - 1
+	if w := doTestRequest(t, "GET", "/pic.png?width=20", ""); w.Code != 413 {
+		t.Errorf("Expected a source over the cap to fail, got %v", w.Code)
+	}
+	*maxImageSource = int64(len(pic))
+
+	*imageMemory = 100 * 50 * 4
+	if w := doTestRequest(t, "GET", "/pic.png?width=20", ""); w.Code != 413 {
+		t.Errorf("Expected an image over the memory budget to fail, got %v",
+			w.Code)
+	}
+	*imageMemory = 1 << 20
+	if w := doTestRequest(t, "GET", "/pic.png?width=20", ""); w.Code != 200 {
+		t.Errorf("Expected an image within the limits to resize, got %v %s",
+			w.Code, w.Body)
+	}
+
+	// An image isn't resized unless it's stored as one.
+	doTestRequest(t, "PUT", "/pic.dat", pic)
+	if w := doTestRequest(t, "GET", "/pic.dat?width=20", ""); w.Code != 415 {
+		t.Errorf("Expected an image stored as data to fail, got %v", w.Code)
+	}
+	if imageMem.used != 0 {
+		t.Errorf("Expected all image memory back, %v still used", imageMem.used)
+	}
+}
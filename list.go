@@ -44,7 +44,7 @@ func listFiles(path string, includeMeta bool,
 	groupLevel := len(startKey) + depth
 
 	// query the view
-	err := couchbase.ViewCustom("cbfs", "file_browse",
+	err := couchbase.View("file_browse",
 		map[string]interface{}{
 			"group_level": groupLevel,
 			"start_key":   startKey,
@@ -61,7 +61,7 @@ func listFiles(path string, includeMeta bool,
 	}
 
 	// do a multi-get on the all the keys returned
-	bulkResult, _, err := couchbase.GetBulk(keys)
+	bulkResult, err := couchbase.GetBulk(keys)
 	if err != nil {
 		return fileListing{}, err
 	}
@@ -80,7 +80,7 @@ func listFiles(path string, includeMeta bool,
 		if ok == true {
 			// this means we have a file
 			if includeMeta {
-				rm := json.RawMessage(res.Body)
+				rm := json.RawMessage(res)
 				files[name] = &rm
 			} else {
 				files[name] = emptyObject
@@ -17,14 +17,17 @@ import (
 
 	"github.com/couchbaselabs/cbfs/config"
 	"github.com/dustin/go-humanize"
-	"github.com/couchbase/gomemcached"
 	"github.com/dustin/httputil"
 )
 
 var bindAddr = flag.String("bind", ":8484", "Address to bind web thing to")
+var nodeZone = flag.String("zone", "",
+	"Failure domain (rack or zone) to spread replicas across")
 var root = flag.String("root", "storage", "Storage location")
 var couchbaseServer = flag.String("couchbase", "", "Couchbase URL")
 var couchbaseBucket = flag.String("bucket", "default", "Couchbase bucket")
+var embeddedMeta = flag.String("embeddedMeta", "",
+	"Path to an embedded metadata store (used instead of couchbase)")
 var cachePercentage = flag.Int("cachePercent", 100,
 	"Percentage of proxied requests to eagerly cache.")
 var enableViewProxy = flag.Bool("viewProxy", false,
@@ -57,6 +60,7 @@ func init() {
 type prevMeta struct {
 	Headers  http.Header `json:"headers"`
 	OID      string      `json:"oid"`
+	Chunks   []chunkRef  `json:"chunks,omitempty"`
 	Length   int64       `json:"length"`
 	Modified time.Time   `json:"modified"`
 	Revno    int         `json:"revno"`
@@ -66,12 +70,16 @@ type fileMeta struct {
 	Name     string           `json:"name,omitempty"`
 	Headers  http.Header      `json:"headers"`
 	OID      string           `json:"oid"`
+	Chunks   []chunkRef       `json:"chunks,omitempty"`
 	Length   int64            `json:"length"`
 	Userdata *json.RawMessage `json:"userdata,omitempty"`
 	Modified time.Time        `json:"modified"`
 	Previous []prevMeta       `json:"older"`
 	Revno    int              `json:"revno"`
 	Type     string           `json:"type"`
+	// Write-once retention; see retention.go
+	RetainUntil time.Time `json:"retainUntil,omitempty"`
+	LegalHold   bool      `json:"legalHold,omitempty"`
 }
 
 func (fm fileMeta) MarshalJSON() ([]byte, error) {
@@ -91,9 +99,18 @@ func (fm fileMeta) MarshalJSON() ([]byte, error) {
 	if fm.Name != "" {
 		m["name"] = fm.Name
 	}
+	if len(fm.Chunks) > 0 {
+		m["chunks"] = fm.Chunks
+	}
 	if len(fm.Previous) > 0 {
 		m["older"] = fm.Previous
 	}
+	if !fm.RetainUntil.IsZero() {
+		m["retainUntil"] = fm.RetainUntil
+	}
+	if fm.LegalHold {
+		m["legalHold"] = true
+	}
 	return json.Marshal(m)
 }
 
@@ -143,13 +160,39 @@ func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) er
 	if k != fn {
 		fm.Name = fn
 	}
-	return couchbase.Update(k, exp, func(in []byte) ([]byte, error) {
-		existing := fileMeta{}
+	if retentionOverride(fm.Headers) != "" {
+		h := http.Header{}
+		for hk, v := range fm.Headers {
+			h[hk] = v
+		}
+		h.Del(retentionOverrideHeader)
+		fm.Headers = h
+	}
+	applyRetention(fn, &fm, header)
+
+	op := "create"
+	existing := fileMeta{}
+	var overridden error
+	err := couchbase.Update(k, exp, func(in []byte) ([]byte, error) {
+		existing = fileMeta{}
 		err := json.Unmarshal(in, &existing)
 		if !shouldStoreMeta(header, err == nil, existing) {
 			return in, errUploadPrecondition
 		}
+		op = "create"
+		overridden = nil
 		if err == nil {
+			op = "update"
+			if rerr := retained(fn, existing, time.Now()); rerr != nil {
+				if retentionOverride(header) == "" {
+					return in, rerr
+				}
+				overridden = rerr
+			}
+			if existing.RetainUntil.After(fm.RetainUntil) {
+				fm.RetainUntil = existing.RetainUntil
+			}
+			fm.LegalHold = fm.LegalHold || existing.LegalHold
 			fm.Userdata = existing.Userdata
 			fm.Revno = existing.Revno + 1
 
@@ -157,6 +200,7 @@ func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) er
 				newMeta := prevMeta{
 					Headers:  existing.Headers,
 					OID:      existing.OID,
+					Chunks:   existing.Chunks,
 					Length:   existing.Length,
 					Modified: existing.Modified,
 					Revno:    existing.Revno,
@@ -173,6 +217,21 @@ func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) er
 		}
 		return json.Marshal(fm)
 	})
+	if err == nil {
+		if overridden != nil {
+			auditOverride(op, fn, existing, header, overridden)
+		}
+		if fm.held(time.Now()) {
+			holdBlobs(fm)
+		}
+		if op == "create" {
+			chargeQuota(fn, fm.Length, 1)
+		} else {
+			chargeQuota(fn, fm.Length-existing.Length, 0)
+		}
+		recordChange(op, fn, fm)
+	}
+	return err
 }
 
 func main() {
@@ -183,7 +242,12 @@ func main() {
 	initLogger(*useSyslog)
 	initNodeListKeys()
 
-	http.DefaultTransport = TimeoutTransport(*internodeTimeout)
+	if err := initTLS(); err != nil {
+		log.Fatalf("Error setting up TLS: %v", err)
+	}
+	t := TimeoutTransport(*internodeTimeout)
+	t.TLSClientConfig = tlsClientConfig
+	http.DefaultTransport = clusterTransport{t}
 	expvar.Publish("httpclients", httputil.InitHTTPTracker(false))
 
 	if getHash() == nil {
@@ -210,9 +274,21 @@ func main() {
 		maxStorage = int64(ms)
 	}
 
-	couchbase, err = dbConnect()
+	if *embeddedMeta != "" {
+		couchbase, err = openEmbeddedStore(*embeddedMeta)
+	} else {
+		couchbase, err = dbConnect()
+	}
 	if err != nil {
-		log.Fatalf("Can't connect to couchbase: %v", err)
+		log.Fatalf("Can't connect to the metadata store: %v", err)
+	}
+
+	if err = initBlobKeys(); err != nil {
+		log.Fatalf("Error loading encryption keys: %v", err)
+	}
+
+	if err = initBlobCodec(); err != nil {
+		log.Fatalf("Error configuring blob compression: %v", err)
 	}
 
 	if err = os.MkdirAll(*root, 0777); err != nil {
@@ -220,7 +296,7 @@ func main() {
 	}
 
 	err = updateConfig()
-	if err != nil && !gomemcached.IsNotFound(err) {
+	if err != nil && !isNotFound(err) {
 		log.Printf("Error updating initial config, using default: %v",
 			err)
 	}
@@ -230,11 +306,27 @@ func main() {
 	}
 
 	go reloadConfig()
+	initBandwidthLimits()
+
+	if err := updateAuthConfig(); err != nil {
+		log.Fatalf("Error loading auth config: %v", err)
+	}
+	if getAuthConfig().enabled() && !clusterAuthRequired() {
+		log.Fatalf("API keys are configured, so nodes need -clusterSecret " +
+			"or -tlsVerifyPeers to reach each other")
+	}
+	go reloadAuthConfig()
+
+	if err := updateRetentionPolicies(); err != nil {
+		log.Fatalf("Error loading retention policies: %v", err)
+	}
+	go reloadRetentionPolicies()
 
 	go dnsServices()
 
-	internodeTaskQueue = make(chan internodeTask, *taskWorkers*1024)
-	initTaskQueueWorkers()
+	if err := initTaskQueueWorkers(); err != nil {
+		log.Fatalf("Error opening internode task queue: %v", err)
+	}
 
 	go heartbeat()
 	go startTasks()
@@ -242,18 +334,20 @@ func main() {
 	time.AfterFunc(time.Second*time.Duration(rand.Intn(30)+5), grabSomeData)
 
 	go serveFrame()
+	go serveS3()
+	go serveDAV()
 
 	s := &http.Server{
 		Addr:        *bindAddr,
-		Handler:     http.HandlerFunc(httpHandler),
+		Handler:     instrumented(httpHandlerName, httpHandler),
 		ReadTimeout: *readTimeout,
 	}
-	log.Printf("Listening to web requests on %s as server %s",
-		*bindAddr, serverId)
+	log.Printf("Listening to web requests on %s as server %s (%v)",
+		*bindAddr, serverId, nodeScheme())
 
 	l, err := rateListen("tcp", *bindAddr)
 	if err != nil {
 		log.Fatalf("Error listening: %v", err)
 	}
-	log.Fatal(s.Serve(l))
+	log.Fatal(s.Serve(tlsListen(l)))
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// A MetaStore holds all of the cluster metadata (file meta, blob
+// ownership, node records, task markers, config, etc...).
+//
+// Expirations follow memcached conventions: 0 never expires, values
+// up to 30 days are relative seconds and anything larger is an
+// absolute unix time.
+type MetaStore interface {
+	// Get a JSON document into rv.
+	Get(k string, rv interface{}) error
+	// Get a JSON document into rv, recording its CAS identifier.
+	Gets(k string, rv interface{}, cas *uint64) error
+	// Get the raw bytes of a document.
+	GetRaw(k string) ([]byte, error)
+	// Get many documents at once.  Missing keys are absent from
+	// the result.
+	GetBulk(keys []string) (map[string][]byte, error)
+	// Store a value as JSON.
+	Set(k string, exp int, v interface{}) error
+	// Store raw bytes.
+	SetRaw(k string, exp int, v []byte) error
+	// Store a value as JSON iff the key doesn't already exist.
+	Add(k string, exp int, v interface{}) (bool, error)
+	// Store a value as JSON iff the CAS identifier still matches.
+	CAS(k string, exp int, cas uint64, v interface{}) error
+	// Atomically transform a document.  The callback receives nil
+	// for a missing document, may return cb.UpdateCancel to leave
+	// it alone, or return nil to delete it.
+	Update(k string, exp int, f func([]byte) ([]byte, error)) error
+	// Delete a document.
+	Delete(k string) error
+	// Increment a counter, initializing it to def if it's missing.
+	Incr(k string, amt, def uint64, exp int) (uint64, error)
+	// Query one of the cbfs views (see designDoc).
+	View(name string, params map[string]interface{}, vres interface{}) error
+}
+
+// The metadata store.  This is usually a couchbase bucket.
+var couchbase MetaStore
+
+var errNotFound = errors.New("not found")
+var errCASMismatch = errors.New("cas mismatch")
+
+func isNotFound(err error) bool {
+	return err == errNotFound || gomemcached.IsNotFound(err)
+}
+
+// The expiration for something that should go away after d.
+func expiryIn(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	if s := int(d.Seconds()); s <= maxRelativeExp {
+		return s
+	}
+	return int(time.Now().Add(d).Unix())
+}
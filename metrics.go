@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus text format metrics for scraping.  Request stats are
+// per node, blob and replica counts come from the views so they're
+// the same from every node.
+
+const metricsPath = "/.cbfs/metrics"
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1,
+	2.5, 5, 10, 30, 60}
+
+type latencyHisto struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *latencyHisto) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type requestKey struct {
+	handler, method string
+	code            int
+}
+
+type taskStat struct {
+	runs, failures uint64
+	sum, last      float64
+}
+
+var promStats = struct {
+	sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*latencyHisto
+	bytesIn   map[string]uint64
+	bytesOut  map[string]uint64
+	tasks     map[string]*taskStat
+
+	gcRun                        time.Time
+	gcRemoved, gcSkipped, gcKept int
+}{
+	requests:  map[requestKey]uint64{},
+	latencies: map[string]*latencyHisto{},
+	bytesIn:   map[string]uint64{},
+	bytesOut:  map[string]uint64{},
+	tasks:     map[string]*taskStat{},
+}
+
+// Bytes through the web listener.
+var netReadBytes, netWriteBytes uint64
+
+// Handler names come from the first path element after /.cbfs/ so
+// clients can't make up new ones.
+var knownHandlers = map[string]bool{}
+
+func init() {
+	for _, p := range []string{blobPrefix, nodePrefix, metaPrefix,
+		proxyPrefix, crudproxyPrefix, fetchPrefix, listPrefix,
+		configPrefix, zipPrefix, tarPrefix, fsckPrefix, taskPrefix,
+		pingPrefix, fileInfoPrefix, backupPrefix, quitPrefix,
+		debugPrefix, uploadPrefix, authPrefix, kmsRotatePrefix,
+		metricsPath, changesPrefix, renamePrefix, trashPrefix,
+		policyPath, quotaPrefix, queuePrefix, replicationPath} {
+
+		knownHandlers[handlerName(p, nil)] = true
+	}
+}
+
+func handlerName(path string, known map[string]bool) string {
+	if !strings.HasPrefix(path, "/.cbfs/") {
+		return "file"
+	}
+	rv := strings.SplitN(path[len("/.cbfs/"):], "/", 2)[0]
+	if known != nil && !known[rv] {
+		return "other"
+	}
+	return rv
+}
+
+func httpHandlerName(req *http.Request) string {
+	if davMounted(req.URL.Path, dirPath(*davPrefix)) {
+		return davHandlerName(req)
+	}
+	return handlerName(req.URL.Path, knownHandlers)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type metricsWriter struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (m *metricsWriter) WriteHeader(code int) {
+	if m.code == 0 {
+		m.code = code
+	}
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *metricsWriter) Write(b []byte) (int, error) {
+	if m.code == 0 {
+		m.code = 200
+	}
+	n, err := m.ResponseWriter.Write(b)
+	m.n += int64(n)
+	return n, err
+}
+
+// Keep sendfile working for blobs.
+func (m *metricsWriter) ReadFrom(r io.Reader) (int64, error) {
+	if m.code == 0 {
+		m.code = 200
+	}
+	var n int64
+	var err error
+	if rf, ok := m.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(m.ResponseWriter, r)
+	}
+	m.n += n
+	return n, err
+}
+
+func (m *metricsWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Wrap h to record request counts, latencies and sizes under the
+// handler name from name.
+func instrumented(name func(*http.Request) string,
+	h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w}
+		var body *countingReader
+		if req.Body != nil {
+			body = &countingReader{ReadCloser: req.Body}
+			req.Body = body
+		}
+		handler := name(req)
+
+		h(mw, req)
+
+		if mw.code == 0 {
+			mw.code = 200
+		}
+		promStats.Lock()
+		defer promStats.Unlock()
+		promStats.requests[requestKey{handler, req.Method, mw.code}]++
+		lh := promStats.latencies[handler]
+		if lh == nil {
+			lh = &latencyHisto{}
+			promStats.latencies[handler] = lh
+		}
+		lh.observe(time.Since(start).Seconds())
+		if body != nil {
+			promStats.bytesIn[handler] += uint64(body.n)
+		}
+		promStats.bytesOut[handler] += uint64(mw.n)
+	}
+}
+
+func recordTaskMetrics(name string, d time.Duration, err error) {
+	promStats.Lock()
+	defer promStats.Unlock()
+	ts := promStats.tasks[name]
+	if ts == nil {
+		ts = &taskStat{}
+		promStats.tasks[name] = ts
+	}
+	ts.runs++
+	if err != nil {
+		ts.failures++
+	}
+	ts.last = d.Seconds()
+	ts.sum += ts.last
+}
+
+func recordGCMetrics(removed, skipped, kept int) {
+	promStats.Lock()
+	defer promStats.Unlock()
+	promStats.gcRun = time.Now()
+	promStats.gcRemoved = removed
+	promStats.gcSkipped = skipped
+	promStats.gcKept = kept
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type promWriter struct {
+	w io.Writer
+}
+
+func (p promWriter) describe(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Labels are given as name, value pairs.
+func (p promWriter) sample(name string, v float64, labels ...string) {
+	l := ""
+	for i := 0; i+1 < len(labels); i += 2 {
+		if l != "" {
+			l += ","
+		}
+		l += labels[i] + `="` + promEscaper.Replace(labels[i+1]) + `"`
+	}
+	if l != "" {
+		name += "{" + l + "}"
+	}
+	fmt.Fprintf(p.w, "%s %s\n", name,
+		strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	rv := make([]string, 0, len(m))
+	for k := range m {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func writeRequestMetrics(p promWriter) {
+	promStats.Lock()
+	defer promStats.Unlock()
+
+	keys := make([]requestKey, 0, len(promStats.requests))
+	for k := range promStats.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.handler != b.handler {
+			return a.handler < b.handler
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	p.describe("cbfs_http_requests_total", "counter",
+		"HTTP requests by handler, method and status.")
+	for _, k := range keys {
+		p.sample("cbfs_http_requests_total",
+			float64(promStats.requests[k]), "handler", k.handler,
+			"method", k.method, "code", strconv.Itoa(k.code))
+	}
+
+	handlers := make([]string, 0, len(promStats.latencies))
+	for h := range promStats.latencies {
+		handlers = append(handlers, h)
+	}
+	sort.Strings(handlers)
+	p.describe("cbfs_http_request_duration_seconds", "histogram",
+		"HTTP request latencies by handler.")
+	for _, h := range handlers {
+		lh := promStats.latencies[h]
+		for i, b := range latencyBuckets {
+			p.sample("cbfs_http_request_duration_seconds_bucket",
+				float64(lh.counts[i]), "handler", h,
+				"le", strconv.FormatFloat(b, 'g', -1, 64))
+		}
+		p.sample("cbfs_http_request_duration_seconds_bucket",
+			float64(lh.count), "handler", h, "le", "+Inf")
+		p.sample("cbfs_http_request_duration_seconds_sum", lh.sum,
+			"handler", h)
+		p.sample("cbfs_http_request_duration_seconds_count",
+			float64(lh.count), "handler", h)
+	}
+
+	p.describe("cbfs_http_request_bytes_total", "counter",
+		"Request body bytes received by handler.")
+	for _, h := range sortedKeys(promStats.bytesIn) {
+		p.sample("cbfs_http_request_bytes_total",
+			float64(promStats.bytesIn[h]), "handler", h)
+	}
+	p.describe("cbfs_http_response_bytes_total", "counter",
+		"Response body bytes sent by handler.")
+	for _, h := range sortedKeys(promStats.bytesOut) {
+		p.sample("cbfs_http_response_bytes_total",
+			float64(promStats.bytesOut[h]), "handler", h)
+	}
+
+	p.describe("cbfs_network_read_bytes_total", "counter",
+		"Bytes read from web connections.")
+	p.sample("cbfs_network_read_bytes_total",
+		float64(atomic.LoadUint64(&netReadBytes)))
+	p.describe("cbfs_network_write_bytes_total", "counter",
+		"Bytes written to web connections.")
+	p.sample("cbfs_network_write_bytes_total",
+		float64(atomic.LoadUint64(&netWriteBytes)))
+}
+
+func writeTaskMetrics(p promWriter) {
+	promStats.Lock()
+	defer promStats.Unlock()
+
+	names := make([]string, 0, len(promStats.tasks))
+	for n := range promStats.tasks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	p.describe("cbfs_task_runs_total", "counter",
+		"Periodic task runs on this node.")
+	for _, n := range names {
+		p.sample("cbfs_task_runs_total",
+			float64(promStats.tasks[n].runs), "task", n)
+	}
+	p.describe("cbfs_task_failures_total", "counter",
+		"Periodic task runs that returned an error.")
+	for _, n := range names {
+		p.sample("cbfs_task_failures_total",
+			float64(promStats.tasks[n].failures), "task", n)
+	}
+	p.describe("cbfs_task_duration_seconds_total", "counter",
+		"Total time spent running each periodic task.")
+	for _, n := range names {
+		p.sample("cbfs_task_duration_seconds_total",
+			promStats.tasks[n].sum, "task", n)
+	}
+	p.describe("cbfs_task_last_duration_seconds", "gauge",
+		"How long the last run of each periodic task took.")
+	for _, n := range names {
+		p.sample("cbfs_task_last_duration_seconds",
+			promStats.tasks[n].last, "task", n)
+	}
+
+	if !promStats.gcRun.IsZero() {
+		p.describe("cbfs_gc_last_run_timestamp_seconds", "gauge",
+			"When this node last finished garbage collection.")
+		p.sample("cbfs_gc_last_run_timestamp_seconds",
+			float64(promStats.gcRun.Unix()))
+		p.describe("cbfs_gc_last_blobs", "gauge",
+			"Blobs handled by the last garbage collection.")
+		p.sample("cbfs_gc_last_blobs", float64(promStats.gcRemoved),
+			"result", "removed")
+		p.sample("cbfs_gc_last_blobs", float64(promStats.gcSkipped),
+			"result", "skipped")
+		p.sample("cbfs_gc_last_blobs", float64(promStats.gcKept),
+			"result", "backup")
+	}
+
+	depth := 0
+	if internodeTaskQueue != nil {
+		depth = internodeTaskQueue.len()
+	}
+	p.describe("cbfs_internode_queue_depth", "gauge",
+		"Blob moves and removals waiting for a worker.")
+	p.sample("cbfs_internode_queue_depth", float64(depth))
+}
+
+func writeBlobMetrics(p promWriter) {
+	garbageRes := struct {
+		Rows []struct {
+			Key   string
+			Value struct {
+				Count float64
+				Sum   float64
+			}
+		}
+	}{}
+	err := couchbase.View("garbage",
+		map[string]interface{}{"group": true}, &garbageRes)
+	if err != nil {
+		log.Printf("Error getting blob counts for metrics: %v", err)
+	} else {
+		p.describe("cbfs_blobs", "gauge", "Blobs in the cluster.")
+		for _, r := range garbageRes.Rows {
+			p.sample("cbfs_blobs", r.Value.Count, "state", r.Key)
+		}
+		p.describe("cbfs_blob_bytes", "gauge",
+			"Bytes of blob content in the cluster (one copy each).")
+		for _, r := range garbageRes.Rows {
+			p.sample("cbfs_blob_bytes", r.Value.Sum, "state", r.Key)
+		}
+	}
+
+	repRes := struct {
+		Rows []struct {
+			Key   int
+			Value float64
+		}
+	}{}
+	err = couchbase.View("repcounts",
+		map[string]interface{}{"group": true}, &repRes)
+	if err != nil {
+		log.Printf("Error getting replica counts for metrics: %v", err)
+	} else {
+		p.describe("cbfs_blob_replicas", "gauge",
+			"Replicated blobs by number of copies.")
+		for _, r := range repRes.Rows {
+			p.sample("cbfs_blob_replicas", r.Value,
+				"replicas", strconv.Itoa(r.Key))
+		}
+	}
+}
+
+func doGetMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p := promWriter{w}
+	writeRequestMetrics(p)
+	writeTaskMetrics(p)
+	writeBlobMetrics(p)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerName(t *testing.T) {
+	tests := map[string]string{
+		"/some/file":          "file",
+		"/.cbfs/blob/abc":     "blob",
+		"/.cbfs/info/file/x":  "info",
+		"/.cbfs/metrics":      "metrics",
+		"/.cbfs/madeup/thing": "other",
+	}
+	for path, exp := range tests {
+		if got := handlerName(path, knownHandlers); got != exp {
+			t.Errorf("Expected %v for %v, got %v", exp, path, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	h := instrumented(httpHandlerName, httpHandler)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost"+path,
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	do("PUT", "/m/a", "hello")
+	do("GET", "/m/a", "")
+	do("GET", "/m/missing", "")
+	recordTaskMetrics("garbageCollectBlobs", time.Second, nil)
+	recordTaskMetrics("garbageCollectBlobs", time.Second, errors.New("x"))
+
+	w := do("GET", metricsPath, "")
+	if w.Code != 200 {
+		t.Fatalf("Error getting metrics: %v %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, exp := range []string{
+		`cbfs_http_requests_total{handler="file",method="PUT",code="201"} 1`,
+		`cbfs_http_requests_total{handler="file",method="GET",code="404"} 1`,
+		`cbfs_http_request_duration_seconds_count{handler="file"} 3`,
+		`cbfs_http_request_bytes_total{handler="file"} 5`,
+		`cbfs_task_runs_total{task="garbageCollectBlobs"} 2`,
+		`cbfs_task_failures_total{task="garbageCollectBlobs"} 1`,
+		`cbfs_blobs{state="live"} 1`,
+		`cbfs_blob_replicas{replicas="1"} 1`,
+		"# TYPE cbfs_internode_queue_depth gauge",
+	} {
+		if !strings.Contains(body, exp+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", exp, body)
+		}
+	}
+}
@@ -8,10 +8,10 @@ import (
 	"math/rand"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/couchbase/gomemcached"
 	cb "github.com/couchbaselabs/go-couchbase"
 )
 
@@ -33,6 +33,8 @@ type StorageNode struct {
 	Used      int64     `json:"used"`
 	Free      int64     `json:"free"`
 	Version   string    `json:"version"`
+	Scheme    string    `json:"scheme,omitempty"`
+	Zone      string    `json:"zone,omitempty"`
 
 	name        string
 	storageSize int64
@@ -71,14 +73,26 @@ func (a StorageNode) ClientForTransfer(l int64) *http.Client {
 	return a.Client()
 }
 
+func (a StorageNode) scheme() string {
+	if a.Scheme == "" {
+		return "http"
+	}
+	return a.Scheme
+}
+
+// The scheme and address to reach this node's web server at.
+func (a StorageNode) URLBase() string {
+	return a.scheme() + "://" + a.Address()
+}
+
 func (a StorageNode) BlobURL(h string) string {
-	return fmt.Sprintf("http://%s/.cbfs/blob/%s",
-		a.Address(), h)
+	return fmt.Sprintf("%s/.cbfs/blob/%s",
+		a.URLBase(), h)
 }
 
 func (a StorageNode) fetchURL(h string) string {
-	return fmt.Sprintf("http://%s/.cbfs/fetch/%s",
-		a.Address(), h)
+	return fmt.Sprintf("%s/.cbfs/fetch/%s",
+		a.URLBase(), h)
 }
 
 func (n StorageNode) IsDead() bool {
@@ -121,9 +135,11 @@ func (a NodeList) Swap(i, j int) {
 }
 
 // Ask a node to acquire a blob.
-func (n StorageNode) acquireBlob(oid, prevNode string) error {
+func (n StorageNode) acquireBlob(oid, prevNode string,
+	pri taskPriority) error {
+
 	if n.IsLocal() {
-		if !maybeQueueBlobFetch(oid, prevNode) {
+		if !maybeQueueBlobFetch(oid, prevNode, pri) {
 			return notQueued
 		}
 	} else {
@@ -133,6 +149,7 @@ func (n StorageNode) acquireBlob(oid, prevNode string) error {
 		}
 
 		req.Header.Set("X-Prevnode", prevNode)
+		req.Header.Set("X-CBFS-Priority", strconv.Itoa(int(pri)))
 
 		resp, err := n.Client().Do(req)
 		if err != nil {
@@ -203,7 +220,7 @@ func (n StorageNode) iterateBlobs(ch chan<- string, cherr chan<- error,
 		if startDocId != "" {
 			params["startkey_docid"] = cb.DocID(startDocId)
 		}
-		err := couchbase.ViewCustom("cbfs", "node_blobs", params,
+		err := couchbase.View("node_blobs", params,
 			&viewRes)
 		if err != nil {
 			cherr <- err
@@ -241,18 +258,18 @@ func findAllNodes() (NodeList, error) {
 
 	rv := make(NodeList, 0, len(nodeSizes))
 
-	bres, _, err := couchbase.GetBulk(nodeKeys)
+	bres, err := couchbase.GetBulk(nodeKeys)
 	if err != nil {
 		return nil, err
 	}
-	for nid, mcresp := range bres {
-		if mcresp.Status != gomemcached.SUCCESS {
-			log.Printf("Error fetching %v: %v", nid, mcresp)
-			continue
+	for _, k := range nodeKeys {
+		if _, ok := bres[k]; !ok {
+			log.Printf("Error fetching %v: not found", k)
 		}
-
+	}
+	for nid, body := range bres {
 		node := StorageNode{}
-		err = json.Unmarshal(mcresp.Body, &node)
+		err = json.Unmarshal(body, &node)
 		if err != nil {
 			log.Printf("Error unmarshalling storage node %v: %v",
 				nid, err)
@@ -284,7 +301,7 @@ func updateNodeSizes() error {
 		}
 	}{}
 
-	err := couchbase.ViewCustom("cbfs", "node_size",
+	err := couchbase.View("node_size",
 		map[string]interface{}{
 			"group_level": 1,
 		}, &viewRes)
@@ -370,6 +387,17 @@ func (nl NodeList) withNoMoreThan(free int64) NodeList {
 	return rv
 }
 
+// Find nodes that have heartbeated recently enough not to be stale.
+func (nl NodeList) alive() NodeList {
+	rv := NodeList{}
+	for _, node := range nl {
+		if time.Since(node.Time) < globalConfig.StaleNodeLimit {
+			rv = append(rv, node)
+		}
+	}
+	return rv
+}
+
 func (nl NodeList) candidatesFor(oid string, exclude NodeList) NodeList {
 	// Find the owners of this blob
 	ownership := BlobOwnership{}
@@ -383,7 +411,71 @@ func (nl NodeList) candidatesFor(oid string, exclude NodeList) NodeList {
 	owners := ownership.ResolveNodes()
 
 	// Find a good destination candidate.
-	return nl.minus(owners).withAtLeast(ownership.Length)
+	return nl.minus(owners).withAtLeast(ownership.Length).
+		spreadFrom(owners.zones())
+}
+
+// The failure domains these nodes are in.
+func (nl NodeList) zones() map[string]bool {
+	rv := map[string]bool{}
+	for _, n := range nl {
+		rv[n.Zone] = true
+	}
+	return rv
+}
+
+// Find the nodes outside the given zones.
+func (nl NodeList) outside(zones map[string]bool) NodeList {
+	rv := NodeList{}
+	for _, n := range nl {
+		if !zones[n.Zone] {
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+// Reorder nl so the first node from each zone not already used comes
+// first, followed by the rest in their original order.
+func (nl NodeList) spreadFrom(used map[string]bool) NodeList {
+	seen := map[string]bool{}
+	for z := range used {
+		seen[z] = true
+	}
+	rv := make(NodeList, 0, len(nl))
+	rest := NodeList{}
+	for _, n := range nl {
+		if seen[n.Zone] {
+			rest = append(rest, n)
+		} else {
+			seen[n.Zone] = true
+			rv = append(rv, n)
+		}
+	}
+	return append(rv, rest...)
+}
+
+// Order the holders of a blob for pruning, taking from the most
+// crowded zone each time.
+func (nl NodeList) pruneOrder() NodeList {
+	counts := map[string]int{}
+	for _, n := range nl {
+		counts[n.Zone]++
+	}
+	remaining := append(NodeList{}, nl...)
+	rv := make(NodeList, 0, len(nl))
+	for len(remaining) > 0 {
+		best := 0
+		for i, n := range remaining {
+			if counts[n.Zone] > counts[remaining[best].Zone] {
+				best = i
+			}
+		}
+		counts[remaining[best].Zone]--
+		rv = append(rv, remaining[best])
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return rv
 }
 
 func (nl NodeList) BlobURLs(h string) []string {
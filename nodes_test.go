@@ -25,3 +25,63 @@ func TestNodeSorting(t *testing.T) {
 		t.Fatalf("Error:  wrong order:  %v", nl)
 	}
 }
+
+func TestNodeURLs(t *testing.T) {
+	n := StorageNode{Addr: "10.0.0.1", BindAddr: ":8484"}
+	if got := n.BlobURL("abc"); got != "http://10.0.0.1:8484/.cbfs/blob/abc" {
+		t.Errorf("Unexpected blob URL: %v", got)
+	}
+	n.Scheme = "https"
+	if got := n.fetchURL("abc"); got != "https://10.0.0.1:8484/.cbfs/fetch/abc" {
+		t.Errorf("Unexpected fetch URL: %v", got)
+	}
+}
+
+func nodeNames(nl NodeList) string {
+	rv := ""
+	for _, n := range nl {
+		rv += n.name
+	}
+	return rv
+}
+
+func TestZonePlacement(t *testing.T) {
+	nl := NodeList{
+		{name: "a", Zone: "r1"},
+		{name: "b", Zone: "r1"},
+		{name: "c", Zone: "r2"},
+		{name: "d", Zone: "r2"},
+		{name: "e", Zone: "r3"},
+	}
+
+	tests := []struct {
+		used map[string]bool
+		exp  string
+	}{
+		{map[string]bool{}, "acebd"},
+		{map[string]bool{"r1": true}, "ceabd"},
+		{map[string]bool{"r1": true, "r2": true, "r3": true}, "abcde"},
+	}
+	for _, test := range tests {
+		if got := nodeNames(nl.spreadFrom(test.used)); got != test.exp {
+			t.Errorf("Expected %v spreading from %v, got %v",
+				test.exp, test.used, got)
+		}
+	}
+
+	if got := nodeNames(nl.outside(NodeList{nl[0], nl[2]}.zones())); got != "e" {
+		t.Errorf("Expected only e outside r1 and r2, got %v", got)
+	}
+
+	// Holders a, b and c: one of the r1 pair goes first.
+	got := nodeNames(NodeList{nl[0], nl[1], nl[2]}.pruneOrder())
+	if got[0] != 'a' && got[0] != 'b' {
+		t.Errorf("Expected to prune from r1 first, got %v", got)
+	}
+
+	// Without zones, nothing changes.
+	plain := NodeList{{name: "x"}, {name: "y"}, {name: "z"}}
+	if got := nodeNames(plain.spreadFrom(map[string]bool{"": true})); got != "xyz" {
+		t.Errorf("Expected unzoned order to be kept, got %v", got)
+	}
+}
@@ -64,7 +64,7 @@ func pathGenerator(from string, ch chan *namedFile,
 	}()
 
 	for !done {
-		err := couchbase.ViewCustom("cbfs", "file_browse",
+		err := couchbase.View("file_browse",
 			map[string]interface{}{
 				"stale":    false,
 				"reduce":   false,
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+// A node that stores whatever's posted to it, or fails after reading
+// it if it's broken.
+type fakeBlobNode struct {
+	mu     sync.Mutex
+	broken bool
+	blobs  map[string]string
+}
+
+func (f *fakeBlobNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, _ := ioutil.ReadAll(req.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Method != "POST" || req.URL.Path != blobPrefix || f.broken {
+		http.Error(w, "no", 500)
+		return
+	}
+	sh := getHash()
+	sh.Write(data)
+	h := hex.EncodeToString(sh.Sum(nil))
+	f.blobs[h] = string(data)
+	w.Header().Set("X-CBFS-Hash", h)
+	w.WriteHeader(201)
+}
+
+func (f *fakeBlobNode) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.blobs)
+}
+
+func withFakeNodes(t *testing.T, nodes ...*fakeBlobNode) func() {
+	reg := NodeRegistry{Nodes: map[string]int64{}}
+	servers := []*httptest.Server{}
+	for i, n := range nodes {
+		n.blobs = map[string]string{}
+		srv := httptest.NewServer(n)
+		servers = append(servers, srv)
+		name := "fake" + string('a'+rune(i))
+		reg.Nodes[name] = 0
+		sn := StorageNode{
+			Addr:     "127.0.0.1",
+			Type:     "storage",
+			Time:     time.Now().UTC(),
+			BindAddr: strings.TrimPrefix(srv.URL, "http://"),
+			Free:     1 << 40,
+		}
+		if err := couchbase.Set("/"+name, 0, sn); err != nil {
+			t.Fatalf("Error registering %v: %v", name, err)
+		}
+	}
+	if err := couchbase.Set(nodeListPrefix, 0, reg); err != nil {
+		t.Fatalf("Error registering nodes: %v", err)
+	}
+	return func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+}
+
+func putWithQuorum(t *testing.T, path, quorum, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("PUT", "http://localhost"+path,
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	if quorum != "" {
+		req.Header.Set("X-CBFS-Quorum", quorum)
+	}
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	return w
+}
+
+func TestWriteQuorum(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer func(c cbfsconfig.CBFSConfig) { *globalConfig = c }(*globalConfig)
+	globalConfig.MinReplicas = 1
+
+	a, b := &fakeBlobNode{}, &fakeBlobNode{}
+	defer withFakeNodes(t, a, b)()
+
+	if w := putWithQuorum(t, "/three", "3", "everywhere"); w.Code != 201 {
+		t.Fatalf("Error storing with a quorum of 3: %v %s", w.Code, w.Body)
+	}
+	if a.count() != 1 || b.count() != 1 {
+		t.Errorf("Expected a copy on each node, got %v/%v", a.count(), b.count())
+	}
+
+	if w := putWithQuorum(t, "/two", "2", "somewhere"); w.Code != 201 ||
+		a.count()+b.count() != 3 {
+		t.Errorf("Expected one more copy, got %v, %v/%v",
+			w.Code, a.count(), b.count())
+	}
+
+	if w := putWithQuorum(t, "/four", "4", "too many"); w.Code != 503 {
+		t.Errorf("Expected a quorum bigger than the cluster to fail, got %v",
+			w.Code)
+	}
+	if w := doTestRequest(t, "GET", "/four", ""); w.Code != 404 {
+		t.Errorf("Expected no file after a failed quorum, got %v", w.Code)
+	}
+
+	b.mu.Lock()
+	b.broken = true
+	b.mu.Unlock()
+	if w := putWithQuorum(t, "/broken", "3", "half"); w.Code != 503 {
+		t.Errorf("Expected a broken node to fail the quorum, got %v", w.Code)
+	}
+	b.mu.Lock()
+	b.broken = false
+	b.mu.Unlock()
+
+	globalConfig.WriteQuorum = 2
+	if w := putWithQuorum(t, "/default", "", "config"); w.Code != 201 {
+		t.Errorf("Expected the configured quorum to be met, got %v %s",
+			w.Code, w.Body)
+	}
+	globalConfig.WriteQuorum = 4
+	if w := putWithQuorum(t, "/default", "", "config"); w.Code != 503 {
+		t.Errorf("Expected the configured quorum to fail, got %v", w.Code)
+	}
+	if w := putWithQuorum(t, "/one", "1", "just us"); w.Code != 201 {
+		t.Errorf("Expected a quorum of 1 to override, got %v", w.Code)
+	}
+
+	for _, q := range []string{"0", "-1", "many"} {
+		if w := putWithQuorum(t, "/bad", q, "x"); w.Code != 400 {
+			t.Errorf("Expected quorum %q to be rejected, got %v", q, w.Code)
+		}
+	}
+}
+
+func putWithHeaders(t *testing.T, path, body string,
+	hdr ...string) *httptest.ResponseRecorder {
+
+	req, err := http.NewRequest("PUT", "http://localhost"+path,
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	for i := 0; i < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	return w
+}
+
+func TestWriteQuorumPaths(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer func(c cbfsconfig.CBFSConfig) { *globalConfig = c }(*globalConfig)
+	globalConfig.MinReplicas = 1
+
+	a, b := &fakeBlobNode{}, &fakeBlobNode{}
+	defer withFakeNodes(t, a, b)()
+
+	if w := putWithHeaders(t, "/unsafe", "x", "X-CBFS-Unsafe", "true",
+		"X-CBFS-Quorum", "3"); w.Code != 400 {
+		t.Errorf("Expected an unsafe quorum of 3 to fail, got %v", w.Code)
+	}
+	if w := putWithHeaders(t, "/unsafe", "x", "X-CBFS-Unsafe", "true",
+		"X-CBFS-Quorum", "1"); w.Code != 201 {
+		t.Errorf("Expected an unsafe quorum of 1 to work, got %v", w.Code)
+	}
+
+	// A chunk we alone have is stored again to meet a bigger quorum.
+	data := string(textContent(1000))
+	if w := putWithHeaders(t, "/mine", data, "X-CBFS-Chunked", "true",
+		"X-CBFS-Quorum", "1"); w.Code != 201 || a.count()+b.count() != 0 {
+		t.Fatalf("Error storing a single chunk: %v, %v/%v",
+			w.Code, a.count(), b.count())
+	}
+	if w := putWithHeaders(t, "/ours", data, "X-CBFS-Chunked", "true",
+		"X-CBFS-Quorum", "2"); w.Code != 201 || a.count()+b.count() != 1 {
+		t.Errorf("Expected another copy of the chunk, got %v, %v/%v",
+			w.Code, a.count(), b.count())
+	}
+
+	// Uploads take their quorum from the completing POST.
+	for _, test := range []struct {
+		quorum string
+		code   int
+	}{{"x", 400}, {"4", 503}, {"3", 201}} {
+		w := doTestRequest(t, "POST", uploadPrefix+"?path=up", "")
+		u := uploadSession{}
+		if w.Code != 201 || json.Unmarshal(w.Body.Bytes(), &u) != nil {
+			t.Fatalf("Error starting upload: %v %s", w.Code, w.Body)
+		}
+		doTestRequest(t, "PUT", uploadPrefix+u.ID+"/1", "up "+test.quorum)
+		req, _ := http.NewRequest("POST", "http://localhost"+uploadPrefix+u.ID, nil)
+		req.Header.Set("X-CBFS-Quorum", test.quorum)
+		w = httptest.NewRecorder()
+		httpHandler(w, req)
+		if w.Code != test.code {
+			t.Errorf("Expected completing with quorum %v to give %v, got %v %s",
+				test.quorum, test.code, w.Code, w.Body)
+		}
+	}
+}
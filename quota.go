@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Quotas cap the bytes and files stored under a path prefix:
+//
+//   GET    /.cbfs/quota/[prefix/]   -> every quota, or just one
+//   PUT    /.cbfs/quota/prefix/     -> {"maxBytes": N, "maxFiles": N}
+//   POST   /.cbfs/quota/prefix/     -> recount its usage
+//   DELETE /.cbfs/quota/prefix/     -> remove it
+//
+// Usage is tracked as files come and go, and recounted from
+// file_browse when a quota is set.  Files that expire on their own
+// aren't noticed until the next recount.  Stores that would go over a
+// quota fail with 507, checked up front against the declared length
+// and again against what was actually stored.
+
+type quota struct {
+	Type   string `json:"type,omitempty"`
+	Prefix string `json:"prefix"`
+	// 0 means no limit.
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int64 `json:"maxFiles"`
+	Bytes    int64 `json:"bytes"`
+	Files    int64 `json:"files"`
+}
+
+type quotaError struct {
+	prefix string
+	what   string
+}
+
+func (e quotaError) Error() string {
+	return fmt.Sprintf("%v quota exceeded for %q", e.what, e.prefix)
+}
+
+func isOverQuota(err error) bool {
+	_, ok := err.(quotaError)
+	return ok
+}
+
+func quotaKey(prefix string) string {
+	return shortName("/@quota/" + prefix)
+}
+
+// The directories a quota for fn could be on, from the top down.
+func quotaPrefixes(fn string) []string {
+	rv := []string{""}
+	parts := strings.Split(fn, "/")
+	for i := 1; i < len(parts); i++ {
+		rv = append(rv, strings.Join(parts[:i], "/")+"/")
+	}
+	return rv
+}
+
+// The quotas that cover fn, by key.
+func quotasFor(fn string) (map[string]quota, error) {
+	keys := []string{}
+	for _, p := range quotaPrefixes(fn) {
+		keys = append(keys, quotaKey(p))
+	}
+	docs, err := couchbase.GetBulk(keys)
+	if err != nil {
+		return nil, err
+	}
+	rv := map[string]quota{}
+	for k, data := range docs {
+		q := quota{}
+		if json.Unmarshal(data, &q) == nil && q.Type == "quota" {
+			rv[k] = q
+		}
+	}
+	return rv, nil
+}
+
+// Make sure storing length bytes at fn (replacing whatever's there)
+// keeps within its quotas.
+func checkQuota(fn string, length int64) error {
+	bytes, files := length, int64(1)
+	old := fileMeta{}
+	if err := couchbase.Get(shortName(fn), &old); err == nil && old.Type == "file" {
+		bytes -= old.Length
+		files = 0
+	}
+
+	qs, err := quotasFor(fn)
+	if err != nil {
+		return err
+	}
+	return overQuota(qs, bytes, files)
+}
+
+// Make sure moving a file of length bytes from src to dst keeps
+// within the quotas dst is under and src isn't.
+func checkRenameQuota(src, dst string, length int64) error {
+	from, err := quotasFor(src)
+	if err != nil {
+		return err
+	}
+	to, err := quotasFor(dst)
+	if err != nil {
+		return err
+	}
+	for k := range from {
+		delete(to, k)
+	}
+	return overQuota(to, length, 1)
+}
+
+// Bytes and files added under fn (negative if removed).  Moves from
+// another path don't change the quotas both are under.
+type quotaChange struct {
+	fn           string
+	bytes, files int64
+	from         string
+}
+
+// Make sure a set of changes made together keeps within every quota
+// they touch.
+func checkQuotaChanges(changes []quotaChange) error {
+	qs := map[string]quota{}
+	bytes, files := map[string]int64{}, map[string]int64{}
+	for _, c := range changes {
+		to, err := quotasFor(c.fn)
+		if err != nil {
+			return err
+		}
+		if c.from != "" {
+			from, err := quotasFor(c.from)
+			if err != nil {
+				return err
+			}
+			for k := range from {
+				delete(to, k)
+			}
+		}
+		for k, q := range to {
+			qs[k] = q
+			bytes[k] += c.bytes
+			files[k] += c.files
+		}
+	}
+	for k, q := range qs {
+		if err := overQuota(map[string]quota{k: q}, bytes[k], files[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func overQuota(qs map[string]quota, bytes, files int64) error {
+	for _, q := range qs {
+		switch {
+		case q.MaxBytes > 0 && bytes > 0 && q.Bytes+bytes > q.MaxBytes:
+			return quotaError{q.Prefix, "storage"}
+		case q.MaxFiles > 0 && files > 0 && q.Files+files > q.MaxFiles:
+			return quotaError{q.Prefix, "file"}
+		}
+	}
+	return nil
+}
+
+// Charge fn's quotas for a change in what's stored there.
+func chargeQuota(fn string, bytes, files int64) {
+	if bytes == 0 && files == 0 {
+		return
+	}
+	qs, err := quotasFor(fn)
+	if err != nil {
+		log.Printf("Error finding quotas for %v: %v", fn, err)
+		return
+	}
+	for k := range qs {
+		err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+			q := quota{}
+			if len(in) == 0 || json.Unmarshal(in, &q) != nil {
+				return nil, cb.UpdateCancel
+			}
+			q.Bytes += bytes
+			q.Files += files
+			return json.Marshal(q)
+		})
+		if err != nil && err != cb.UpdateCancel {
+			log.Printf("Error updating quota %v for %v: %v", k, fn, err)
+		}
+	}
+}
+
+// Add up what's under prefix.
+func countUsage(prefix string) (bytes, files int64, err error) {
+	startKey := []interface{}{}
+	if p := strings.TrimSuffix(prefix, "/"); p != "" {
+		for _, k := range strings.Split(p, "/") {
+			startKey = append(startKey, k)
+		}
+	}
+	endKey := append(append([]interface{}{}, startKey...),
+		&(json.RawMessage{'{', '}'}))
+
+	viewRes := struct {
+		Rows []struct {
+			Value struct {
+				Count, Sum int64
+			}
+		}
+	}{}
+	err = couchbase.View("file_browse",
+		map[string]interface{}{
+			"startkey": startKey,
+			"endkey":   endKey,
+		}, &viewRes)
+	if err != nil || len(viewRes.Rows) == 0 {
+		return 0, 0, err
+	}
+	return viewRes.Rows[0].Value.Sum, viewRes.Rows[0].Value.Count, nil
+}
+
+// Recount the usage of an existing quota, optionally setting new
+// limits on the way.
+func recountQuota(prefix string, limits *quota) (quota, error) {
+	bytes, files, err := countUsage(prefix)
+	if err != nil {
+		return quota{}, err
+	}
+	var rv quota
+	err = couchbase.Update(quotaKey(prefix), 0, func(in []byte) ([]byte, error) {
+		rv = quota{}
+		if len(in) > 0 {
+			if err := json.Unmarshal(in, &rv); err != nil {
+				return nil, err
+			}
+		} else if limits == nil {
+			return nil, errNotFound
+		}
+		if limits != nil {
+			rv.MaxBytes, rv.MaxFiles = limits.MaxBytes, limits.MaxFiles
+		}
+		rv.Type, rv.Prefix = "quota", prefix
+		rv.Bytes, rv.Files = bytes, files
+		return json.Marshal(rv)
+	})
+	return rv, err
+}
+
+func listQuotas() ([]quota, error) {
+	viewRes := struct {
+		Rows []struct {
+			Id string
+		}
+	}{}
+	err := couchbase.View("quotas",
+		map[string]interface{}{"stale": false}, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, r := range viewRes.Rows {
+		ids = append(ids, r.Id)
+	}
+	docs, err := couchbase.GetBulk(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []quota{}
+	for _, id := range ids {
+		q := quota{}
+		if data, ok := docs[id]; ok && json.Unmarshal(data, &q) == nil {
+			q.Type = ""
+			rv = append(rv, q)
+		}
+	}
+	return rv, nil
+}
+
+func doGetQuota(w http.ResponseWriter, req *http.Request, prefix string) {
+	prefix = dirPath(strings.Trim(prefix, "/"))
+	if prefix == "" {
+		rv, err := listQuotas()
+		if err != nil {
+			log.Printf("Error listing quotas: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		sendJson(w, req, rv)
+		return
+	}
+
+	q := quota{}
+	if err := couchbase.Get(quotaKey(prefix), &q); err != nil {
+		http.Error(w, "No quota for "+prefix, 404)
+		return
+	}
+	q.Type = ""
+	sendJson(w, req, q)
+}
+
+func doSetQuota(w http.ResponseWriter, req *http.Request, prefix string) {
+	prefix = dirPath(strings.Trim(prefix, "/"))
+
+	var limits *quota
+	if req.Method == "PUT" {
+		limits = &quota{}
+		if err := json.NewDecoder(req.Body).Decode(limits); err != nil {
+			http.Error(w, "Error reading quota: "+err.Error(), 400)
+			return
+		}
+		if limits.MaxBytes < 0 || limits.MaxFiles < 0 {
+			http.Error(w, "Quotas can't be negative", 400)
+			return
+		}
+	}
+
+	q, err := recountQuota(prefix, limits)
+	switch {
+	case err == errNotFound:
+		http.Error(w, "No quota for "+prefix, 404)
+		return
+	case err != nil:
+		log.Printf("Error setting quota for %q: %v", prefix, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	log.Printf("Quota for %q: %v/%v bytes, %v/%v files", prefix,
+		q.Bytes, q.MaxBytes, q.Files, q.MaxFiles)
+	q.Type = ""
+	sendJson(w, req, q)
+}
+
+func doDeleteQuota(w http.ResponseWriter, req *http.Request, prefix string) {
+	prefix = dirPath(strings.Trim(prefix, "/"))
+	if err := couchbase.Delete(quotaKey(prefix)); err != nil {
+		http.Error(w, "No quota for "+prefix, 404)
+		return
+	}
+	log.Printf("Removed quota for %q", prefix)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getTestQuota(t *testing.T, prefix string) quota {
+	q := quota{}
+	w := doTestRequest(t, "GET", quotaPrefix+prefix, "")
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &q) != nil {
+		t.Fatalf("Error getting quota for %v: %v %s", prefix, w.Code, w.Body)
+	}
+	return q
+}
+
+func TestQuota(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	if w := doTestRequest(t, "PUT", "/team/old.txt", "12345"); w.Code != 201 {
+		t.Fatalf("Error storing: %v %s", w.Code, w.Body)
+	}
+
+	w := doTestRequest(t, "PUT", quotaPrefix+"team",
+		`{"maxBytes": 20, "maxFiles": 3}`)
+	if w.Code != 200 {
+		t.Fatalf("Error setting quota: %v %s", w.Code, w.Body)
+	}
+	if q := getTestQuota(t, "team/"); q.Bytes != 5 || q.Files != 1 {
+		t.Errorf("Expected existing usage to be counted, got %+v", q)
+	}
+
+	doTestRequest(t, "PUT", "/team/a.txt", "0123456789")
+	doTestRequest(t, "PUT", "/team/old.txt", "123")
+	doTestRequest(t, "PUT", "/other.txt", "not counted")
+	if q := getTestQuota(t, "team/"); q.Bytes != 13 || q.Files != 2 {
+		t.Errorf("Expected 13 bytes in 2 files, got %+v", q)
+	}
+
+	if w := doTestRequest(t, "PUT", "/team/big.txt", "0123456789"); w.Code != 507 {
+		t.Errorf("Expected storage quota to be enforced, got %v %s", w.Code, w.Body)
+	}
+	if w := doTestRequest(t, "PUT", "/team/b.txt", "x"); w.Code != 201 {
+		t.Errorf("Error storing within quota: %v %s", w.Code, w.Body)
+	}
+	if w := doTestRequest(t, "PUT", "/team/c.txt", "y"); w.Code != 507 {
+		t.Errorf("Expected file quota to be enforced, got %v %s", w.Code, w.Body)
+	}
+
+	doTestRequest(t, "DELETE", "/team/a.txt", "")
+	doTestRequest(t, "POST", renamePrefix+"team/b.txt?to=gone.txt", "")
+	if q := getTestQuota(t, "team/"); q.Bytes != 3 || q.Files != 1 {
+		t.Errorf("Expected 3 bytes in 1 file, got %+v", q)
+	}
+
+	quotas := []quota{}
+	w = doTestRequest(t, "GET", quotaPrefix, "")
+	if json.Unmarshal(w.Body.Bytes(), &quotas) != nil || len(quotas) != 1 {
+		t.Errorf("Expected one quota listed, got %v %s", w.Code, w.Body)
+	}
+
+	if w := doTestRequest(t, "DELETE", quotaPrefix+"team/", ""); w.Code != 204 {
+		t.Fatalf("Error removing quota: %v %s", w.Code, w.Body)
+	}
+	if w := doTestRequest(t, "PUT", "/team/c.txt", "0123456789abcdefghijk"); w.Code != 201 {
+		t.Errorf("Expected no quota after removing it, got %v", w.Code)
+	}
+}
+
+func TestQuotaWritePaths(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	for fn, body := range map[string]string{
+		"/team/a.txt": "12345678", "/big.txt": "0123456789abcdef"} {
+		if w := doTestRequest(t, "PUT", fn, body); w.Code != 201 {
+			t.Fatalf("Error storing %v: %v %s", fn, w.Code, w.Body)
+		}
+	}
+	w := doTestRequest(t, "PUT", quotaPrefix+"team", `{"maxBytes": 10}`)
+	if w.Code != 200 {
+		t.Fatalf("Error setting quota: %v %s", w.Code, w.Body)
+	}
+
+	// No length up front.
+	req, _ := http.NewRequest("PUT", "http://localhost/team/b.txt",
+		ioutil.NopCloser(strings.NewReader("0123456789")))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	httpHandler(w, req)
+	if w.Code != 507 {
+		t.Errorf("Expected an unsized PUT over quota to fail, got %v %s",
+			w.Code, w.Body)
+	}
+
+	w = doTestRequest(t, "POST", uploadPrefix+"?path=team/up", "")
+	u := uploadSession{}
+	if w.Code != 201 || json.Unmarshal(w.Body.Bytes(), &u) != nil {
+		t.Fatalf("Error starting upload: %v %s", w.Code, w.Body)
+	}
+	doTestRequest(t, "PUT", uploadPrefix+u.ID+"/1", "0123456789")
+	if w := doTestRequest(t, "POST", uploadPrefix+u.ID, ""); w.Code != 507 {
+		t.Errorf("Expected an upload over quota to fail, got %v %s",
+			w.Code, w.Body)
+	}
+
+	w = doTestRequest(t, "POST", renamePrefix+"big.txt?to=team/big.txt", "")
+	if w.Code != 507 {
+		t.Errorf("Expected a rename over quota to fail, got %v %s",
+			w.Code, w.Body)
+	}
+	w = doTestRequest(t, "POST", renamePrefix+"team/a.txt?to=team/sub/a.txt", "")
+	if w.Code != 200 {
+		t.Errorf("Error renaming within the quota: %v %s", w.Code, w.Body)
+	}
+
+	w = davDo(t, "COPY", "team/sub/a.txt", "", map[string]string{
+		"Destination": "http://localhost/.cbfs/dav/team/copy.txt"})
+	if w.Code != 507 {
+		t.Errorf("Expected a copy over quota to fail, got %v %s",
+			w.Code, w.Body)
+	}
+
+	big := fileMeta{}
+	if err := couchbase.Get("big.txt", &big); err != nil {
+		t.Fatalf("Error getting meta: %v", err)
+	}
+	w = doTestRequest(t, "POST", "/team/link.txt?blob="+big.OID, "")
+	if w.Code != 507 {
+		t.Errorf("Expected a link over quota to fail, got %v %s",
+			w.Code, w.Body)
+	}
+	a := fileMeta{}
+	if err := couchbase.Get("team/sub/a.txt", &a); err != nil {
+		t.Fatalf("Error getting meta: %v", err)
+	}
+	w = doTestRequest(t, "POST", "/team/sub/a.txt?blob="+a.OID, "")
+	if w.Code != 201 {
+		t.Errorf("Error relinking within the quota: %v %s", w.Code, w.Body)
+	}
+
+	for _, fn := range []string{"/team/b.txt", "/team/up", "/team/big.txt",
+		"/team/copy.txt", "/team/link.txt"} {
+		if w := doTestRequest(t, "GET", fn, ""); w.Code != 404 {
+			t.Errorf("Expected no %v, got %v", fn, w.Code)
+		}
+	}
+	if q := getTestQuota(t, "team/"); q.Bytes != 8 || q.Files != 1 {
+		t.Errorf("Expected 8 bytes in 1 file, got %+v", q)
+	}
+}
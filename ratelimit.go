@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/dustin/go-humanize"
+)
+
+// Background blob transfers between nodes (replication, trimming full
+// nodes, salvaging blobs from dead ones) share a token bucket so they
+// can't starve clients of bandwidth.  The cluster-wide rate comes from
+// the internodeBandwidth config; -internodeBandwidth overrides it for
+// one node.
+
+var internodeBandwidth = flag.String("internodeBandwidth", "",
+	"Limit background transfers to this many bytes/s (overrides config)")
+
+var internodeBucket = &tokenBucket{}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 for unlimited
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(bps int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(bps)
+	b.tokens = b.rate
+	b.last = time.Now()
+}
+
+// Account for n bytes, waiting until the bucket has room for them.
+// The bucket holds up to a second's worth.
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	if b.rate == 0 {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+type limitedWriter struct {
+	w io.Writer
+	b *tokenBucket
+}
+
+func (l limitedWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	l.b.wait(n)
+	return n, err
+}
+
+// The rate this node should use under conf.
+func internodeRate(conf *cbfsconfig.CBFSConfig) int64 {
+	if *internodeBandwidth != "" {
+		bps, err := humanize.ParseBytes(*internodeBandwidth)
+		if err == nil {
+			return int64(bps)
+		}
+	}
+	return conf.InternodeBandwidth
+}
+
+func updateBandwidthLimits(conf *cbfsconfig.CBFSConfig) {
+	rate := internodeRate(conf)
+	internodeBucket.mu.Lock()
+	changed := int64(internodeBucket.rate) != rate
+	internodeBucket.mu.Unlock()
+	if changed {
+		log.Printf("Limiting background transfers to %v/s (0 is unlimited)",
+			humanize.Bytes(uint64(rate)))
+		internodeBucket.setRate(rate)
+	}
+}
+
+func initBandwidthLimits() {
+	if *internodeBandwidth != "" {
+		if _, err := humanize.ParseBytes(*internodeBandwidth); err != nil {
+			log.Fatalf("Error parsing internode bandwidth: %v", err)
+		}
+	}
+	updateBandwidthLimits(globalConfig)
+
+	changes := make(chan interface{})
+	confBroadcaster.Register(changes)
+	go func() {
+		// The change arrives before globalConfig is updated.
+		for c := range changes {
+			updateBandwidthLimits(c.(configChange).current)
+		}
+	}()
+}
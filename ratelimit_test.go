@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := &tokenBucket{}
+	w := limitedWriter{ioutil.Discard, b}
+	data := make([]byte, 1500)
+
+	start := time.Now()
+	w.Write(data)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Expected no limit by default, took %v", d)
+	}
+
+	// A second's worth is free, the rest has to wait.
+	b.setRate(1000)
+	start = time.Now()
+	w.Write(data)
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Expected 1500 bytes at 1000B/s to take ~500ms, took %v", d)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Renaming moves file records (history, userdata and all) to a new
+// name without touching their blobs:
+//
+//   POST /.cbfs/rename/some/dir?to=other/dir
+//
+// A path naming a file moves that file; otherwise everything beneath
+// it moves.  Each file moves on its own, so a failure partway leaves
+// the rest where they are, and the response says which ones failed.
+
+// Don't send back an unbounded number of failures.
+const maxRenameErrors = 1000
+
+var errFileChanged = errors.New("file changed concurrently")
+
+type renameResult struct {
+	Moved      int               `json:"moved"`
+	Failed     int               `json:"failed"`
+	Errors     map[string]string `json:"errors,omitempty"`
+	Incomplete bool              `json:"incomplete,omitempty"`
+}
+
+func (r *renameResult) fail(fn string, err error) {
+	log.Printf("Error renaming %v: %v", fn, err)
+	r.Failed++
+	if len(r.Errors) < maxRenameErrors {
+		r.Errors[fn] = err.Error()
+	}
+}
+
+// The expiration to store a moved file with so it still expires when
+// it would have.
+func renameExpiration(fm fileMeta) int {
+	exp := getExpiration(fm.Headers)
+	if exp > 0 && exp <= maxRelativeExp {
+		exp += int(fm.Modified.Unix())
+	}
+	return exp
+}
+
+// Move one file record from src to dst.  The destination must not
+// already exist, and the source is only removed if it hasn't changed
+// since it was copied.
+func renameFile(src, dst string) (fileMeta, error) {
+	data, err := couchbase.GetRaw(shortName(src))
+	if err != nil {
+		return fileMeta{}, err
+	}
+	fm := fileMeta{}
+	if err := json.Unmarshal(data, &fm); err != nil {
+		return fm, err
+	}
+	if fm.Type != "file" {
+		return fm, errNotFound
+	}
+	if err := retained(src, fm, time.Now()); err != nil {
+		return fm, err
+	}
+
+	if err := checkRenameQuota(src, dst, fm.Length); err != nil {
+		return fm, err
+	}
+
+	fm.Name = ""
+	if shortName(dst) != dst {
+		fm.Name = dst
+	}
+	added, err := couchbase.Add(shortName(dst), renameExpiration(fm), fm)
+	if err == nil && !added {
+		err = errExists
+	}
+	if err != nil {
+		return fm, err
+	}
+
+	err = couchbase.Update(shortName(src), 0, func(in []byte) ([]byte, error) {
+		if !bytes.Equal(in, data) {
+			return nil, errFileChanged
+		}
+		return nil, nil
+	})
+	if err != nil {
+		if derr := couchbase.Delete(shortName(dst)); derr != nil {
+			log.Printf("Error removing %v after failed rename from %v: %v",
+				dst, src, derr)
+		}
+		return fm, err
+	}
+
+	chargeQuota(src, -fm.Length, -1)
+	chargeQuota(dst, fm.Length, 1)
+	recordChange("delete", src, fm)
+	recordChange("create", dst, fm)
+	return fm, nil
+}
+
+// Call fn with the path of every file beneath dir (which ends in /),
+// in order.  It's fine for fn to remove the file.
+func walkFiles(dir string, fn func(string)) error {
+	startKey := strings.Split(strings.TrimSuffix(dir, "/"), "/")
+	last := ""
+	for done := false; !done; {
+		viewRes := struct {
+			Rows []struct {
+				Key []string
+			}
+		}{}
+		limit := 1000
+		err := couchbase.View("file_browse",
+			map[string]interface{}{
+				"reduce":   false,
+				"limit":    limit,
+				"startkey": startKey,
+			}, &viewRes)
+		if err != nil {
+			return err
+		}
+		done = len(viewRes.Rows) < limit
+
+		for _, r := range viewRes.Rows {
+			k := strings.Join(r.Key, "/")
+			if !strings.HasPrefix(k, dir) {
+				done = true
+				break
+			}
+			startKey = r.Key
+			if k != last {
+				last = k
+				fn(k)
+			}
+		}
+	}
+	return nil
+}
+
+func doRename(w http.ResponseWriter, req *http.Request, src string) {
+	src = strings.Trim(src, "/")
+	dst := strings.Trim(req.FormValue("to"), "/")
+	switch {
+	case src == "" || dst == "":
+		http.Error(w, "source and destination are required", 400)
+		return
+	case strings.Contains(dst, "//") || strings.HasPrefix(dst, ".cbfs/"):
+		http.Error(w, "Invalid destination: "+dst, 400)
+		return
+	case dst == src || strings.HasPrefix(dst, src+"/"):
+		http.Error(w, "can't rename something into itself", 400)
+		return
+	}
+	// The source was checked before we got here.
+	need := access{role: roleWriter, path: dirPath(dst), scoped: true}
+	if !authorizeFor(w, req, need) {
+		return
+	}
+
+	rv := renameResult{Errors: map[string]string{}}
+	_, err := renameFile(src, dst)
+	switch {
+	case err == nil:
+		rv.Moved++
+	case err == errExists:
+		http.Error(w, dst+" already exists", 409)
+		return
+	case isRetained(err):
+		http.Error(w, err.Error(), 403)
+		return
+	case isOverQuota(err):
+		http.Error(w, err.Error(), 507)
+		return
+	case isNotFound(err):
+		err = walkFiles(src+"/", func(fn string) {
+			to := dst + strings.TrimPrefix(fn, src)
+			if _, err := renameFile(fn, to); err != nil {
+				rv.fail(fn, err)
+			} else {
+				rv.Moved++
+			}
+		})
+		if err != nil {
+			log.Printf("Error listing files under %v to rename: %v", src, err)
+			rv.Incomplete = true
+			rv.Errors[src+"/"] = err.Error()
+		}
+	default:
+		log.Printf("Error renaming %v -> %v: %v", src, dst, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Printf("Renamed %v -> %v: %v moved, %v failed", src, dst,
+		rv.Moved, rv.Failed)
+
+	status := 200
+	if rv.Moved+rv.Failed == 0 && !rv.Incomplete {
+		status = 404
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(mustEncode(rv))
+}
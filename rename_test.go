@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	long := "d/" + strings.Repeat("x", maxFilename)
+	for _, fn := range []string{"d/a.txt", "d/e/b.txt", long, "dd.txt"} {
+		if w := doTestRequest(t, "PUT", "/"+fn, "data for "+fn); w.Code != 201 {
+			t.Fatalf("Error storing %v: %v %s", fn, w.Code, w.Body)
+		}
+	}
+	doTestRequest(t, "PUT", "/d/a.txt", "new data")
+	doTestRequest(t, "PUT", metaPrefix+"d/a.txt", `{"x": 1}`)
+
+	w := doTestRequest(t, "POST", renamePrefix+"d?to=n", "")
+	res := renameResult{}
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &res) != nil ||
+		res.Moved != 3 || res.Failed != 0 {
+		t.Fatalf("Error renaming: %v %s", w.Code, w.Body)
+	}
+
+	for _, fn := range []string{"n/e/b.txt", "n/" + strings.Repeat("x", maxFilename)} {
+		w := doTestRequest(t, "GET", "/"+fn, "")
+		if w.Code != 200 || w.Body.String() != "data for d"+fn[1:] {
+			t.Errorf("Error getting %v: %v %s", fn, w.Code, w.Body)
+		}
+	}
+	for _, fn := range []string{"d/a.txt", "d/e/b.txt", long} {
+		if w := doTestRequest(t, "GET", "/"+fn, ""); w.Code != 404 {
+			t.Errorf("Expected %v to be gone, got %v", fn, w.Code)
+		}
+	}
+	if w := doTestRequest(t, "GET", "/dd.txt", ""); w.Code != 200 {
+		t.Errorf("Expected dd.txt to stay put, got %v", w.Code)
+	}
+
+	fm := fileMeta{}
+	if err := couchbase.Get("n/a.txt", &fm); err != nil {
+		t.Fatalf("Error getting renamed meta: %v", err)
+	}
+	if fm.Revno != 1 || fm.Userdata == nil || string(*fm.Userdata) != `{"x":1}` {
+		t.Errorf("Expected history and userdata to move, got %+v", fm)
+	}
+
+	if w := doTestRequest(t, "POST", renamePrefix+"dd.txt?to=n/a.txt", ""); w.Code != 409 {
+		t.Errorf("Expected rename onto a file to fail, got %v", w.Code)
+	}
+	if w := doTestRequest(t, "POST", renamePrefix+"n?to=n/sub", ""); w.Code != 400 {
+		t.Errorf("Expected rename into itself to fail, got %v", w.Code)
+	}
+	if w := doTestRequest(t, "POST", renamePrefix+"missing?to=x", ""); w.Code != 404 {
+		t.Errorf("Expected rename of nothing to 404, got %v", w.Code)
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files under a prefix can be copied to another cbfs cluster as they
+// change:
+//
+//   GET/PUT /.cbfs/replication/  -> targets and how far each has got
+//
+// A target names a prefix and the remote cluster's URL (with a key in
+// it if the remote needs one).  The replicate task follows the change
+// feed for each target from where it last got to, copying the current
+// state of every changed file.  Blobs the remote already has are
+// linked rather than sent.  Each copy carries the revno and modified
+// time of the file it came from.  When both sides have changed a file,
+// a remote copy that's still one of ours loses to a later revno of
+// ours, and one changed on the remote side loses only if ours was
+// modified after it, so the same file changed in both places settles
+// instead of bouncing back and forth.  A new target (or one that's
+// fallen further behind than the change feed goes back) starts with a
+// copy of everything already under its prefix.
+
+const replicationKey = "/@replication"
+
+const (
+	replicaRevnoHeader    = "X-CBFS-Source-Revno"
+	replicaModifiedHeader = "X-CBFS-Source-Modified"
+)
+
+type replicationTarget struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	Remote string `json:"remote"`
+}
+
+type replicationTargets struct {
+	Targets []replicationTarget `json:"targets"`
+}
+
+func (r replicationTargets) validate() error {
+	seen := map[string]bool{}
+	for _, t := range r.Targets {
+		if t.Name == "" || strings.Contains(t.Name, "/") {
+			return fmt.Errorf("invalid replication target name %q", t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("duplicate replication target %q", t.Name)
+		}
+		seen[t.Name] = true
+		u, err := url.Parse(t.Remote)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid remote for %q: %q", t.Name, t.Remote)
+		}
+	}
+	return nil
+}
+
+// How far a target has got, kept under its own key so progress
+// doesn't race with changes to the targets.
+type replicationStatus struct {
+	Type      string    `json:"type"`
+	Name      string    `json:"name"`
+	Seq       uint64    `json:"seq"`
+	Synced    bool      `json:"synced"`
+	LastRun   time.Time `json:"lastRun"`
+	Copied    int64     `json:"copied"`
+	Linked    int64     `json:"linked"`
+	Deleted   int64     `json:"deleted"`
+	Conflicts int64     `json:"conflicts"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"lastError,omitempty"`
+	ErrorTime time.Time `json:"errorTime,omitempty"`
+	Behind    uint64    `json:"behind"`
+	Remote    string    `json:"remote,omitempty"`
+}
+
+func replicationStatusKey(name string) string {
+	return replicationKey + "/" + name
+}
+
+func getReplicationTargets() (replicationTargets, error) {
+	r := replicationTargets{}
+	err := couchbase.Get(replicationKey, &r)
+	if isNotFound(err) {
+		err = nil
+	}
+	return r, err
+}
+
+func getReplicationStatus(name string) (replicationStatus, error) {
+	st := replicationStatus{}
+	err := couchbase.Get(replicationStatusKey(name), &st)
+	if isNotFound(err) {
+		err = nil
+	}
+	st.Type = "replication"
+	st.Name = name
+	return st, err
+}
+
+// Raised when the remote's copy of a file should win.
+var errReplicaConflict = errors.New("remote copy is newer")
+
+type replicator struct {
+	target replicationTarget
+	base   *url.URL
+	status *replicationStatus
+}
+
+func (r *replicator) url(prefix, fn string) string {
+	u := *r.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + prefix +
+		strings.TrimLeft(fn, "/")
+	return u.String()
+}
+
+func (r *replicator) do(req *http.Request, ok ...int) (*http.Response, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range ok {
+		if res.StatusCode == c {
+			return res, nil
+		}
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	return nil, fmt.Errorf("%v %v: HTTP %v: %s", req.Method,
+		req.URL.Path, res.Status, bytes.TrimSpace(msg))
+}
+
+// The remote's record of fn, or nil if it doesn't have one.
+func (r *replicator) remoteMeta(fn string) (*fileMeta, error) {
+	req, err := http.NewRequest("GET", r.url(fileInfoPrefix, fn), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.do(req, 200, 404)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	info := struct {
+		Meta fileMeta `json:"meta"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info.Meta, nil
+}
+
+// Whether the remote has all of oids.
+func (r *replicator) remoteHasBlobs(oids []string) (bool, error) {
+	form := url.Values{"blob": oids}
+	req, err := http.NewRequest("POST", r.url(blobInfoPath, ""),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := r.do(req, 200)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	infos := map[string]struct {
+		Nodes map[string]time.Time `json:"nodes"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&infos); err != nil {
+		return false, err
+	}
+	for _, oid := range oids {
+		if len(infos[oid].Nodes) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// The revno and modified time of the file fm is an unchanged copy of,
+// if it is one.
+func replicaSource(fm fileMeta) (int, time.Time, bool) {
+	revno, err := strconv.Atoi(fm.Headers.Get(replicaRevnoHeader))
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	modified, err := time.Parse(time.RFC3339Nano,
+		fm.Headers.Get(replicaModifiedHeader))
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return revno, modified, true
+}
+
+// The revno and modified time to send along with a copy of fm.
+func sourceVersion(fm fileMeta) (int, time.Time) {
+	if revno, modified, ok := replicaSource(fm); ok {
+		return revno, modified
+	}
+	return fm.Revno, fm.Modified
+}
+
+// Which copy of a file is newer: positive for ours, negative for the
+// remote's.
+func compareReplicas(local, remote fileMeta) int {
+	lrev, lmod := sourceVersion(local)
+	rrev, rmod, ok := replicaSource(remote)
+	if !ok {
+		// Changed on the remote, whose revnos aren't ours.
+		rrev, rmod = lrev, remote.Modified
+	}
+	switch {
+	case lrev > rrev, lrev == rrev && lmod.After(rmod):
+		return 1
+	case lrev < rrev, rmod.After(lmod):
+		return -1
+	}
+	return 0
+}
+
+// Make the remote's copy of fn match fm.
+func (r *replicator) push(fn string, fm fileMeta) error {
+	remote, err := r.remoteMeta(fn)
+	if err != nil {
+		return err
+	}
+	if remote != nil && remote.OID != fm.OID {
+		if compareReplicas(fm, *remote) <= 0 {
+			return errReplicaConflict
+		}
+	}
+	pushed := false
+	if remote == nil || remote.OID != fm.OID {
+		if err := r.pushContent(fn, fm); err != nil {
+			return err
+		}
+		pushed = true
+	}
+
+	if fm.Userdata != nil && (remote == nil || remote.Userdata == nil ||
+		!bytes.Equal(*remote.Userdata, *fm.Userdata)) {
+		// Userdata changes don't bump the revno or modified time, so
+		// only a later revision on the remote beats ours.
+		if !pushed && remote != nil && compareReplicas(fm, *remote) < 0 {
+			return errReplicaConflict
+		}
+		req, err := http.NewRequest("PUT", r.url(metaPrefix, fn),
+			bytes.NewReader(*fm.Userdata))
+		if err != nil {
+			return err
+		}
+		res, err := r.do(req, 201, 204)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+	return nil
+}
+
+func (r *replicator) pushContent(fn string, fm fileMeta) error {
+	have, err := r.remoteHasBlobs(fm.blobs())
+	if err != nil {
+		return err
+	}
+
+	var req *http.Request
+	if have && len(fm.Chunks) == 0 {
+		form := url.Values{
+			"blob": {fm.OID},
+			"type": {fm.Headers.Get("Content-Type")},
+		}
+		req, err = http.NewRequest("POST", r.url("/", fn),
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if exp := fm.Headers.Get("X-CBFS-Expiration"); exp != "" {
+			req.Header.Set("X-CBFS-Expiration", exp)
+		}
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(copyFileContent(pw, fm))
+		}()
+		defer pr.Close()
+		req, err = http.NewRequest("PUT", r.url("/", fn), pr)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = fm.Length
+		// Older records may have kept the uploader's credentials.
+		req.Header = filterHeaders(fm.Headers, isFileHeader)
+		if len(fm.Chunks) == 0 {
+			req.Header.Set("X-CBFS-Hash", fm.OID)
+		}
+	}
+	revno, modified := sourceVersion(fm)
+	req.Header.Set(replicaRevnoHeader, strconv.Itoa(revno))
+	req.Header.Set(replicaModifiedHeader, modified.Format(time.RFC3339Nano))
+
+	res, err := r.do(req, 201)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if have && len(fm.Chunks) == 0 {
+		r.status.Linked++
+	} else {
+		r.status.Copied++
+	}
+	return nil
+}
+
+// Remove the remote's copy of fn if it's still the one we deleted.
+func (r *replicator) remove(fn, oid string) error {
+	remote, err := r.remoteMeta(fn)
+	if err != nil || remote == nil {
+		return err
+	}
+	if remote.OID != oid {
+		return errReplicaConflict
+	}
+	req, err := http.NewRequest("DELETE", r.url("/", fn), nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.do(req, 204, 404)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	r.status.Deleted++
+	return nil
+}
+
+// Bring the remote up to date with one change.  Conflicts are
+// counted and skipped; anything else stops the run so the change is
+// tried again next time.
+func (r *replicator) apply(c fileChange) error {
+	var err error
+	if c.Op == "delete" {
+		err = r.remove(c.Path, c.OID)
+	} else {
+		fm := fileMeta{}
+		err = couchbase.Get(shortName(c.Path), &fm)
+		switch {
+		case isNotFound(err):
+			// Gone since; its delete is further along.
+			return nil
+		case err == nil:
+			err = r.push(c.Path, fm)
+		}
+	}
+	if err == errReplicaConflict {
+		log.Printf("Replication to %v: not replacing newer %v",
+			r.target.Name, c.Path)
+		r.status.Conflicts++
+		return nil
+	}
+	return err
+}
+
+// Copy everything already under the prefix.
+func (r *replicator) fullSync() error {
+	quit := make(chan bool)
+	defer close(quit)
+	ch := make(chan *namedFile)
+	cherr := make(chan error)
+	go pathGenerator(r.target.Prefix, ch, cherr, quit)
+
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		for e := range cherr {
+			err = e
+		}
+		errc <- err
+	}()
+	for nf := range ch {
+		if nf.err != nil {
+			log.Printf("Replication to %v: error reading %v: %v",
+				r.target.Name, nf.name, nf.err)
+			continue
+		}
+		e := r.push(nf.name, nf.meta)
+		if e == errReplicaConflict {
+			r.status.Conflicts++
+		} else if e != nil {
+			return e
+		}
+	}
+	return <-errc
+}
+
+func (r *replicator) saveStatus() {
+	err := couchbase.Set(replicationStatusKey(r.target.Name), 0, r.status)
+	if err != nil {
+		log.Printf("Error saving replication checkpoint for %v: %v",
+			r.target.Name, err)
+	}
+}
+
+func (r *replicator) run() error {
+	last, err := lastChangeSeq()
+	if err != nil {
+		return err
+	}
+
+	if r.status.Synced {
+		expired, err := changesExpired(r.status.Seq, last)
+		if err != nil {
+			return err
+		}
+		if expired {
+			log.Printf("Replication to %v: changes since %v have expired",
+				r.target.Name, r.status.Seq)
+			r.status.Synced = false
+		}
+	}
+	if !r.status.Synced {
+		log.Printf("Replication to %v: copying existing files under %q",
+			r.target.Name, r.target.Prefix)
+		if err := r.fullSync(); err != nil {
+			return err
+		}
+		r.status.Seq = last
+		r.status.Synced = true
+		r.saveStatus()
+	}
+
+	for r.status.Seq < last {
+		changes, next, err := readChanges(r.status.Seq, last)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			if !changeMatches(c, r.target.Prefix) {
+				continue
+			}
+			if err := r.apply(c); err != nil {
+				// Keep what got done before this one.
+				r.status.Seq = c.Seq - 1
+				return err
+			}
+		}
+		if next == r.status.Seq {
+			break
+		}
+		r.status.Seq = next
+		r.saveStatus()
+	}
+	return nil
+}
+
+func replicateTo(t replicationTarget) error {
+	base, err := url.Parse(t.Remote)
+	if err != nil {
+		return err
+	}
+	st, err := getReplicationStatus(t.Name)
+	if err != nil {
+		return err
+	}
+	r := &replicator{target: t, base: base, status: &st}
+
+	err = r.run()
+	st.LastRun = time.Now().UTC()
+	if err != nil {
+		st.Errors++
+		st.LastError = err.Error()
+		st.ErrorTime = st.LastRun
+	}
+	r.saveStatus()
+	return err
+}
+
+func replicate() error {
+	r, err := getReplicationTargets()
+	if err != nil {
+		return err
+	}
+	for _, t := range r.Targets {
+		if err := replicateTo(t); err != nil {
+			log.Printf("Error replicating to %v: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// The remote without the key in it.
+func redactedRemote(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return ""
+	}
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	return u.String()
+}
+
+func doGetReplication(w http.ResponseWriter, req *http.Request) {
+	r, err := getReplicationTargets()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	last, err := lastChangeSeq()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rv := []replicationStatus{}
+	for _, t := range r.Targets {
+		st, err := getReplicationStatus(t.Name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if st.Seq < last {
+			st.Behind = last - st.Seq
+		}
+		st.Remote = redactedRemote(t.Remote)
+		rv = append(rv, st)
+	}
+	sendJson(w, req, map[string]interface{}{
+		"targets": rv,
+		"lastSeq": last,
+	})
+}
+
+func doSetReplication(w http.ResponseWriter, req *http.Request) {
+	r := replicationTargets{}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, "Error reading replication targets: "+err.Error(), 400)
+		return
+	}
+	if err := r.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Targets that went away or now point somewhere else start over.
+	old, err := getReplicationTargets()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	current := map[string]replicationTarget{}
+	for i, t := range r.Targets {
+		r.Targets[i].Prefix = dirPath(strings.TrimLeft(t.Prefix, "/"))
+		current[t.Name] = r.Targets[i]
+	}
+	for _, t := range old.Targets {
+		if c, ok := current[t.Name]; !ok || c.Remote != t.Remote ||
+			c.Prefix != t.Prefix {
+
+			err := couchbase.Delete(replicationStatusKey(t.Name))
+			if err != nil && !isNotFound(err) {
+				log.Printf("Error removing replication status for %v: %v",
+					t.Name, err)
+			}
+		}
+	}
+
+	if err := couchbase.Set(replicationKey, 0, r); err != nil {
+		http.Error(w, "Error storing replication targets: "+err.Error(), 500)
+		return
+	}
+	log.Printf("Replication targets updated: %v targets", len(r.Targets))
+	w.WriteHeader(204)
+}
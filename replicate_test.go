@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Just enough of a remote cluster to replicate to.
+type fakeRemote struct {
+	mu       sync.Mutex
+	files    map[string]fileMeta
+	contents map[string]string
+	blobs    map[string]bool
+	links    int
+	auth     []string
+}
+
+func (f *fakeRemote) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := req.URL.Path
+	switch {
+	case req.Method == "GET" && strings.HasPrefix(p, fileInfoPrefix):
+		fm, ok := f.files[minusPrefix(p, fileInfoPrefix)]
+		if !ok {
+			http.Error(w, "not found", 404)
+			return
+		}
+		sendJson(w, req, map[string]interface{}{"meta": fm})
+	case req.Method == "POST" && p == blobInfoPath:
+		req.ParseForm()
+		rv := map[string]interface{}{}
+		for _, oid := range req.Form["blob"] {
+			if f.blobs[oid] {
+				rv[oid] = map[string]interface{}{
+					"nodes": map[string]time.Time{"r": time.Now()}}
+			}
+		}
+		sendJson(w, req, rv)
+	case req.Method == "PUT" && strings.HasPrefix(p, metaPrefix):
+		fn := minusPrefix(p, metaPrefix)
+		fm := f.files[fn]
+		data, _ := ioutil.ReadAll(req.Body)
+		raw := json.RawMessage(data)
+		fm.Userdata = &raw
+		f.files[fn] = fm
+		w.WriteHeader(201)
+	case req.Method == "PUT", req.Method == "POST":
+		fn := p[1:]
+		fm := fileMeta{
+			Headers:  filterHeaders(req.Header, isFileHeader),
+			Modified: time.Now(),
+		}
+		if old, ok := f.files[fn]; ok {
+			fm.Revno = old.Revno + 1
+		}
+		f.auth = append(f.auth, req.Header.Get("Authorization"))
+		if req.Method == "PUT" {
+			data, _ := ioutil.ReadAll(req.Body)
+			fm.OID = req.Header.Get("X-CBFS-Hash")
+			f.contents[fn] = string(data)
+			f.blobs[fm.OID] = true
+		} else {
+			fm.OID = req.FormValue("blob")
+			f.links++
+		}
+		f.files[fn] = fm
+		w.WriteHeader(201)
+	case req.Method == "DELETE":
+		delete(f.files, p[1:])
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "unexpected "+req.Method+" "+p, 400)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	remote := &fakeRemote{
+		files:    map[string]fileMeta{},
+		contents: map[string]string{},
+		blobs:    map[string]bool{},
+	}
+	srv := httptest.NewServer(remote)
+	defer srv.Close()
+
+	doTestRequest(t, "PUT", "/docs/a.txt", "hello")
+	doTestRequest(t, "PUT", "/other/x.txt", "not replicated")
+
+	// A record from before stored headers were filtered.
+	fm := fileMeta{}
+	if err := couchbase.Get(shortName("docs/a.txt"), &fm); err != nil {
+		t.Fatalf("Error getting a.txt: %v", err)
+	}
+	fm.Headers = http.Header{"Authorization": {"Basic dXBsb2FkZXI6eA=="}}
+	couchbase.Set(shortName("docs/a.txt"), 0, fm)
+
+	w := doTestRequest(t, "PUT", replicationPath,
+		`{"targets": [{"name": "dr", "prefix": "docs",
+                       "remote": "http://web:key@`+
+			strings.TrimPrefix(srv.URL, "http://")+`"}]}`)
+	if w.Code != 204 {
+		t.Fatalf("Error setting targets: %v %s", w.Code, w.Body)
+	}
+
+	replicate()
+	if remote.contents["docs/a.txt"] != "hello" || len(remote.files) != 1 {
+		t.Fatalf("Expected existing file copied, got %v", remote.contents)
+	}
+	if len(remote.auth) != 1 || remote.auth[0] != "Basic d2ViOmtleQ==" {
+		t.Errorf("Expected the target's key to be sent, got %v", remote.auth)
+	}
+
+	// Same content as a.txt was, so just linked.
+	doTestRequest(t, "PUT", "/docs/b.txt", "hello")
+	doTestRequest(t, "PUT", "/docs/a.txt", "changed")
+	// Changed more recently on the remote.
+	remote.files["docs/c.txt"] = fileMeta{OID: "theirs", Revno: 5,
+		Modified: time.Now().Add(time.Hour)}
+	// Changed on the remote, but a while ago; its revno is its own.
+	remote.files["docs/d.txt"] = fileMeta{OID: "stale", Revno: 9,
+		Modified: time.Now().Add(-time.Hour)}
+	doTestRequest(t, "PUT", "/docs/c.txt", "ours")
+	doTestRequest(t, "PUT", "/docs/d.txt", "ours too")
+	replicate()
+
+	if remote.contents["docs/a.txt"] != "changed" || remote.links != 1 ||
+		!remote.blobs[remote.files["docs/b.txt"].OID] {
+		t.Errorf("Expected update copied and new file linked, got %v/%v",
+			remote.contents, remote.links)
+	}
+	if remote.files["docs/c.txt"].OID != "theirs" {
+		t.Errorf("Expected remote's newer file to win, got %+v",
+			remote.files["docs/c.txt"])
+	}
+	if remote.contents["docs/d.txt"] != "ours too" {
+		t.Errorf("Expected our newer file to win, got %+v",
+			remote.files["docs/d.txt"])
+	}
+
+	doTestRequest(t, "DELETE", "/docs/b.txt", "")
+	doTestRequest(t, "PUT", metaPrefix+"docs/a.txt", `{"x":1}`)
+	replicate()
+	if _, ok := remote.files["docs/b.txt"]; ok {
+		t.Errorf("Expected delete to replicate")
+	}
+	if ud := remote.files["docs/a.txt"].Userdata; ud == nil ||
+		string(*ud) != `{"x":1}` {
+		t.Errorf("Expected userdata to replicate, got %v", ud)
+	}
+
+	st := struct {
+		Targets []replicationStatus `json:"targets"`
+	}{}
+	w = doTestRequest(t, "GET", replicationPath, "")
+	if json.Unmarshal(w.Body.Bytes(), &st) != nil || len(st.Targets) != 1 {
+		t.Fatalf("Error getting status: %v %s", w.Code, w.Body)
+	}
+	got := st.Targets[0]
+	if !got.Synced || got.Behind != 0 || got.Copied != 3 ||
+		got.Linked != 1 || got.Deleted != 1 || got.Conflicts != 1 {
+		t.Errorf("Unexpected status: %+v", got)
+	}
+}
+
+func newFakeRemote() (*fakeRemote, *httptest.Server) {
+	f := &fakeRemote{
+		files:    map[string]fileMeta{},
+		contents: map[string]string{},
+		blobs:    map[string]bool{},
+	}
+	return f, httptest.NewServer(f)
+}
+
+func TestReplicationResync(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	first, srv := newFakeRemote()
+	defer srv.Close()
+	second, srv2 := newFakeRemote()
+	defer srv2.Close()
+
+	setTarget := func(remote string) {
+		w := doTestRequest(t, "PUT", replicationPath,
+			`{"targets": [{"name": "dr", "prefix": "docs",
+                           "remote": "`+remote+`"}]}`)
+		if w.Code != 204 {
+			t.Fatalf("Error setting targets: %v %s", w.Code, w.Body)
+		}
+	}
+
+	doTestRequest(t, "PUT", "/docs/a.txt", "a")
+	setTarget(srv.URL)
+	replicate()
+	st, _ := getReplicationStatus("dr")
+
+	// The changes after the checkpoint expire before the next run.
+	doTestRequest(t, "PUT", "/docs/b.txt", "b")
+	doTestRequest(t, "PUT", "/docs/c.txt", "c")
+	for seq := st.Seq; seq <= st.Seq+1; seq++ {
+		couchbase.Delete(changeKey(seq))
+	}
+	replicate()
+	if len(first.contents) != 3 {
+		t.Errorf("Expected a full copy after changes expired, got %v",
+			first.contents)
+	}
+
+	setTarget(srv2.URL)
+	replicate()
+	if len(second.contents) != 3 {
+		t.Errorf("Expected a full copy to a new remote, got %v",
+			second.contents)
+	}
+}
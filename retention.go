@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Files can be made write-once: nothing may overwrite, delete, rename
+// or change the userdata of a file before its retainUntil date, or at
+// all while it's under a legal hold.
+//
+//   GET/PUT /.cbfs/retention/file/{path}  -> {"retainUntil": ..., "legalHold": ...}
+//   GET/PUT /.cbfs/retention/             -> per-prefix policies
+//   GET     /.cbfs/retention/audit/       -> overrides, newest first
+//
+// Files can also be given retention when they're stored with the
+// X-CBFS-Retain-Until and X-CBFS-Legal-Hold headers.  A policy gives
+// new files under its prefix a number of days of retention, or holds
+// everything under it.
+//
+// An admin can get past all of this by sending
+// X-CBFS-Override-Retention: true.  Every override is logged and kept
+// in the audit log.
+
+const (
+	retentionKey            = "/@retention"
+	auditSeqKey             = "/@auditSeq"
+	retentionOverrideHeader = "X-CBFS-Override-Retention"
+	defaultAuditLimit       = 100
+)
+
+type retentionError struct {
+	path  string
+	until time.Time
+}
+
+func (e retentionError) Error() string {
+	if e.until.IsZero() {
+		return e.path + " is under legal hold"
+	}
+	return fmt.Sprintf("%v is retained until %v", e.path,
+		e.until.Format(time.RFC3339))
+}
+
+func isRetained(err error) bool {
+	_, ok := err.(retentionError)
+	return ok
+}
+
+type retentionPolicy struct {
+	Prefix string `json:"prefix"`
+	Days   int    `json:"days,omitempty"`
+	Hold   bool   `json:"hold,omitempty"`
+}
+
+type retentionPolicies struct {
+	Policies []retentionPolicy `json:"policies"`
+}
+
+func (r retentionPolicies) validate() error {
+	for _, p := range r.Policies {
+		if p.Days < 0 {
+			return fmt.Errorf("negative retention for %q", p.Prefix)
+		}
+	}
+	return nil
+}
+
+// The policies that apply to fn.
+func (r retentionPolicies) matching(fn string) []retentionPolicy {
+	rv := []retentionPolicy{}
+	for _, p := range r.Policies {
+		if strings.HasPrefix(fn, strings.TrimLeft(p.Prefix, "/")) {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
+
+var (
+	retentionLock    sync.RWMutex
+	currentRetention retentionPolicies
+)
+
+func getRetentionPolicies() retentionPolicies {
+	retentionLock.RLock()
+	defer retentionLock.RUnlock()
+	return currentRetention
+}
+
+func setRetentionPolicies(r retentionPolicies) {
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+	currentRetention = r
+}
+
+func updateRetentionPolicies() error {
+	r := retentionPolicies{}
+	err := couchbase.Get(retentionKey, &r)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	setRetentionPolicies(r)
+	return nil
+}
+
+func reloadRetentionPolicies() {
+	for _ = range time.Tick(authReloadFreq) {
+		if err := updateRetentionPolicies(); err != nil {
+			log.Printf("Error updating retention policies: %v", err)
+		}
+	}
+}
+
+// Whether the file's blobs have to be kept around.
+func (fm fileMeta) held(now time.Time) bool {
+	return fm.LegalHold || now.Before(fm.RetainUntil)
+}
+
+// Why fm (stored at fn) can't be modified, if it can't.
+func retained(fn string, fm fileMeta, now time.Time) error {
+	held := fm.LegalHold
+	for _, p := range getRetentionPolicies().matching(fn) {
+		held = held || p.Hold
+	}
+	switch {
+	case held:
+		return retentionError{path: fn}
+	case now.Before(fm.RetainUntil):
+		return retentionError{path: fn, until: fm.RetainUntil}
+	}
+	return nil
+}
+
+// Who asked to override retention, if anyone.  authorizeFor only lets
+// this through for admins, and replaces it with who they are.
+func retentionOverride(header http.Header) string {
+	return header.Get(retentionOverrideHeader)
+}
+
+// Like retained, but an override lets it through (and is audited).
+func checkRetention(action, fn string, fm fileMeta, header http.Header) error {
+	err := retained(fn, fm, time.Now())
+	if err != nil && retentionOverride(header) != "" {
+		auditOverride(action, fn, fm, header, err)
+		return nil
+	}
+	return err
+}
+
+// Like checkRetention, for whatever's currently stored at fn.
+func checkFileRetention(action, fn string, header http.Header) error {
+	fm := fileMeta{}
+	if err := couchbase.Get(shortName(fn), &fm); err != nil || fm.Type != "file" {
+		return nil
+	}
+	return checkRetention(action, fn, fm, header)
+}
+
+// Give a new version of fn the retention its header and policies ask
+// for.
+func applyRetention(fn string, fm *fileMeta, header http.Header) {
+	for _, p := range getRetentionPolicies().matching(fn) {
+		until := fm.Modified.Add(time.Duration(p.Days) * 24 * time.Hour)
+		if until.After(fm.RetainUntil) {
+			fm.RetainUntil = until
+		}
+	}
+	if t, err := time.Parse(time.RFC3339,
+		header.Get("X-CBFS-Retain-Until")); err == nil && t.After(fm.RetainUntil) {
+		fm.RetainUntil = t.UTC()
+	}
+	if hold, _ := strconv.ParseBool(header.Get("X-CBFS-Legal-Hold")); hold {
+		fm.LegalHold = true
+	}
+}
+
+// Check the retention headers of a request before doing anything
+// with it.
+func validRetentionHeaders(header http.Header) error {
+	if s := header.Get("X-CBFS-Retain-Until"); s != "" {
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			return fmt.Errorf("Invalid X-CBFS-Retain-Until: %v", err)
+		}
+	}
+	return nil
+}
+
+// Mark the blobs of a retained file so GC and pruning leave them be.
+func holdBlobs(fm fileMeta) {
+	for _, oid := range fm.blobs() {
+		err := couchbase.Update("/"+oid, 0, func(in []byte) ([]byte, error) {
+			ownership := BlobOwnership{}
+			if len(in) == 0 || json.Unmarshal(in, &ownership) != nil {
+				return nil, cb.UpdateCancel
+			}
+			if fm.RetainUntil.After(ownership.RetainUntil) {
+				ownership.RetainUntil = fm.RetainUntil
+			}
+			ownership.LegalHold = fm.LegalHold
+			return json.Marshal(&ownership)
+		})
+		if err != nil && err != cb.UpdateCancel {
+			log.Printf("Error holding blob %v: %v", oid, err)
+		}
+	}
+}
+
+type auditRecord struct {
+	Type   string    `json:"type,omitempty"`
+	Seq    uint64    `json:"seq"`
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	OID    string    `json:"oid,omitempty"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason"`
+	Node   string    `json:"node"`
+	Time   time.Time `json:"time"`
+}
+
+func auditKey(seq uint64) string {
+	return "/@audit/" + strconv.FormatUint(seq, 10)
+}
+
+func auditOverride(action, fn string, fm fileMeta, header http.Header,
+	why error) {
+
+	by := retentionOverride(header)
+	log.Printf("Retention override by %v: %v %v (%v)", by, action, fn, why)
+
+	seq, err := couchbase.Incr(auditSeqKey, 1, 1, 0)
+	if err != nil {
+		log.Printf("Error allocating audit sequence for %v %v: %v",
+			action, fn, err)
+		return
+	}
+	a := auditRecord{
+		Type:   "audit",
+		Seq:    seq,
+		Action: action,
+		Path:   fn,
+		OID:    fm.OID,
+		By:     by,
+		Reason: why.Error(),
+		Node:   serverId,
+		Time:   time.Now().UTC(),
+	}
+	if err := couchbase.Set(auditKey(seq), 0, a); err != nil {
+		log.Printf("Error recording audit %v (%v %v): %v",
+			seq, action, fn, err)
+	}
+}
+
+func doGetAudit(w http.ResponseWriter, req *http.Request) {
+	limit := defaultAuditLimit
+	if s := req.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit: "+s, 400)
+			return
+		}
+	}
+
+	last, err := couchbase.Incr(auditSeqKey, 0, 0, 0)
+	if err != nil {
+		log.Printf("Error reading audit sequence: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	keys := []string{}
+	for seq := last; seq > 0 && len(keys) < limit; seq-- {
+		keys = append(keys, auditKey(seq))
+	}
+	docs, err := couchbase.GetBulk(keys)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rv := []auditRecord{}
+	for _, k := range keys {
+		a := auditRecord{}
+		if data, ok := docs[k]; ok && json.Unmarshal(data, &a) == nil {
+			a.Type = ""
+			rv = append(rv, a)
+		}
+	}
+	sendJson(w, req, rv)
+}
+
+func doGetRetentionPolicies(w http.ResponseWriter, req *http.Request) {
+	sendJson(w, req, getRetentionPolicies())
+}
+
+func doSetRetentionPolicies(w http.ResponseWriter, req *http.Request) {
+	r := retentionPolicies{}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, "Error reading retention policies: "+err.Error(), 400)
+		return
+	}
+	if err := r.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := couchbase.Set(retentionKey, 0, r); err != nil {
+		http.Error(w, "Error storing retention policies: "+err.Error(), 500)
+		return
+	}
+	setRetentionPolicies(r)
+	log.Printf("Retention policies updated: %v policies", len(r.Policies))
+	w.WriteHeader(204)
+}
+
+type fileRetention struct {
+	RetainUntil time.Time `json:"retainUntil"`
+	LegalHold   bool      `json:"legalHold"`
+	// Whether the file can't be modified right now, including by
+	// policy.  Ignored when setting.
+	Retained bool `json:"retained"`
+}
+
+func doGetRetention(w http.ResponseWriter, req *http.Request, fn string) {
+	fm := fileMeta{}
+	if err := couchbase.Get(shortName(fn), &fm); err != nil || fm.Type != "file" {
+		http.Error(w, "No such file: "+fn, 404)
+		return
+	}
+	sendJson(w, req, fileRetention{
+		RetainUntil: fm.RetainUntil,
+		LegalHold:   fm.LegalHold,
+		Retained:    retained(fn, fm, time.Now()) != nil,
+	})
+}
+
+// Retention can be extended and holds placed by any writer, but only
+// an override can shorten retention or release a hold.
+func doSetRetention(w http.ResponseWriter, req *http.Request, fn string) {
+	r := fileRetention{}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, "Error reading retention: "+err.Error(), 400)
+		return
+	}
+
+	now := time.Now()
+	var fm fileMeta
+	var overridden error
+	err := couchbase.Update(shortName(fn), 0, func(in []byte) ([]byte, error) {
+		fm = fileMeta{}
+		if len(in) == 0 || json.Unmarshal(in, &fm) != nil || fm.Type != "file" {
+			return nil, errNotFound
+		}
+		overridden = nil
+		var why error
+		switch {
+		case fm.LegalHold && !r.LegalHold:
+			why = retentionError{path: fn}
+		case now.Before(fm.RetainUntil) && r.RetainUntil.Before(fm.RetainUntil):
+			why = retentionError{path: fn, until: fm.RetainUntil}
+		}
+		if why != nil {
+			if retentionOverride(req.Header) == "" {
+				return nil, why
+			}
+			overridden = why
+		}
+		fm.RetainUntil = r.RetainUntil.UTC()
+		fm.LegalHold = r.LegalHold
+		return json.Marshal(fm)
+	})
+	switch {
+	case err == errNotFound:
+		http.Error(w, "No such file: "+fn, 404)
+		return
+	case isRetained(err):
+		http.Error(w, err.Error(), 403)
+		return
+	case err != nil:
+		log.Printf("Error setting retention of %v: %v", fn, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if overridden != nil {
+		auditOverride("retention", fn, fm, req.Header, overridden)
+	}
+	holdBlobs(fm)
+	recordChange("meta", fn, fm)
+	log.Printf("Retention of %v set to %v (hold: %v)", fn,
+		fm.RetainUntil, fm.LegalHold)
+	w.WriteHeader(204)
+}
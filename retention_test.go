@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doOverrideRequest(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://localhost"+path,
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	req.Header.Set(retentionOverrideHeader, "true")
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	return w
+}
+
+func TestRetention(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer setRetentionPolicies(retentionPolicies{})
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	req, _ := http.NewRequest("PUT", "http://localhost/kept.txt",
+		strings.NewReader("original"))
+	req.Header.Set("X-CBFS-Retain-Until", until.Format(time.RFC3339))
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	if w.Code != 201 {
+		t.Fatalf("Error storing retained file: %v %s", w.Code, w.Body)
+	}
+
+	for _, r := range []struct{ method, path, body string }{
+		{"PUT", "/kept.txt", "replaced"},
+		{"DELETE", "/kept.txt", ""},
+		{"PUT", metaPrefix + "kept.txt", `{"x": 1}`},
+		{"POST", renamePrefix + "kept.txt?to=moved.txt", ""},
+		{"PUT", retentionPrefix + "kept.txt", `{"retainUntil": "2000-01-01T00:00:00Z"}`},
+	} {
+		if w := doTestRequest(t, r.method, r.path, r.body); w.Code != 403 {
+			t.Errorf("Expected %v %v to be refused, got %v %s",
+				r.method, r.path, w.Code, w.Body)
+		}
+	}
+	if w := doTestRequest(t, "GET", "/kept.txt", ""); w.Body.String() != "original" {
+		t.Errorf("Expected the retained file to be untouched, got %s", w.Body)
+	}
+
+	fm := fileMeta{}
+	if err := couchbase.Get("kept.txt", &fm); err != nil {
+		t.Fatalf("Error getting meta: %v", err)
+	}
+	if w := doTestRequest(t, "POST", "/kept.txt?blob="+fm.OID, ""); w.Code != 403 {
+		t.Errorf("Expected linking over the retained file to be refused, got %v %s",
+			w.Code, w.Body)
+	}
+	b := BlobOwnership{}
+	if err := couchbase.Get("/"+fm.OID, &b); err != nil || !b.RetainUntil.Equal(until) {
+		t.Errorf("Expected the blob to be retained until %v, got %+v (%v)",
+			until, b, err)
+	}
+
+	w = doTestRequest(t, "PUT", retentionPrefix+"kept.txt", `{"legalHold": true,
+		"retainUntil": "`+until.Add(time.Hour).Format(time.RFC3339)+`"}`)
+	if w.Code != 204 {
+		t.Fatalf("Error placing a hold: %v %s", w.Code, w.Body)
+	}
+	got := fileRetention{}
+	w = doTestRequest(t, "GET", retentionPrefix+"kept.txt", "")
+	if json.Unmarshal(w.Body.Bytes(), &got) != nil || !got.LegalHold || !got.Retained {
+		t.Errorf("Expected a hold, got %v %s", w.Code, w.Body)
+	}
+
+	if w := doOverrideRequest(t, "DELETE", "/kept.txt", ""); w.Code != 204 {
+		t.Fatalf("Error overriding retention: %v %s", w.Code, w.Body)
+	}
+	audit := []auditRecord{}
+	w = doTestRequest(t, "GET", auditPath, "")
+	if json.Unmarshal(w.Body.Bytes(), &audit) != nil || len(audit) != 1 ||
+		audit[0].Action != "delete" || audit[0].Path != "kept.txt" ||
+		!strings.HasPrefix(audit[0].By, "anonymous") {
+		t.Errorf("Expected the override to be audited, got %v %s", w.Code, w.Body)
+	}
+
+	w = doTestRequest(t, "PUT", policyPath,
+		`{"policies": [{"prefix": "/locked/", "days": 30}, {"prefix": "held/", "hold": true}]}`)
+	if w.Code != 204 {
+		t.Fatalf("Error setting policies: %v %s", w.Code, w.Body)
+	}
+	for _, fn := range []string{"/locked/a", "/held/b", "/free/c"} {
+		if w := doTestRequest(t, "PUT", fn, "data"); w.Code != 201 {
+			t.Fatalf("Error storing %v: %v %s", fn, w.Code, w.Body)
+		}
+	}
+	if w := doTestRequest(t, "PUT", "/locked/a", "more"); w.Code != 403 {
+		t.Errorf("Expected policy retention to refuse overwrite, got %v", w.Code)
+	}
+	if w := doTestRequest(t, "DELETE", "/held/b", ""); w.Code != 403 {
+		t.Errorf("Expected prefix hold to refuse delete, got %v", w.Code)
+	}
+	if w := doTestRequest(t, "DELETE", "/free/c", ""); w.Code != 204 {
+		t.Errorf("Expected unretained delete to work, got %v", w.Code)
+	}
+
+	setRetentionPolicies(retentionPolicies{})
+	if w := doTestRequest(t, "DELETE", "/held/b", ""); w.Code != 204 {
+		t.Errorf("Expected delete to work after the hold was lifted, got %v", w.Code)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon coding over GF(2^8) for erasure coded blobs.
+//
+// The encoding matrix is a Vandermonde matrix transformed so its top
+// k rows are the identity, so the first k shards are the data itself
+// and any k of the k+m shards can rebuild the rest.
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	rv := make(gfMatrix, rows)
+	for i := range rv {
+		rv[i] = make([]byte, cols)
+	}
+	return rv
+}
+
+func (a gfMatrix) mul(b gfMatrix) gfMatrix {
+	rv := newGFMatrix(len(a), len(b[0]))
+	for i := range a {
+		for j := range b[0] {
+			var v byte
+			for k := range b {
+				v ^= gfMul(a[i][k], b[k][j])
+			}
+			rv[i][j] = v
+		}
+	}
+	return rv
+}
+
+var errSingular = errors.New("matrix is singular")
+
+// Gauss-Jordan elimination.
+func (a gfMatrix) invert() (gfMatrix, error) {
+	n := len(a)
+	work := newGFMatrix(n, 2*n)
+	for i := range a {
+		copy(work[i], a[i])
+		work[i][n+i] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && work[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errSingular
+		}
+		work[c], work[p] = work[p], work[c]
+
+		inv := gfInv(work[c][c])
+		for j := range work[c] {
+			work[c][j] = gfMul(work[c][j], inv)
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				f := work[r][c]
+				for j := range work[r] {
+					work[r][j] ^= gfMul(f, work[c][j])
+				}
+			}
+		}
+	}
+
+	rv := newGFMatrix(n, n)
+	for i := range rv {
+		copy(rv[i], work[i][n:])
+	}
+	return rv, nil
+}
+
+type rsCodec struct {
+	k, m   int
+	matrix gfMatrix
+}
+
+func newRSCodec(k, m int) (*rsCodec, error) {
+	if k < 1 || m < 1 || k+m > 256 {
+		return nil, fmt.Errorf("invalid erasure coding %v+%v", k, m)
+	}
+	vm := newGFMatrix(k+m, k)
+	for r := range vm {
+		for c := range vm[r] {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := gfMatrix(vm[:k]).invert()
+	if err != nil {
+		return nil, err
+	}
+	return &rsCodec{k, m, vm.mul(top)}, nil
+}
+
+// out ^= coef * in
+func gfMulAdd(coef byte, in, out []byte) {
+	if coef == 0 {
+		return
+	}
+	lc := int(gfLog[coef])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= gfExp[lc+int(gfLog[b])]
+		}
+	}
+}
+
+// Compute the m parity shards from the k data shards.  All shards
+// must be the same length.
+func (c *rsCodec) encode(shards [][]byte) {
+	for p := 0; p < c.m; p++ {
+		out := shards[c.k+p]
+		for i := range out {
+			out[i] = 0
+		}
+		for d := 0; d < c.k; d++ {
+			gfMulAdd(c.matrix[c.k+p][d], shards[d], out)
+		}
+	}
+}
+
+// Fill in the nil shards from at least k of the others (only the data
+// shards if dataOnly).  Missing shards are allocated with the length
+// of the present ones.
+func (c *rsCodec) reconstruct(shards [][]byte, dataOnly bool) error {
+	missing := false
+	for i, s := range shards {
+		if s == nil && (i < c.k || !dataOnly) {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	rows := make(gfMatrix, 0, c.k)
+	have := make([][]byte, 0, c.k)
+	size := 0
+	for i, s := range shards {
+		if s != nil && len(rows) < c.k {
+			rows = append(rows, c.matrix[i])
+			have = append(have, s)
+			size = len(s)
+		}
+	}
+	if len(rows) < c.k {
+		return fmt.Errorf("need %v shards to reconstruct, have %v",
+			c.k, len(rows))
+	}
+
+	dec, err := rows.invert()
+	if err != nil {
+		return err
+	}
+
+	// Recover the data shards, then recompute any missing parity.
+	for d := 0; d < c.k; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		shards[d] = make([]byte, size)
+		for j, s := range have {
+			gfMulAdd(dec[d][j], s, shards[d])
+		}
+	}
+	if dataOnly {
+		return nil
+	}
+	for p := c.k; p < c.k+c.m; p++ {
+		if shards[p] != nil {
+			continue
+		}
+		shards[p] = make([]byte, size)
+		for d := 0; d < c.k; d++ {
+			gfMulAdd(c.matrix[p][d], shards[d], shards[p])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRSReconstruct(t *testing.T) {
+	codec, err := newRSCodec(4, 2)
+	if err != nil {
+		t.Fatalf("Error making codec: %v", err)
+	}
+
+	shards := make([][]byte, 6)
+	for i := range shards {
+		if i < 4 {
+			shards[i] = randomContent(1000)
+		} else {
+			shards[i] = make([]byte, 1000)
+		}
+	}
+	codec.encode(shards)
+
+	// Every combination of two lost shards.
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			got := make([][]byte, 6)
+			copy(got, shards)
+			got[a], got[b] = nil, nil
+			if err := codec.reconstruct(got, false); err != nil {
+				t.Fatalf("Error reconstructing without %v,%v: %v",
+					a, b, err)
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], shards[i]) {
+					t.Errorf("Shard %v wrong without %v,%v", i, a, b)
+				}
+			}
+		}
+	}
+
+	got := make([][]byte, 6)
+	copy(got, shards)
+	got[0], got[1], got[2] = nil, nil, nil
+	if err := codec.reconstruct(got, false); err == nil {
+		t.Errorf("Expected failure with three shards lost")
+	}
+
+	if _, err := newRSCodec(0, 2); err == nil {
+		t.Errorf("Expected failure with no data shards")
+	}
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var s3Bind = flag.String("s3bind", "",
+	"Address to bind the S3 gateway to (empty to disable)")
+var s3AccessKey = flag.String("s3accessKey", "",
+	"Access key with full access to the S3 gateway (API keys also work)")
+var s3SecretKey = flag.String("s3secretKey", "",
+	"Secret key for the S3 gateway's access key")
+
+// S3 buckets are the top-level directories of the cbfs namespace
+// and object keys are the paths beneath them.  Only path-style
+// requests (http://host/bucket/key) are understood.
+
+const (
+	s3Namespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat    = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys       = 1000
+	s3StorageClass  = "STANDARD"
+	s3StreamingHash = "STREAMING-"
+	// View rows fetched at a time when listing.
+	s3ListPage = 1000
+)
+
+type s3ErrorResult struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	Marker                string `xml:",omitempty"`
+	NextMarker            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3CopyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string
+	ETag         string
+}
+
+// An S3 listing entry.  Common prefixes have no meta.
+type s3Entry struct {
+	key  string
+	meta *fileMeta
+}
+
+func sendS3XML(w http.ResponseWriter, status int, ob interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(ob); err != nil {
+		log.Printf("Error encoding S3 response: %v", err)
+	}
+}
+
+func sendS3Error(w http.ResponseWriter, req *http.Request,
+	status int, code, msg string) {
+
+	sendS3XML(w, status, s3ErrorResult{
+		Code:     code,
+		Message:  msg,
+		Resource: req.URL.Path,
+	})
+}
+
+func s3ErrorCode(status int) string {
+	switch status {
+	case 400:
+		return "InvalidRequest"
+	case 403:
+		return "AccessDenied"
+	case 404:
+		return "NoSuchKey"
+	case 405:
+		return "MethodNotAllowed"
+	case 410:
+		return "NoSuchVersion"
+	case 412:
+		return "PreconditionFailed"
+	case 416:
+		return "InvalidRange"
+	case 507:
+		return "QuotaExceeded"
+	}
+	return "InternalError"
+}
+
+// Translates the native handlers' responses into what S3 clients
+// expect: remapped status codes and XML error bodies.
+type s3ResponseWriter struct {
+	http.ResponseWriter
+	req       *http.Request
+	statusMap map[int]int
+	discard   bool
+}
+
+func (s *s3ResponseWriter) WriteHeader(code int) {
+	if c, ok := s.statusMap[code]; ok {
+		s.discard = true
+		s.ResponseWriter.WriteHeader(c)
+		return
+	}
+	if code >= 400 {
+		s.discard = true
+		h := s.Header()
+		h.Del("Content-Length")
+		h.Del("Content-Encoding")
+		sendS3Error(s.ResponseWriter, s.req, code, s3ErrorCode(code),
+			http.StatusText(code))
+		return
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *s3ResponseWriter) Write(b []byte) (int, error) {
+	if s.discard {
+		return len(b), nil
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func s3Writer(w http.ResponseWriter, req *http.Request,
+	statusMap map[int]int) http.ResponseWriter {
+	return &s3ResponseWriter{ResponseWriter: w, req: req, statusMap: statusMap}
+}
+
+// Drop the signing headers so they don't end up stored with the file.
+func s3FileHeaders(in http.Header) http.Header {
+	rv := http.Header{}
+	for k, v := range in {
+		l := strings.ToLower(k)
+		if l == "authorization" || (strings.HasPrefix(l, "x-amz-") &&
+			!strings.HasPrefix(l, "x-amz-meta-")) {
+			continue
+		}
+		rv[k] = v
+	}
+	return rv
+}
+
+// Build a request the native handlers will treat as being for the
+// named object.
+func s3Request(req *http.Request, bucket, key string) *http.Request {
+	rv := *req
+	u := *req.URL
+	u.Path = "/" + bucket + "/" + key
+	u.RawPath = ""
+	rv.URL = &u
+	rv.Header = s3FileHeaders(req.Header)
+	return &rv
+}
+
+func s3Split(p string) (bucket, key string) {
+	p = strings.TrimPrefix(p, "/")
+	parts := strings.SplitN(p, "/", 2)
+	bucket = parts[0]
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	return
+}
+
+func s3ListBuckets(w http.ResponseWriter, req *http.Request) {
+	fl, err := listFiles("", false, 1)
+	if err != nil {
+		sendS3Error(w, req, 500, "InternalError", err.Error())
+		return
+	}
+	rv := s3ListBucketsResult{Xmlns: s3Namespace, Buckets: []s3Bucket{}}
+	for name := range fl.Dirs {
+		rv.Buckets = append(rv.Buckets, s3Bucket{
+			Name:         name,
+			CreationDate: time.Time{}.Format(s3TimeFormat),
+		})
+	}
+	sort.Slice(rv.Buckets, func(i, j int) bool {
+		return rv.Buckets[i].Name < rv.Buckets[j].Name
+	})
+	sendS3XML(w, 200, rv)
+}
+
+// List with a "/" delimiter, which is exactly one directory level.
+func s3ListDir(bucket, prefix string) ([]s3Entry, error) {
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+	fl, err := listFiles(strings.TrimSuffix(bucket+"/"+dir, "/"), true, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []s3Entry{}
+	for name, v := range fl.Files {
+		fm := fileMeta{}
+		if rm, ok := v.(*json.RawMessage); !ok || json.Unmarshal(*rm, &fm) != nil {
+			continue
+		}
+		if k := dir + name; strings.HasPrefix(k, prefix) {
+			rv = append(rv, s3Entry{k, &fm})
+		}
+	}
+	for name := range fl.Dirs {
+		if k := dir + name + "/"; strings.HasPrefix(k, prefix) {
+			rv = append(rv, s3Entry{k, nil})
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].key < rv[j].key })
+	return rv, nil
+}
+
+// List up to max+1 keys under a prefix after the given key.  The
+// file_browse view orders paths by component, which isn't the byte
+// order S3 lists in (a/b sorts before a-b there, and after it here),
+// so each directory is walked on its own, after the siblings that
+// sort before it.
+func s3ListFlat(bucket, prefix, after string, max int) ([]s3Entry, error) {
+	full := strings.Split(bucket+"/"+prefix, "/")
+	dir, name := full[:len(full)-1], full[len(full)-1]
+	to := ""
+	if name != "" {
+		to = name + "\xff"
+	}
+
+	l := s3FlatLister{after: bucket + "/" + after, max: max + 1}
+	if err := l.walk(dir, name, to); err != nil && err != errS3ListFull {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, f := range l.found {
+		ids = append(ids, f.id)
+	}
+	docs, err := couchbase.GetBulk(ids)
+	if err != nil {
+		return nil, err
+	}
+	rv := []s3Entry{}
+	for _, f := range l.found {
+		fm := fileMeta{}
+		if data, ok := docs[f.id]; ok && json.Unmarshal(data, &fm) == nil {
+			rv = append(rv, s3Entry{f.key[len(bucket)+1:], &fm})
+		}
+	}
+	return rv, nil
+}
+
+var errS3ListFull = errors.New("listing is full")
+
+type s3FlatLister struct {
+	after string
+	max   int
+	found []struct{ key, id string }
+}
+
+func s3BrowseKey(dir []string, last interface{}) []interface{} {
+	rv := []interface{}{}
+	for _, c := range dir {
+		rv = append(rv, c)
+	}
+	return append(rv, last)
+}
+
+// Collect, in byte order, the files under dir whose next component
+// is in [from, to) (to "" for no limit).
+func (l *s3FlatLister) walk(dir []string, from, to string) error {
+	base := strings.Join(dir, "/") + "/"
+	if strings.HasPrefix(l.after, base) {
+		// Skip to after's component here, but not past a directory
+		// that sorts after it (a/ follows a-b).
+		s := l.after[len(base):]
+		if i := strings.Index(s, "/"); i >= 0 {
+			s = s[:i]
+		}
+		if i := strings.IndexFunc(s, func(r rune) bool { return r < '/' }); i >= 0 {
+			s = s[:i]
+		}
+		if s > from {
+			from = s
+		}
+	} else if l.after > base {
+		return nil
+	}
+	if to != "" && from >= to {
+		return nil
+	}
+
+	var end interface{} = to
+	if to == "" {
+		end = map[string]interface{}{}
+	}
+	start := s3BrowseKey(dir, from)
+	last := ""
+	for {
+		viewRes := struct {
+			Rows []struct {
+				Key []string
+				Id  string
+			}
+		}{}
+		err := couchbase.View("file_browse",
+			map[string]interface{}{
+				"reduce":   false,
+				"limit":    s3ListPage,
+				"startkey": start,
+				"endkey":   s3BrowseKey(dir, end),
+			}, &viewRes)
+		if err != nil {
+			return err
+		}
+
+		descended := false
+		for _, r := range viewRes.Rows {
+			k := strings.Join(r.Key, "/")
+			if k == last {
+				// Each page starts with the last row of the previous one.
+				continue
+			}
+			c := r.Key[len(dir)]
+			if len(r.Key) == len(dir)+1 {
+				last = k
+				start = s3BrowseKey(dir, c)
+				if k > l.after {
+					l.found = append(l.found, struct{ key, id string }{k, r.Id})
+					if len(l.found) >= l.max {
+						return errS3ListFull
+					}
+				}
+				continue
+			}
+
+			// A directory: first the siblings that sort before it,
+			// then what's in it.
+			if err := l.walk(dir, c+"\x00", c+"/"); err != nil {
+				return err
+			}
+			sub := append(append([]string{}, dir...), c)
+			if err := l.walk(sub, "", ""); err != nil {
+				return err
+			}
+			start, descended = s3BrowseKey(dir, c+"/"), true
+			break
+		}
+		if !descended && len(viewRes.Rows) < s3ListPage {
+			return nil
+		}
+	}
+}
+
+func s3ListObjects(w http.ResponseWriter, req *http.Request, bucket string) {
+	q := req.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	rv := s3ListResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   s3MaxKeys,
+	}
+
+	if mk := q.Get("max-keys"); mk != "" {
+		i, err := strconv.Atoi(mk)
+		if err != nil || i < 0 {
+			sendS3Error(w, req, 400, "InvalidArgument", "invalid max-keys")
+			return
+		}
+		if i < rv.MaxKeys {
+			rv.MaxKeys = i
+		}
+	}
+
+	after := q.Get("marker")
+	if v2 {
+		rv.StartAfter = q.Get("start-after")
+		after = rv.StartAfter
+		if t := q.Get("continuation-token"); t != "" {
+			rv.ContinuationToken = t
+			k, err := base64.URLEncoding.DecodeString(t)
+			if err != nil {
+				sendS3Error(w, req, 400, "InvalidArgument",
+					"invalid continuation token")
+				return
+			}
+			after = string(k)
+		}
+	} else {
+		rv.Marker = after
+	}
+
+	var entries []s3Entry
+	var err error
+	switch rv.Delimiter {
+	case "":
+		entries, err = s3ListFlat(bucket, rv.Prefix, after, rv.MaxKeys)
+	case "/":
+		entries, err = s3ListDir(bucket, rv.Prefix)
+		for len(entries) > 0 && after != "" && entries[0].key <= after {
+			entries = entries[1:]
+		}
+	default:
+		sendS3Error(w, req, 501, "NotImplemented",
+			"only the / delimiter is supported")
+		return
+	}
+	if err != nil {
+		sendS3Error(w, req, 500, "InternalError", err.Error())
+		return
+	}
+
+	if len(entries) > rv.MaxKeys {
+		entries = entries[:rv.MaxKeys]
+		rv.IsTruncated = true
+	}
+	for _, e := range entries {
+		if e.meta == nil {
+			rv.CommonPrefixes = append(rv.CommonPrefixes, s3CommonPrefix{e.key})
+			continue
+		}
+		rv.Contents = append(rv.Contents, s3Object{
+			Key:          e.key,
+			LastModified: e.meta.Modified.UTC().Format(s3TimeFormat),
+			ETag:         `"` + e.meta.OID + `"`,
+			Size:         e.meta.Length,
+			StorageClass: s3StorageClass,
+		})
+	}
+	rv.KeyCount = len(entries)
+
+	if rv.IsTruncated && len(entries) > 0 {
+		last := entries[len(entries)-1].key
+		if v2 {
+			rv.NextContinuationToken =
+				base64.URLEncoding.EncodeToString([]byte(last))
+		} else {
+			rv.NextMarker = last
+		}
+	}
+
+	sendS3XML(w, 200, rv)
+}
+
+func s3DeleteBucket(w http.ResponseWriter, req *http.Request, bucket string) {
+	fl, err := listFiles(bucket, false, 1)
+	if err != nil {
+		sendS3Error(w, req, 500, "InternalError", err.Error())
+		return
+	}
+	if len(fl.Files)+len(fl.Dirs) > 0 {
+		sendS3Error(w, req, 409, "BucketNotEmpty",
+			"The bucket you tried to delete is not empty")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func s3PutObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	r := s3Request(req, bucket, key)
+	// s3Authenticate has already swapped in a decoding body.
+	if isStreamingPayload(req) {
+		r.ContentLength = -1
+		if l, err := strconv.ParseInt(
+			req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			r.ContentLength = l
+		}
+		if r.Header.Get("Content-Encoding") == "aws-chunked" {
+			r.Header.Del("Content-Encoding")
+		}
+	}
+	putUserFile(s3Writer(w, req, map[int]int{201: 200}), r)
+}
+
+// Copy by referencing the source's blob from a new file record.
+// The bucket/key named by X-Amz-Copy-Source.
+func s3CopySource(req *http.Request) (string, error) {
+	src := req.Header.Get("X-Amz-Copy-Source")
+	if i := strings.Index(src, "?"); i >= 0 {
+		src = src[:i]
+	}
+	src, err := url.PathUnescape(strings.TrimPrefix(src, "/"))
+	if err == nil && !strings.Contains(src, "/") {
+		err = errors.New("invalid copy source")
+	}
+	return src, err
+}
+
+func s3CopyObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	src, err := s3CopySource(req)
+	if err != nil {
+		sendS3Error(w, req, 400, "InvalidArgument", "invalid copy source")
+		return
+	}
+
+	got := fileMeta{}
+	if err := couchbase.Get(shortName(src), &got); err != nil {
+		sendS3Error(w, req, 404, "NoSuchKey", err.Error())
+		return
+	}
+
+	if req.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		got.Headers = filterHeaders(req.Header, isFileHeader)
+	}
+
+	dst := bucket + "/" + key
+	fm, err := linkCopy(got, dst)
+	if isRetained(err) {
+		sendS3Error(w, req, 403, s3ErrorCode(403), err.Error())
+		return
+	}
+	if isOverQuota(err) {
+		sendS3Error(w, req, 507, s3ErrorCode(507), err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error copying %v -> %v: %v", src, dst, err)
+		sendS3Error(w, req, 500, "InternalError", err.Error())
+		return
+	}
+
+	log.Printf("Copied %v -> %v (%v)", src, dst, fm.OID)
+
+	sendS3XML(w, 200, s3CopyResult{
+		Xmlns:        s3Namespace,
+		LastModified: fm.Modified.Format(s3TimeFormat),
+		ETag:         `"` + fm.OID + `"`,
+	})
+}
+
+// Apply the path ACLs to an S3 request.  The -s3accessKey key can do
+// anything.
+func s3Authorized(req *http.Request, accessKey, bucket, key string) bool {
+	a := getAuthConfig()
+	if !a.enabled() || (accessKey != "" && accessKey == *s3AccessKey) {
+		return true
+	}
+
+	need := access{role: roleWriter, path: bucket + "/" + key, scoped: true}
+	switch {
+	case bucket == "":
+		need = access{role: roleReader}
+	case req.Method == "GET" || req.Method == "HEAD":
+		need.role = roleReader
+	}
+	if a.roleFor(accessKey, need) < need.role {
+		return false
+	}
+
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		src, err := s3CopySource(req)
+		return err != nil || a.roleFor(accessKey,
+			access{role: roleReader, path: src, scoped: true}) >= roleReader
+	}
+	return true
+}
+
+func s3Handler(w http.ResponseWriter, req *http.Request) {
+	if isStreamingPayload(req) &&
+		req.Header.Get("X-Amz-Content-Sha256") != signedStreamingPayload {
+		sendS3Error(w, req, 501, "NotImplemented",
+			"only "+signedStreamingPayload+" streaming is supported")
+		return
+	}
+	accessKey, err := s3Authenticate(req, time.Now())
+	if err != nil {
+		code, msg := "AccessDenied", err.Error()
+		if ae, ok := err.(s3AuthError); ok {
+			code, msg = ae.code, ae.msg
+		}
+		sendS3Error(w, req, 403, code, msg)
+		return
+	}
+
+	// Retention can only be overridden through the native API.
+	req.Header.Del(retentionOverrideHeader)
+
+	bucket, key := s3Split(req.URL.Path)
+	if !s3Authorized(req, accessKey, bucket, key) {
+		sendS3Error(w, req, 403, "AccessDenied", "Access denied")
+		return
+	}
+	switch {
+	case bucket == "" && req.Method == "GET":
+		s3ListBuckets(w, req)
+	case bucket == "" || strings.HasPrefix(bucket, "."):
+		sendS3Error(w, req, 405, "MethodNotAllowed", "Method not allowed")
+	case key == "":
+		switch req.Method {
+		case "GET":
+			s3ListObjects(w, req, bucket)
+		case "PUT", "HEAD":
+			// Buckets are just directories, so they always exist.
+			w.WriteHeader(200)
+		case "DELETE":
+			s3DeleteBucket(w, req, bucket)
+		default:
+			sendS3Error(w, req, 405, "MethodNotAllowed", "Method not allowed")
+		}
+	default:
+		switch req.Method {
+		case "GET":
+			doGetUserDoc(s3Writer(w, req, nil), s3Request(req, bucket, key))
+		case "HEAD":
+			doHeadUserFile(s3Writer(w, req, nil), s3Request(req, bucket, key))
+		case "PUT":
+			if req.Header.Get("X-Amz-Copy-Source") != "" {
+				s3CopyObject(w, req, bucket, key)
+			} else {
+				s3PutObject(w, req, bucket, key)
+			}
+		case "DELETE":
+			// Deleting something that isn't there is fine in S3.
+			doDeleteUserDoc(s3Writer(w, req, map[int]int{404: 204}),
+				s3Request(req, bucket, key))
+		default:
+			sendS3Error(w, req, 405, "MethodNotAllowed", "Method not allowed")
+		}
+	}
+}
+
+func s3HandlerName(*http.Request) string {
+	return "s3"
+}
+
+func serveS3() {
+	if *s3Bind == "" {
+		return
+	}
+
+	s := &http.Server{
+		Addr:        *s3Bind,
+		Handler:     instrumented(s3HandlerName, s3Handler),
+		ReadTimeout: *readTimeout,
+	}
+	log.Printf("Listening to S3 requests on %s", *s3Bind)
+
+	l, err := net.Listen("tcp", *s3Bind)
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	log.Fatal(s.Serve(tlsListen(l)))
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// The only streaming payload we accept; each chunk is signed.
+	signedStreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	chunkAlgorithm         = "AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256            = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxRequestSkew         = 15 * time.Minute
+)
+
+var (
+	errPayloadHash    = errors.New("cbfs: payload doesn't match x-amz-content-sha256")
+	errChunkSignature = errors.New("cbfs: chunk signature doesn't match")
+)
+
+type s3AuthError struct {
+	code, msg string
+}
+
+func (e s3AuthError) Error() string {
+	return e.code + ": " + e.msg
+}
+
+// The pieces of an AWS signature version 4 request, from either the
+// Authorization header or a presigned URL.
+type sigV4Request struct {
+	accessKey     string
+	scopeDate     string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+func (s sigV4Request) scope() string {
+	return strings.Join([]string{s.scopeDate, s.region, s.service,
+		"aws4_request"}, "/")
+}
+
+func parseCredential(s *sigV4Request, cred string) error {
+	parts := strings.Split(cred, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return s3AuthError{"AuthorizationHeaderMalformed",
+			"invalid credential: " + cred}
+	}
+	s.accessKey, s.scopeDate, s.region, s.service =
+		parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+func parseAmzDate(req *http.Request, s *sigV4Request, d string) error {
+	var err error
+	if d != "" {
+		s.amzDate, err = time.Parse(sigV4TimeFormat, d)
+	} else {
+		s.amzDate, err = http.ParseTime(req.Header.Get("Date"))
+	}
+	if err != nil {
+		return s3AuthError{"AccessDenied", "invalid or missing date"}
+	}
+	if s.amzDate.UTC().Format("20060102") != s.scopeDate {
+		return s3AuthError{"SignatureDoesNotMatch",
+			"credential date doesn't match request date"}
+	}
+	return nil
+}
+
+func parseSigV4(req *http.Request) (sigV4Request, error) {
+	rv := sigV4Request{}
+	q := req.URL.Query()
+
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+			return rv, s3AuthError{"InvalidRequest",
+				"only " + sigV4Algorithm + " is supported"}
+		}
+		fields := map[string]string{}
+		for _, f := range strings.Split(auth[len(sigV4Algorithm)+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+			if len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+		if err := parseCredential(&rv, fields["Credential"]); err != nil {
+			return rv, err
+		}
+		rv.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+		rv.signature = fields["Signature"]
+		rv.payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+		return rv, parseAmzDate(req, &rv, req.Header.Get("X-Amz-Date"))
+	}
+
+	if q.Get("X-Amz-Algorithm") == "" {
+		return rv, s3AuthError{"AccessDenied", "anonymous access is not allowed"}
+	}
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return rv, s3AuthError{"InvalidRequest",
+			"only " + sigV4Algorithm + " is supported"}
+	}
+	if err := parseCredential(&rv, q.Get("X-Amz-Credential")); err != nil {
+		return rv, err
+	}
+	rv.presigned = true
+	rv.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	rv.signature = q.Get("X-Amz-Signature")
+	rv.payloadHash = unsignedPayload
+	secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || secs < 0 {
+		return rv, s3AuthError{"AuthorizationQueryParametersError",
+			"invalid X-Amz-Expires"}
+	}
+	rv.expires = time.Duration(secs) * time.Second
+	return rv, parseAmzDate(req, &rv, q.Get("X-Amz-Date"))
+}
+
+// URI encode as described by the SigV4 spec: everything but the
+// unreserved characters, and optionally leaving slashes alone.
+func s3Escape(s string, encodeSlash bool) string {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z',
+			'0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~',
+			c == '/' && !encodeSlash:
+			buf = append(buf, c)
+		default:
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
+
+func canonicalHeaderValue(req *http.Request, name string) string {
+	switch name {
+	case "host":
+		return req.Host
+	case "content-length":
+		if _, ok := req.Header["Content-Length"]; !ok {
+			return strconv.FormatInt(req.ContentLength, 10)
+		}
+	}
+	vals := []string{}
+	for _, v := range req.Header[http.CanonicalHeaderKey(name)] {
+		vals = append(vals, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(vals, ",")
+}
+
+func (s sigV4Request) canonicalRequest(req *http.Request) string {
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	params := []string{}
+	for k, vs := range req.URL.Query() {
+		if s.presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	headers := []string{}
+	for _, h := range s.signedHeaders {
+		headers = append(headers, h+":"+canonicalHeaderValue(req, h)+"\n")
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		s3Escape(path, false),
+		strings.Join(params, "&"),
+		strings.Join(headers, ""),
+		strings.Join(s.signedHeaders, ";"),
+		s.payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s sigV4Request) signingKey(secret string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), s.scopeDate)
+	k = hmacSHA256(k, s.region)
+	k = hmacSHA256(k, s.service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func (s sigV4Request) sign(req *http.Request, secret string) string {
+	crh := sha256.Sum256([]byte(s.canonicalRequest(req)))
+	toSign := strings.Join([]string{
+		sigV4Algorithm,
+		s.amzDate.UTC().Format(sigV4TimeFormat),
+		s.scope(),
+		hex.EncodeToString(crh[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(s.signingKey(secret), toSign))
+}
+
+func isSigV4(req *http.Request) bool {
+	return req.Header.Get("Authorization") != "" ||
+		req.URL.Query().Get("X-Amz-Algorithm") != ""
+}
+
+// Verify the request's signature against the -s3accessKey
+// credentials or the API keys, returning the access key it was
+// signed with.  Without -s3accessKey, unsigned requests are allowed
+// through as anonymous.
+func s3Authenticate(req *http.Request, now time.Time) (string, error) {
+	a := getAuthConfig()
+	if *s3AccessKey == "" && (!a.enabled() || !isSigV4(req)) {
+		// Anonymous, and left to the path ACLs.  With no secret to
+		// check them against, chunk signatures are just skipped.
+		if isStreamingPayload(req) {
+			req.Body = newAWSChunkedBody(req.Body, nil)
+		}
+		return "", nil
+	}
+
+	s, err := parseSigV4(req)
+	if err != nil {
+		return "", err
+	}
+	secret := ""
+	switch {
+	case *s3AccessKey != "" && s.accessKey == *s3AccessKey:
+		secret = *s3SecretKey
+	case a.Keys[s.accessKey].Secret != "":
+		secret = a.Keys[s.accessKey].Secret
+	default:
+		return "", s3AuthError{"InvalidAccessKeyId", "unknown access key"}
+	}
+
+	if s.presigned {
+		if now.After(s.amzDate.Add(s.expires)) {
+			return "", s3AuthError{"AccessDenied", "request has expired"}
+		}
+	} else if d := now.Sub(s.amzDate); d > maxRequestSkew || d < -maxRequestSkew {
+		return "", s3AuthError{"RequestTimeTooSkewed",
+			"request time too far from server time"}
+	}
+
+	if !hmac.Equal([]byte(s.sign(req, secret)), []byte(s.signature)) {
+		return "", s3AuthError{"SignatureDoesNotMatch",
+			"request signature doesn't match"}
+	}
+
+	// The signature covers the declared payload hash, so make sure
+	// the payload actually has it.
+	switch {
+	case len(s.payloadHash) == sha256.Size*2:
+		if want, err := hex.DecodeString(s.payloadHash); err == nil {
+			req.Body = &sha256Reader{req.Body, sha256.New(), want}
+		}
+	case s.payloadHash == signedStreamingPayload:
+		req.Body = newAWSChunkedBody(req.Body, &chunkSigner{
+			key:   s.signingKey(secret),
+			date:  s.amzDate.UTC().Format(sigV4TimeFormat),
+			scope: s.scope(),
+			prev:  s.signature,
+		})
+	}
+
+	return s.accessKey, nil
+}
+
+// Fails at EOF if the content didn't hash to what was signed.
+type sha256Reader struct {
+	io.ReadCloser
+	h    hash.Hash
+	want []byte
+}
+
+func (s *sha256Reader) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.h.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(s.h.Sum(nil), s.want) {
+		err = errPayloadHash
+	}
+	return n, err
+}
+
+func isStreamingPayload(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), s3StreamingHash)
+}
+
+// Checks the signature of each chunk of a streaming upload, each one
+// chained off the one before it, starting from the request's.
+type chunkSigner struct {
+	key         []byte
+	date, scope string
+	prev        string
+}
+
+func (c *chunkSigner) verify(sig string, sum []byte) bool {
+	toSign := strings.Join([]string{
+		chunkAlgorithm,
+		c.date,
+		c.scope,
+		c.prev,
+		emptySHA256,
+		hex.EncodeToString(sum),
+	}, "\n")
+	c.prev = hex.EncodeToString(hmacSHA256(c.key, toSign))
+	return hmac.Equal([]byte(c.prev), []byte(sig))
+}
+
+// Decodes the aws-chunked body encoding used by streaming uploads,
+// failing at the end of any chunk whose signature doesn't match (if
+// there's a signer).
+type awsChunkedReader struct {
+	r       *bufio.Reader
+	signer  *chunkSigner
+	h       hash.Hash
+	sig     string
+	left    int64
+	started bool
+	done    bool
+}
+
+func newAWSChunkedReader(r io.Reader, signer *chunkSigner) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r), signer: signer,
+		h: sha256.New()}
+}
+
+func newAWSChunkedBody(body io.ReadCloser, signer *chunkSigner) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{newAWSChunkedReader(body, signer), body}
+}
+
+func (a *awsChunkedReader) checkChunk() error {
+	if a.signer != nil && !a.signer.verify(a.sig, a.h.Sum(nil)) {
+		return errChunkSignature
+	}
+	a.h.Reset()
+	return nil
+}
+
+func (a *awsChunkedReader) nextChunk() error {
+	if a.started {
+		if _, err := a.r.ReadString('\n'); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if err := a.checkChunk(); err != nil {
+			return err
+		}
+	}
+	a.started = true
+	line, err := a.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	parts := strings.SplitN(strings.TrimSpace(line), ";", 2)
+	a.left, err = strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || a.left < 0 {
+		return fmt.Errorf("invalid chunk header: %q", line)
+	}
+	a.sig = ""
+	if len(parts) == 2 {
+		a.sig = strings.TrimPrefix(parts[1], "chunk-signature=")
+	}
+	a.done = a.left == 0
+	if a.done {
+		return a.checkChunk()
+	}
+	return nil
+}
+
+func (a *awsChunkedReader) Read(p []byte) (int, error) {
+	for a.left == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		if err := a.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > a.left {
+		p = p[:a.left]
+	}
+	n, err := a.r.Read(p)
+	a.h.Write(p[:n])
+	a.left -= int64(n)
+	if err == io.EOF {
+		err = nil
+		if a.left > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
@@ -52,7 +52,7 @@ func doTarDocs(w http.ResponseWriter, req *http.Request,
 			continue
 		}
 
-		err = copyBlob(tw, nf.meta.OID)
+		err = copyFileContent(tw, nf.meta)
 		if err != nil {
 			log.Printf("Error copying blob for %v: %v",
 				nf.name, err)
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Internode tasks are kept in a bolt database under the root so they
+// survive a restart.  Workers take them in priority order (oldest
+// first within a priority), a task that's already queued isn't queued
+// again, and failed tasks are retried with backoff.  Changes are
+// written out in batches by flushLoop so producers and workers don't
+// wait on the disk.
+//
+//   GET    /.cbfs/queue/                      -> what's queued
+//   DELETE /.cbfs/queue/[?cmd=..&oid=..&node=..] -> drain it
+
+const (
+	taskQueueFile   = ".tasks.db"
+	maxTaskAttempts = 10
+	maxTaskBackoff  = time.Hour
+)
+
+var maxQueuedTasks = flag.Int("maxQueuedTasks", 1000000,
+	"Most internode tasks to keep queued")
+
+var taskQueueBucket = []byte("tasks")
+
+var errQueueFull = errors.New("internode task queue is full")
+
+type taskPriority int
+
+const (
+	// New copies of blobs that are short of replicas.
+	prioritySalvage = taskPriority(iota)
+	// Moving blobs off full nodes.
+	priorityRebalance
+	// Removing extra and garbage copies.
+	priorityCleanup
+	numTaskPriorities
+)
+
+var internodeCommandNames = map[internodeCommand]string{
+	removeObjectCmd:  "remove",
+	acquireObjectCmd: "acquire",
+	fetchObjectCmd:   "fetch",
+}
+
+func (c internodeCommand) String() string {
+	if s, ok := internodeCommandNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("internodeCommand(%d)", c)
+}
+
+func (c internodeCommand) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *internodeCommand) UnmarshalText(b []byte) error {
+	for k, v := range internodeCommandNames {
+		if v == string(b) {
+			*c = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown internode command %q", b)
+}
+
+// Tasks for the same blob, command and node are the same task.
+func (t internodeTask) id() string {
+	return t.Cmd.String() + "/" + t.Node + "/" + t.OID
+}
+
+func clampPriority(p taskPriority) taskPriority {
+	if p < 0 || p >= numTaskPriorities {
+		return priorityCleanup
+	}
+	return p
+}
+
+func taskBackoff(attempts int) time.Duration {
+	d := time.Second << uint(attempts)
+	if d > maxTaskBackoff || d <= 0 {
+		d = maxTaskBackoff
+	}
+	return d
+}
+
+type queueEntry struct {
+	id  string
+	seq uint64
+}
+
+type taskQueue struct {
+	db      *bolt.DB
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tasks   map[string]*internodeTask
+	running map[string]bool
+	// Entries whose seq no longer matches their task are stale.
+	ready   [numTaskPriorities][]queueEntry
+	delayed []queueEntry
+	seq     uint64
+	// IDs of tasks whose queued state hasn't been written out.
+	dirty    map[string]bool
+	flushReq chan bool
+	flushMu  sync.Mutex
+}
+
+var internodeTaskQueue *taskQueue
+
+func openTaskQueue(path string) (*taskQueue, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	q := &taskQueue{
+		db:       db,
+		tasks:    map[string]*internodeTask{},
+		running:  map[string]bool{},
+		dirty:    map[string]bool{},
+		flushReq: make(chan bool, 1),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	loaded := []*internodeTask{}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(taskQueueBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			t := &internodeTask{}
+			if err := json.Unmarshal(v, t); err != nil {
+				log.Printf("Dropping unreadable queued task %s: %v", k, err)
+				return nil
+			}
+			loaded = append(loaded, t)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].Queued.Before(loaded[j].Queued)
+	})
+	for _, t := range loaded {
+		t.Priority = clampPriority(t.Priority)
+		q.tasks[t.id()] = t
+		q.schedule(t)
+	}
+	if len(loaded) > 0 {
+		log.Printf("Resuming %v queued internode tasks", len(loaded))
+	}
+	return q, nil
+}
+
+func (q *taskQueue) Close() error {
+	q.flush()
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	return q.db.Close()
+}
+
+// Put a task in line to run.  Must hold q.mu.
+func (q *taskQueue) schedule(t *internodeTask) {
+	q.seq++
+	t.seq = q.seq
+	e := queueEntry{t.id(), t.seq}
+	if time.Now().Before(t.NotBefore) {
+		q.delayed = append(q.delayed, e)
+	} else {
+		q.ready[t.Priority] = append(q.ready[t.Priority], e)
+		q.cond.Signal()
+	}
+}
+
+// Note a task needs saving.  Must hold q.mu.
+func (q *taskQueue) persist(t *internodeTask) {
+	q.dirty[t.id()] = true
+	q.requestFlush()
+}
+
+// Note tasks need removing.  Must hold q.mu.
+func (q *taskQueue) forget(ids []string) {
+	for _, id := range ids {
+		q.dirty[id] = true
+	}
+	q.requestFlush()
+}
+
+func (q *taskQueue) requestFlush() {
+	select {
+	case q.flushReq <- true:
+	default:
+	}
+}
+
+// Write out every task that's changed since the last flush.
+func (q *taskQueue) flush() {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	puts := map[string][]byte{}
+	for id := range q.dirty {
+		var data []byte
+		if t, ok := q.tasks[id]; ok {
+			var err error
+			if data, err = json.Marshal(t); err != nil {
+				log.Printf("Error saving queued task %v: %v", id, err)
+				continue
+			}
+		}
+		puts[id] = data
+	}
+	q.dirty = map[string]bool{}
+	q.mu.Unlock()
+
+	if len(puts) == 0 {
+		return
+	}
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(taskQueueBucket)
+		for id, data := range puts {
+			var err error
+			if data == nil {
+				err = b.Delete([]byte(id))
+			} else {
+				err = b.Put([]byte(id), data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error saving %v queued tasks: %v", len(puts), err)
+		// Try again next time.
+		q.mu.Lock()
+		for id := range puts {
+			q.dirty[id] = true
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *taskQueue) flushLoop() {
+	for _ = range q.flushReq {
+		q.flush()
+	}
+}
+
+// Queue a task unless it's already queued, in which case it keeps the
+// more urgent of the two priorities.
+func (q *taskQueue) add(t internodeTask) error {
+	t.Priority = clampPriority(t.Priority)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := t.id()
+	if existing, ok := q.tasks[id]; ok {
+		if t.Priority < existing.Priority && !q.running[id] {
+			existing.Priority = t.Priority
+			q.persist(existing)
+			q.schedule(existing)
+		}
+		return nil
+	}
+	if len(q.tasks) >= *maxQueuedTasks {
+		return errQueueFull
+	}
+
+	t.Queued = time.Now().UTC()
+	q.tasks[id] = &t
+	q.persist(&t)
+	q.schedule(&t)
+	return nil
+}
+
+// Move tasks whose backoff is over back in line.
+func (q *taskQueue) promote() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	waiting := q.delayed[:0]
+	for _, e := range q.delayed {
+		t, ok := q.tasks[e.id]
+		switch {
+		case !ok || t.seq != e.seq:
+		case now.Before(t.NotBefore):
+			waiting = append(waiting, e)
+		default:
+			q.schedule(t)
+		}
+	}
+	q.delayed = waiting
+}
+
+// Wait for the next task to run.
+func (q *taskQueue) next() internodeTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for p := range q.ready {
+			for len(q.ready[p]) > 0 {
+				e := q.ready[p][0]
+				q.ready[p] = q.ready[p][1:]
+				t, ok := q.tasks[e.id]
+				if ok && t.seq == e.seq && !q.running[e.id] {
+					q.running[e.id] = true
+					return *t
+				}
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+// Record the outcome of a task from next.
+func (q *taskQueue) done(t internodeTask, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := t.id()
+	delete(q.running, id)
+	queued, ok := q.tasks[id]
+	if !ok {
+		// Drained while it was running.
+		return
+	}
+
+	if err == nil {
+		delete(q.tasks, id)
+		q.forget([]string{id})
+		return
+	}
+
+	queued.Attempts++
+	queued.LastError = err.Error()
+	if queued.Attempts >= maxTaskAttempts {
+		log.Printf("Giving up on %v after %v attempts: %v",
+			id, queued.Attempts, err)
+		delete(q.tasks, id)
+		q.forget([]string{id})
+		return
+	}
+	queued.NotBefore = time.Now().Add(taskBackoff(queued.Attempts)).UTC()
+	q.persist(queued)
+	q.schedule(queued)
+}
+
+func (q *taskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// Queued tasks, most urgent first.
+func (q *taskQueue) list() []internodeTask {
+	q.mu.Lock()
+	rv := make([]internodeTask, 0, len(q.tasks))
+	for _, t := range q.tasks {
+		rv = append(rv, *t)
+	}
+	q.mu.Unlock()
+
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Priority != rv[j].Priority {
+			return rv[i].Priority < rv[j].Priority
+		}
+		return rv[i].Queued.Before(rv[j].Queued)
+	})
+	return rv
+}
+
+// Remove the queued tasks matching, returning how many there were.
+// Running tasks finish, but aren't retried.
+func (q *taskQueue) drain(match func(internodeTask) bool) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := []string{}
+	for id, t := range q.tasks {
+		if match(*t) {
+			ids = append(ids, id)
+			delete(q.tasks, id)
+		}
+	}
+	q.forget(ids)
+	return len(ids)
+}
+
+func (q *taskQueue) promoteLoop() {
+	for _ = range time.Tick(time.Second) {
+		q.promote()
+	}
+}
+
+type queueStatus struct {
+	Total      int             `json:"total"`
+	ByPriority map[string]int  `json:"byPriority"`
+	Tasks      []internodeTask `json:"tasks"`
+}
+
+var taskPriorityNames = []string{"salvage", "rebalance", "cleanup"}
+
+func doListQueue(w http.ResponseWriter, req *http.Request) {
+	limit := 1000
+	if s := req.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit: "+s, 400)
+			return
+		}
+	}
+
+	tasks := internodeTaskQueue.list()
+	rv := queueStatus{Total: len(tasks), ByPriority: map[string]int{}}
+	for _, t := range tasks {
+		rv.ByPriority[taskPriorityNames[t.Priority]]++
+	}
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	rv.Tasks = tasks
+	sendJson(w, req, rv)
+}
+
+func doDrainQueue(w http.ResponseWriter, req *http.Request) {
+	cmd, oid, node := req.FormValue("cmd"), req.FormValue("oid"),
+		req.FormValue("node")
+	n := internodeTaskQueue.drain(func(t internodeTask) bool {
+		return (cmd == "" || t.Cmd.String() == cmd) &&
+			(oid == "" || t.OID == oid) &&
+			(node == "" || t.Node == node)
+	})
+	log.Printf("Drained %v internode tasks (cmd=%q oid=%q node=%q)",
+		n, cmd, oid, node)
+	sendJson(w, req, map[string]int{"drained": n})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTaskQueue(t *testing.T) {
+	defer withTmpRoot(t)()
+	path := filepath.Join(*root, taskQueueFile)
+
+	q, err := openTaskQueue(path)
+	if err != nil {
+		t.Fatalf("Error opening queue: %v", err)
+	}
+
+	q.add(internodeTask{Cmd: removeObjectCmd, Node: "a", OID: "1",
+		Priority: priorityCleanup})
+	q.add(internodeTask{Cmd: acquireObjectCmd, Node: "a", OID: "2",
+		Priority: priorityRebalance})
+	q.add(internodeTask{Cmd: acquireObjectCmd, Node: "b", OID: "3",
+		Priority: priorityRebalance})
+	// Already queued, but this is more urgent.
+	q.add(internodeTask{Cmd: acquireObjectCmd, Node: "b", OID: "3",
+		Priority: prioritySalvage})
+	if q.len() != 3 {
+		t.Fatalf("Expected 3 tasks after dedup, got %v", q.len())
+	}
+
+	first := q.next()
+	if first.OID != "3" || first.Priority != prioritySalvage {
+		t.Errorf("Expected salvage first, got %+v", first)
+	}
+	q.done(first, nil)
+
+	second := q.next()
+	if second.OID != "2" {
+		t.Errorf("Expected rebalance second, got %+v", second)
+	}
+	q.done(second, errors.New("node down"))
+	if q.len() != 2 {
+		t.Errorf("Expected failed task to stay queued, got %v", q.len())
+	}
+	for _, task := range q.list() {
+		if task.OID == "2" && (task.Attempts != 1 ||
+			!task.NotBefore.After(time.Now())) {
+			t.Errorf("Expected failed task to back off, got %+v", task)
+		}
+	}
+	q.Close()
+
+	q, err = openTaskQueue(path)
+	if err != nil {
+		t.Fatalf("Error reopening queue: %v", err)
+	}
+	defer q.Close()
+	tasks := q.list()
+	if len(tasks) != 2 || tasks[0].OID != "2" || tasks[0].Attempts != 1 ||
+		tasks[1].Cmd != removeObjectCmd {
+		t.Fatalf("Expected queue to survive reopening, got %+v", tasks)
+	}
+
+	// The retry is still backing off, so the removal goes next.
+	if task := q.next(); task.OID != "1" {
+		t.Errorf("Expected removal while retry waits, got %+v", task)
+	}
+
+	if n := q.drain(func(t internodeTask) bool { return t.Node == "a" }); n != 2 {
+		t.Errorf("Expected to drain 2 tasks, drained %v", n)
+	}
+	if q.len() != 0 {
+		t.Errorf("Expected empty queue, got %+v", q.list())
+	}
+}
+
+func TestTaskQueueBadPriority(t *testing.T) {
+	defer withTmpRoot(t)()
+	path := filepath.Join(*root, taskQueueFile)
+
+	q, err := openTaskQueue(path)
+	if err != nil {
+		t.Fatalf("Error opening queue: %v", err)
+	}
+	task := internodeTask{Cmd: removeObjectCmd, Node: "a", OID: "1",
+		Priority: numTaskPriorities + 3}
+	data, _ := json.Marshal(task)
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(taskQueueBucket).Put([]byte(task.id()), data)
+	})
+	if err != nil {
+		t.Fatalf("Error writing task: %v", err)
+	}
+	q.Close()
+
+	q, err = openTaskQueue(path)
+	if err != nil {
+		t.Fatalf("Error reopening queue: %v", err)
+	}
+	defer q.Close()
+	if got := q.next(); got.OID != "1" || got.Priority != priorityCleanup {
+		t.Errorf("Expected the task back as cleanup, got %+v", got)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -15,8 +14,6 @@ import (
 
 	"encoding/hex"
 
-	"github.com/couchbase/gomemcached"
-	"github.com/couchbase/gomemcached/client"
 	cb "github.com/couchbaselabs/go-couchbase"
 )
 
@@ -59,7 +56,7 @@ func init() {
 				return globalConfig.GCFreq
 			},
 			garbageCollectBlobs,
-			[]string{"ensureMinReplCount", "trimFullNodes"},
+			[]string{"ensureMinReplCount", "trimFullNodes", "repairShards"},
 		},
 		"ensureMinReplCount": {
 			func() time.Duration {
@@ -68,6 +65,13 @@ func init() {
 			ensureMinimumReplicaCount,
 			[]string{"garbageCollectBlobs", "trimFullNodes"},
 		},
+		"repairShards": {
+			func() time.Duration {
+				return globalConfig.UnderReplicaCheckFreq
+			},
+			repairShards,
+			[]string{"ensureMinReplCount", "garbageCollectBlobs"},
+		},
 		"pruneExcessiveReplicas": {
 			func() time.Duration {
 				return globalConfig.OverReplicaCheckFreq
@@ -89,6 +93,13 @@ func init() {
 			trimFullNodes,
 			[]string{"ensureMinReplCount", "garbageCollectBlobs"},
 		},
+		"replicate": {
+			func() time.Duration {
+				return globalConfig.ReplicationFreq
+			},
+			replicate,
+			nil,
+		},
 	}
 
 	localPeriodicJobRecipes = map[string]*periodicJobRecipe{
@@ -127,6 +138,20 @@ func init() {
 			checkTime,
 			nil,
 		},
+		"cleanUploads": {
+			func() time.Duration {
+				return time.Hour
+			},
+			cleanAbandonedUploads,
+			nil,
+		},
+		"rekeyBlobs": {
+			func() time.Duration {
+				return globalConfig.RekeyFreq
+			},
+			rekeyBlobs,
+			[]string{"reconcile"},
+		},
 	}
 
 	initTaskMetrics()
@@ -189,20 +214,18 @@ func listRunningTasks() (map[string]TaskList, error) {
 		keys = append(keys, "/@"+n.name+"/tasks")
 	}
 
-	responses, _, err := couchbase.GetBulk(keys)
+	responses, err := couchbase.GetBulk(keys)
 	if err != nil {
 		return nil, err
 	}
 
 	for k, res := range responses {
-		if res.Status == gomemcached.SUCCESS {
-			ob := TaskList{}
-			err = json.Unmarshal(res.Body, &ob)
-			if err != nil {
-				return nil, err
-			}
-			rv[k] = ob
+		ob := TaskList{}
+		err = json.Unmarshal(res, &ob)
+		if err != nil {
+			return nil, err
 		}
+		rv[k] = ob
 	}
 
 	return rv, err
@@ -226,27 +249,16 @@ func runNamedTask(name string, job *PeriodicJob, force bool) error {
 
 	alreadyRunning := errors.New("running")
 
-	err := couchbase.Do(key, func(mc *memcached.Client, vb uint16) error {
-		var resp *gomemcached.MCResponse
-		var err error
-		if force {
-			resp, err = memcached.UnwrapMemcachedError(mc.Set(vb,
-				key, 0, int(t.Seconds()), mustEncode(&jm)))
-		} else {
-			resp, err = memcached.UnwrapMemcachedError(mc.Add(vb,
-				key, 0, int(t.Seconds()), mustEncode(&jm)))
-		}
-		if err != nil {
-			return err
+	var err error
+	if force {
+		err = couchbase.Set(key, int(t.Seconds()), &jm)
+	} else {
+		added := false
+		added, err = couchbase.Add(key, int(t.Seconds()), &jm)
+		if err == nil && !added {
+			err = alreadyRunning
 		}
-		if resp.Status == gomemcached.KEY_EEXISTS {
-			return alreadyRunning
-		}
-		if resp.Status != gomemcached.SUCCESS {
-			return fmt.Errorf("Wanted success, got %v", resp.Status)
-		}
-		return nil
-	})
+	}
 
 	if err == nil {
 		err = setTaskState(name, "preparing")
@@ -341,6 +353,7 @@ func cleanupNode(node string) {
 				Json struct {
 					Nodes   map[string]string
 					Garbage bool
+					ShardOf string
 				}
 			}
 		}
@@ -349,7 +362,7 @@ func cleanupNode(node string) {
 
 	log.Printf("Cleaning up node %v with count %v",
 		node, globalConfig.NodeCleanCount)
-	err = couchbase.ViewCustom("cbfs", "node_blobs",
+	err = couchbase.View("node_blobs",
 		map[string]interface{}{
 			"key":          node,
 			"limit":        globalConfig.NodeCleanCount,
@@ -369,6 +382,9 @@ func cleanupNode(node string) {
 			log.Printf("%v appears to be garbage during cleanup. Dropping",
 				r.Id[1:])
 			removeBlobOwnershipRecord(r.Id[1:], node)
+		} else if r.Doc.Json.ShardOf != "" {
+			// repairShards rebuilds it elsewhere.
+			removeBlobOwnershipRecord(r.Id[1:], node)
 		} else if len(r.Doc.Json.Nodes) < globalConfig.MinReplicas {
 			if !salvageBlob(r.Id[1:], node, 1, nodes) {
 				log.Printf("Queue is full during cleanup")
@@ -472,36 +488,16 @@ func relockTask(taskName string) bool {
 		k = "/@" + serverId + "/" + taskName
 	}
 
-	err := couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		resp, err := mc.Get(vb, k)
-		if err != nil {
-			return err
-		}
-
-		jm := JobMarker{}
-		err = json.Unmarshal(resp.Body, &jm)
-		if err != nil {
-			return err
-		}
-		if jm.Node != serverId {
-			return errors.New("Lost lock")
-		}
+	jm := JobMarker{}
+	cas := uint64(0)
+	err := couchbase.Gets(k, &jm, &cas)
+	if err == nil && jm.Node != serverId {
+		err = errors.New("Lost lock")
+	}
+	if err == nil {
 		jm.Started = time.Now().UTC()
-		req := &gomemcached.MCRequest{
-			Opcode:  gomemcached.SET,
-			VBucket: vb,
-			Key:     []byte(k),
-			Cas:     resp.Cas,
-			Opaque:  0,
-			Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
-			Body:    mustEncode(&jm),
-		}
-		exp := task.period().Seconds()
-		binary.BigEndian.PutUint64(req.Extras, uint64(exp))
-
-		_, err = mc.Send(req)
-		return err
-	})
+		err = couchbase.CAS(k, int(task.period().Seconds()), cas, &jm)
+	}
 
 	return err == nil
 }
@@ -540,8 +536,10 @@ func runMarkedTask(name string, job *PeriodicJob) error {
 		return err
 	}
 
-	defer endedTask(name, time.Now())
-	return job.f()
+	start = time.Now()
+	err = job.f()
+	endedTask(name, start, err)
+	return err
 }
 
 func moveSomeOffOf(n StorageNode, nl NodeList) {
@@ -560,7 +558,7 @@ func moveSomeOffOf(n StorageNode, nl NodeList) {
 		Errors []cb.ViewError
 	}{}
 
-	err := couchbase.ViewCustom("cbfs", "node_blobs",
+	err := couchbase.View("node_blobs",
 		map[string]interface{}{
 			"key":          n.name,
 			"limit":        globalConfig.TrimFullNodesCount,
@@ -573,6 +571,11 @@ func moveSomeOffOf(n StorageNode, nl NodeList) {
 		return
 	}
 
+	nm, err := findNodeMap()
+	if err != nil {
+		log.Printf("Error finding node zones: %v", err)
+	}
+
 	removed := int64(0)
 	log.Printf("Moving %v blobs from %v", len(viewRes.Rows), n)
 	for _, row := range viewRes.Rows {
@@ -602,11 +605,22 @@ func moveSomeOffOf(n StorageNode, nl NodeList) {
 				continue
 			}
 
+			// Prefer a zone that has no other copy.
+			others := NodeList{}
+			for name := range row.Doc.Json.Nodes {
+				if sn, ok := nm[name]; ok && name != n.name {
+					others = append(others, sn)
+				}
+			}
+			if c := candidates.outside(others.zones()); len(c) > 0 {
+				candidates = c
+			}
+
 			newnode := candidates[rand.Intn(len(candidates))]
 
 			log.Printf("Moving replica of %v from %v to %v",
 				oid, n, newnode)
-			queueBlobAcquire(newnode, oid, n.name)
+			queueBlobAcquire(newnode, oid, n.name, priorityRebalance)
 		} else {
 			// There are enough, just trim it.
 			log.Printf("Just trimming %v from %v", oid, n)
@@ -678,7 +692,7 @@ func garbageCollectBlobs() error {
 		// we hit this view descending because we want file sorted
 		// before blob the fact that we walk the list backwards
 		// hopefully not too awkward
-		err := couchbase.ViewCustom("cbfs", "file_blobs",
+		err := couchbase.View("file_blobs",
 			map[string]interface{}{
 				"stale":      false,
 				"descending": true,
@@ -713,8 +727,14 @@ func garbageCollectBlobs() error {
 					n, ok := nm[blobNode]
 					switch {
 					case blobNode == "":
-						removeBlobOwnershipRecord(blobId, serverId)
-						count++
+						// Erasure coded blobs have no owners,
+						// so give new ones time to be linked.
+						if okToClean(blobId) {
+							removeBlobOwnershipRecord(blobId, serverId)
+							count++
+						} else {
+							skipped++
+						}
 					case ok:
 						if b, err := hex.DecodeString(blobId); err == nil &&
 							backedup.Contains(b) {
@@ -745,11 +765,17 @@ func garbageCollectBlobs() error {
 
 	log.Printf("Scheduled %d blobs for deletion, skipped %d, in backup %d",
 		count, skipped, inBackup)
+	recordGCMetrics(count, skipped, inBackup)
 	return nil
 }
 
 func checkTime() error {
-	m := couchbase.GetStats("")
+	cbs, ok := couchbase.(*cbStore)
+	if !ok {
+		// Only meaningful against a couchbase cluster.
+		return nil
+	}
+	m := cbs.GetStats("")
 	post := time.Now()
 
 	totalTimes := int64(0)
@@ -796,7 +822,7 @@ func grabSomeData() {
 	}{}
 
 	// Find some less replicated docs to suck in.
-	err := couchbase.ViewCustom("cbfs", "repcounts",
+	err := couchbase.View("repcounts",
 		map[string]interface{}{
 			"reduce":   false,
 			"limit":    *maxStartupObjects,
@@ -815,7 +841,7 @@ func grabSomeData() {
 
 	for _, r := range viewRes.Rows {
 		if !hasBlob(r.Id[1:]) {
-			if !maybeQueueBlobFetch(r.Id[1:], "") {
+			if !maybeQueueBlobFetch(r.Id[1:], "", priorityRebalance) {
 				log.Printf("Fetch queue is full, giving up.")
 				return
 			}
@@ -944,7 +970,7 @@ func updateConfig() error {
 
 func reloadConfig() {
 	for _ = range time.Tick(time.Minute) {
-		if err := updateConfig(); err != nil && !gomemcached.IsNotFound(err) {
+		if err := updateConfig(); err != nil && !isNotFound(err) {
 			log.Printf("Error updating config: %v", err)
 		}
 	}
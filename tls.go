@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// With a certificate and key, the web (and S3) listeners serve HTTPS
+// and the node advertises that in its heartbeat so other nodes use
+// HTTPS to reach it.  Frames connections aren't encrypted, so TLS
+// nodes don't offer frames at all.
+
+var tlsCert = flag.String("tlsCert", "", "TLS certificate file")
+var tlsKey = flag.String("tlsKey", "", "TLS private key file")
+var tlsCA = flag.String("tlsCA", "",
+	"CA certificates for verifying other nodes (default: system roots)")
+var tlsVerifyPeers = flag.Bool("tlsVerifyPeers", false,
+	"Accept client certificates signed by -tlsCA as other nodes")
+var tlsSkipVerify = flag.Bool("tlsSkipVerify", false,
+	"Don't verify other nodes' certificates")
+
+var tlsServerConfig, tlsClientConfig *tls.Config
+
+func tlsEnabled() bool {
+	return *tlsCert != "" && *tlsKey != ""
+}
+
+func nodeScheme() string {
+	if tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+func initTLS() error {
+	if *tlsCert == "" && *tlsKey == "" {
+		if *tlsVerifyPeers {
+			return errors.New("-tlsVerifyPeers needs -tlsCert and -tlsKey")
+		}
+		tlsClientConfig = &tls.Config{InsecureSkipVerify: *tlsSkipVerify}
+		return loadTLSCA(tlsClientConfig, nil)
+	}
+	if !tlsEnabled() {
+		return errors.New("both -tlsCert and -tlsKey are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+
+	tlsServerConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	// Present the same certificate when talking to other nodes.
+	tlsClientConfig = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: *tlsSkipVerify,
+	}
+
+	if *tlsVerifyPeers {
+		if *tlsCA == "" {
+			return errors.New("-tlsVerifyPeers needs -tlsCA")
+		}
+		tlsServerConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return loadTLSCA(tlsClientConfig, tlsServerConfig)
+}
+
+func loadTLSCA(client, server *tls.Config) error {
+	if *tlsCA == "" {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(*tlsCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates found in " + *tlsCA)
+	}
+	client.RootCAs = pool
+	if server != nil && *tlsVerifyPeers {
+		server.ClientCAs = pool
+	}
+	return nil
+}
+
+func tlsListen(l net.Listener) net.Listener {
+	if tlsServerConfig == nil {
+		return l
+	}
+	return tls.NewListener(l, tlsServerConfig)
+}
+
+// Is this request from another node with a certificate we trust?
+func isTLSPeer(req *http.Request) bool {
+	return *tlsVerifyPeers && req.TLS != nil &&
+		len(req.TLS.VerifiedChains) > 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A self-signed certificate for 127.0.0.1, usable as its own CA.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cbfs test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating cert: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+			0600)
+	}
+	if err != nil {
+		t.Fatalf("Error writing cert: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbfstls")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(c, k, ca string, v bool) {
+		*tlsCert, *tlsKey, *tlsCA, *tlsVerifyPeers = c, k, ca, v
+		tlsServerConfig, tlsClientConfig = nil, nil
+	}(*tlsCert, *tlsKey, *tlsCA, *tlsVerifyPeers)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	*tlsCert, *tlsKey, *tlsCA, *tlsVerifyPeers = certFile, keyFile, certFile, true
+	if err := initTLS(); err != nil {
+		t.Fatalf("Error initializing TLS: %v", err)
+	}
+	if nodeScheme() != "https" {
+		t.Errorf("Expected https, got %v", nodeScheme())
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go http.Serve(tlsListen(l), http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if isTLSPeer(req) {
+				w.WriteHeader(204)
+			} else {
+				w.WriteHeader(403)
+			}
+		}))
+
+	url := "https://" + l.Addr().String() + "/"
+	peer := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsClientConfig}}
+	res, err := peer.Get(url)
+	if err != nil {
+		t.Fatalf("Error making peer request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 204 {
+		t.Errorf("Expected peer to be recognized, got %v", res.Status)
+	}
+
+	// Without a client certificate, it's just another client.
+	anon := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: tlsClientConfig.RootCAs}}}
+	res, err = anon.Get(url)
+	if err != nil {
+		t.Fatalf("Error making anonymous request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 403 {
+		t.Errorf("Expected anonymous client, got %v", res.Status)
+	}
+}
@@ -17,12 +17,18 @@ import (
 
 var backupFlags = flag.NewFlagSet("backup", flag.ExitOnError)
 var backupWait = backupFlags.Bool("w", false, "Wait for backup to complete")
+var backupIncremental = backupFlags.Bool("i", false,
+	"Only back up what changed since the latest backup")
+var backupArchive = backupFlags.Bool("archive", false,
+	"Write an archive with the blobs to the named destination")
 
 type Backup struct {
-	Filename string
-	OID      string
-	When     time.Time
-	Conf     cbfsconfig.CBFSConfig
+	Filename    string
+	OID         string
+	When        time.Time
+	Conf        cbfsconfig.CBFSConfig
+	Incremental bool
+	Base        string
 }
 
 func backupCommand(ustr string, args []string) {
@@ -33,8 +39,13 @@ func backupCommand(ustr string, args []string) {
 	u.Path = "/.cbfs/backup/"
 
 	form := url.Values{
-		"fn": []string{fn},
-		"bg": []string{strconv.FormatBool(*backupWait == false)},
+		"fn":          []string{fn},
+		"bg":          []string{strconv.FormatBool(*backupWait == false)},
+		"incremental": []string{strconv.FormatBool(*backupIncremental)},
+	}
+	if *backupArchive {
+		u.Path = "/.cbfs/backup/archive/"
+		form.Set("dest", fn)
 	}
 
 	start := time.Now()
@@ -44,7 +55,8 @@ func backupCommand(ustr string, args []string) {
 	cbfstool.MaybeFatal(err, "Error executing POST to %v - %v", u, err)
 
 	defer res.Body.Close()
-	if !(res.StatusCode == 202 || res.StatusCode == 201) {
+	if !(res.StatusCode == 202 || res.StatusCode == 201 ||
+		res.StatusCode == 200) {
 		log.Printf("backup error: %v", res.Status)
 		io.Copy(os.Stderr, res.Body)
 		os.Exit(1)
@@ -12,8 +12,9 @@ func main() {
 			"fsck":    {0, fsckCommand, "", fsckFlags},
 			"backup":  {1, backupCommand, "filename", backupFlags},
 			"rmbak":   {0, rmBakCommand, "", rmbakFlags},
-			"restore": {1, restoreCommand, "filename", restoreFlags},
+			"restore": {0, restoreCommand, "[-at time] [-archive dest] [filename...]", restoreFlags},
 			"induce":  {0, induceCommand, "taskname", induceFlags},
 			"lsbak":   {0, lsBakCommand, "", nil},
+			"quota":   {0, quotaCommand, "[-bytes N] [-files N] [-rm] [prefix]", quotaFlags},
 		})
 }
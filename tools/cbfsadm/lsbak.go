@@ -20,7 +20,11 @@ func lsBakCommand(ustr string, args []string) {
 
 	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
 	for _, b := range backups.Previous {
-		fmt.Fprintf(tw, "%s\t%v\n", b.Filename, b.When)
+		kind := "full"
+		if b.Incremental {
+			kind = "incremental"
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", b.Filename, b.When, kind)
 	}
 	tw.Flush()
 }
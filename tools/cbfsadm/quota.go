@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var quotaFlags = flag.NewFlagSet("quota", flag.ExitOnError)
+var quotaBytes = quotaFlags.String("bytes", "",
+	"Set the storage quota (e.g. 500GB, 0 for no limit)")
+var quotaFiles = quotaFlags.Int64("files", 0,
+	"Set the file count quota (0 for no limit)")
+var quotaRm = quotaFlags.Bool("rm", false, "Remove the quota")
+
+func quotaLimit(n int64, human string) string {
+	if n == 0 {
+		return "-"
+	}
+	return human
+}
+
+func printQuotas(quotas []cbfsclient.Quota) {
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "prefix\tbytes\tlimit\tfiles\tlimit\n")
+	for _, q := range quotas {
+		prefix := q.Prefix
+		if prefix == "" {
+			prefix = "/"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", prefix,
+			humanize.Bytes(uint64(q.Bytes)),
+			quotaLimit(q.MaxBytes, humanize.Bytes(uint64(q.MaxBytes))),
+			humanize.Comma(q.Files),
+			quotaLimit(q.MaxFiles, humanize.Comma(q.MaxFiles)))
+	}
+	tw.Flush()
+}
+
+func quotaCommand(u string, args []string) {
+	c := getClient(u)
+	prefix := strings.Trim(quotaFlags.Arg(0), "/")
+
+	set := false
+	quotaFlags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "bytes" || f.Name == "files"
+	})
+
+	switch {
+	case *quotaRm:
+		err := c.RemoveQuota(prefix)
+		cbfstool.MaybeFatal(err, "Error removing quota: %v", err)
+	case set:
+		maxBytes := uint64(0)
+		if *quotaBytes != "" {
+			var err error
+			maxBytes, err = humanize.ParseBytes(*quotaBytes)
+			cbfstool.MaybeFatal(err, "Error parsing -bytes: %v", err)
+		}
+		q, err := c.SetQuota(prefix, int64(maxBytes), *quotaFiles)
+		cbfstool.MaybeFatal(err, "Error setting quota: %v", err)
+		printQuotas([]cbfsclient.Quota{q})
+	default:
+		quotas, err := c.Quotas()
+		cbfstool.MaybeFatal(err, "Error getting quotas: %v", err)
+		shown := []cbfsclient.Quota{}
+		for _, q := range quotas {
+			if strings.HasPrefix(q.Prefix, prefix) {
+				shown = append(shown, q)
+			}
+		}
+		printQuotas(shown)
+	}
+}
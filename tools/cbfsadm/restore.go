@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"sync"
@@ -17,6 +18,7 @@ import (
 	"strconv"
 
 	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
 	"github.com/dustin/httputil"
 )
 
@@ -28,10 +30,15 @@ var restorePat = restoreFlags.String("match", ".*", "Regex for paths to match")
 var restoreWorkers = restoreFlags.Int("workers", 4, "Number of restore workers")
 var restoreExpire = restoreFlags.Int("expire", -1,
 	"Override expiration time (in seconds, or abs unix time)")
+var restoreAt = restoreFlags.String("at", "",
+	"Restore from the cluster's backups as of this time (RFC3339)")
+var restoreArchive = restoreFlags.String("archive", "",
+	"Have the cluster load an archive from this destination")
 
 type restoreWorkItem struct {
-	Path string
-	Meta *json.RawMessage
+	Path    string
+	Meta    *json.RawMessage
+	Deleted bool
 }
 
 func restoreFile(base, path string, data interface{}) error {
@@ -85,20 +92,139 @@ func restoreWorker(wg *sync.WaitGroup, base string, ch <-chan restoreWorkItem) {
 	}
 }
 
-func restoreCommand(ustr string, args []string) {
-	regex, err := regexp.Compile(*restorePat)
-	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+// The backups to replay, oldest first, to restore the cluster as of
+// at.
+func backupChainAt(ustr string, at time.Time) ([]Backup, error) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/backup/"
 
-	fn := restoreFlags.Arg(0)
+	data := struct{ Backups []Backup }{}
+	if err := cbfstool.GetJsonData(u.String(), &data); err != nil {
+		return nil, err
+	}
 
-	start := time.Now()
+	var latest *Backup
+	byOid := map[string]Backup{}
+	for i, b := range data.Backups {
+		byOid[b.OID] = b
+		if !b.When.After(at) && (latest == nil || b.When.After(latest.When)) {
+			latest = &data.Backups[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no backups as old as %v", at)
+	}
+
+	chain := []Backup{*latest}
+	for chain[0].Incremental {
+		b, ok := byOid[chain[0].Base]
+		if !ok || len(chain) > len(data.Backups) {
+			return nil, fmt.Errorf("can't find the base of %v",
+				chain[0].Filename)
+		}
+		chain = append([]Backup{b}, chain...)
+	}
+	return chain, nil
+}
+
+// A backup in the cluster, by its blob since the file may be gone.
+func openClusterBackup(ustr string, b Backup) (io.ReadCloser, error) {
+	res, err := http.Get(relativeUrl(ustr, "/.cbfs/blob/"+b.OID))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, httputil.HTTPErrorf(res, "error fetching backup %v - %S\n%B",
+			b.Filename)
+	}
+	return res.Body, nil
+}
 
-	f, err := os.Open(fn)
+func readBackup(open func() (io.ReadCloser, error), f func(restoreWorkItem)) {
+	r, err := open()
 	cbfstool.MaybeFatal(err, "Error opening restore file: %v", err)
+	defer r.Close()
 
-	defer f.Close()
-	gz, err := gzip.NewReader(f)
+	gz, err := gzip.NewReader(r)
 	cbfstool.MaybeFatal(err, "Error uncompressing restore file: %v", err)
+	defer gz.Close()
+
+	d := json.NewDecoder(gz)
+	for {
+		ob := restoreWorkItem{}
+		switch err := d.Decode(&ob); err {
+		case nil:
+			f(ob)
+		case io.EOF:
+			return
+		default:
+			log.Fatalf("Error reading backup file: %v", err)
+		}
+	}
+}
+
+// Archives are read by the cluster, so they can be restored into one
+// that's empty.
+func restoreArchiveCommand(ustr string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/backup/archive/restore/"
+	u.RawQuery = url.Values{"dest": {*restoreArchive}}.Encode()
+
+	start := time.Now()
+	res, err := http.Post(u.String(), "application/x-www-form-urlencoded", nil)
+	cbfstool.MaybeFatal(err, "Error executing POST to %v - %v", u, err)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		log.Fatalf("%v", httputil.HTTPErrorf(res, "restore error - %S\n%B"))
+	}
+
+	rv := struct {
+		Files, Skipped, Blobs, Errors int
+		Bytes                         uint64
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	cbfstool.MaybeFatal(err, "Error reading restore results: %v", err)
+	log.Printf("Restored %v files (%v already there, %v failed) and %v blobs (%v) in %v",
+		rv.Files, rv.Skipped, rv.Errors, rv.Blobs, humanize.Bytes(rv.Bytes),
+		time.Since(start))
+}
+
+func restoreCommand(ustr string, args []string) {
+	if *restoreArchive != "" {
+		restoreArchiveCommand(ustr)
+		return
+	}
+
+	regex, err := regexp.Compile(*restorePat)
+	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+
+	sources := []func() (io.ReadCloser, error){}
+	switch {
+	case *restoreAt != "":
+		at, err := time.Parse(time.RFC3339, *restoreAt)
+		cbfstool.MaybeFatal(err, "Error parsing -at: %v", err)
+		chain, err := backupChainAt(ustr, at)
+		cbfstool.MaybeFatal(err, "Error finding backups: %v", err)
+		for _, b := range chain {
+			b := b
+			log.Printf("Replaying %v from %v", b.Filename, b.When)
+			sources = append(sources, func() (io.ReadCloser, error) {
+				return openClusterBackup(ustr, b)
+			})
+		}
+	case restoreFlags.NArg() > 0:
+		for _, fn := range restoreFlags.Args() {
+			fn := fn
+			sources = append(sources, func() (io.ReadCloser, error) {
+				return os.Open(fn)
+			})
+		}
+	default:
+		log.Fatalf("Give the backup files to restore, or -at to use the cluster's")
+	}
+
+	start := time.Now()
 
 	wg := &sync.WaitGroup{}
 
@@ -108,24 +234,32 @@ func restoreCommand(ustr string, args []string) {
 		go restoreWorker(wg, ustr, ch)
 	}
 
-	d := json.NewDecoder(gz)
 	nfiles := 0
-	done := false
-	for !done {
-		ob := restoreWorkItem{}
-
-		err := d.Decode(&ob)
-		switch err {
-		case nil:
+	if len(sources) == 1 {
+		readBackup(sources[0], func(ob restoreWorkItem) {
+			if !ob.Deleted && regex.MatchString(ob.Path) {
+				nfiles++
+				ch <- ob
+			}
+		})
+	} else {
+		// Each incremental backup replaces or deletes what came
+		// before it.
+		files := map[string]restoreWorkItem{}
+		for _, src := range sources {
+			readBackup(src, func(ob restoreWorkItem) {
+				if ob.Deleted {
+					delete(files, ob.Path)
+				} else {
+					files[ob.Path] = ob
+				}
+			})
+		}
+		for _, ob := range files {
 			if regex.MatchString(ob.Path) {
 				nfiles++
 				ch <- ob
 			}
-		case io.EOF:
-			done = true
-			break
-		default:
-			log.Fatalf("Error reading backup file: %v", err)
 		}
 	}
 	close(ch)
@@ -12,6 +12,7 @@ func main() {
 			"find":     {1, findCommand, "/src/dir", findFlags},
 			"ls":       {0, lsCommand, "[path]", lsFlags},
 			"rm":       {-1, rmCommand, "path", rmFlags},
+			"mv":       {2, mvCommand, "src dest", mvFlags},
 			"info":     {0, infoCommand, "", infoFlags},
 			"fileinfo": {1, fileInfoCommand, "path", fileInfoFlags},
 		})
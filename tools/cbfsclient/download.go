@@ -25,6 +25,9 @@ var totalConcurrency = dlFlags.Int("ct", 4, "Total number of concurrent download
 var nodeConcurrency = dlFlags.Int("cn", 2, "Max concurrent downloads per node")
 var dlNoop = dlFlags.Bool("n", false, "Noop")
 var dlLink = dlFlags.Bool("L", false, "hard link identical content")
+var dlParallel = dlFlags.String("p", "64MB",
+	"Download files at least this big in parallel ranges from every node")
+var dlRanges = dlFlags.Int("pc", 4, "Concurrent ranges per parallel download")
 
 var totalBytes int64
 
@@ -116,14 +119,72 @@ func downloadCommand(u string, args []string) {
 	things, err := client.ListDepth(src, 4096)
 	cbfstool.MaybeFatal(err, "Can't list things: %v", err)
 
+	parallelSize, err := humanize.ParseBytes(*dlParallel)
+	cbfstool.MaybeFatal(err, "Invalid parallel download size: %v", err)
+
 	start := time.Now()
 	oids := []string{}
+	// Large files by path, which also reads those with no blob.
+	large := map[string]string{}
 	dests := map[string][]string{}
+	// Content with no blob of its own, by a path it can be read from.
+	byPath := map[string]string{}
 	for fn, inf := range things.Files {
-		fn = fn[len(src):]
 		dests[inf.OID] = append(dests[inf.OID],
-			filepath.Join(destbase, fn))
-		oids = append(oids, inf.OID)
+			filepath.Join(destbase, fn[len(src):]))
+		switch {
+		case inf.Length >= int64(parallelSize):
+			large[inf.OID] = fn
+		case len(inf.Chunks) > 0:
+			byPath[inf.OID] = fn
+		default:
+			oids = append(oids, inf.OID)
+		}
+	}
+
+	if len(oids) > 0 {
+		infos, err := client.GetBlobInfos(oids...)
+		cbfstool.MaybeFatal(err, "Error getting blob info: %v", err)
+		for fn, inf := range things.Files {
+			if _, ok := large[inf.OID]; !ok && len(infos[inf.OID].Nodes) == 0 {
+				byPath[inf.OID] = fn
+			}
+		}
+		oids = oids[:0]
+		for oid := range infos {
+			if _, ok := byPath[oid]; !ok {
+				oids = append(oids, oid)
+			}
+		}
+	}
+
+	for oid, fn := range byPath {
+		fh, err := client.OpenFile(fn)
+		cbfstool.MaybeFatal(err, "Error opening %v: %v", fn, err)
+		err = saveDownload(dests[oid], oid, fh)
+		cbfstool.MaybeFatal(err, "Error downloading %v: %v", fn, err)
+	}
+
+	if len(large) > 0 {
+		conf, err := client.GetConfig()
+		cbfstool.MaybeFatal(err, "Error getting config: %v", err)
+		opts := cbfsclient.DownloadOptions{
+			Concurrency: *dlRanges,
+			Hash:        conf.Hash,
+		}
+		for oid, fn := range large {
+			pr, pw := io.Pipe()
+			go func(oid, fn string) {
+				opts := opts
+				opts.Path = fn
+				_, err := client.DownloadBlob(pw, oid,
+					things.Files[fn].Length, opts)
+				pw.CloseWithError(err)
+			}(oid, fn)
+			err := saveDownload(dests[oid], oid, pr)
+			pr.Close()
+			cbfstool.MaybeFatal(err, "Error downloading %v: %v", oid, err)
+		}
 	}
 
 	err = client.Blobs(*totalConcurrency, *nodeConcurrency,
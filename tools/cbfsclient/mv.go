@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var mvFlags = flag.NewFlagSet("mv", flag.ExitOnError)
+
+func mvCommand(u string, args []string) {
+	client, err := cbfsclient.New(u)
+	cbfstool.MaybeFatal(err, "Error creating cbfs client: %v", err)
+
+	src, dest := mvFlags.Arg(0), mvFlags.Arg(1)
+	res, err := client.Rename(src, dest)
+	cbfstool.MaybeFatal(err, "Error renaming %v: %v", src, err)
+
+	for fn, msg := range res.Errors {
+		log.Printf("Error moving %v: %v", fn, msg)
+	}
+	log.Printf("Moved %v files", res.Moved)
+	if res.Failed > 0 || res.Incomplete {
+		log.Printf("%v files couldn't be moved", res.Failed)
+		os.Exit(1)
+	}
+}
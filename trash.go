@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deleted files go to the trash for trashRetention, where they still
+// hold on to their blobs and can be put back:
+//
+//   GET    /.cbfs/trash/[dir/]          -> trashed files under dir
+//   POST   /.cbfs/trash/restore/{id}    -> put one back (?to=elsewhere)
+//   DELETE /.cbfs/trash/{id}            -> purge one
+//   DELETE /.cbfs/trash/?path=dir/      -> purge everything under dir
+//
+// A retention of 0 turns the trash off.
+
+type trashedFile struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	Node    string    `json:"node"`
+	Meta    fileMeta  `json:"meta"`
+}
+
+func trashKey(id string) string {
+	return "/@trash/" + id
+}
+
+// Remove a file, keeping it in the trash if that's on.  The header
+// may hold preconditions.
+func deleteFile(fn string, header http.Header) (fileMeta, error) {
+	k := shortName(fn)
+	data, err := couchbase.GetRaw(k)
+	if err != nil {
+		return fileMeta{}, err
+	}
+	existing := fileMeta{}
+	err = json.Unmarshal(data, &existing)
+	if !shouldStoreMeta(header, err == nil, existing) {
+		return existing, errUploadPrecondition
+	}
+	if err == nil {
+		if err := checkRetention("delete", fn, existing, header); err != nil {
+			return existing, err
+		}
+	}
+
+	id := ""
+	if globalConfig.TrashRetention > 0 && err == nil {
+		if id, err = randomID(); err != nil {
+			return existing, err
+		}
+		existing.Name = ""
+		t := trashedFile{
+			Type:    "trash",
+			ID:      id,
+			Path:    fn,
+			Deleted: time.Now().UTC(),
+			Node:    serverId,
+			Meta:    existing,
+		}
+		err = couchbase.Set(trashKey(id),
+			expiryIn(globalConfig.TrashRetention), t)
+		if err != nil {
+			log.Printf("Error moving %v to the trash: %v", fn, err)
+			return existing, err
+		}
+	}
+
+	err = couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		if !bytes.Equal(in, data) {
+			return nil, errFileChanged
+		}
+		return nil, nil
+	})
+	if err != nil {
+		if id != "" {
+			couchbase.Delete(trashKey(id))
+		}
+		return existing, err
+	}
+
+	chargeQuota(fn, -existing.Length, -1)
+	recordChange("delete", fn, existing)
+	return existing, nil
+}
+
+func listTrash(dir string) ([]trashedFile, error) {
+	dir = strings.Trim(dir, "/")
+	startKey := []interface{}{}
+	if dir != "" {
+		for _, k := range strings.Split(dir, "/") {
+			startKey = append(startKey, k)
+		}
+	}
+	endKey := append(append([]interface{}{}, startKey...),
+		&(json.RawMessage{'{', '}'}))
+
+	viewRes := struct {
+		Rows []struct {
+			Id string
+		}
+	}{}
+	err := couchbase.View("trash",
+		map[string]interface{}{
+			"reduce":   false,
+			"startkey": startKey,
+			"endkey":   endKey,
+		}, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, r := range viewRes.Rows {
+		ids = append(ids, r.Id)
+	}
+	docs, err := couchbase.GetBulk(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []trashedFile{}
+	for _, id := range ids {
+		t := trashedFile{}
+		if data, ok := docs[id]; ok && json.Unmarshal(data, &t) == nil {
+			rv = append(rv, t)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Deleted.After(rv[j].Deleted)
+	})
+	return rv, nil
+}
+
+func doListTrash(w http.ResponseWriter, req *http.Request, dir string) {
+	rv, err := listTrash(dir)
+	if err != nil {
+		log.Printf("Error listing trash under %v: %v", dir, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, rv)
+}
+
+// Find a trashed file the request may write to.  Missing files are
+// only reported to those who could write anywhere, so nobody else
+// learns which IDs exist.
+func getTrashed(w http.ResponseWriter, req *http.Request,
+	id string) (trashedFile, bool) {
+
+	t := trashedFile{}
+	err := couchbase.Get(trashKey(id), &t)
+	if err != nil || t.Type != "trash" {
+		if authorizeFor(w, req, access{role: roleWriter, scoped: true}) {
+			http.Error(w, "No such trashed file: "+id, 404)
+		}
+		return t, false
+	}
+	return t, authorizeFor(w, req,
+		access{role: roleWriter, path: t.Path, scoped: true})
+}
+
+func doRestoreTrash(w http.ResponseWriter, req *http.Request, id string) {
+	t, ok := getTrashed(w, req, id)
+	if !ok {
+		return
+	}
+	dst := strings.Trim(req.FormValue("to"), "/")
+	if dst == "" {
+		dst = t.Path
+	}
+	if strings.Contains(dst, "//") || strings.HasPrefix(dst, ".cbfs/") {
+		http.Error(w, "Invalid destination: "+dst, 400)
+		return
+	}
+	if !authorizeFor(w, req,
+		access{role: roleWriter, path: dst, scoped: true}) {
+		return
+	}
+
+	fm := t.Meta
+	if shortName(dst) != dst {
+		fm.Name = dst
+	}
+	if err := checkQuota(dst, fm.Length); isOverQuota(err) {
+		http.Error(w, err.Error(), 507)
+		return
+	} else if err != nil {
+		log.Printf("Error checking quotas for %v: %v", dst, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	added, err := couchbase.Add(shortName(dst), getExpiration(fm.Headers), fm)
+	switch {
+	case err != nil:
+		log.Printf("Error restoring %v to %v: %v", id, dst, err)
+		http.Error(w, err.Error(), 500)
+		return
+	case !added:
+		http.Error(w, dst+" already exists", 409)
+		return
+	}
+	if err := couchbase.Delete(trashKey(id)); err != nil {
+		log.Printf("Error removing restored %v from the trash: %v", id, err)
+	}
+
+	chargeQuota(dst, fm.Length, 1)
+	recordChange("create", dst, fm)
+	log.Printf("Restored %v from the trash to %v", t.Path, dst)
+	w.WriteHeader(201)
+}
+
+func doPurgeTrash(w http.ResponseWriter, req *http.Request, id string) {
+	toPurge := []trashedFile{}
+	if id == "" {
+		dir := dirPath(strings.Trim(req.FormValue("path"), "/"))
+		if !authorizeFor(w, req,
+			access{role: roleWriter, path: dir, scoped: true}) {
+			return
+		}
+		var err error
+		if toPurge, err = listTrash(dir); err != nil {
+			log.Printf("Error listing trash under %v: %v", dir, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	} else {
+		t, ok := getTrashed(w, req, id)
+		if !ok {
+			return
+		}
+		toPurge = append(toPurge, t)
+	}
+
+	for _, t := range toPurge {
+		err := checkRetention("purge", t.Path, t.Meta, req.Header)
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+	}
+	for _, t := range toPurge {
+		if err := couchbase.Delete(trashKey(t.ID)); err != nil {
+			log.Printf("Error purging %v (%v) from the trash: %v",
+				t.ID, t.Path, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	log.Printf("Purged %v files from the trash", len(toPurge))
+	w.WriteHeader(204)
+}
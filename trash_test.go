@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func listTestTrash(t *testing.T, dir string) []trashedFile {
+	w := doTestRequest(t, "GET", trashPrefix+dir, "")
+	rv := []trashedFile{}
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &rv) != nil {
+		t.Fatalf("Error listing trash: %v %s", w.Code, w.Body)
+	}
+	return rv
+}
+
+// Whether a file (or trashed file) still refers to the blob.
+func blobReferenced(t *testing.T, oid string) bool {
+	viewRes := struct {
+		Rows []struct {
+			Key []string
+		}
+	}{}
+	err := couchbase.View("file_blobs", map[string]interface{}{}, &viewRes)
+	if err != nil {
+		t.Fatalf("Error querying file_blobs: %v", err)
+	}
+	for _, r := range viewRes.Rows {
+		if r.Key[0] == oid && r.Key[1] == "file" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTrash(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer func(c cbfsconfig.CBFSConfig) { *globalConfig = c }(*globalConfig)
+
+	for _, fn := range []string{"/a/b.txt", "/c.txt"} {
+		if w := doTestRequest(t, "PUT", fn, "data for "+fn); w.Code != 201 {
+			t.Fatalf("Error storing %v: %v %s", fn, w.Code, w.Body)
+		}
+		if w := doTestRequest(t, "DELETE", fn, ""); w.Code != 204 {
+			t.Fatalf("Error deleting %v: %v %s", fn, w.Code, w.Body)
+		}
+		if w := doTestRequest(t, "GET", fn, ""); w.Code != 404 {
+			t.Errorf("Expected %v to be gone, got %v", fn, w.Code)
+		}
+	}
+
+	if got := listTestTrash(t, ""); len(got) != 2 {
+		t.Fatalf("Expected two trashed files, got %+v", got)
+	}
+	got := listTestTrash(t, "a/")
+	if len(got) != 1 || got[0].Path != "a/b.txt" {
+		t.Fatalf("Expected a/b.txt in the trash, got %+v", got)
+	}
+	trashed := got[0]
+	if !blobReferenced(t, trashed.Meta.OID) {
+		t.Errorf("Expected trashed file to keep its blob referenced")
+	}
+
+	w := doTestRequest(t, "POST", untrashPrefix+trashed.ID, "")
+	if w.Code != 201 {
+		t.Fatalf("Error restoring: %v %s", w.Code, w.Body)
+	}
+	w = doTestRequest(t, "GET", "/a/b.txt", "")
+	if w.Code != 200 || w.Body.String() != "data for /a/b.txt" {
+		t.Errorf("Error getting restored file: %v %s", w.Code, w.Body)
+	}
+	if got := listTestTrash(t, "a/"); len(got) != 0 {
+		t.Errorf("Expected restored file out of the trash, got %+v", got)
+	}
+
+	c := listTestTrash(t, "")[0]
+	w = doTestRequest(t, "PUT", quotaPrefix+"team", `{"maxBytes": 5}`)
+	if w.Code != 200 {
+		t.Fatalf("Error setting quota: %v %s", w.Code, w.Body)
+	}
+	w = doTestRequest(t, "POST", untrashPrefix+c.ID+"?to=team/c.txt", "")
+	if w.Code != 507 {
+		t.Errorf("Expected restore over quota to fail, got %v %s", w.Code, w.Body)
+	}
+	if got := listTestTrash(t, ""); len(got) != 1 {
+		t.Errorf("Expected refused restore to stay in the trash, got %+v", got)
+	}
+
+	if w := doTestRequest(t, "DELETE", trashPrefix+c.ID, ""); w.Code != 204 {
+		t.Fatalf("Error purging: %v %s", w.Code, w.Body)
+	}
+	if got := listTestTrash(t, ""); len(got) != 0 {
+		t.Errorf("Expected empty trash, got %+v", got)
+	}
+	if blobReferenced(t, c.Meta.OID) {
+		t.Errorf("Expected purged file's blob to be unreferenced")
+	}
+
+	globalConfig.TrashRetention = 0
+	doTestRequest(t, "DELETE", "/a/b.txt", "")
+	if got := listTestTrash(t, ""); len(got) != 0 {
+		t.Errorf("Expected no trash when it's off, got %+v", got)
+	}
+}
+
+func TestTrashAuth(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+	defer setAuthConfig(authConfig{})
+
+	doTestRequest(t, "PUT", "/x.txt", "data")
+	doTestRequest(t, "DELETE", "/x.txt", "")
+	got := listTestTrash(t, "")
+	if len(got) != 1 {
+		t.Fatalf("Expected a trashed file, got %+v", got)
+	}
+	setAuthConfig(testAuth)
+
+	restore := func(id, key, pw string) int {
+		req, err := http.NewRequest("POST",
+			"http://localhost"+untrashPrefix+id, nil)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		req.SetBasicAuth(key, pw)
+		w := httptest.NewRecorder()
+		httpHandler(w, req)
+		return w.Code
+	}
+	// Those who can't restore anything can't tell what's there.
+	if code := restore(got[0].ID, "alice", "alicepw"); code != 403 {
+		t.Errorf("Expected restoring someone else's file to fail, got %v", code)
+	}
+	if code := restore("missing", "alice", "alicepw"); code != 403 {
+		t.Errorf("Expected the same refusal for a missing file, got %v", code)
+	}
+	if code := restore("missing", "root", "rootpw"); code != 404 {
+		t.Errorf("Expected missing file to be missing, got %v", code)
+	}
+	if code := restore(got[0].ID, "root", "rootpw"); code != 201 {
+		t.Errorf("Error restoring: %v", code)
+	}
+}
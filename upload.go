@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// Upload sessions let a large file arrive as a series of numbered
+// parts over as many requests as it takes.  Each part is stored as a
+// blob as it arrives and completing the session concatenates them
+// into the file's blob.
+//
+//   POST   /.cbfs/upload/?path=some/file  -> start a session
+//   GET    /.cbfs/upload/{id}             -> session state
+//   PUT    /.cbfs/upload/{id}/{n}         -> store part n
+//   POST   /.cbfs/upload/{id}             -> complete
+//   DELETE /.cbfs/upload/{id}             -> abort
+//
+// Headers given when starting the session (Content-Type,
+// X-CBFS-Expiration, preconditions, etc...) apply to the final file.
+// Only those are kept with the session.  An X-CBFS-Quorum on the
+// completing POST sets the final file's write quorum.
+
+var errUploadBusy = errors.New("upload is being completed")
+
+type uploadPart struct {
+	OID    string    `json:"oid"`
+	Length int64     `json:"length"`
+	Node   string    `json:"node"`
+	Stored time.Time `json:"stored"`
+}
+
+type uploadSession struct {
+	Type       string             `json:"type"`
+	ID         string             `json:"id"`
+	Path       string             `json:"path"`
+	Node       string             `json:"node"`
+	Headers    http.Header        `json:"headers"`
+	Started    time.Time          `json:"started"`
+	Updated    time.Time          `json:"updated"`
+	Parts      map[int]uploadPart `json:"parts"`
+	Completing bool               `json:"completing,omitempty"`
+}
+
+func uploadKey(id string) string {
+	return "/@upload/" + id
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (u uploadSession) sortedParts() []int {
+	rv := make([]int, 0, len(u.Parts))
+	for n := range u.Parts {
+		rv = append(rv, n)
+	}
+	sort.Ints(rv)
+	return rv
+}
+
+// Modify a session in place.  Returning cb.UpdateCancel from f leaves
+// it alone.
+func updateUploadSession(id string, f func(*uploadSession) error) error {
+	return couchbase.Update(uploadKey(id), 0, func(in []byte) ([]byte, error) {
+		if in == nil {
+			return nil, errNotFound
+		}
+		u := uploadSession{}
+		if err := json.Unmarshal(in, &u); err != nil {
+			return nil, err
+		}
+		if err := f(&u); err != nil {
+			return nil, err
+		}
+		return json.Marshal(u)
+	})
+}
+
+func uploadError(w http.ResponseWriter, err error) {
+	switch {
+	case isNotFound(err):
+		http.Error(w, "No such upload", 404)
+	case err == errUploadBusy:
+		http.Error(w, err.Error(), 409)
+	case err == errUploadPrecondition:
+		http.Error(w, "precondition failed", 412)
+	case isRetained(err):
+		http.Error(w, err.Error(), 403)
+	case isOverQuota(err):
+		http.Error(w, err.Error(), 507)
+	case isWriteQuorum(err):
+		http.Error(w, err.Error(), 503)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func isUploadHeader(s string) bool {
+	switch strings.ToLower(s) {
+	case "if-match", "if-none-match", "x-cbfs-hash", "x-cbfs-keeprevs",
+		"x-cbfs-chunked", "x-cbfs-storageclass", "x-cbfs-retain-until",
+		"x-cbfs-legal-hold":
+		return true
+	}
+	return isFileHeader(s)
+}
+
+func doStartUpload(w http.ResponseWriter, req *http.Request) {
+	fn := strings.TrimLeft(req.FormValue("path"), "/")
+	if fn == "" || strings.Contains(fn, "//") ||
+		strings.HasPrefix(fn, ".cbfs/") {
+		http.Error(w, "Invalid path: "+fn, 400)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	now := time.Now().UTC()
+	u := uploadSession{
+		Type:    "upload",
+		ID:      id,
+		Path:    fn,
+		Node:    serverId,
+		Headers: filterHeaders(req.Header, isUploadHeader),
+		Started: now,
+		Updated: now,
+		Parts:   map[int]uploadPart{},
+	}
+	if err := couchbase.Set(uploadKey(id), 0, u); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Printf("Started upload %v of %v", id, fn)
+
+	w.Header().Set("Location", uploadPrefix+id)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(u)
+}
+
+func doGetUpload(w http.ResponseWriter, req *http.Request, id string) {
+	u := uploadSession{}
+	if err := couchbase.Get(uploadKey(id), &u); err != nil {
+		uploadError(w, err)
+		return
+	}
+	sendJson(w, req, u)
+}
+
+// Parts are stored only on the node that receives them.  If that
+// node goes away before the upload completes, the client will have
+// to send the part again.
+func doPutUploadPart(w http.ResponseWriter, req *http.Request,
+	id, partStr string) {
+
+	n, err := strconv.Atoi(partStr)
+	if err != nil || n < 1 {
+		http.Error(w, "Invalid part number: "+partStr, 400)
+		return
+	}
+
+	u := uploadSession{}
+	if err := couchbase.Get(uploadKey(id), &u); err != nil {
+		uploadError(w, err)
+		return
+	}
+	if u.Completing {
+		uploadError(w, errUploadBusy)
+		return
+	}
+
+	f, err := NewHashRecord(*root, req.Header.Get("X-CBFS-Hash"))
+	if err != nil {
+		log.Printf("Error writing tmp file: %v", err)
+		http.Error(w, "Error writing tmp file", 500)
+		return
+	}
+	defer f.Close()
+
+	h, length, err := f.Process(req.Body)
+	if err != nil {
+		log.Printf("Error completing part %v of upload %v: %v", n, id, err)
+		http.Error(w, fmt.Sprintf("Error completing blob write: %v", err), 500)
+		return
+	}
+
+	err = recordBlobOwnership(h, length, true)
+	if err != nil {
+		log.Printf("Error storing blob ownership of %v for upload %v: %v",
+			h, id, err)
+		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
+			500)
+		return
+	}
+
+	err = updateUploadSession(id, func(u *uploadSession) error {
+		if u.Completing {
+			return errUploadBusy
+		}
+		u.Updated = time.Now().UTC()
+		u.Parts[n] = uploadPart{
+			OID:    h,
+			Length: length,
+			Node:   serverId,
+			Stored: u.Updated,
+		}
+		return nil
+	})
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	w.Header().Set("X-CBFS-Hash", h)
+	w.WriteHeader(201)
+}
+
+// Reads the parts of an upload in order, fetching any that live on
+// other nodes.
+type uploadPartsReader struct {
+	parts []uploadPart
+	cur   io.ReadCloser
+}
+
+func (u *uploadPartsReader) Read(p []byte) (int, error) {
+	for {
+		if u.cur == nil {
+			if len(u.parts) == 0 {
+				return 0, io.EOF
+			}
+			f, err := openBlob(u.parts[0].OID, false)
+			if err != nil {
+				return 0, fmt.Errorf("part %v: %v", u.parts[0].OID, err)
+			}
+			u.cur, u.parts = f, u.parts[1:]
+		}
+		n, err := u.cur.Read(p)
+		if err == io.EOF {
+			u.cur.Close()
+			u.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (u *uploadPartsReader) Close() error {
+	if u.cur != nil {
+		return u.cur.Close()
+	}
+	return nil
+}
+
+func completeUpload(id, quorum string) (string, error) {
+	u := uploadSession{}
+	err := updateUploadSession(id, func(us *uploadSession) error {
+		if us.Completing {
+			return errUploadBusy
+		}
+		us.Completing = true
+		us.Updated = time.Now().UTC()
+		u = *us
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	r := &uploadPartsReader{}
+	length := int64(0)
+	for _, n := range u.sortedParts() {
+		r.parts = append(r.parts, u.Parts[n])
+		length += u.Parts[n].Length
+	}
+	defer r.Close()
+
+	l := length
+	if l < 1 {
+		l = 1024 * 1024
+	}
+	if quorum != "" {
+		if u.Headers == nil {
+			u.Headers = http.Header{}
+		}
+		u.Headers.Set("X-CBFS-Quorum", quorum)
+	}
+	h, err := storeUserFile(u.Path, r, l, u.Headers)
+	if err != nil {
+		// Let the client try again.
+		uerr := updateUploadSession(id, func(us *uploadSession) error {
+			us.Completing = false
+			return nil
+		})
+		if uerr != nil {
+			log.Printf("Error releasing upload %v: %v", id, uerr)
+		}
+		return "", err
+	}
+
+	// The parts are garbage now.
+	if err := couchbase.Delete(uploadKey(id)); err != nil {
+		log.Printf("Error removing completed upload %v: %v", id, err)
+	}
+
+	log.Printf("Completed upload %v of %v from %v parts -> %v",
+		id, u.Path, len(u.Parts), h)
+	return h, nil
+}
+
+func doCompleteUpload(w http.ResponseWriter, req *http.Request, id string) {
+	if _, err := writeQuorum(req.Header); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	h, err := completeUpload(id, req.Header.Get("X-CBFS-Quorum"))
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	w.Header().Set("Etag", `"`+h+`"`)
+	w.WriteHeader(201)
+}
+
+func doAbortUpload(w http.ResponseWriter, req *http.Request, id string) {
+	err := couchbase.Update(uploadKey(id), 0, func(in []byte) ([]byte, error) {
+		u := uploadSession{}
+		if err := json.Unmarshal(in, &u); err != nil {
+			return nil, errNotFound
+		}
+		if u.Completing {
+			return nil, errUploadBusy
+		}
+		return nil, nil
+	})
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	log.Printf("Aborted upload %v", id)
+	w.WriteHeader(204)
+}
+
+func doUpload(w http.ResponseWriter, req *http.Request) {
+	rest := minusPrefix(req.URL.Path, uploadPrefix)
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "" && req.Method == "POST":
+		doStartUpload(w, req)
+	case len(parts) == 1 && req.Method == "GET":
+		doGetUpload(w, req, parts[0])
+	case len(parts) == 1 && req.Method == "POST":
+		doCompleteUpload(w, req, parts[0])
+	case len(parts) == 1 && req.Method == "DELETE":
+		doAbortUpload(w, req, parts[0])
+	case len(parts) == 2 && req.Method == "PUT":
+		doPutUploadPart(w, req, parts[0], parts[1])
+	default:
+		http.Error(w, "Unsupported upload request", 400)
+	}
+}
+
+// Forget upload sessions nobody has touched in a while.  Their parts
+// are then unreferenced and will be garbage collected.
+func cleanAbandonedUploads() error {
+	cutoff := time.Now().UTC().Add(-globalConfig.UploadSessionTimeout)
+
+	viewRes := struct {
+		Rows []struct {
+			Id string
+		}
+		Errors []cb.ViewError
+	}{}
+	err := couchbase.View("uploads",
+		map[string]interface{}{
+			"stale":  false,
+			"endkey": cutoff,
+			"limit":  1000,
+		}, &viewRes)
+	if err != nil {
+		return err
+	}
+	if len(viewRes.Errors) > 0 {
+		return fmt.Errorf("View errors: %v", viewRes.Errors)
+	}
+
+	cleaned := 0
+	for _, r := range viewRes.Rows {
+		err := couchbase.Update(r.Id, 0, func(in []byte) ([]byte, error) {
+			u := uploadSession{}
+			if err := json.Unmarshal(in, &u); err != nil ||
+				u.Updated.After(cutoff) {
+				return nil, cb.UpdateCancel
+			}
+			return nil, nil
+		})
+		switch {
+		case err == nil:
+			cleaned++
+		case err != cb.UpdateCancel:
+			log.Printf("Error cleaning upload %v: %v", r.Id, err)
+		}
+	}
+	if cleaned > 0 {
+		log.Printf("Removed %v abandoned uploads", cleaned)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doTestRequest(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://localhost"+path,
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	return w
+}
+
+func withTmpRoot(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cbfsroot")
+	if err != nil {
+		t.Fatalf("Error making tmp dir: %v", err)
+	}
+	prev := *root
+	*root = dir
+	return func() {
+		*root = prev
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	defer withEmbeddedStore(t)()
+	defer withTmpRoot(t)()
+
+	req, _ := http.NewRequest("POST",
+		"http://localhost"+uploadPrefix+"?path=big/file", nil)
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	httpHandler(w, req)
+	u := uploadSession{}
+	if w.Code != 201 || json.Unmarshal(w.Body.Bytes(), &u) != nil {
+		t.Fatalf("Error starting upload: %v %s", w.Code, w.Body)
+	}
+	if err := couchbase.Get(uploadKey(u.ID), &u); err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if u.Headers.Get("Authorization") != "" ||
+		u.Headers.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected only file headers kept, got %v", u.Headers)
+	}
+
+	for _, p := range []struct{ n, body string }{
+		{"2", " world"}, {"1", "hellx"}, {"1", "hello"}} {
+		w = doTestRequest(t, "PUT", uploadPrefix+u.ID+"/"+p.n, p.body)
+		if w.Code != 201 {
+			t.Fatalf("Error putting part %v: %v %s", p.n, w.Code, w.Body)
+		}
+	}
+
+	// Parts are referenced while the session is alive.
+	viewRes := struct {
+		Rows []struct{ Key []string }
+	}{}
+	err := couchbase.View("file_blobs", map[string]interface{}{}, &viewRes)
+	if err != nil {
+		t.Fatalf("Error querying file_blobs: %v", err)
+	}
+	refs := 0
+	for _, r := range viewRes.Rows {
+		if r.Key[1] == "file" && r.Key[2] == uploadKey(u.ID) {
+			refs++
+		}
+	}
+	if refs != 2 {
+		t.Errorf("Expected 2 part references, got %v", viewRes.Rows)
+	}
+
+	w = doTestRequest(t, "POST", uploadPrefix+u.ID, "")
+	if w.Code != 201 {
+		t.Fatalf("Error completing upload: %v %s", w.Code, w.Body)
+	}
+	w = doTestRequest(t, "GET", "/big/file", "")
+	if w.Body.String() != "hello world" {
+		t.Errorf("Expected hello world, got %v %q", w.Code, w.Body)
+	}
+	if w = doTestRequest(t, "GET", uploadPrefix+u.ID, ""); w.Code != 404 {
+		t.Errorf("Expected completed session to be gone, got %v", w.Code)
+	}
+}
+
+func TestAbandonedUploads(t *testing.T) {
+	defer withEmbeddedStore(t)()
+
+	old := time.Now().Add(-globalConfig.UploadSessionTimeout - time.Minute)
+	for id, updated := range map[string]time.Time{
+		"old": old, "new": time.Now()} {
+
+		u := uploadSession{Type: "upload", ID: id, Updated: updated}
+		if err := couchbase.Set(uploadKey(id), 0, u); err != nil {
+			t.Fatalf("Error storing session: %v", err)
+		}
+	}
+
+	if err := cleanAbandonedUploads(); err != nil {
+		t.Fatalf("Error cleaning uploads: %v", err)
+	}
+
+	u := uploadSession{}
+	if err := couchbase.Get(uploadKey("old"), &u); !isNotFound(err) {
+		t.Errorf("Expected old session to be cleaned, got %v", err)
+	}
+	if err := couchbase.Get(uploadKey("new"), &u); err != nil {
+		t.Errorf("Expected new session to remain, got %v", err)
+	}
+}
@@ -59,7 +59,7 @@ func doZipDocs(w http.ResponseWriter, req *http.Request,
 			return
 		}
 
-		err = copyBlob(zf, nf.meta.OID)
+		err = copyFileContent(zf, nf.meta)
 		if err != nil {
 			log.Printf("Error copying blob for %v: %v",
 				nf.name, err)